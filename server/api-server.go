@@ -2,24 +2,448 @@ package main
 
 import (
 	a "./api"
+	"./api/service"
+	"./api/service/blob"
+	"./api/service/mail"
+	"./api/service/query"
 	routes "./routes"
 	"fmt"
 	"github.com/jadengore/goconfig"
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
+/**
+ * Opens the storage backend named by the `store` option of the default
+ * section: "neo4j" (the default), "bolt" or "memory". The bolt database
+ * lives at the `path` option of the bolt section.
+ */
+func openStore(config *goconfig.ConfigFile, local bool) (query.Query, error) {
+	store := "neo4j"
+	if config.HasOption("default", "store") {
+		if s, err := config.GetString("default", "store"); err != nil {
+			return nil, err
+		} else {
+			store = s
+		}
+	}
+
+	switch store {
+	case "neo4j":
+		var uri string
+		var err error
+		if local {
+			uri, err = config.GetString("local-test", "url")
+		} else {
+			uri, err = config.GetString("gen-test", "url")
+		}
+		if err != nil {
+			return nil, err
+		}
+		return query.NewNeo4jQuery(uri)
+	case "bolt":
+		if path, err := config.GetString("bolt", "path"); err != nil {
+			return nil, err
+		} else {
+			return query.NewBoltQuery(path)
+		}
+	case "memory":
+		return query.NewMemoryQuery(), nil
+	default:
+		return nil, fmt.Errorf("unknown store %q, expected neo4j, bolt or memory", store)
+	}
+}
+
+/**
+ * Reads token lifetimes from the optional sessions section, falling back
+ * to service.DefaultSessionPolicy for anything left out:
+ *
+ *   access-token-minutes, refresh-token-days, sliding-expiry, token-pepper,
+ *   password-reset-minutes
+ */
+func sessionPolicy(config *goconfig.ConfigFile) (service.SessionPolicy, error) {
+	policy := service.DefaultSessionPolicy()
+	if config.HasOption("sessions", "access-token-minutes") {
+		if minutes, err := config.GetInt("sessions", "access-token-minutes"); err != nil {
+			return policy, err
+		} else {
+			policy.AccessTokenDuration = time.Duration(minutes) * time.Minute
+		}
+	}
+	if config.HasOption("sessions", "refresh-token-days") {
+		if days, err := config.GetInt("sessions", "refresh-token-days"); err != nil {
+			return policy, err
+		} else {
+			policy.RefreshTokenDuration = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	if config.HasOption("sessions", "sliding-expiry") {
+		if sliding, err := config.GetBool("sessions", "sliding-expiry"); err != nil {
+			return policy, err
+		} else {
+			policy.SlidingExpiry = sliding
+		}
+	}
+	if config.HasOption("sessions", "token-pepper") {
+		if pepper, err := config.GetString("sessions", "token-pepper"); err != nil {
+			return policy, err
+		} else {
+			policy.TokenPepper = pepper
+		}
+	}
+	if config.HasOption("sessions", "password-reset-minutes") {
+		if minutes, err := config.GetInt("sessions", "password-reset-minutes"); err != nil {
+			return policy, err
+		} else {
+			policy.PasswordResetDuration = time.Duration(minutes) * time.Minute
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Reads the optional verification section, falling back to
+ * service.DefaultVerificationPolicy for anything left out:
+ *
+ *   secret, link-hours, unverified-publish-public, unverified-public-circles
+ */
+func verificationPolicy(config *goconfig.ConfigFile) (service.VerificationPolicy, error) {
+	policy := service.DefaultVerificationPolicy()
+	if config.HasOption("verification", "secret") {
+		if secret, err := config.GetString("verification", "secret"); err != nil {
+			return policy, err
+		} else {
+			policy.Secret = secret
+		}
+	} else {
+		log.Printf("No verification secret configured, verification links will not survive a restart")
+	}
+	if config.HasOption("verification", "link-hours") {
+		if hours, err := config.GetInt("verification", "link-hours"); err != nil {
+			return policy, err
+		} else {
+			policy.LinkDuration = time.Duration(hours) * time.Hour
+		}
+	}
+	if config.HasOption("verification", "unverified-publish-public") {
+		if allowed, err := config.GetBool("verification", "unverified-publish-public"); err != nil {
+			return policy, err
+		} else {
+			policy.UnverifiedPublishPublic = allowed
+		}
+	}
+	if config.HasOption("verification", "unverified-public-circles") {
+		if allowed, err := config.GetBool("verification", "unverified-public-circles"); err != nil {
+			return policy, err
+		} else {
+			policy.UnverifiedPublicCircles = allowed
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Reads login throttling from the optional lockout section, falling back
+ * to service.DefaultLockoutPolicy for anything left out:
+ *
+ *   handle-free-failures, handle-failures, ip-free-failures, ip-failures,
+ *   backoff-seconds, max-backoff-seconds, lockout-minutes,
+ *   failure-window-minutes, trust-forwarded-for
+ */
+func lockoutPolicy(config *goconfig.ConfigFile) (service.LockoutPolicy, error) {
+	policy := service.DefaultLockoutPolicy()
+	for _, o := range []struct {
+		name  string
+		value *int
+	}{
+		{"handle-free-failures", &policy.HandleFreeFailures},
+		{"handle-failures", &policy.HandleFailures},
+		{"ip-free-failures", &policy.IPFreeFailures},
+		{"ip-failures", &policy.IPFailures},
+	} {
+		if config.HasOption("lockout", o.name) {
+			n, err := config.GetInt("lockout", o.name)
+			if err != nil {
+				return policy, err
+			}
+			*o.value = n
+		}
+	}
+	for _, o := range []struct {
+		name  string
+		unit  time.Duration
+		value *time.Duration
+	}{
+		{"backoff-seconds", time.Second, &policy.Backoff},
+		{"max-backoff-seconds", time.Second, &policy.MaxBackoff},
+		{"lockout-minutes", time.Minute, &policy.LockoutDuration},
+		{"failure-window-minutes", time.Minute, &policy.FailureWindow},
+	} {
+		if config.HasOption("lockout", o.name) {
+			n, err := config.GetInt("lockout", o.name)
+			if err != nil {
+				return policy, err
+			}
+			*o.value = time.Duration(n) * o.unit
+		}
+	}
+	if config.HasOption("lockout", "trust-forwarded-for") {
+		if trust, err := config.GetBool("lockout", "trust-forwarded-for"); err != nil {
+			return policy, err
+		} else {
+			policy.TrustForwardedFor = trust
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Reads the optional oauth section, falling back to
+ * service.DefaultOAuthPolicy for anything left out:
+ *
+ *   consent-url, code-minutes, token-minutes
+ */
+func oauthPolicy(config *goconfig.ConfigFile) (service.OAuthPolicy, error) {
+	policy := service.DefaultOAuthPolicy()
+	if config.HasOption("oauth", "consent-url") {
+		if consent, err := config.GetString("oauth", "consent-url"); err != nil {
+			return policy, err
+		} else {
+			policy.ConsentUrl = consent
+		}
+	}
+	if config.HasOption("oauth", "code-minutes") {
+		if minutes, err := config.GetInt("oauth", "code-minutes"); err != nil {
+			return policy, err
+		} else {
+			policy.CodeDuration = time.Duration(minutes) * time.Minute
+		}
+	}
+	if config.HasOption("oauth", "token-minutes") {
+		if minutes, err := config.GetInt("oauth", "token-minutes"); err != nil {
+			return policy, err
+		} else {
+			policy.TokenDuration = time.Duration(minutes) * time.Minute
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Reads the optional deletion section, falling back to
+ * service.DefaultDeletionPolicy for anything left out:
+ *
+ *   grace-days, purge-minutes
+ */
+func deletionPolicy(config *goconfig.ConfigFile) (service.DeletionPolicy, error) {
+	policy := service.DefaultDeletionPolicy()
+	if config.HasOption("deletion", "grace-days") {
+		if days, err := config.GetInt("deletion", "grace-days"); err != nil {
+			return policy, err
+		} else {
+			policy.GracePeriod = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	if config.HasOption("deletion", "purge-minutes") {
+		if minutes, err := config.GetInt("deletion", "purge-minutes"); err != nil {
+			return policy, err
+		} else if minutes < 1 {
+			return policy, fmt.Errorf("purge-minutes must be at least 1, not %d", minutes)
+		} else {
+			policy.PurgeInterval = time.Duration(minutes) * time.Minute
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Reads the optional avatars section, falling back to
+ * service.DefaultAvatarPolicy for anything left out:
+ *
+ *   max-kb, max-pixels
+ */
+func avatarPolicy(config *goconfig.ConfigFile) (service.AvatarPolicy, error) {
+	policy := service.DefaultAvatarPolicy()
+	if config.HasOption("avatars", "max-kb") {
+		if kb, err := config.GetInt("avatars", "max-kb"); err != nil {
+			return policy, err
+		} else {
+			policy.MaxBytes = int64(kb) * 1024
+		}
+	}
+	if config.HasOption("avatars", "max-pixels") {
+		if pixels, err := config.GetInt("avatars", "max-pixels"); err != nil {
+			return policy, err
+		} else {
+			policy.MaxPixels = pixels
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Reads the optional handles section, falling back to
+ * service.DefaultRenamePolicy for anything left out:
+ *
+ *   cooldown-days, reserve-days
+ */
+func renamePolicy(config *goconfig.ConfigFile) (service.RenamePolicy, error) {
+	policy := service.DefaultRenamePolicy()
+	if config.HasOption("handles", "cooldown-days") {
+		if days, err := config.GetInt("handles", "cooldown-days"); err != nil {
+			return policy, err
+		} else {
+			policy.Cooldown = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	if config.HasOption("handles", "reserve-days") {
+		if days, err := config.GetInt("handles", "reserve-days"); err != nil {
+			return policy, err
+		} else {
+			policy.Reservation = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Keeps the files the service generates, avatars among them, under the
+ * `dir` option of the optional blobs section, "blobs" by default
+ */
+func blobStore(config *goconfig.ConfigFile) (blob.Store, error) {
+	dir := "blobs"
+	if config.HasOption("blobs", "dir") {
+		var err error
+		if dir, err = config.GetString("blobs", "dir"); err != nil {
+			return nil, err
+		}
+	}
+	return blob.FileStore{Dir: dir}, nil
+}
+
+/**
+ * The comma separated `handles` option of the optional admin section,
+ * users that are made admins at startup
+ */
+func admins(config *goconfig.ConfigFile) ([]string, error) {
+	admins := []string{}
+	if !config.HasOption("admin", "handles") {
+		return admins, nil
+	}
+	handles, err := config.GetString("admin", "handles")
+	if err != nil {
+		return nil, err
+	}
+	for _, handle := range strings.Split(handles, ",") {
+		if handle = strings.TrimSpace(handle); handle != "" {
+			admins = append(admins, handle)
+		}
+	}
+	return admins, nil
+}
+
+/**
+ * Picks how the service sends mail from the `sender` option of the optional
+ * mail section: "file" (the default) writes messages into `dir`, "smtp"
+ * relays them through `addr` as `from`, logging in with `username` and
+ * `password` when given.
+ */
+func mailSender(config *goconfig.ConfigFile) (mail.Sender, error) {
+	option := func(name, fallback string) (string, error) {
+		if !config.HasOption("mail", name) {
+			return fallback, nil
+		}
+		return config.GetString("mail", name)
+	}
+
+	sender, err := option("sender", "file")
+	if err != nil {
+		return nil, err
+	}
+	switch sender {
+	case "file":
+		dir, err := option("dir", "mail")
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Writing outgoing mail to %s instead of sending it", dir)
+		return mail.FileSender{Dir: dir}, nil
+	case "smtp":
+		s := mail.SmtpSender{}
+		for _, o := range []struct {
+			name  string
+			value *string
+		}{
+			{"addr", &s.Addr},
+			{"from", &s.From},
+			{"username", &s.Username},
+			{"password", &s.Password},
+		} {
+			if *o.value, err = option(o.name, ""); err != nil {
+				return nil, err
+			}
+		}
+		if s.Addr == "" || s.From == "" {
+			return nil, fmt.Errorf("the smtp mail sender needs both addr and from")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("unknown mail sender %q, expected file or smtp", sender)
+	}
+}
+
 func main() {
 	config, err := goconfig.ReadConfigFile("../config.cfg")
+	if err != nil {
+		log.Fatal(err)
+	}
 	port, err := config.GetString("default", "server-port")
-	var uri string
-	if len(os.Args) > 1 && os.Args[1] == "local" {
-		uri, err = config.GetString("local-test", "url")
-	} else {
-		uri, err = config.GetString("gen-test", "url")
+	if err != nil {
+		log.Fatal(err)
+	}
+	q, err := openStore(config, len(os.Args) > 1 && os.Args[1] == "local")
+	if err != nil {
+		log.Fatal(err)
+	}
+	api := a.NewApi(q)
+	if api.Svc.Sessions, err = sessionPolicy(config); err != nil {
+		log.Fatal(err)
+	}
+	if api.Svc.Verification, err = verificationPolicy(config); err != nil {
+		log.Fatal(err)
+	}
+	if api.Svc.Lockouts, err = lockoutPolicy(config); err != nil {
+		log.Fatal(err)
+	}
+	if api.Svc.OAuth, err = oauthPolicy(config); err != nil {
+		log.Fatal(err)
+	}
+	if api.Svc.Deletion, err = deletionPolicy(config); err != nil {
+		log.Fatal(err)
+	}
+	if api.Svc.Avatars, err = avatarPolicy(config); err != nil {
+		log.Fatal(err)
+	}
+	if api.Svc.Renames, err = renamePolicy(config); err != nil {
+		log.Fatal(err)
+	}
+	if api.Svc.Blobs, err = blobStore(config); err != nil {
+		log.Fatal(err)
+	}
+	go api.Svc.RunPurger()
+	if handles, err := admins(config); err != nil {
+		log.Fatal(err)
+	} else if missing, err := api.Svc.SeedAdmins(handles); err != nil {
+		log.Fatal(err)
+	} else if len(missing) > 0 {
+		log.Printf("Admins not signed up yet, restart once they are: %s", strings.Join(missing, ", "))
+	}
+	if api.Svc.Mail, err = mailSender(config); err != nil {
+		log.Fatal(err)
 	}
-	api := a.NewApi(uri)
 	handler, err := routes.MakeHandler(*api, false)
 	if err != nil {
 		log.Fatal(err)
@@ -3,12 +3,19 @@ package api
 import (
 	"../types"
 	"./service"
+	"./service/query"
 	apiutil "./util"
 	"github.com/ChimeraCoder/go.crypto/bcrypt"
 	"github.com/ant0ine/go-json-rest/rest"
 	"github.com/mccoyst/validate"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,11 +30,11 @@ type Api struct {
 }
 
 /**
- * Constructor
+ * Constructor, q is the storage backend the service runs on
  */
-func NewApi(uri string) *Api {
+func NewApi(q query.Query) *Api {
 	api := &Api{
-		Svc:       service.NewService(uri),
+		Svc:       service.NewService(q),
 		Util:      &apiutil.Util{},
 		Validator: types.NewValidator(),
 	}
@@ -38,11 +45,57 @@ func NewApi(uri string) *Api {
 // API util
 //
 
-func (a Api) authenticate(r *rest.Request) (success bool) {
-	if token := a.getTokenFromHeader(r); token != "" {
-		return a.Svc.VerifyAuthToken(token)
+/**
+ * Resolves the Authorization header to the handle it belongs to. Sessions
+ * may use any route; API keys and OAuth access tokens only those whose
+ * scope they carry, and none that are service.SESSION_ONLY. On failure the
+ * response has already been written and the handler should return.
+ */
+func (a Api) authenticate(w rest.ResponseWriter, r *rest.Request, scope string) (handle string, ok bool) {
+	token := a.getTokenFromHeader(r)
+	if token == "" {
+		a.Util.FailedToAuthenticate(w)
+		return "", false
+	}
+	if service.IsScopedCredential(token) {
+		return a.authenticateScoped(w, token, scope)
+	}
+	if handle, err := a.Svc.GetHandleFromAuthorization(token); types.IsNotFound(err) {
+		a.Util.FailedToAuthenticate(w)
+		return "", false
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return "", false
+	} else {
+		// Bookkeeping only, a failure here should not fail the request
+		if err := a.Svc.TouchSession(token); err != nil {
+			log.Printf("Failed to update last use of session: %v", err)
+		}
+		return handle, true
+	}
+}
+
+// A request body that did not decode into what the route expects
+func malformedPayload(err error) error {
+	return types.InvalidInput("malformed_payload", "Malformed request body: "+err.Error())
+}
+
+func (a Api) authenticateScoped(w rest.ResponseWriter, credential, scope string) (handle string, ok bool) {
+	if handle, err := a.Svc.GetHandleFromScopedCredential(credential, scope); types.IsNotFound(err) {
+		a.Util.FailedToAuthenticate(w)
+		return "", false
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return "", false
 	} else {
-		return false
+		// Bookkeeping only, a failure here should not fail the request
+		if !service.IsApiKey(credential) {
+			return handle, true
+		}
+		if err := a.Svc.TouchApiKey(credential); err != nil {
+			log.Printf("Failed to update last use of API key: %v", err)
+		}
+		return handle, true
 	}
 }
 
@@ -50,6 +103,67 @@ func (a Api) getTokenFromHeader(r *rest.Request) string {
 	return r.Header.Get("Authorization")
 }
 
+/**
+ * Like authenticate, but also requires the user to be an admin
+ */
+func (a Api) authenticateAdmin(w rest.ResponseWriter, r *rest.Request) (handle string, ok bool) {
+	if handle, ok = a.authenticate(w, r, service.SESSION_ONLY); !ok {
+		return "", false
+	}
+	if admin, err := a.Svc.IsAdmin(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return "", false
+	} else if !admin {
+		a.Util.ErrorResponse(w, types.Forbidden("admin_only", "Only admins may do this"))
+		return "", false
+	}
+	return handle, true
+}
+
+/**
+ * The :handle of the route as stored, so that any case or normalization of
+ * a handle names the same user. Unknown handles are answered as they are.
+ */
+func (a Api) pathHandle(w rest.ResponseWriter, r *rest.Request) (handle string, ok bool) {
+	if handle, err := a.Svc.CanonicalHandle(r.PathParam("handle")); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return "", false
+	} else {
+		return handle, true
+	}
+}
+
+/**
+ * Like authenticate for sessions, but also requires the :handle of the
+ * route to be the logged in user, answering 403 with reason otherwise
+ */
+func (a Api) authenticateSelf(w rest.ResponseWriter, r *rest.Request, reason string) (handle string, ok bool) {
+	if handle, ok = a.authenticate(w, r, service.SESSION_ONLY); !ok {
+		return "", false
+	}
+	if target, ok := a.pathHandle(w, r); !ok {
+		return "", false
+	} else if handle != target {
+		a.Util.ErrorResponse(w, types.Forbidden("not_self", reason))
+		return "", false
+	}
+	return handle, true
+}
+
+// The address the request came from, as told by the proxy in front of
+// the server if it is trusted to say
+func (a Api) clientIP(r *rest.Request) string {
+	if a.Svc.Lockouts.TrustForwardedFor {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+		}
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 //
 // API
 //
@@ -64,7 +178,7 @@ func (a Api) getTokenFromHeader(r *rest.Request) string {
 func (a Api) Signup(w rest.ResponseWriter, r *rest.Request) {
 	proposal := types.SignupProposal{}
 	if err := r.DecodeJsonPayload(&proposal); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+		a.Util.ErrorResponse(w, malformedPayload(err))
 		return
 	}
 
@@ -73,58 +187,128 @@ func (a Api) Signup(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	handle := proposal.Handle
+	handle := types.NormalizeHandle(proposal.Handle)
 	email := proposal.Email
 	password := proposal.Password
 	confirm_password := proposal.ConfirmPassword
 
 	// Password checks
 	if password != confirm_password {
-		a.Util.SimpleJsonReason(w, 403, "Passwords do not match")
-		return
-	}
-
-	// Ensure unique handle
-	if unique := a.Svc.HandleIsUnique(handle); !unique {
-		a.Util.SimpleJsonReason(w, 409, "Sorry, handle or email is already taken")
-		return
-	}
-
-	// Ensure unique email
-	if unique := a.Svc.EmailIsUnique(email); !unique {
-		a.Util.SimpleJsonReason(w, 409, "Sorry, handle or email is already taken")
+		a.Util.ErrorResponse(w, types.Forbidden("password_mismatch", "Passwords do not match"))
 		return
 	}
 
 	var hashed_pass string
 	if hash, err := bcrypt.GenerateFromPassword([]byte(password), 10); err != nil {
-		rest.Error(w, err.Error(), http.StatusInternalServerError)
+		a.Util.ErrorResponse(w, err)
 		return
 	} else {
 		hashed_pass = string(hash)
 	}
-	if !a.Svc.CreateNewUser(handle, email, hashed_pass) {
-		a.Util.SimpleJsonReason(w, http.StatusInternalServerError, "Unexpected failure to create new user")
+	// Fails with 409 if the handle or email is taken
+	if err := a.Svc.CreateNewUser(handle, email, hashed_pass); err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
 	}
 
-	if !a.Svc.MakeDefaultCirclesFor(handle) {
-		a.Util.SimpleJsonReason(w, http.StatusInternalServerError, "Unexpected failure to make default circles")
+	if err := a.Svc.MakeDefaultCirclesFor(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
 	}
 
+	// The user is signed up either way and can ask for the mail again
+	if err := a.Svc.SendVerificationMail(handle); err != nil {
+		log.Printf("Failed to send verification mail to %s: %v", handle, err)
+	}
+
 	w.WriteHeader(201)
 	w.WriteJson(types.Json{
 		"response": "Signed up a new user!",
 		"handle":   handle,
 		"email":    email,
+		"verified": false,
+	})
+}
+
+/**
+ * Expects a json POST with "expires" and "signature" as found in the
+ * verification link mailed to the user
+ */
+func (a Api) VerifyEmail(w rest.ResponseWriter, r *rest.Request) {
+	payload := types.EmailVerification{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+	a.verifyEmail(w, r.PathParam("handle"), payload.Expires, payload.Signature)
+}
+
+/**
+ * The verification link itself, with "expires" and "signature" as query
+ * parameters, so following it from a mail client is enough
+ */
+func (a Api) FollowVerificationLink(w rest.ResponseWriter, r *rest.Request) {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		a.Util.ErrorResponse(w, types.InvalidInput("invalid_expires", "Bad `expires` parameter"))
+		return
+	}
+	a.verifyEmail(w, r.PathParam("handle"), expires, query.Get("signature"))
+}
+
+func (a Api) verifyEmail(w rest.ResponseWriter, handle string, expires int64, signature string) {
+	if signature == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `signature` parameter"))
+		return
+	}
+
+	if err := a.Svc.VerifyEmail(handle, expires, signature); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.WriteJson(types.Json{
+		"response": "Verified the email of " + handle,
+		"handle":   handle,
+		"verified": true,
+	})
+}
+
+/**
+ * Sends the logged in user a new verification link
+ */
+func (a Api) ResendVerification(w rest.ResponseWriter, r *rest.Request) {
+	self, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
+		return
+	}
+	if self != handle {
+		a.Util.ErrorResponse(w, types.Forbidden("not_self", "Cannot send a verification mail for another user"))
+		return
+	}
+
+	if err := a.Svc.SendVerificationMail(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(202)
+	w.WriteJson(types.Json{
+		"response": "Sent a new verification mail to " + handle,
 	})
 }
 
 func (a Api) Login(w rest.ResponseWriter, r *rest.Request) {
 	credentials := types.LoginCredentials{}
 	if err := r.DecodeJsonPayload(&credentials); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+		a.Util.ErrorResponse(w, malformedPayload(err))
 		return
 	}
 
@@ -133,28 +317,64 @@ func (a Api) Login(w rest.ResponseWriter, r *rest.Request) {
 		return
 	}
 
-	handle := credentials.Handle
+	// Lockouts count against the user whatever casing they log in with
+	handle, err := a.Svc.CanonicalHandle(credentials.Handle)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
 	password := []byte(credentials.Password)
+	ip := a.clientIP(r)
+
+	// Answers 429 with Retry-After without looking at the password
+	if err := a.Svc.CheckLoginAllowed(handle, ip); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
 
-	if passwordHash, ok := a.Svc.GetPasswordHash(handle); !ok {
-		a.Util.SimpleJsonReason(w, 403, "Invalid username or password, please try again.")
+	if passwordHash, err := a.Svc.GetPasswordHash(handle); types.IsNotFound(err) {
+		a.Svc.RecordLoginFailure(handle, ip)
+		a.Util.ErrorResponse(w, types.Forbidden("invalid_credentials", "Invalid username or password, please try again."))
+		return
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
 	} else {
 		// err is nil if successful, error if comparison failed
 		if err := bcrypt.CompareHashAndPassword(passwordHash, password); err != nil {
-			a.Util.SimpleJsonReason(w, 403, "Invalid username or password, please try again.")
+			a.Svc.RecordLoginFailure(handle, ip)
+			a.Util.ErrorResponse(w, types.Forbidden("invalid_credentials", "Invalid username or password, please try again."))
 			return
 		} else {
+			device := credentials.Device
+			userAgent := r.Header.Get("User-Agent")
+
+			// With 2FA the password only buys a challenge, failures are
+			// forgotten once the second step succeeds
+			if enabled, err := a.Svc.TotpEnabled(handle); err != nil {
+				a.Util.ErrorResponse(w, err)
+				return
+			} else if enabled {
+				if challenge, err := a.Svc.NewLoginChallenge(handle, device, userAgent); err != nil {
+					a.Util.ErrorResponse(w, err)
+				} else {
+					w.WriteHeader(200)
+					w.WriteJson(types.Json{
+						"handle":           handle,
+						"response":         "Password accepted, please send a two-factor code along with the challenge.",
+						"challenge":        challenge.Challenge,
+						"challengeexpires": challenge.Expires,
+					})
+				}
+				return
+			}
+
+			a.Svc.RecordLoginSuccess(handle, ip)
 			// Create an Authentication token and return it to client
-			if token, ok := a.Svc.SetGetNewAuthToken(handle); !ok {
-				a.Util.SimpleJsonReason(w, 500, "Unexpected failure to produce new Authorization token")
+			if tokens, err := a.Svc.SetGetNewAuthToken(handle, device, userAgent); err != nil {
+				a.Util.ErrorResponse(w, err)
 			} else {
-				w.WriteHeader(201)
-				w.WriteJson(types.Json{
-					"handle":   handle,
-					"response": "Logged in " + handle + ". Note your Authorization token.",
-					"token":    token,
-				})
+				a.writeLoginTokens(w, tokens)
 				return
 			}
 		}
@@ -162,647 +382,2030 @@ func (a Api) Login(w rest.ResponseWriter, r *rest.Request) {
 }
 
 /**
- * Expects a json post with "handle"
+ * Expects a json POST with "challenge", as answered by Login when 2FA is
+ * enabled, and "code", from the authenticator app or a recovery code
  */
-func (a Api) Logout(w rest.ResponseWriter, r *rest.Request) {
-	if a.Svc.DestroyAuthToken(a.getTokenFromHeader(r)) {
-		w.WriteHeader(204)
-		return
-	} else {
-		a.Util.SimpleJsonReason(w, 403, "Cannot invalidate token because it is missing")
+func (a Api) CompleteLogin(w rest.ResponseWriter, r *rest.Request) {
+	response := types.ChallengeResponse{}
+	if err := r.DecodeJsonPayload(&response); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
 		return
 	}
-}
 
-//
-// User
-//
-func (a Api) GetUser(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+	if response.Challenge == "" || response.Code == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `challenge` or `code` parameter"))
 		return
 	}
 
-	target := r.PathParam("handle")
+	handle, err := a.Svc.GetLoginChallengeHandle(response.Challenge)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
 
-	if handle, ok := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !ok {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
+	// Wrong codes count as failed logins, guessing them is throttled too
+	ip := a.clientIP(r)
+	if err := a.Svc.CheckLoginAllowed(handle, ip); err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
+	}
+
+	if tokens, err := a.Svc.CompleteLoginChallenge(response.Challenge, response.Code); types.IsKind(err, types.FORBIDDEN) {
+		a.Svc.RecordLoginFailure(handle, ip)
+		a.Util.ErrorResponse(w, err)
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
 	} else {
-		if user, ok := a.Svc.GetVisibleUser(handle, target); !ok {
-			a.Util.SimpleJsonReason(w, 500, "Failed to get user "+target)
-			return
-		} else {
-			w.WriteHeader(200)
-			w.WriteJson(user)
-		}
+		a.Svc.RecordLoginSuccess(handle, ip)
+		a.writeLoginTokens(w, tokens)
 	}
 }
 
-func (a Api) EditUser(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+func (a Api) writeLoginTokens(w rest.ResponseWriter, tokens types.SessionTokens) {
+	w.WriteHeader(201)
+	w.WriteJson(types.Json{
+		"handle":         tokens.Handle,
+		"response":       "Logged in " + tokens.Handle + ". Note your Authorization token.",
+		"token":          tokens.Token,
+		"expires":        tokens.Expires,
+		"refreshtoken":   tokens.RefreshToken,
+		"refreshexpires": tokens.RefreshExpires,
+	})
+}
+
+/**
+ * Expects a json POST with "refreshtoken", answering with a new access
+ * token and a new refresh token. The old refresh token is spent.
+ */
+func (a Api) RefreshSession(w rest.ResponseWriter, r *rest.Request) {
+	payload := types.RefreshRequest{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
 		return
 	}
 
-	attributes := []types.UserPatch{}
-	if err := r.DecodeJsonPayload(&attributes); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+	if payload.RefreshToken == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `refreshtoken` parameter"))
 		return
 	}
 
-	handle := r.PathParam("handle")
-	if h, ok := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !ok {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
+	if tokens, err := a.Svc.RefreshSession(payload.RefreshToken); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(201)
+		w.WriteJson(types.Json{
+			"handle":         tokens.Handle,
+			"response":       "Refreshed session of " + tokens.Handle + ". Note your new tokens.",
+			"token":          tokens.Token,
+			"expires":        tokens.Expires,
+			"refreshtoken":   tokens.RefreshToken,
+			"refreshexpires": tokens.RefreshExpires,
+		})
+	}
+}
+
+/**
+ * Expects a json post with "handle"
+ */
+func (a Api) Logout(w rest.ResponseWriter, r *rest.Request) {
+	if err := a.Svc.DestroyAuthToken(a.getTokenFromHeader(r)); types.IsNotFound(err) {
+		a.Util.ErrorResponse(w, types.Forbidden("token_not_found", "Cannot invalidate token because it is missing"))
+		return
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
-	} else if h != handle {
-		a.Util.SimpleJsonReason(w, 401, "You are not authorized to modify user "+handle)
+	} else {
+		w.WriteHeader(204)
 		return
 	}
+}
 
-	// Validate input of patch objects
-	for index, obj := range attributes {
-		if err := a.Validator.ValidateAndTag(obj, "json"); err != nil {
-			a.Util.PatchValidationReason(w, 400, err, index)
-			return
-		}
+/**
+ * Lists the sessions of the logged in user
+ */
+func (a Api) GetSessions(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
 	}
 
-	// Service requests
-	for i, obj := range attributes {
-		resource := obj.Resource
-		value := obj.Value
-
-		if !a.Svc.UpdateUserAttribute(handle, resource, value) {
-			a.Util.SimpleJsonReason(w, 500, "Unexpected failure to fulfill service request at "+strconv.Itoa(i))
-			return
-		}
+	if sessions, err := a.Svc.GetSessions(handle, a.getTokenFromHeader(r)); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"results":  sessions,
+			"response": "Sessions of " + handle,
+			"count":    len(sessions),
+		})
 	}
-
-	w.WriteHeader(200)
-	w.WriteJson(types.Json{
-		"response": "Successfully updated user " + handle,
-		"changes":  len(attributes),
-	})
-
 }
 
-func (a Api) SearchForUsers(w rest.ResponseWriter, r *rest.Request) {
-	querymap := r.URL.Query()
+/**
+ * Revokes one session of the logged in user by id, or every session
+ * except the current one when the id is "others"
+ */
+func (a Api) DeleteSession(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
 
-	var circle string
-	var nameprefix string
-	var skip int
-	var limit int
-	var sort string
+	sessionid := r.PathParam("id")
 
-	if val, ok := querymap["limit"]; !ok {
-		limit = 10
-	} else {
-		if intval, err := strconv.Atoi(val[0]); err != nil {
-			w.WriteHeader(400)
+	if sessionid == "others" {
+		if count, err := a.Svc.RevokeOtherSessions(handle, a.getTokenFromHeader(r)); err != nil {
+			a.Util.ErrorResponse(w, err)
+		} else {
+			w.WriteHeader(200)
 			w.WriteJson(types.Json{
-				"results":  nil,
-				"response": "Search failed",
-				"reason":   "Malformed limit",
-				"count":    0,
+				"response": "Revoked all other sessions",
+				"count":    count,
 			})
-			return
-
-		} else {
-			if intval > 100 || intval < 1 {
-				w.WriteHeader(400)
-				w.WriteJson(types.Json{
-					"results":  nil,
-					"response": "Search failed",
-					"reason":   "Limit out of range",
-					"count":    0,
-				})
-			} else {
-				limit = intval
-			}
 		}
+		return
 	}
 
-	if val, ok := querymap["nameprefix"]; !ok {
-		nameprefix = ""
+	if err := a.Svc.RevokeSession(handle, sessionid); err != nil {
+		a.Util.ErrorResponse(w, err)
 	} else {
-		nameprefix = val[0]
+		w.WriteHeader(204)
 	}
+}
 
-	if val, ok := querymap["circle"]; !ok {
-		circle = ""
-	} else {
-		circle = val[0]
+/**
+ * Expects a json POST with "oldpassword", "newpassword", "confirmpassword".
+ * Every other session of the user is signed out.
+ */
+func (a Api) ChangePassword(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
 	}
 
-	if val, ok := querymap["skip"]; !ok {
-		skip = 0
-	} else {
-		if intval, err := strconv.Atoi(val[0]); err != nil {
-			w.WriteHeader(400)
-			w.WriteJson(types.Json{
-				"results":  nil,
-				"response": "Search failed",
-				"reason":   "Malformed skip",
-				"count":    0,
-			})
-			return
-		} else {
-			skip = intval
-		}
+	change := types.PasswordChange{}
+	if err := r.DecodeJsonPayload(&change); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
 	}
 
-	if sortType, ok := querymap["sort"]; !ok {
-		w.WriteHeader(400)
-		w.WriteJson(types.Json{
-			"results":  nil,
-			"response": "Search failed",
-			"reason":   "Missing required sort parameter",
-			"count":    0,
-		})
+	if err := a.Validator.ValidateAndTag(change, "json"); err != nil {
+		a.Util.SimpleJsonValidationReason(w, 400, err)
 		return
-	} else if sortType[0] != "handle" && sortType[0] != "joined" {
-		w.WriteHeader(200)
-		w.WriteJson(types.Json{
-			"results":  nil,
-			"response": "Search failed",
-			"reason":   "No such sort " + sortType[0],
-			"count":    0,
-		})
+	}
+
+	if change.NewPassword != change.ConfirmPassword {
+		a.Util.ErrorResponse(w, types.Forbidden("password_mismatch", "Passwords do not match"))
+		return
+	}
+
+	if passwordHash, err := a.Svc.GetPasswordHash(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(change.OldPassword)); err != nil {
+		a.Util.ErrorResponse(w, types.Forbidden("wrong_password", "Old password is incorrect"))
+		return
+	}
+
+	var hashed_pass string
+	if hash, err := bcrypt.GenerateFromPassword([]byte(change.NewPassword), 10); err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
+	} else {
+		hashed_pass = string(hash)
 	}
 
-	results, count := a.Svc.SearchForUsers(circle, nameprefix, skip, limit, sort)
+	if err := a.Svc.ChangePassword(handle, a.getTokenFromHeader(r), hashed_pass); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
 
 	w.WriteHeader(200)
 	w.WriteJson(types.Json{
-		"results":  results,
-		"response": "Search complete",
-		"count":    count,
+		"response": "Changed password of " + handle + ", other sessions were signed out",
 	})
 }
 
-//
-// Circles
-//
+/**
+ * Expects a json POST with "email". Answers the same whether or not
+ * the address belongs to anyone.
+ */
+func (a Api) ForgotPassword(w rest.ResponseWriter, r *rest.Request) {
+	request := types.PasswordResetRequest{}
+	if err := r.DecodeJsonPayload(&request); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if err := a.Validator.ValidateAndTag(request, "json"); err != nil {
+		a.Util.SimpleJsonValidationReason(w, 400, err)
+		return
+	}
+
+	if err := a.Svc.RequestPasswordReset(request.Email); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(202)
+	w.WriteJson(types.Json{
+		"response": "If " + request.Email + " belongs to an account, a reset code is on its way",
+	})
+}
+
+/**
+ * Expects a json POST with "code", "password", "confirmpassword", the
+ * code being the one mailed by ForgotPassword
+ */
+func (a Api) ResetPassword(w rest.ResponseWriter, r *rest.Request) {
+	reset := types.PasswordReset{}
+	if err := r.DecodeJsonPayload(&reset); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if reset.Code == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `code` parameter"))
+		return
+	}
+
+	if err := a.Validator.ValidateAndTag(reset, "json"); err != nil {
+		a.Util.SimpleJsonValidationReason(w, 400, err)
+		return
+	}
+
+	if reset.Password != reset.ConfirmPassword {
+		a.Util.ErrorResponse(w, types.Forbidden("password_mismatch", "Passwords do not match"))
+		return
+	}
+
+	var hashed_pass string
+	if hash, err := bcrypt.GenerateFromPassword([]byte(reset.Password), 10); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else {
+		hashed_pass = string(hash)
+	}
+
+	if handle, err := a.Svc.ResetPassword(reset.Code, hashed_pass); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Reset password of " + handle + ", please log in again",
+			"handle":   handle,
+		})
+	}
+}
+
+//
+// Two-Factor Authentication
+//
+
+/**
+ * Starts enrolling the logged in user in TOTP 2FA, answering with the
+ * secret and an otpauth:// uri for authenticator apps. Nothing changes
+ * at login until the enrollment is confirmed.
+ */
+func (a Api) EnrollTotp(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	if enrollment, err := a.Svc.EnrollTotp(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(201)
+		w.WriteJson(types.Json{
+			"response": "Add the secret to your authenticator app, then confirm with a code",
+			"secret":   enrollment.Secret,
+			"uri":      enrollment.Uri,
+		})
+	}
+}
+
+/**
+ * Expects a json POST with "code" from the authenticator app, enabling
+ * 2FA. Answers with recovery codes, each good for one login.
+ */
+func (a Api) ConfirmTotp(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	payload := types.TotpCode{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if payload.Code == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `code` parameter"))
+		return
+	}
+
+	if codes, err := a.Svc.ConfirmTotp(handle, payload.Code); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response":      "Enabled two-factor authentication for " + handle + ". Keep the recovery codes somewhere safe.",
+			"recoverycodes": codes,
+		})
+	}
+}
+
+/**
+ * Expects a json POST with "password" and "code", either from the
+ * authenticator app or a recovery code
+ */
+func (a Api) DisableTotp(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	payload := types.TotpDisable{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if payload.Code == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `code` parameter"))
+		return
+	}
+
+	if passwordHash, err := a.Svc.GetPasswordHash(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(payload.Password)); err != nil {
+		a.Util.ErrorResponse(w, types.Forbidden("wrong_password", "Password is incorrect"))
+		return
+	}
+
+	if err := a.Svc.DisableTotp(handle, payload.Code); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Disabled two-factor authentication for " + handle,
+		})
+	}
+}
+
+//
+// API Keys
+//
+
+/**
+ * Lists the API keys of the logged in user, never the keys themselves
+ */
+func (a Api) GetApiKeys(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	if keys, err := a.Svc.GetApiKeys(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"results":  keys,
+			"response": "API keys of " + handle,
+			"count":    len(keys),
+		})
+	}
+}
+
+/**
+ * Expects a json POST with "name", "scopes" and optionally "expires",
+ * answering with the key. It is not shown again.
+ */
+func (a Api) NewApiKey(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	request := types.ApiKeyRequest{}
+	if err := r.DecodeJsonPayload(&request); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if key, view, err := a.Svc.CreateApiKey(handle, request); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(201)
+		w.WriteJson(types.Json{
+			"response": "Created API key " + view.Name + ". Note the key, it is not shown again.",
+			"key":      key,
+			"id":       view.Id,
+			"name":     view.Name,
+			"scopes":   view.Scopes,
+			"created":  view.Created,
+			"expires":  view.Expires,
+		})
+	}
+}
+
+func (a Api) RevokeApiKey(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	if err := a.Svc.RevokeApiKey(handle, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+//
+// OAuth
+//
+
+/**
+ * Expects a json POST with "name" and "redirecturis", registering a
+ * client owned by the logged in user
+ */
+func (a Api) RegisterOAuthClient(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	request := types.OAuthClientRequest{}
+	if err := r.DecodeJsonPayload(&request); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if client, err := a.Svc.RegisterOAuthClient(handle, request); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(201)
+		w.WriteJson(types.Json{
+			"response":     "Registered OAuth client " + client.Name,
+			"clientid":     client.Id,
+			"name":         client.Name,
+			"redirecturis": client.RedirectUris,
+			"created":      client.Created,
+		})
+	}
+}
+
+func (a Api) GetOAuthClients(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	if clients, err := a.Svc.GetOAuthClients(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"results":  clients,
+			"response": "OAuth clients of " + handle,
+			"count":    len(clients),
+		})
+	}
+}
+
+func (a Api) DeleteOAuthClient(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	if err := a.Svc.DeleteOAuthClient(handle, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+/**
+ * The authorization endpoint clients send users to. Sends them on to the
+ * configured consent page, or describes what they are asked to allow.
+ */
+func (a Api) GetOAuthConsent(w rest.ResponseWriter, r *rest.Request) {
+	params := r.URL.Query()
+	request := types.OAuthAuthorizationRequest{
+		ResponseType:        params.Get("response_type"),
+		ClientId:            params.Get("client_id"),
+		RedirectUri:         params.Get("redirect_uri"),
+		Scope:               params.Get("scope"),
+		State:               params.Get("state"),
+		CodeChallenge:       params.Get("code_challenge"),
+		CodeChallengeMethod: params.Get("code_challenge_method"),
+	}
+
+	consent, err := a.Svc.CheckAuthorizationRequest(request)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	if a.Svc.OAuth.ConsentUrl != "" {
+		w.Header().Set("Location", a.Svc.OAuth.ConsentUrl+"?"+r.URL.RawQuery)
+		w.WriteHeader(302)
+		return
+	}
+	w.WriteHeader(200)
+	w.WriteJson(types.Json{
+		"response":     consent.Client.Name + " asks for access to your account",
+		"client":       consent.Client,
+		"scopes":       consent.Scopes,
+		"redirect_uri": consent.RedirectUri,
+		"state":        consent.State,
+	})
+}
+
+/**
+ * Expects a json POST with the parameters of the authorization request
+ * and "approve", the decision of the logged in user. Answers with where
+ * to send them back to.
+ */
+func (a Api) AuthorizeOAuthClient(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	request := types.OAuthAuthorizationRequest{}
+	if err := r.DecodeJsonPayload(&request); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if redirect, err := a.Svc.AuthorizeOAuthClient(handle, request); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Send the user back to the client",
+			"redirect": redirect,
+		})
+	}
+}
+
+/**
+ * The token endpoint, taking the form RFC 6749 prescribes or the same
+ * fields in json
+ */
+func (a Api) ExchangeOAuthCode(w rest.ResponseWriter, r *rest.Request) {
+	request := types.OAuthTokenRequest{}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if err := r.ParseForm(); err != nil {
+			a.Util.ErrorResponse(w, malformedPayload(err))
+			return
+		}
+		request = types.OAuthTokenRequest{
+			GrantType:    r.PostForm.Get("grant_type"),
+			Code:         r.PostForm.Get("code"),
+			RedirectUri:  r.PostForm.Get("redirect_uri"),
+			ClientId:     r.PostForm.Get("client_id"),
+			CodeVerifier: r.PostForm.Get("code_verifier"),
+		}
+	} else if err := r.DecodeJsonPayload(&request); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if token, err := a.Svc.ExchangeOAuthCode(request); err != nil {
+		a.Util.OAuthErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(token)
+	}
+}
+
+//
+// User
+//
+func (a Api) GetUser(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_READ_FEED)
+	if !ok {
+		return
+	}
+
+	target, ok := a.pathHandle(w, r)
+	if !ok {
+		return
+	}
+
+	if user, err := a.Svc.GetVisibleUser(handle, target); types.IsNotFound(err) {
+		// Former handles lead to the user for as long as they are reserved
+		if current, rerr := a.Svc.ResolveHandle(target); rerr == nil && types.HandleKey(current) != types.HandleKey(target) {
+			a.redirectToHandle(w, r, current)
+			return
+		}
+		a.Util.ErrorResponse(w, err)
+		return
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(user)
+	}
+}
+
+func (a Api) EditUser(w rest.ResponseWriter, r *rest.Request) {
+	self, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	attributes := []types.UserPatch{}
+	if err := r.DecodeJsonPayload(&attributes); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
+		return
+	}
+	if self != handle {
+		if admin, err := a.Svc.IsAdmin(self); err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		} else if !admin {
+			a.Util.ErrorResponse(w, types.Forbidden("not_self", "You can only edit yourself unless you are an admin"))
+			return
+		}
+	}
+
+	// Validate input of patch objects, all of them before changing anything
+	for index, obj := range attributes {
+		if err := a.Validator.ValidateAndTag(obj, "json"); err != nil {
+			a.Util.PatchValidationReason(w, 400, err, index)
+			return
+		}
+		if value, err := a.Svc.NormalizeUserAttribute(obj.Resource, obj.Value); err != nil {
+			a.Util.PatchValidationReason(w, 400, []error{err}, index)
+			return
+		} else {
+			attributes[index].Value = value
+		}
+	}
+
+	// Service requests
+	for _, obj := range attributes {
+		resource := obj.Resource
+		value := obj.Value
+
+		if err := a.Svc.UpdateUserAttribute(handle, resource, value); err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+	w.WriteJson(types.Json{
+		"response": "Successfully updated user " + handle,
+		"changes":  len(attributes),
+	})
+
+}
+
+/**
+ * Answers 302 to the same route for current, relative to the request so it
+ * works behind any prefix
+ */
+func (a Api) redirectToHandle(w rest.ResponseWriter, r *rest.Request, current string) {
+	location := url.PathEscape(current)
+	if r.URL.RawQuery != "" {
+		location += "?" + r.URL.RawQuery
+	}
+	w.Header().Set("Location", location)
+	w.WriteHeader(302)
+	w.WriteJson(types.Json{
+		"response": r.PathParam("handle") + " is now " + current,
+		"handle":   current,
+	})
+}
+
+/**
+ * Expects a json PUT with the new "handle" of the logged in user
+ */
+func (a Api) RenameUser(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only change your own handle")
+	if !ok {
+		return
+	}
+
+	proposal := types.HandleChange{}
+	if err := r.DecodeJsonPayload(&proposal); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+	if err := a.Validator.ValidateAndTag(proposal, "json"); err != nil {
+		a.Util.SimpleJsonValidationReason(w, 400, err)
+		return
+	}
+
+	newHandle := types.NormalizeHandle(proposal.Handle)
+	if err := a.Svc.RenameUser(handle, newHandle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Changed handle " + handle + " to " + newHandle,
+			"handle":   newHandle,
+		})
+	}
+}
+
+/**
+ * Answers who may see each profile field of the logged in user
+ */
+func (a Api) GetProfileVisibility(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only see your own privacy settings")
+	if !ok {
+		return
+	}
+
+	if visibility, err := a.Svc.GetProfileVisibility(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(visibility)
+	}
+}
+
+/**
+ * Expects a json PATCH of profile fields to "public", "private" or the id
+ * of one of the logged in user's circles, answering the settings of every
+ * field
+ */
+func (a Api) SetProfileVisibility(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only change your own privacy settings")
+	if !ok {
+		return
+	}
+
+	changes := map[string]string{}
+	if err := r.DecodeJsonPayload(&changes); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if visibility, err := a.Svc.SetProfileVisibility(handle, changes); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(visibility)
+	}
+}
+
+/**
+ * Expects a json DELETE with the password of the logged in user, who may
+ * only delete someone else as an admin. The account is deactivated until
+ * the grace period runs out, logging in restores it.
+ */
+func (a Api) DeleteUser(w rest.ResponseWriter, r *rest.Request) {
+	self, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Password string `json:"password"`
+	}{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
+		return
+	}
+	if self != handle {
+		if admin, err := a.Svc.IsAdmin(self); err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		} else if !admin {
+			a.Util.ErrorResponse(w, types.Forbidden("not_self", "You can only delete yourself unless you are an admin"))
+			return
+		}
+	}
+
+	if passwordHash, err := a.Svc.GetPasswordHash(self); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(payload.Password)); err != nil {
+		a.Util.ErrorResponse(w, types.Unauthenticated("wrong_password", "Invalid password, please try again"))
+		return
+	}
+
+	// Admins deleting someone else purge them at once, so that logging
+	// back in cannot undo it
+	if self != handle {
+		if summary, err := a.Svc.DeleteUser(handle); err != nil {
+			a.Util.ErrorResponse(w, err)
+		} else {
+			w.WriteHeader(200)
+			w.WriteJson(types.Json{
+				"response": "Deleted " + handle + " for good",
+				"deleted":  summary,
+			})
+		}
+		return
+	}
+
+	if purge, err := a.Svc.DeactivateUser(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response":   "Deleted " + handle + ", logging in before the purge restores the account",
+			"purgeafter": purge,
+		})
+	}
+}
+
+/**
+ * Starts an export of everything the logged in user has, answering the
+ * job to poll until the archive is ready
+ */
+func (a Api) StartExport(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only export your own data")
+	if !ok {
+		return
+	}
+
+	if job, err := a.Svc.StartExport(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(202)
+		w.WriteJson(job)
+	}
+}
+
+func (a Api) GetExport(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only export your own data")
+	if !ok {
+		return
+	}
+
+	if job, err := a.Svc.GetExport(handle, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(job)
+	}
+}
+
+/**
+ * Answers the zip archive of a ready export
+ */
+func (a Api) GetExportArchive(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only export your own data")
+	if !ok {
+		return
+	}
+
+	exportid := r.PathParam("id")
+	if archive, err := a.Svc.GetExportArchive(handle, exportid); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", `attachment; filename="cherami-`+handle+`-`+exportid+`.zip"`)
+		w.WriteHeader(200)
+		w.(http.ResponseWriter).Write(archive)
+	}
+}
+
+/**
+ * Expects the image itself as the body of a PUT. The logged in user may
+ * only set someone else's avatar as an admin.
+ */
+func (a Api) SetAvatar(w rest.ResponseWriter, r *rest.Request) {
+	self, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
+		return
+	}
+	if self != handle {
+		if admin, err := a.Svc.IsAdmin(self); err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		} else if !admin {
+			a.Util.ErrorResponse(w, types.Forbidden("not_self", "You can not set others' avatars unless you are an admin"))
+			return
+		}
+	}
+
+	// One byte over the limit is enough for the service to refuse it
+	data, err := ioutil.ReadAll(io.LimitReader(r.Body, a.Svc.Avatars.MaxBytes+1))
+	if err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if avatar, err := a.Svc.SetAvatar(handle, data); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Updated the avatar of " + handle,
+			"avatar":   avatar,
+		})
+	}
+}
+
+/**
+ * Answers the PNG of an avatar, as large as the optional size parameter
+ * says. Anyone may fetch avatars, and as their urls change with every
+ * upload they can be cached for good.
+ */
+func (a Api) GetAvatar(w rest.ResponseWriter, r *rest.Request) {
+	size := 0
+	if val := r.URL.Query().Get("size"); val != "" {
+		var err error
+		if size, err = strconv.Atoi(val); err != nil {
+			a.Util.ErrorResponse(w, types.InvalidInput("bad_avatar_size", "Malformed size"))
+			return
+		}
+	}
+
+	if image, err := a.Svc.GetAvatar(r.PathParam("id"), size); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.WriteHeader(200)
+		w.(http.ResponseWriter).Write(image)
+	}
+}
+
+/**
+ * Expects the query parameter "sort", either handle or joined, and
+ * optionally "order" (asc or desc), "nameprefix", "circle", "skip", "limit"
+ */
+func (a Api) SearchForUsers(w rest.ResponseWriter, r *rest.Request) {
+	querymap := r.URL.Query()
+
+	var circle string
+	var nameprefix string
+	var skip int
+	var limit int
+	var sort string
+	var descending bool
+
+	if val, ok := querymap["limit"]; !ok {
+		limit = 10
+	} else {
+		if intval, err := strconv.Atoi(val[0]); err != nil {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_limit", "Malformed limit"))
+			return
+		} else {
+			if intval > 100 || intval < 1 {
+				a.Util.ErrorResponse(w, types.InvalidInput("invalid_limit", "Limit out of range"))
+				return
+			} else {
+				limit = intval
+			}
+		}
+	}
+
+	if val, ok := querymap["nameprefix"]; !ok {
+		nameprefix = ""
+	} else {
+		nameprefix = val[0]
+	}
+
+	if val, ok := querymap["circle"]; !ok {
+		circle = ""
+	} else {
+		circle = val[0]
+	}
+
+	if val, ok := querymap["skip"]; !ok {
+		skip = 0
+	} else {
+		if intval, err := strconv.Atoi(val[0]); err != nil {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_skip", "Malformed skip"))
+			return
+		} else if intval < 0 {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_skip", "Skip out of range"))
+			return
+		} else {
+			skip = intval
+		}
+	}
+
+	if sortType, ok := querymap["sort"]; !ok {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing required sort parameter"))
+		return
+	} else {
+		sort = sortType[0]
+		// Handles come alphabetically, newest first
+		switch sort {
+		case query.SORT_BY_HANDLE:
+		case query.SORT_BY_JOINED:
+			descending = true
+		default:
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_sort", "No such sort "+sort))
+			return
+		}
+	}
+
+	if order := querymap.Get("order"); order != "" {
+		switch order {
+		case "asc":
+			descending = false
+		case "desc":
+			descending = true
+		default:
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_order", "No such order "+order))
+			return
+		}
+	}
+
+	results, total, err := a.Svc.SearchForUsers(circle, nameprefix, skip, limit, sort, descending)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.WriteJson(types.Json{
+		"results":  results,
+		"response": "Search complete",
+		"count":    total,
+	})
+}
+
+//
+// Circles
+//
 
 func (a Api) NewCircle(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+	handle, ok := a.authenticate(w, r, service.SCOPE_MANAGE_CIRCLES)
+	if !ok {
+		return
+	}
+	payload := struct {
+		CircleName string `json:"circlename"`
+		Public     bool   `json:"public"`
+	}{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+	circleName := payload.CircleName
+	isPublic := payload.Public
+
+	if circleName == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `circlename` parameter"))
+		return
+	} else if circleName == types.GOLD || circleName == types.BROADCAST {
+		a.Util.ErrorResponse(w, types.Forbidden("reserved_circle", circleName+" is a reserved circle name"))
+		return
+	}
+
+	if err := a.Svc.CheckMayCreateCircle(handle, isPublic); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	if circleResponse, err := a.Svc.NewCircle(handle, circleName, isPublic); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else {
+		w.WriteHeader(201)
+		w.WriteJson(circleResponse)
+	}
+}
+
+func (a Api) SearchCircles(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_READ_FEED)
+	if !ok {
+		return
+	}
+
+	querymap := r.URL.Query()
+
+	var user string
+	var before time.Time
+	var limit int
+
+	if val, ok := querymap["limit"]; !ok {
+		limit = 20
+	} else {
+		if intval, err := strconv.Atoi(val[0]); err != nil {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_limit", "Malformed limit"))
+			return
+		} else {
+			if intval > 100 || intval < 1 {
+				a.Util.ErrorResponse(w, types.InvalidInput("invalid_limit", "Limit out of range"))
+				return
+			} else {
+				limit = intval
+			}
+		}
+	}
+
+	// Reveals public and private circles user is apart of. If user parameter is absent
+	// will use the logged in user as the target of the query.
+	// Empty assumed not to be the name of a user, DWIW
+	if val, ok := querymap["user"]; !ok || val[0] == "" {
+		user = handle
+	} else {
+		user = val[0]
+	}
+
+	if val, ok := querymap["before"]; !ok {
+		before = time.Now().Local()
+	} else {
+		if millis, err := strconv.Atoi(val[0]); err != nil {
+			a.Util.SimpleJsonResponse(w, 400, "Malformed duration")
+			return
+		} else {
+			var seconds, nanoseconds int64
+			seconds = int64(millis / 1000)
+			nanoseconds = int64(millis % 1000 * 1000000)
+			before = time.Unix(seconds, nanoseconds)
+		}
+	}
+
+	results, count, err := a.Svc.CirclesUserIsPartOf(user, before, limit)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.WriteJson(types.SearchCirclesResponse{
+		Results:  results,
+		Response: "Search complete",
+		Count:    count,
+	})
+}
+
+func (a Api) GetCircleById(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_READ_FEED)
+	if !ok {
+		return
+	}
+
+	if circle, err := a.Svc.GetCircle(handle, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(circle)
+	}
+}
+
+/**
+ * Expects a json PATCH with the new "name" or "description", or both.
+ * Only the owner and admins may edit a circle.
+ */
+func (a Api) EditCircle(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_MANAGE_CIRCLES)
+	if !ok {
+		return
+	}
+
+	patch := types.CirclePatch{}
+	if err := r.DecodeJsonPayload(&patch); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	if _, err := a.Svc.EditCircle(handle, r.PathParam("id"), patch); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+func (a Api) DeleteCircle(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_MANAGE_CIRCLES)
+	if !ok {
+		return
+	}
+
+	if err := a.Svc.DeleteCircle(handle, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+//
+// Messages
+//
+
+/**
+ * Create a new, unpublished message
+ */
+func (a Api) NewMessage(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_POST_MESSAGES)
+	if !ok {
+		return
+	}
+	payload := struct {
+		Content string
+		Circles []string
+	}{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	content := payload.Content
+	circles := payload.Circles
+
+	if payload.Content == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_content", "Please enter some content for your message"))
+		return
+	}
+
+	for _, circleid := range circles {
+		if err := a.Svc.CheckMayPublishTo(handle, circleid); err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		}
+	}
+
+	if message, err := a.Svc.NewMessage(handle, content); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else {
+		if len(circles) > 0 {
+			for _, circleid := range circles {
+				if err := a.Svc.PublishMessageToCircle(message.Id, circleid); types.IsNotFound(err) {
+					a.Util.ErrorResponse(w, types.InvalidInput("invalid_circle", "Failed to publish to one of circles provided"))
+					return
+				} else if err != nil {
+					a.Util.ErrorResponse(w, err)
+					return
+				}
+			}
+		}
+		w.WriteHeader(201)
+		w.WriteJson(message)
+	}
+}
+
+func (a Api) GetMessages(w rest.ResponseWriter, r *rest.Request) {
+	self, ok := a.authenticate(w, r, service.SCOPE_READ_FEED)
+	if !ok {
+		return
+	}
+
+	querymap := r.URL.Query()
+	var target, circleid string
+	var t, c bool
+
+	if _, ok := querymap["all"]; ok {
+		if messagesView, err := a.Svc.GetAllMessages(self); err != nil {
+			a.Util.ErrorResponse(w, err)
+		} else {
+			w.WriteHeader(200)
+			w.WriteJson(messagesView)
+		}
+		return
+	}
+	if targetUses, ok := querymap["handle"]; ok {
+		target, t = targetUses[0], ok
+		if canonical, err := a.Svc.CanonicalHandle(target); err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		} else {
+			target = canonical
+		}
+	}
+	if circleidUses, ok := querymap["circleid"]; ok {
+		circleid, c = circleidUses[0], ok
+	}
+
+	var messagesView []types.PublishedMessageView
+	var err error
+	if t && c {
+		messagesView, err = a.Svc.GetMessagesByTargetInCircle(self, target, circleid)
+	} else if t && !c && types.HandleKey(target) != types.HandleKey(self) {
+		messagesView, err = a.Svc.GetPublicMessagesByHandle(self, target)
+	} else if !t && c {
+		messagesView, err = a.Svc.GetMessagesInCircle(self, circleid)
+	} else {
+		messagesView, err = a.Svc.GetMessageFeedOfSelf(self)
+	}
+
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(messagesView)
+	}
+}
+
+func (a Api) GetMessageById(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_READ_FEED)
+	if !ok {
+		return
+	}
+
+	id := r.PathParam("id")
+
+	if message, err := a.Svc.GetVisibleMessageById(handle, id); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(message)
+	}
+}
+
+func (a Api) EditMessage(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_POST_MESSAGES)
+	if !ok {
+		return
+	}
+
+	payload := make([]types.MessagePatch, 0)
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+
+	messageid := r.PathParam("id")
+
+	// Admins act on behalf of the author
+	author, err := a.Svc.MessageAuthorForEdit(handle, messageid)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
+
+	// Validate input of patch objects
+	for index, obj := range payload {
+		if err := a.Validator.ValidateAndTag(obj, "json"); err != nil {
+			a.Util.PatchValidationReason(w, 400, err, index)
+			return
+		} else {
+			op := obj.Op
+			resource := obj.Resource
+			value := obj.Value
+			if op == "update" {
+				if resource == "image" {
+					a.Util.ErrorResponse(w, types.InvalidInput("unsupported_patch", "Edit message image value has yet to be implemented"))
+					return
+				}
+			} else if op == "publish" && resource == "circle" {
+				if can, err := a.Svc.UserCanPublishTo(author, value); err != nil {
+					a.Util.ErrorResponse(w, err)
+					return
+				} else if !can {
+					a.Util.ErrorResponse(w, types.InvalidInput("invalid_circle", "Could not publish message to circle "+value))
+					return
+				} else if err := a.Svc.CheckMayPublishTo(author, value); err != nil {
+					a.Util.ErrorResponse(w, err)
+					return
+				}
+			} else if op == "unpublish" && resource == "circle" {
+				if can, err := a.Svc.UserCanRetractPublication(author, messageid, value); err != nil {
+					a.Util.ErrorResponse(w, err)
+					return
+				} else if !can {
+					a.Util.ErrorResponse(w, types.InvalidInput("not_published", "Cannot unpublish message, specified published relation not found"))
+					return
+				}
+			} else {
+				a.Util.ErrorResponse(w, types.InvalidInput("invalid_patch", "Malformed patch request at object "+strconv.Itoa(index)))
+				return
+			}
+		}
+	}
+
+	// Service requests
+	for i, obj := range payload {
+		op := obj.Op
+		resource := obj.Resource
+		value := obj.Value
+
+		var err error
+		if op == "update" {
+			if resource == "content" {
+				err = a.Svc.UpdateContentOfMessage(messageid, value)
+			}
+		} else if op == "publish" {
+			err = a.Svc.PublishMessageToCircle(messageid, value)
+		} else if op == "unpublish" {
+			err = a.Svc.UnpublishMessageFromCircle(messageid, value)
+		} else {
+			a.Util.ErrorResponse(w, types.NewError(types.INTERNAL, "internal_error", "Unexpected failure to fulfill service request at "+strconv.Itoa(i)))
+			return
+		}
+		if err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		}
+	}
+
+	w.WriteHeader(200)
+	w.WriteJson(types.Json{
+		"response": "Successfully patched message " + messageid,
+		"changes":  len(payload),
+	})
+}
+
+/**
+ * Deletes a message on behalf of its author or an admin
+ */
+func (a Api) DeleteMessage(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_POST_MESSAGES)
+	if !ok {
 		return
 	}
+
+	if err := a.Svc.DeleteMessage(handle, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+//
+// Social
+//
+
+func (a Api) BlockUser(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
 	payload := struct {
-		CircleName string `json:"circlename"`
-		Public     bool   `json:"public"`
+		Target string
 	}{}
 	if err := r.DecodeJsonPayload(&payload); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+		a.Util.ErrorResponse(w, malformedPayload(err))
 		return
 	}
-	circleName := payload.CircleName
-	isPublic := payload.Public
+	target := payload.Target
 
-	if circleName == "" {
-		a.Util.SimpleJsonReason(w, 400, "Missing `circlename` parameter")
+	if current, err := a.Svc.ResolveHandle(target); types.IsNotFound(err) {
+		a.Util.ErrorResponse(w, types.InvalidInput("user_not_found", "Bad request, user "+target+" wasn't found"))
 		return
-	} else if circleName == types.GOLD || circleName == types.BROADCAST {
-		a.Util.SimpleJsonReason(w, 403, circleName+" is a reserved circle name")
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
+	} else {
+		target = current
 	}
 
-	if handle, success := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !success {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
-		return
+	if err := a.Svc.BlockUser(handle, target); err != nil {
+		a.Util.ErrorResponse(w, err)
 	} else {
-		if circleResponse, ok := a.Svc.NewCircle(handle, circleName, isPublic); !ok {
-			a.Util.SimpleJsonReason(w, 400, "Unexpected failure to create circle")
+		a.Util.SimpleJsonResponse(w, 200, "User "+target+" has been blocked")
+	}
+}
+
+/**
+ * Expects "skip" and "limit" query parameters, both optional. Only the
+ * user and admins may see whom the user blocked.
+ */
+func (a Api) GetBlockedUsers(w rest.ResponseWriter, r *rest.Request) {
+	self, ok := a.authenticate(w, r, service.SESSION_ONLY)
+	if !ok {
+		return
+	}
+
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
+		return
+	}
+	if self != handle {
+		if admin, err := a.Svc.IsAdmin(self); err != nil {
+			a.Util.ErrorResponse(w, err)
+			return
+		} else if !admin {
+			a.Util.ErrorResponse(w, types.Forbidden("not_self", "You can not see whom others blocked unless you are an admin"))
+			return
+		}
+	}
+
+	querymap := r.URL.Query()
+	skip, limit := 0, 20
+	if param := querymap.Get("skip"); param != "" {
+		if s, err := strconv.Atoi(param); err != nil || s < 0 {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_skip", "Bad `skip` parameter"))
+			return
+		} else {
+			skip = s
+		}
+	}
+	if param := querymap.Get("limit"); param != "" {
+		if l, err := strconv.Atoi(param); err != nil || l < 1 || l > 100 {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_limit", "Bad `limit` parameter"))
 			return
 		} else {
-			w.WriteHeader(201)
-			w.WriteJson(circleResponse)
+			limit = l
 		}
 	}
+
+	if blocked, total, err := a.Svc.GetBlockedUsers(handle, skip, limit); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Blocked users of " + handle,
+			"results":  blocked,
+			"count":    total,
+		})
+	}
 }
 
-func (a Api) SearchCircles(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+/**
+ * Expects a json PATCH with the "handle" of the user to block or unblock
+ * and the "action", either "block" or "unblock"
+ */
+func (a Api) PatchBlockedUsers(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only block or unblock users yourself")
+	if !ok {
 		return
 	}
 
-	querymap := r.URL.Query()
+	payload := struct {
+		Handle string `json:"handle"`
+		Action string `json:"action"`
+	}{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+	if payload.Handle == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Missing `handle` of the user to block or unblock"))
+		return
+	}
+	if payload.Action != "block" && payload.Action != "unblock" {
+		a.Util.ErrorResponse(w, types.InvalidInput("invalid_action", "Unknown action "+payload.Action+", expected block or unblock"))
+		return
+	}
 
-	var user string
-	var before time.Time
-	var limit int
+	target, err := a.Svc.ResolveHandle(payload.Handle)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	}
 
-	if val, ok := querymap["limit"]; !ok {
-		limit = 20
+	if payload.Action == "block" {
+		err = a.Svc.BlockUser(handle, target)
 	} else {
-		if intval, err := strconv.Atoi(val[0]); err != nil {
-			a.Util.SimpleJsonReason(w, 400, "Malformed limit")
-			return
-		} else {
-			if intval > 100 || intval < 1 {
-				a.Util.SimpleJsonReason(w, 400, "Limit out of range")
-				return
+		err = a.Svc.UnblockUser(handle, target)
+	}
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+/**
+ * Only users themselves may see whom they muted, the muted never learn
+ */
+func (a Api) GetMutes(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only see whom you muted yourself")
+	if !ok {
+		return
+	}
+
+	if mutes, err := a.Svc.GetMutes(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Mutes of " + handle,
+			"results":  mutes,
+			"count":    len(mutes),
+		})
+	}
+}
+
+/**
+ * Expects a json PATCH with either the "handle" of a user or the
+ * "circleid" of a circle, the "action", either "mute" or "unmute", and
+ * optionally when the mute ends as "until"
+ */
+func (a Api) PatchMutes(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticateSelf(w, r, "You can only mute or unmute yourself")
+	if !ok {
+		return
+	}
+
+	payload := types.MuteRequest{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+	if (payload.Handle == "") == (payload.CircleId == "") {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_parameter", "Give either the `handle` of a user or the `circleid` of a circle"))
+		return
+	}
+	if payload.Action != "mute" && payload.Action != "unmute" {
+		a.Util.ErrorResponse(w, types.InvalidInput("invalid_action", "Unknown action "+payload.Action+", expected mute or unmute"))
+		return
+	}
+
+	var err error
+	if payload.Handle != "" {
+		var target string
+		if target, err = a.Svc.ResolveHandle(payload.Handle); err == nil {
+			if payload.Action == "mute" {
+				err = a.Svc.MuteUser(handle, target, payload.Until)
 			} else {
-				limit = intval
+				err = a.Svc.UnmuteUser(handle, target)
 			}
 		}
+	} else if payload.Action == "mute" {
+		err = a.Svc.MuteCircle(handle, payload.CircleId, payload.Until)
+	} else {
+		err = a.Svc.UnmuteCircle(handle, payload.CircleId)
+	}
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
+	}
+}
+
+func (a Api) JoinDefault(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_MANAGE_CIRCLES)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Target string
+	}{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
+	target := payload.Target
+
+	if current, err := a.Svc.ResolveHandle(target); types.IsNotFound(err) {
+		a.Util.ErrorResponse(w, types.InvalidInput("user_not_found", "Bad request, user "+target+" wasn't found"))
+		return
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else {
+		target = current
+	}
+
+	if blocked, err := a.Svc.BlockExistsFromTo(target, handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else if blocked {
+		a.Util.ErrorResponse(w, types.Forbidden("blocked", "Server refusal to comply with join request"))
+		return
+	}
+
+	if err := a.Svc.JoinBroadcast(handle, target); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		a.Util.SimpleJsonResponse(w, 201, "JoinDefault request successful!")
+	}
+}
+
+/**
+ * Allows joining by (target, circlename) or (circleid) candidate keys
+ */
+func (a Api) Join(w rest.ResponseWriter, r *rest.Request) {
+	handle, ok := a.authenticate(w, r, service.SCOPE_MANAGE_CIRCLES)
+	if !ok {
+		return
+	}
+
+	payload := struct {
+		Target   string
+		Circle   string
+		CircleId string
+	}{}
+	if err := r.DecodeJsonPayload(&payload); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
 	}
+	target := payload.Target
+	circle := payload.Circle
+	circleid := payload.CircleId
 
-	// Reveals public and private circles user is apart of. If user parameter is absent
-	// will use the logged in user as the target of the query.
-	// Empty assumed not to be the name of a user, DWIW
-	if val, ok := querymap["user"]; !ok || val[0] == "" {
-		if handle, ok := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !ok {
-			a.Util.FailedToDetermineHandleFromAuthToken(w)
-			return
-		} else {
-			user = handle
-		}
+	// Former handles still work while they are reserved
+	if current, err := a.Svc.ResolveHandle(target); types.IsNotFound(err) {
+		a.Util.ErrorResponse(w, types.InvalidInput("user_not_found", "Bad request, user "+target+" wasn't found"))
+		return
+	} else if err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
 	} else {
-		user = val[0]
+		target = current
 	}
 
-	if val, ok := querymap["before"]; !ok {
-		before = time.Now().Local()
-	} else {
-		if millis, err := strconv.Atoi(val[0]); err != nil {
-			a.Util.SimpleJsonResponse(w, 400, "Malformed duration")
+	if blocked, err := a.Svc.BlockExistsFromTo(target, handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else if blocked {
+		a.Util.ErrorResponse(w, types.Forbidden("blocked", "Server refusal to comply with join request"))
+		return
+	}
+
+	if circleid == "" {
+		if id, err := a.Svc.GetCircleId(target, circle); types.IsNotFound(err) {
+			a.Util.ErrorResponse(w, types.NotFound("circle_not_found", "Could not find target circle, join failed"))
+			return
+		} else if err != nil {
+			a.Util.ErrorResponse(w, err)
 			return
 		} else {
-			var seconds, nanoseconds int64
-			seconds = int64(millis / 1000)
-			nanoseconds = int64(millis % 1000 * 1000000)
-			before = time.Unix(seconds, nanoseconds)
+			circleid = id
 		}
 	}
 
-	results, count := a.Svc.CirclesUserIsPartOf(user, before, limit)
+	if visible, err := a.Svc.CanSeeCircle(handle, circleid); err != nil {
+		a.Util.ErrorResponse(w, err)
+		return
+	} else if !visible {
+		a.Util.ErrorResponse(w, types.NotFound("circle_not_found", "Could not find target circle, join failed"))
+		return
+	}
 
-	w.WriteHeader(200)
-	w.WriteJson(types.SearchCirclesResponse{
-		Results:  results,
-		Response: "Search complete",
-		Count:    count,
-	})
+	if err := a.Svc.JoinCircle(handle, circleid); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		a.Util.SimpleJsonResponse(w, 201, "Join request successful!")
+	}
 }
 
 //
-// Messages
+// Admin
 //
 
 /**
- * Create a new, unpublished message
+ * Lists the handles and IPs locked out of logging in, along with the
+ * latest lockout events. Takes an optional "limit" on the events.
  */
-func (a Api) NewMessage(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+func (a Api) GetLockouts(w rest.ResponseWriter, r *rest.Request) {
+	if _, ok := a.authenticateAdmin(w, r); !ok {
 		return
 	}
-	payload := struct {
-		Content string
-		Circles []string
-	}{}
-	if err := r.DecodeJsonPayload(&payload); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
-		return
+
+	limit := 100
+	if param := r.URL.Query().Get("limit"); param != "" {
+		if l, err := strconv.Atoi(param); err != nil || l < 1 {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_limit", "Bad `limit` parameter"))
+			return
+		} else {
+			limit = l
+		}
 	}
 
-	handle, ok := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r))
-	if !ok {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
+	events, err := a.Svc.GetLockoutEvents(limit)
+	if err != nil {
+		a.Util.ErrorResponse(w, err)
 		return
 	}
+	lockouts := a.Svc.GetLockouts()
 
-	content := payload.Content
-	circles := payload.Circles
+	w.WriteHeader(200)
+	w.WriteJson(types.Json{
+		"response": "Current lockouts and latest lockout events",
+		"results":  lockouts,
+		"count":    len(lockouts),
+		"events":   events,
+	})
+}
 
-	if payload.Content == "" {
-		a.Util.SimpleJsonReason(w, 400, "Please enter some content for your message")
+/**
+ * Lifts the lockout of a handle or IP, given as :kind and :subject
+ */
+func (a Api) ClearLockout(w rest.ResponseWriter, r *rest.Request) {
+	admin, ok := a.authenticateAdmin(w, r)
+	if !ok {
 		return
 	}
 
-	if message, ok := a.Svc.NewMessage(handle, content); !ok {
-		a.Util.SimpleJsonReason(w, 500, "Unexpected failure to create message")
-		return
+	if err := a.Svc.ClearLockout(r.PathParam("kind"), r.PathParam("subject"), admin); err != nil {
+		a.Util.ErrorResponse(w, err)
 	} else {
-		if len(circles) > 0 {
-			for _, circleid := range circles {
-				if !a.Svc.PublishMessageToCircle(message.Id, circleid) {
-					a.Util.SimpleJsonReason(w, 400, "Failed to publish to one of circles provided")
-					return
-				}
-			}
-		}
-		w.WriteHeader(201)
-		w.WriteJson(message)
+		w.WriteHeader(204)
 	}
 }
 
-func (a Api) GetMessages(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+/**
+ * Lists the users whose handle or email starts with "q", all of them
+ * without it, by handle. Takes optional "skip" and "limit", "count" is
+ * how many there are in all.
+ */
+func (a Api) GetAccounts(w rest.ResponseWriter, r *rest.Request) {
+	if _, ok := a.authenticateAdmin(w, r); !ok {
 		return
 	}
 
 	querymap := r.URL.Query()
-	var target, circleid string
-	var t, c bool
-
-	if self, ok := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !ok {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
-		return
-	} else {
-		if _, ok := querymap["all"]; ok {
-			if messagesView, ok := a.Svc.GetAllMessages(self); !ok {
-				a.Util.SimpleJsonReason(w, 400, "Something happened")
-			} else {
-				w.WriteHeader(200)
-				w.WriteJson(messagesView)
-				return
-			}
-		}
-		if targetUses, ok := querymap["handle"]; ok {
-			target, t = targetUses[0], ok
-		}
-		if circleidUses, ok := querymap["circleid"]; ok {
-			circleid, c = circleidUses[0], ok
+	skip, limit := 0, 20
+	if param := querymap.Get("skip"); param != "" {
+		if s, err := strconv.Atoi(param); err != nil || s < 0 {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_skip", "Bad `skip` parameter"))
+			return
+		} else {
+			skip = s
 		}
-
-		if t && c {
-			if messagesView, ok := a.Svc.GetMessagesByTargetInCircle(self, target, circleid); !ok {
-				a.Util.SimpleJsonReason(w, 400, "Could not find circle or you lack access rights")
-			} else {
-				w.WriteHeader(200)
-				w.WriteJson(messagesView)
-			}
-		} else if t && !c && target != self {
-			if messagesView, ok := a.Svc.GetPublicMessagesByHandle(self, target); !ok {
-				a.Util.SimpleJsonReason(w, 400, "Could not find circle or you lack access rights")
-			} else {
-				w.WriteHeader(200)
-				w.WriteJson(messagesView)
-			}
-		} else if !t && c {
-			if messagesView, ok := a.Svc.GetMessagesInCircle(self, circleid); !ok {
-				a.Util.SimpleJsonReason(w, 400, "Could not find circle or you lack access rights")
-			} else {
-				w.WriteHeader(200)
-				w.WriteJson(messagesView)
-			}
+	}
+	if param := querymap.Get("limit"); param != "" {
+		if l, err := strconv.Atoi(param); err != nil || l < 1 || l > 100 {
+			a.Util.ErrorResponse(w, types.InvalidInput("invalid_limit", "Bad `limit` parameter"))
+			return
 		} else {
-			if messagesView, ok := a.Svc.GetMessageFeedOfSelf(self); !ok {
-				a.Util.SimpleJsonReason(w, 500, "Unexpected failure to get feed")
-			} else {
-				w.WriteHeader(200)
-				w.WriteJson(messagesView)
-			}
+			limit = l
 		}
 	}
+
+	if accounts, total, err := a.Svc.SearchAccounts(querymap.Get("q"), skip, limit); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Search complete",
+			"results":  accounts,
+			"count":    total,
+		})
+	}
 }
 
-func (a Api) GetMessageById(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+/**
+ * Expects a json PUT with "role", either "user" or "admin"
+ */
+func (a Api) SetUserRole(w rest.ResponseWriter, r *rest.Request) {
+	admin, ok := a.authenticateAdmin(w, r)
+	if !ok {
 		return
 	}
 
-	id := r.PathParam("id")
+	change := types.RoleChange{}
+	if err := r.DecodeJsonPayload(&change); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
+		return
+	}
 
-	handle, ok := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r))
+	handle, ok := a.pathHandle(w, r)
 	if !ok {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
 		return
 	}
-
-	if message, ok := a.Svc.GetVisibleMessageById(handle, id); ok {
-		w.WriteHeader(200)
-		w.WriteJson(message)
+	if err := a.Svc.SetRole(admin, handle, change.Role); err != nil {
+		a.Util.ErrorResponse(w, err)
 	} else {
-		a.Util.SimpleJsonReason(w, 404, "No such message with id "+id+" could be found")
-		return
+		a.Util.SimpleJsonResponse(w, 200, handle+" is now "+change.Role)
 	}
 }
 
-func (a Api) EditMessage(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+func (a Api) SuspendUser(w rest.ResponseWriter, r *rest.Request) {
+	admin, ok := a.authenticateAdmin(w, r)
+	if !ok {
 		return
 	}
 
-	payload := make([]types.MessagePatch, 0)
-	if err := r.DecodeJsonPayload(&payload); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
 		return
 	}
+	if err := a.Svc.SuspendUser(admin, handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		a.Util.SimpleJsonResponse(w, 200, handle+" has been suspended")
+	}
+}
 
-	messageid := r.PathParam("id")
-	handle, ok := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r))
-	if !ok {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
+func (a Api) ReinstateUser(w rest.ResponseWriter, r *rest.Request) {
+	if _, ok := a.authenticateAdmin(w, r); !ok {
 		return
 	}
 
-	// Validate input of patch objects
-	for index, obj := range payload {
-		if err := a.Validator.ValidateAndTag(obj, "json"); err != nil {
-			a.Util.PatchValidationReason(w, 400, err, index)
-			return
-		} else {
-			op := obj.Op
-			resource := obj.Resource
-			value := obj.Value
-			if op == "update" {
-				if resource == "image" {
-					a.Util.SimpleJsonReason(w, 405, "Edit message image value has yet to be implemented")
-					return
-				}
-			} else if op == "publish" && resource == "circle" {
-				if !a.Svc.UserCanPublishTo(handle, value) {
-					a.Util.SimpleJsonReason(w, 400, "Could not publish message to circle "+value)
-					return
-				}
-			} else if op == "unpublish" && resource == "circle" {
-				if !a.Svc.UserCanRetractPublication(handle, messageid, value) {
-					a.Util.SimpleJsonReason(w, 400, "Cannot unpublish message, specified published relation not found")
-					return
-				}
-			} else {
-				a.Util.SimpleJsonReason(w, 400, "Malformed patch request at object "+strconv.Itoa(index))
-				return
-			}
-		}
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
+		return
 	}
-
-	// Service requests
-	for i, obj := range payload {
-		op := obj.Op
-		resource := obj.Resource
-		value := obj.Value
-
-		if op == "update" {
-			if resource == "content" {
-				a.Svc.UpdateContentOfMessage(messageid, value)
-			}
-		} else if op == "publish" {
-			a.Svc.PublishMessageToCircle(messageid, value)
-		} else if op == "unpublish" {
-			a.Svc.UnpublishMessageFromCircle(messageid, value)
-		} else {
-			a.Util.SimpleJsonReason(w, 500, "Unexpected failure to fulfill service request at "+strconv.Itoa(i))
-			return
-		}
+	if err := a.Svc.ReinstateUser(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		a.Util.SimpleJsonResponse(w, 200, handle+" has been reinstated")
 	}
-
-	w.WriteHeader(200)
-	w.WriteJson(types.Json{
-		"response": "Successfully patched message " + messageid,
-		"changes":  len(payload),
-	})
 }
 
 /**
- * Deletes an unpublished message
+ * Logs the user out of every session
  */
-func (a Api) DeleteMessage(w rest.ResponseWriter, r *rest.Request) {
-	a.Util.SimpleJsonReason(w, 405, "Unimplemented")
-}
-
-//
-// Social
-//
-
-func (a Api) BlockUser(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+func (a Api) ForceLogout(w rest.ResponseWriter, r *rest.Request) {
+	if _, ok := a.authenticateAdmin(w, r); !ok {
 		return
 	}
 
-	payload := struct {
-		Target string
-	}{}
-	if err := r.DecodeJsonPayload(&payload); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+	handle, ok := a.pathHandle(w, r)
+	if !ok {
 		return
 	}
-	if handle, success := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !success {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
-		return
+	if count, err := a.Svc.ForceLogout(handle); err != nil {
+		a.Util.ErrorResponse(w, err)
 	} else {
-		target := payload.Target
-
-		if !a.Svc.UserExists(target) {
-			a.Util.SimpleJsonReason(w, 400, "Bad request, user "+target+" wasn't found")
-			return
-		}
-
-		a.Svc.KickTargetFromCircles(handle, target)
-
-		if !a.Svc.CreateBlockFromTo(handle, target) {
-			a.Util.SimpleJsonReason(w, 400, "Unexpected failure to block user")
-		} else {
-			a.Util.SimpleJsonResponse(w, 200, "User "+target+" has been blocked")
-		}
+		w.WriteHeader(200)
+		w.WriteJson(types.Json{
+			"response": "Logged out " + handle,
+			"count":    count,
+		})
 	}
 }
 
-func (a Api) JoinDefault(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+/**
+ * Expects a json PATCH with "name" and/or "description"
+ */
+func (a Api) AdminEditCircle(w rest.ResponseWriter, r *rest.Request) {
+	admin, ok := a.authenticateAdmin(w, r)
+	if !ok {
 		return
 	}
 
-	payload := struct {
-		Target string
-	}{}
-	if err := r.DecodeJsonPayload(&payload); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+	patch := types.CirclePatch{}
+	if err := r.DecodeJsonPayload(&patch); err != nil {
+		a.Util.ErrorResponse(w, malformedPayload(err))
 		return
 	}
 
-	if handle, success := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !success {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
-		return
+	if circle, err := a.Svc.EditCircle(admin, r.PathParam("id"), patch); err != nil {
+		a.Util.ErrorResponse(w, err)
 	} else {
-		target := payload.Target
-
-		if !a.Svc.UserExists(target) {
-			a.Util.SimpleJsonReason(w, 400, "Bad request, user "+target+" wasn't found")
-			return
-		}
+		w.WriteHeader(200)
+		w.WriteJson(circle)
+	}
+}
 
-		if a.Svc.BlockExistsFromTo(target, handle) {
-			a.Util.SimpleJsonReason(w, 403, "Server refusal to comply with join request")
-			return
-		}
+func (a Api) AdminDeleteCircle(w rest.ResponseWriter, r *rest.Request) {
+	admin, ok := a.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
 
-		if !a.Svc.JoinBroadcast(handle, target) {
-			a.Util.SimpleJsonReason(w, 400, "Unexpected failure to join Broadcast")
-		} else {
-			a.Util.SimpleJsonResponse(w, 201, "JoinDefault request successful!")
-		}
+	if err := a.Svc.DeleteCircle(admin, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
 	}
 }
 
 /**
- * Allows joining by (target, circlename) or (circleid) candidate keys
+ * Expects a json PATCH with the new "content"
  */
-func (a Api) Join(w rest.ResponseWriter, r *rest.Request) {
-	if !a.authenticate(r) {
-		a.Util.FailedToAuthenticate(w)
+func (a Api) AdminEditMessage(w rest.ResponseWriter, r *rest.Request) {
+	if _, ok := a.authenticateAdmin(w, r); !ok {
 		return
 	}
 
 	payload := struct {
-		Target   string
-		Circle   string
-		CircleId string
+		Content string `json:"content"`
 	}{}
 	if err := r.DecodeJsonPayload(&payload); err != nil {
-		rest.Error(w, err.Error(), http.StatusBadRequest)
+		a.Util.ErrorResponse(w, malformedPayload(err))
 		return
 	}
-
-	if handle, success := a.Svc.GetHandleFromAuthorization(a.getTokenFromHeader(r)); !success {
-		a.Util.FailedToDetermineHandleFromAuthToken(w)
+	if payload.Content == "" {
+		a.Util.ErrorResponse(w, types.InvalidInput("missing_content", "Please enter some content for the message"))
 		return
-	} else {
-		target := payload.Target
-		circle := payload.Circle
-		circleid := payload.CircleId
-
-		if !a.Svc.UserExists(target) {
-			a.Util.SimpleJsonReason(w, 400, "Bad request, user "+target+" wasn't found")
-			return
-		}
-
-		if a.Svc.BlockExistsFromTo(target, handle) {
-			a.Util.SimpleJsonReason(w, 403, "Server refusal to comply with join request")
-			return
-		}
+	}
 
-		if circleid == "" {
-			if id := a.Svc.GetCircleId(target, circle); id == "" {
-				a.Util.SimpleJsonReason(w, 404, "Could not find target circle, join failed")
-				return
-			} else {
-				circleid = id
-			}
-		}
+	messageid := r.PathParam("id")
+	if err := a.Svc.UpdateContentOfMessage(messageid, payload.Content); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		a.Util.SimpleJsonResponse(w, 200, "Successfully updated message "+messageid)
+	}
+}
 
-		if !a.Svc.CanSeeCircle(handle, circleid) {
-			a.Util.SimpleJsonReason(w, 404, "Could not find target circle, join failed")
-			return
-		}
+func (a Api) AdminDeleteMessage(w rest.ResponseWriter, r *rest.Request) {
+	admin, ok := a.authenticateAdmin(w, r)
+	if !ok {
+		return
+	}
 
-		if a.Svc.JoinCircle(handle, circleid) {
-			a.Util.SimpleJsonResponse(w, 201, "Join request successful!")
-		} else {
-			a.Util.SimpleJsonReason(w, 400, "Unexpected failure to join circle, join failed")
-		}
+	if err := a.Svc.DeleteMessage(admin, r.PathParam("id")); err != nil {
+		a.Util.ErrorResponse(w, err)
+	} else {
+		w.WriteHeader(204)
 	}
 }
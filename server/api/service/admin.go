@@ -0,0 +1,211 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"strings"
+)
+
+//
+// Constants
+//
+
+const (
+	// What a user may do beyond their own account. Admins may use the
+	// admin endpoints and edit or delete what belongs to anyone.
+	ROLE_USER  = query.DEFAULT_ROLE
+	ROLE_ADMIN = "admin"
+)
+
+//
+// Errors
+//
+
+func accountSuspended() error {
+	return types.Forbidden("account_suspended", "This account is suspended")
+}
+
+func ownAccount(reason string) error {
+	return types.Forbidden("own_account", reason)
+}
+
+//
+// Roles
+//
+
+func (s Svc) IsAdmin(handle string) (bool, error) {
+	role, err := s.Query.GetUserRole(handle)
+	if types.IsNotFound(err) {
+		return false, nil
+	}
+	return role == ROLE_ADMIN, err
+}
+
+// Makes admins of handles, as named in the server's configuration,
+// answering which of them are not signed up. Nobody is demoted.
+func (s Svc) SeedAdmins(handles []string) (missing []string, err error) {
+	for _, handle := range handles {
+		if err := s.Query.SetUserRole(handle, ROLE_ADMIN); types.IsNotFound(err) {
+			missing = append(missing, handle)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
+
+// Gives handle role on behalf of admin, who may not demote themselves.
+// Fails with INVALID_INPUT for unknown roles.
+func (s Svc) SetRole(admin, handle, role string) error {
+	if role != ROLE_USER && role != ROLE_ADMIN {
+		return types.InvalidInput("invalid_role", "No such role "+role+", use "+ROLE_USER+" or "+ROLE_ADMIN)
+	}
+	if types.HandleKey(admin) == types.HandleKey(handle) && role != ROLE_ADMIN {
+		return ownAccount("Admins cannot demote themselves")
+	}
+	return s.Query.SetUserRole(handle, role)
+}
+
+//
+// Accounts
+//
+
+// A page of the users whose handle or email starts with prefix, by handle,
+// along with how many there are in all
+func (s Svc) SearchAccounts(prefix string, skip, limit int) (accounts []types.AccountView, total int, err error) {
+	return s.Query.SearchAccounts(strings.TrimSpace(prefix), skip, limit)
+}
+
+// Fails with FORBIDDEN if handle is suspended
+func (s Svc) CheckNotSuspended(handle string) error {
+	if suspended, err := s.Query.UserIsSuspended(handle); err != nil {
+		return err
+	} else if suspended {
+		return accountSuspended()
+	}
+	return nil
+}
+
+// Locks handle out until reinstated, ending their sessions. Their API keys
+// and OAuth grants are kept but refused while the suspension lasts.
+func (s Svc) SuspendUser(admin, handle string) error {
+	if types.HandleKey(admin) == types.HandleKey(handle) {
+		return ownAccount("Admins cannot suspend themselves")
+	}
+	if err := s.Query.SetUserSuspended(handle, true); err != nil {
+		return err
+	}
+	_, err := s.Query.DestroySessionsExcept(handle, "")
+	return err
+}
+
+func (s Svc) ReinstateUser(handle string) error {
+	return s.Query.SetUserSuspended(handle, false)
+}
+
+// Ends every session of handle, answering how many there were
+func (s Svc) ForceLogout(handle string) (count int, err error) {
+	if exists, err := s.Query.UserExistsByHandle(handle); err != nil {
+		return 0, err
+	} else if !exists {
+		return 0, types.NotFound("user_not_found", "No such user "+handle)
+	}
+	return s.Query.DestroySessionsExcept(handle, "")
+}
+
+//
+// Circles and Messages
+//
+
+// The circle circleid if handle owns it or is an admin. Fails with
+// NOT_FOUND for missing circles and those handle can not see, and
+// FORBIDDEN otherwise.
+func (s Svc) circleOwnedOrAdministered(handle, circleid string) (query.RawCircleView, error) {
+	circle, err := s.Query.GetCircleById(circleid)
+	if err != nil {
+		return query.RawCircleView{}, err
+	}
+	if circle.Owner == handle {
+		return circle, nil
+	}
+	if admin, err := s.IsAdmin(handle); err != nil {
+		return query.RawCircleView{}, err
+	} else if admin {
+		return circle, nil
+	}
+	if visible, err := s.CanSeeCircle(handle, circleid); err != nil {
+		return query.RawCircleView{}, err
+	} else if !visible {
+		return query.RawCircleView{}, circleNotVisible()
+	}
+	return query.RawCircleView{}, types.Forbidden("not_circle_owner", "You can only edit circles you own unless you are an admin")
+}
+
+// The author of messageid if handle wrote it or is an admin. Fails with
+// NOT_FOUND for missing messages and FORBIDDEN otherwise.
+func (s Svc) MessageAuthorForEdit(handle, messageid string) (author string, err error) {
+	author, err = s.Query.GetMessageAuthor(messageid)
+	if err != nil || author == handle {
+		return author, err
+	}
+	if admin, err := s.IsAdmin(handle); err != nil {
+		return "", err
+	} else if !admin {
+		return "", types.Forbidden("not_message_author", "You can only edit messages you wrote unless you are an admin")
+	}
+	return author, nil
+}
+
+func isReservedCircleName(name string) bool {
+	return name == types.GOLD || name == types.BROADCAST
+}
+
+// Renames circleid or changes or clears its description on behalf of
+// handle, the owner or an admin. The circles every user starts with keep
+// their names.
+func (s Svc) EditCircle(handle, circleid string, patch types.CirclePatch) (types.CircleResponse, error) {
+	circle, err := s.circleOwnedOrAdministered(handle, circleid)
+	if err != nil {
+		return types.CircleResponse{}, err
+	}
+
+	name := circle.Name
+	if patch.Name != nil {
+		if name = strings.TrimSpace(*patch.Name); name == "" {
+			return types.CircleResponse{}, types.InvalidInput("invalid_circle_name", "Circles cannot go without a name")
+		} else if name != circle.Name && (isReservedCircleName(circle.Name) || isReservedCircleName(name)) {
+			return types.CircleResponse{}, types.Forbidden("reserved_circle", types.GOLD+" and "+types.BROADCAST+" are reserved circle names")
+		}
+	}
+	description := circle.Description
+	if patch.Description != nil {
+		description = *patch.Description
+	}
+
+	updated, err := s.Query.UpdateCircle(circleid, name, description)
+	if err != nil {
+		return types.CircleResponse{}, err
+	}
+	return formatCircleView(updated), nil
+}
+
+// Deletes circleid on behalf of handle, the owner or an admin, leaving the
+// messages published to it. The circles every user starts with stay.
+func (s Svc) DeleteCircle(handle, circleid string) error {
+	circle, err := s.circleOwnedOrAdministered(handle, circleid)
+	if err != nil {
+		return err
+	}
+	if isReservedCircleName(circle.Name) {
+		return types.Forbidden("reserved_circle", "The "+circle.Name+" circle cannot be deleted")
+	}
+	return s.Query.DeleteCircle(circleid)
+}
+
+// Deletes messageid on behalf of handle, the author or an admin
+func (s Svc) DeleteMessage(handle, messageid string) error {
+	if _, err := s.MessageAuthorForEdit(handle, messageid); err != nil {
+		return err
+	}
+	return s.Query.DeleteMessage(messageid)
+}
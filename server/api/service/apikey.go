@@ -0,0 +1,164 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"strings"
+)
+
+//
+// Constants
+//
+
+const (
+	// API keys go in the Authorization header like session tokens do,
+	// told apart by their prefix
+	API_KEY_PREFIX = "Key "
+
+	// What an API key may be used for
+	SCOPE_READ_FEED      = "feed:read"
+	SCOPE_POST_MESSAGES  = "messages:post"
+	SCOPE_MANAGE_CIRCLES = "circles:manage"
+
+	// Routes that take a session and never an API key, such as managing
+	// the account or the keys themselves
+	SESSION_ONLY = ""
+)
+
+var API_KEY_SCOPES = []string{
+	SCOPE_READ_FEED,
+	SCOPE_POST_MESSAGES,
+	SCOPE_MANAGE_CIRCLES,
+}
+
+//
+// Utility Functions
+//
+
+func IsApiKey(authorization string) bool {
+	return strings.HasPrefix(authorization, API_KEY_PREFIX)
+}
+
+// Scoped credentials, API keys and OAuth access tokens, only work for the
+// routes their scopes cover, unlike the tokens of sessions
+func IsScopedCredential(authorization string) bool {
+	return IsApiKey(authorization) || IsOAuthToken(authorization)
+}
+
+func checkScope(granted []string, scope string) error {
+	if scope == SESSION_ONLY {
+		return types.Forbidden("session_required", "API keys and OAuth tokens cannot be used for this, please log in")
+	}
+	for _, g := range granted {
+		if g == scope {
+			return nil
+		}
+	}
+	return types.Forbidden("insufficient_scope", "This credential lacks the "+scope+" scope")
+}
+
+func isApiKeyScope(scope string) bool {
+	for _, known := range API_KEY_SCOPES {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+//
+// API Keys
+//
+
+// Creates a named key for handle, answering with the key itself, which is
+// never shown again. Fails with INVALID_INPUT for a missing name, unknown
+// scopes or an expiry in the past.
+func (s Svc) CreateApiKey(handle string, request types.ApiKeyRequest) (key string, view types.ApiKeyView, err error) {
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return "", types.ApiKeyView{}, types.InvalidInput("missing_key_name", "API keys need a name")
+	}
+	if len(request.Scopes) == 0 {
+		return "", types.ApiKeyView{}, types.InvalidInput("invalid_scope",
+			"API keys need at least one of the scopes "+strings.Join(API_KEY_SCOPES, ", "))
+	}
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, scope := range request.Scopes {
+		if !isApiKeyScope(scope) {
+			return "", types.ApiKeyView{}, types.InvalidInput("invalid_scope", "No such scope "+scope)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	if !request.Expires.IsZero() && !query.Now().Before(request.Expires) {
+		return "", types.ApiKeyView{}, types.InvalidInput("invalid_expiry", "API keys cannot expire in the past")
+	}
+
+	key = API_KEY_PREFIX + query.NewApiKey()
+	record := query.ApiKeyRecord{
+		Id:      query.NewUUID(),
+		KeyHash: s.hashToken(key),
+		Name:    name,
+		Scopes:  scopes,
+		Expires: request.Expires,
+	}
+	if err := s.Query.CreateApiKey(handle, record); err != nil {
+		return "", types.ApiKeyView{}, err
+	}
+	return key, types.ApiKeyView{
+		Id:      record.Id,
+		Name:    record.Name,
+		Scopes:  record.Scopes,
+		Created: query.Now(),
+		Expires: record.Expires,
+	}, nil
+}
+
+func (s Svc) GetApiKeys(handle string) ([]types.ApiKeyView, error) {
+	return s.Query.GetApiKeysByHandle(handle)
+}
+
+func (s Svc) RevokeApiKey(handle, keyid string) error {
+	return s.Query.DestroyApiKey(handle, keyid)
+}
+
+// Resolves an API key to its owner for a route needing scope. Fails with
+// NOT_FOUND for unknown or expired keys and FORBIDDEN when the key lacks
+// the scope or the route takes sessions only.
+func (s Svc) GetHandleFromApiKey(key, scope string) (string, error) {
+	handle, scopes, err := s.Query.DeriveApiKey(s.hashToken(key))
+	if err != nil {
+		return "", err
+	}
+	if err := checkScope(scopes, scope); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+// Resolves an API key or OAuth access token for a route needing scope.
+// Neither works while its user is suspended or deactivated.
+func (s Svc) GetHandleFromScopedCredential(authorization, scope string) (handle string, err error) {
+	if IsOAuthToken(authorization) {
+		handle, err = s.GetHandleFromOAuthToken(authorization, scope)
+	} else {
+		handle, err = s.GetHandleFromApiKey(authorization, scope)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.CheckNotSuspended(handle); err != nil {
+		return "", err
+	}
+	if err := s.checkActive(handle); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+func (s Svc) TouchApiKey(key string) error {
+	return s.Query.UpdateApiKeyLastUsed(s.hashToken(key))
+}
@@ -0,0 +1,201 @@
+package service
+
+import (
+	"../../types"
+	"./blob"
+	"./query"
+	"bytes"
+	"fmt"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+//
+// Constants
+//
+
+const (
+	// Avatar upload defaults
+	AVATAR_MAX_BYTES  = 2 << 20
+	AVATAR_MAX_PIXELS = 4096 * 4096
+)
+
+// The media types avatars are accepted in, as sniffed from their content
+var avatarMediaTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+//
+// Types
+//
+
+// What avatars may be uploaded and how they are kept. Uploads of more than
+// MaxBytes, or that decode to more than MaxPixels, are refused. Every
+// avatar is cropped square and stored as a PNG thumbnail of each of Sizes
+// pixels a side, the last being the one served by default.
+type AvatarPolicy struct {
+	MaxBytes  int64
+	MaxPixels int
+	Sizes     []int
+}
+
+func DefaultAvatarPolicy() AvatarPolicy {
+	return AvatarPolicy{
+		MaxBytes:  AVATAR_MAX_BYTES,
+		MaxPixels: AVATAR_MAX_PIXELS,
+		Sizes:     []int{32, 64, 128, 256},
+	}
+}
+
+//
+// Utility Functions
+//
+
+// Avatars are addressed by id rather than by handle, so a url never
+// changes what it shows and can be cached for good
+func MakeAvatarUrl(avatarid string) string {
+	if avatarid == "" {
+		return ""
+	}
+	return API_URL + "/avatars/" + url.PathEscape(avatarid)
+}
+
+func avatarKey(avatarid string, size int) string {
+	return "avatars/" + avatarid + "/" + strconv.Itoa(size) + ".png"
+}
+
+func avatarNotFound(avatarid string) error {
+	return types.NotFound("avatar_not_found", "No such avatar "+avatarid)
+}
+
+func badAvatarMedia() error {
+	return types.InvalidInput("bad_media", "Avatars must be PNG, JPEG, GIF or WebP images")
+}
+
+// Scales the largest square in the middle of img to size pixels a side
+func thumbnail(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	min := image.Pt(b.Min.X+(b.Dx()-side)/2, b.Min.Y+(b.Dy()-side)/2)
+	square := image.Rectangle{min, min.Add(image.Pt(side, side))}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), img, square, draw.Src, nil)
+	return thumb
+}
+
+//
+// Avatars
+//
+
+// Replaces the avatar of handle with the image in data, answering the url
+// of the new one. Fails with INVALID_INPUT for anything that is not a PNG,
+// JPEG, GIF or WebP image, as told by its content rather than what the
+// client claims, and for images too large.
+func (s Svc) SetAvatar(handle string, data []byte) (string, error) {
+	if exists, err := s.Query.UserExistsByHandle(handle); err != nil {
+		return "", err
+	} else if !exists {
+		return "", types.NotFound("user_not_found", "No such user "+handle)
+	}
+
+	if int64(len(data)) > s.Avatars.MaxBytes {
+		return "", types.InvalidInput("avatar_too_large",
+			fmt.Sprintf("Avatars can be at most %d KB", s.Avatars.MaxBytes/1024))
+	}
+	if !avatarMediaTypes[http.DetectContentType(data)] {
+		return "", badAvatarMedia()
+	}
+	// Checked before decoding, a small file can claim a huge image
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width < 1 || config.Height < 1 {
+		return "", badAvatarMedia()
+	}
+	if config.Width*config.Height > s.Avatars.MaxPixels {
+		return "", types.InvalidInput("avatar_too_large",
+			fmt.Sprintf("Avatars can be at most %d pixels, this one is %dx%d", s.Avatars.MaxPixels, config.Width, config.Height))
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", badAvatarMedia()
+	}
+
+	avatarid := query.NewUUID()
+	for _, size := range s.Avatars.Sizes {
+		encoded := &bytes.Buffer{}
+		if err := png.Encode(encoded, thumbnail(img, size)); err != nil {
+			return "", types.WrapError(types.INTERNAL, "internal_error", "Unexpected failure to encode avatar", err)
+		}
+		if err := s.Blobs.Put(avatarKey(avatarid, size), encoded.Bytes()); err != nil {
+			s.deleteAvatar(avatarid)
+			return "", types.WrapError(types.UNAVAILABLE, "blob_store_unavailable", "Failed to store avatar", err)
+		}
+	}
+
+	previous, err := s.Query.GetUserAvatar(handle)
+	if err != nil {
+		s.deleteAvatar(avatarid)
+		return "", err
+	}
+	if err := s.Query.SetUserAvatar(handle, avatarid); err != nil {
+		s.deleteAvatar(avatarid)
+		return "", err
+	}
+	s.deleteAvatar(previous)
+	return MakeAvatarUrl(avatarid), nil
+}
+
+// The PNG of avatarid that is size pixels a side, or of the largest size
+// when size is 0
+func (s Svc) GetAvatar(avatarid string, size int) ([]byte, error) {
+	if size == 0 {
+		size = s.Avatars.Sizes[len(s.Avatars.Sizes)-1]
+	}
+	known := false
+	for _, candidate := range s.Avatars.Sizes {
+		known = known || candidate == size
+	}
+	if !known {
+		return nil, types.InvalidInput("bad_avatar_size", fmt.Sprintf("Avatars come in sizes %v", s.Avatars.Sizes))
+	}
+	for _, r := range avatarid {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return nil, avatarNotFound(avatarid)
+		}
+	}
+
+	data, err := s.Blobs.Get(avatarKey(avatarid, size))
+	if err == blob.ErrNotFound {
+		return nil, avatarNotFound(avatarid)
+	} else if err != nil {
+		return nil, types.WrapError(types.UNAVAILABLE, "blob_store_unavailable", "Failed to read avatar", err)
+	}
+	return data, nil
+}
+
+// Deletes every size of avatarid. Leftovers only waste space, so failures
+// are logged rather than returned.
+func (s Svc) deleteAvatar(avatarid string) {
+	if avatarid == "" {
+		return
+	}
+	for _, size := range s.Avatars.Sizes {
+		if err := s.Blobs.Delete(avatarKey(avatarid, size)); err != nil {
+			log.Printf("Failed to delete avatar %s: %v", avatarKey(avatarid, size), err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package blob
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+//
+// Types
+//
+
+// Returned by Get for keys that were never stored or have been deleted
+var ErrNotFound = errors.New("blob not found")
+
+// Store keeps the files the service generates, such as avatar thumbnails,
+// under slash separated keys. Which one is used is a deployment decision,
+// see MemoryStore and FileStore.
+type Store interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	// Deleting a missing key is not an error
+	Delete(key string) error
+}
+
+//
+// Memory
+//
+
+// MemoryStore keeps every blob in process memory, for tests
+type MemoryStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{blobs: map[string][]byte{}}
+}
+
+func (s *MemoryStore) Put(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *MemoryStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, key)
+	return nil
+}
+
+// The keys stored so far, in no particular order
+func (s *MemoryStore) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.blobs))
+	for key := range s.blobs {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+//
+// File
+//
+
+// FileStore keeps every blob in its own file under Dir, the key being the
+// path relative to it
+type FileStore struct {
+	Dir string
+}
+
+func (s FileStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// Written aside and renamed so readers never see half a file
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s FileStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+func (s FileStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Refuses keys that would leave Dir
+func (s FileStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if key == "" || strings.TrimPrefix(clean, "/") != key {
+		return "", errors.New("illegal blob key " + key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
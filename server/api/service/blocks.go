@@ -0,0 +1,50 @@
+package service
+
+import (
+	"../../types"
+)
+
+//
+// Utility Functions
+//
+
+func MakeBlockedUrl(handle string) string {
+	return MakeUserUrl(handle) + "/blocked"
+}
+
+//
+// Blocking
+//
+
+// Blocks target from handle's circles, kicking them out of those they are
+// in. Fails with FORBIDDEN for handle blocking itself.
+func (s Svc) BlockUser(handle, target string) error {
+	if handle == target {
+		return types.Forbidden("self_block", "You can not block yourself")
+	}
+	if err := s.KickTargetFromCircles(handle, target); err != nil {
+		return err
+	}
+	return s.CreateBlockFromTo(handle, target)
+}
+
+// Lets target join handle's circles again, without putting them back in
+// those they were kicked out of. Unblocking a user that is not blocked is
+// no error.
+func (s Svc) UnblockUser(handle, target string) error {
+	return s.Query.DeleteBlockRelationFromTo(handle, target)
+}
+
+// A page of the users handle has blocked in handle order, along with how
+// many there are in all
+func (s Svc) GetBlockedUsers(handle string, skip, limit int) ([]types.UserSearchView, int, error) {
+	blocked, total, err := s.Query.GetBlockedUsers(handle, skip, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range blocked {
+		blocked[i].Url = MakeUserUrl(blocked[i].Handle)
+		blocked[i].Avatar = MakeAvatarUrl(blocked[i].Avatar)
+	}
+	return blocked, total, nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"log"
+	"time"
+)
+
+//
+// Constants
+//
+
+const (
+	// Account deletion defaults
+	DELETION_GRACE_PERIOD   = 30 * 24 * time.Hour
+	DELETION_PURGE_INTERVAL = time.Hour
+)
+
+//
+// Types
+//
+
+// How deleted accounts are kept. Deleting an account deactivates it, and
+// logging back in within GracePeriod restores it. Past that the purger,
+// which runs every PurgeInterval, deletes it for good.
+type DeletionPolicy struct {
+	GracePeriod   time.Duration
+	PurgeInterval time.Duration
+}
+
+func DefaultDeletionPolicy() DeletionPolicy {
+	return DeletionPolicy{
+		GracePeriod:   DELETION_GRACE_PERIOD,
+		PurgeInterval: DELETION_PURGE_INTERVAL,
+	}
+}
+
+//
+// Deactivation
+//
+
+// Deactivates handle, hiding them and their messages and ending their
+// sessions, answering when the account will be purged. Deleting an account
+// that is already deactivated changes nothing.
+func (s Svc) DeactivateUser(handle string) (purge time.Time, err error) {
+	deactivated, err := s.Query.GetUserDeactivation(handle)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if deactivated.IsZero() {
+		deactivated = query.Now()
+		if err := s.Query.SetUserDeactivated(handle, deactivated); err != nil {
+			return time.Time{}, err
+		}
+	}
+	if _, err := s.Query.DestroySessionsExcept(handle, ""); err != nil {
+		return time.Time{}, err
+	}
+	return deactivated.Add(s.Deletion.GracePeriod), nil
+}
+
+// Fails with NOT_FOUND if handle is deactivated, so that their API keys and
+// OAuth tokens are refused like unknown ones
+func (s Svc) checkActive(handle string) error {
+	if deactivated, err := s.Query.GetUserDeactivation(handle); err != nil {
+		return err
+	} else if !deactivated.IsZero() {
+		return types.NotFound("user_not_found", "No such user "+handle)
+	}
+	return nil
+}
+
+// Restores handle if they deleted their account within the grace period,
+// and purges them if it ran out before the purger got to them, failing
+// with NOT_FOUND.
+func (s Svc) recoverAccount(handle string) error {
+	deactivated, err := s.Query.GetUserDeactivation(handle)
+	if err != nil || deactivated.IsZero() {
+		return err
+	}
+	if !query.Now().Before(deactivated.Add(s.Deletion.GracePeriod)) {
+		if _, err := s.DeleteUser(handle); err != nil {
+			return err
+		}
+		return types.NotFound("user_not_found", "No such user "+handle)
+	}
+	return s.Query.SetUserDeactivated(handle, time.Time{})
+}
+
+//
+// Purging
+//
+
+// Deletes every account deactivated for longer than the grace period,
+// answering what went with each
+func (s Svc) PurgeDeactivatedUsers() ([]types.DeletionSummary, error) {
+	handles, err := s.Query.GetUsersDeactivatedBefore(query.Now().Add(-s.Deletion.GracePeriod))
+	if err != nil {
+		return nil, err
+	}
+	summaries := []types.DeletionSummary{}
+	for _, handle := range handles {
+		summary, err := s.DeleteUser(handle)
+		if types.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return summaries, err
+		}
+		summaries = append(summaries, summary)
+	}
+	return summaries, nil
+}
+
+// Purges every PurgeInterval, never returning
+func (s Svc) RunPurger() {
+	for range time.Tick(s.Deletion.PurgeInterval) {
+		summaries, err := s.PurgeDeactivatedUsers()
+		for _, summary := range summaries {
+			log.Printf("Purged %s: %d messages, %d circles", summary.Handle, summary.Messages, summary.Circles)
+		}
+		if err != nil {
+			log.Printf("Failed to purge deactivated users: %v", err)
+		}
+	}
+}
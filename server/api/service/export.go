@@ -0,0 +1,289 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+)
+
+//
+// Constants
+//
+
+const (
+	// Export job states
+	EXPORT_PENDING = "pending"
+	EXPORT_READY   = "ready"
+	EXPORT_FAILED  = "failed"
+
+	// How long a finished export can be downloaded
+	EXPORT_DURATION = 24 * time.Hour
+)
+
+//
+// Types
+//
+
+type exportJob struct {
+	handle  string
+	view    types.ExportJob
+	archive []byte
+}
+
+// Exports live in process memory, like login failures. A restart loses
+// them, the user just asks again.
+type exportJobs struct {
+	mu   sync.Mutex
+	jobs map[string]*exportJob
+}
+
+func newExportJobs() *exportJobs {
+	return &exportJobs{jobs: map[string]*exportJob{}}
+}
+
+// Forgets the jobs finished too long ago
+func (e *exportJobs) prune(now time.Time) {
+	for id, job := range e.jobs {
+		if job.view.Status != EXPORT_PENDING && !now.Before(job.view.Expires) {
+			delete(e.jobs, id)
+		}
+	}
+}
+
+// The parts of an archive, each a json file, in the order the index lists
+// them
+var exportParts = []struct {
+	File  string
+	Title string
+}{
+	{"profile.json", "Profile"},
+	{"circles.json", "Circles you own and joined"},
+	{"messages.json", "Messages you wrote, with where and when you published them"},
+	{"blocked.json", "Users you blocked"},
+	{"comments.json", "Comments you wrote"},
+}
+
+var exportIndex = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>CherAmi export of {{.Handle}}</title>
+</head>
+<body>
+<h1>Everything {{.Handle}} has on CherAmi</h1>
+<p>Exported {{.Created.Format "2 January 2006, 15:04 MST"}}</p>
+<ul>
+{{range .Parts}}<li><a href="{{.File}}">{{.Title}}</a></li>
+{{end}}</ul>
+</body>
+</html>
+`))
+
+//
+// Utility Functions
+//
+
+func MakeExportArchiveUrl(handle, exportid string) string {
+	return API_URL + "/users/" + url.PathEscape(handle) + "/export/" + exportid + "/archive"
+}
+
+func exportNotFound(exportid string) error {
+	return types.NotFound("export_not_found", "No such export "+exportid)
+}
+
+//
+// Exports
+//
+
+// Starts building the archive of handle in the background, answering the
+// job to poll
+func (s Svc) StartExport(handle string) (types.ExportJob, error) {
+	if exists, err := s.Query.UserExistsByHandle(handle); err != nil {
+		return types.ExportJob{}, err
+	} else if !exists {
+		return types.ExportJob{}, types.NotFound("user_not_found", "No such user "+handle)
+	}
+
+	now := query.Now()
+	job := &exportJob{
+		handle: handle,
+		view: types.ExportJob{
+			Id:      query.NewUUID(),
+			Status:  EXPORT_PENDING,
+			Created: now,
+		},
+	}
+	s.exports.mu.Lock()
+	s.exports.prune(now)
+	s.exports.jobs[job.view.Id] = job
+	view := job.view
+	s.exports.mu.Unlock()
+
+	go s.runExport(job)
+	return view, nil
+}
+
+func (s Svc) runExport(job *exportJob) {
+	archive, err := s.buildExport(job.handle, job.view.Created)
+
+	s.exports.mu.Lock()
+	defer s.exports.mu.Unlock()
+	now := query.Now()
+	job.view.Finished = now
+	job.view.Expires = now.Add(EXPORT_DURATION)
+	if err != nil {
+		log.Printf("Failed to export %s: %v", job.handle, err)
+		job.view.Status = EXPORT_FAILED
+		return
+	}
+	job.view.Status = EXPORT_READY
+	job.view.Archive = MakeExportArchiveUrl(job.handle, job.view.Id)
+	job.archive = archive
+}
+
+// The zip archive of everything handle has: a json file per part along
+// with an html index
+func (s Svc) buildExport(handle string, created time.Time) ([]byte, error) {
+	profile, err := s.GetVisibleUser(handle, handle)
+	if err != nil {
+		return nil, err
+	}
+
+	owned, err := s.Query.SearchCircles(handle, query.Now().Add(time.Minute), math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	circles := struct {
+		Owned  []types.CircleResponse `json:"owned"`
+		Joined []types.CircleResponse `json:"joined"`
+	}{[]types.CircleResponse{}, []types.CircleResponse{}}
+	for _, c := range owned {
+		circles.Owned = append(circles.Owned, formatCircleView(c))
+	}
+	joined, _, err := s.Query.GetJoinedCirclesByHandle(handle, query.Now().Add(time.Minute), math.MaxInt32)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range joined {
+		if c.Owner != handle {
+			circles.Joined = append(circles.Joined, formatCircleView(c))
+		}
+	}
+
+	written, err := s.Query.GetAllMessagesByHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	publications, err := s.Query.GetPublicationsByAuthor(handle)
+	if err != nil {
+		return nil, err
+	}
+	published := map[string][]types.Publication{}
+	for _, p := range publications {
+		published[p.Id] = append(published[p.Id], types.Publication{
+			Circleid:    p.Circleid,
+			PublishedAt: p.PublishedAt,
+		})
+	}
+	messages := make([]types.ExportedMessage, len(written))
+	for i, m := range written {
+		messages[i] = types.ExportedMessage{
+			Id:           m.Id,
+			Content:      m.Content,
+			Created:      m.Created,
+			Publications: published[m.Id],
+		}
+		if messages[i].Publications == nil {
+			messages[i].Publications = []types.Publication{}
+		}
+	}
+
+	_, total, err := s.GetBlockedUsers(handle, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	blocked, _, err := s.GetBlockedUsers(handle, 0, total)
+	if err != nil {
+		return nil, err
+	}
+
+	// There are no comments yet, the file keeps the layout of the archive
+	// stable for when there are
+	parts := map[string]interface{}{
+		"profile.json":  profile,
+		"circles.json":  circles,
+		"messages.json": messages,
+		"blocked.json":  blocked,
+		"comments.json": []interface{}{},
+	}
+
+	buffer := &bytes.Buffer{}
+	archive := zip.NewWriter(buffer)
+	for _, part := range exportParts {
+		f, err := archive.Create(part.File)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := json.MarshalIndent(parts[part.File], "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(encoded); err != nil {
+			return nil, err
+		}
+	}
+	index, err := archive.Create("index.html")
+	if err != nil {
+		return nil, err
+	}
+	if err := exportIndex.Execute(index, struct {
+		Handle  string
+		Created time.Time
+		Parts   interface{}
+	}{handle, created, exportParts}); err != nil {
+		return nil, err
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// The export exportid of handle. Fails with NOT_FOUND for unknown or
+// expired exports and for those of others.
+func (s Svc) GetExport(handle, exportid string) (types.ExportJob, error) {
+	s.exports.mu.Lock()
+	defer s.exports.mu.Unlock()
+
+	s.exports.prune(query.Now())
+	job, ok := s.exports.jobs[exportid]
+	if !ok || job.handle != handle {
+		return types.ExportJob{}, exportNotFound(exportid)
+	}
+	return job.view, nil
+}
+
+// The archive of a ready export. Fails like GetExport, and with CONFLICT
+// while the export is not ready.
+func (s Svc) GetExportArchive(handle, exportid string) ([]byte, error) {
+	s.exports.mu.Lock()
+	defer s.exports.mu.Unlock()
+
+	s.exports.prune(query.Now())
+	job, ok := s.exports.jobs[exportid]
+	if !ok || job.handle != handle {
+		return nil, exportNotFound(exportid)
+	}
+	if job.view.Status != EXPORT_READY {
+		return nil, types.Conflict("export_not_ready", "The export is "+job.view.Status+", not ready")
+	}
+	return job.archive, nil
+}
@@ -0,0 +1,106 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"time"
+)
+
+//
+// Constants
+//
+
+const (
+	// Handle change defaults
+	RENAME_COOLDOWN    = 30 * 24 * time.Hour
+	RENAME_RESERVATION = 90 * 24 * time.Hour
+)
+
+//
+// Types
+//
+
+// How users change their handle. After a change they wait Cooldown before
+// the next, and their former handle stays theirs for Reservation: nobody
+// else can sign up with it, and looking it up leads to the new one.
+type RenamePolicy struct {
+	Cooldown    time.Duration
+	Reservation time.Duration
+}
+
+func DefaultRenamePolicy() RenamePolicy {
+	return RenamePolicy{
+		Cooldown:    RENAME_COOLDOWN,
+		Reservation: RENAME_RESERVATION,
+	}
+}
+
+//
+// Handle Changes
+//
+
+// Changes the handle of handle to newHandle, which must already be valid.
+// Fails with TOO_MANY_REQUESTS during the cooldown and with CONFLICT when
+// newHandle is taken or reserved by someone else, or looks like such a
+// handle. Users may take back their own former handles and change the
+// casing of their handle.
+func (s Svc) RenameUser(handle, newHandle string) error {
+	if newHandle == handle {
+		return types.InvalidInput("same_handle", "You already go by "+handle)
+	}
+
+	renamed, err := s.Query.GetUserRenamed(handle)
+	if err != nil {
+		return err
+	}
+	if !renamed.IsZero() {
+		if wait := renamed.Add(s.Renames.Cooldown).Sub(query.Now()); wait > 0 {
+			return types.TooManyRequests("rename_cooldown",
+				"You changed your handle recently, please wait before changing it again", wait)
+		}
+	}
+
+	if err := s.checkNotConfusable(newHandle, handle); err != nil {
+		return err
+	}
+	return s.Query.RenameUser(handle, newHandle, query.Now().Add(s.Renames.Reservation))
+}
+
+// Fails with CONFLICT if handle looks like a handle in use or reserved by
+// anyone but owner
+func (s Svc) checkNotConfusable(handle, owner string) error {
+	holder, err := s.Query.GetConfusableHandle(handle)
+	if types.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if owner != "" {
+		if current, err := s.ResolveHandle(holder); err == nil && current == owner {
+			return nil
+		}
+	}
+	return types.Conflict("handle_confusable", "Sorry, "+handle+" is too easily mistaken for a handle already taken")
+}
+
+// The handle, as stored, of the user handle names whatever its casing and
+// normalization form, or handle itself if there is no such user
+func (s Svc) CanonicalHandle(handle string) (string, error) {
+	if stored, err := s.Query.GetUserHandle(handle); types.IsNotFound(err) {
+		return handle, nil
+	} else if err != nil {
+		return "", err
+	} else {
+		return stored, nil
+	}
+}
+
+// The handle handle goes by now: the stored spelling of the handle of a
+// user, or the new handle when it is the reserved former handle of a
+// renamed user. Fails with NOT_FOUND for neither.
+func (s Svc) ResolveHandle(handle string) (string, error) {
+	if stored, err := s.Query.GetUserHandle(handle); !types.IsNotFound(err) {
+		return stored, err
+	}
+	return s.Query.GetHandleRenamedFrom(handle)
+}
@@ -0,0 +1,312 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"log"
+	"sync"
+	"time"
+)
+
+//
+// Constants
+//
+
+const (
+	// Lockout kinds
+	LOCKOUT_HANDLE = "handle"
+	LOCKOUT_IP     = "ip"
+
+	// Lockout events
+	LOCKOUT_LOCKED   = "locked"
+	LOCKOUT_UNLOCKED = "unlocked"
+	LOCKOUT_CLEARED  = "cleared"
+
+	// Login throttling defaults
+	LOGIN_HANDLE_FREE_FAILURES = 3
+	LOGIN_HANDLE_FAILURES      = 10
+	LOGIN_IP_FREE_FAILURES     = 20
+	LOGIN_IP_FAILURES          = 50
+	LOGIN_BACKOFF              = time.Second
+	LOGIN_MAX_BACKOFF          = time.Minute
+	LOGIN_LOCKOUT_DURATION     = 15 * time.Minute
+	LOGIN_FAILURE_WINDOW       = time.Hour
+)
+
+//
+// Types
+//
+
+// How failed logins are throttled. Failures are counted per handle and per
+// client IP over the last FailureWindow. Past HandleFreeFailures or
+// IPFreeFailures every failure makes the next attempt wait, starting at
+// Backoff and doubling up to MaxBackoff; at HandleFailures or IPFailures
+// the handle or IP is locked out for LockoutDuration. IPs get more leeway
+// as many users may share one.
+// TrustForwardedFor takes the client IP from X-Forwarded-For, which is only
+// safe behind a proxy that sets it.
+type LockoutPolicy struct {
+	HandleFreeFailures int
+	HandleFailures     int
+	IPFreeFailures     int
+	IPFailures         int
+	Backoff            time.Duration
+	MaxBackoff         time.Duration
+	LockoutDuration    time.Duration
+	FailureWindow      time.Duration
+	TrustForwardedFor  bool
+}
+
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{
+		HandleFreeFailures: LOGIN_HANDLE_FREE_FAILURES,
+		HandleFailures:     LOGIN_HANDLE_FAILURES,
+		IPFreeFailures:     LOGIN_IP_FREE_FAILURES,
+		IPFailures:         LOGIN_IP_FAILURES,
+		Backoff:            LOGIN_BACKOFF,
+		MaxBackoff:         LOGIN_MAX_BACKOFF,
+		LockoutDuration:    LOGIN_LOCKOUT_DURATION,
+		FailureWindow:      LOGIN_FAILURE_WINDOW,
+	}
+}
+
+type lockoutKey struct {
+	kind    string
+	subject string
+}
+
+// The failures within the window, oldest first
+type loginFailures struct {
+	times       []time.Time
+	lockedUntil time.Time
+}
+
+// Forgets the failures before cutoff
+func (f *loginFailures) expire(cutoff time.Time) {
+	i := 0
+	for i < len(f.times) && f.times[i].Before(cutoff) {
+		i++
+	}
+	f.times = f.times[i:]
+}
+
+// Failure counts live in process memory, they are cheap to lose on a
+// restart. The lockout events they lead to go to the store. Entries with
+// neither failures in the window nor a lockout are pruned once a window.
+type loginGuard struct {
+	mu       sync.Mutex
+	failures map[lockoutKey]*loginFailures
+	pruned   time.Time
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{failures: map[lockoutKey]*loginFailures{}}
+}
+
+//
+// Login Throttling
+//
+
+// How many failures kind tolerates before backing off and locking out
+func (s Svc) lockoutThresholds(kind string) (free, lockout int) {
+	if kind == LOCKOUT_HANDLE {
+		return s.Lockouts.HandleFreeFailures, s.Lockouts.HandleFailures
+	}
+	return s.Lockouts.IPFreeFailures, s.Lockouts.IPFailures
+}
+
+// How long kind has to wait after its count-th failure
+func (s Svc) backoffAfter(kind string, count int) time.Duration {
+	free, _ := s.lockoutThresholds(kind)
+	if count <= free {
+		return 0
+	}
+	wait := s.Lockouts.Backoff
+	for i := free + 1; i < count && wait < s.Lockouts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > s.Lockouts.MaxBackoff {
+		wait = s.Lockouts.MaxBackoff
+	}
+	return wait
+}
+
+func newLockoutEvent(key lockoutKey, event string, until time.Time, by string) types.LockoutEvent {
+	return types.LockoutEvent{
+		Id:      query.NewUUID(),
+		Kind:    key.kind,
+		Subject: key.subject,
+		Event:   event,
+		At:      query.Now(),
+		Until:   until,
+		By:      by,
+	}
+}
+
+// Stores events, which callers collect while holding the guard and only
+// record once they let go of it, so that logins do not queue up behind
+// the store
+func (s Svc) recordLockoutEvents(events []types.LockoutEvent) {
+	for _, event := range events {
+		if err := s.Query.CreateLockoutEvent(event); err != nil {
+			log.Printf("Failed to record %s lockout event of %s %s: %v", event.Event, event.Kind, event.Subject, err)
+		}
+	}
+}
+
+// Drops the entries with nothing left to remember, at most once a window.
+// Lockouts that ran out unnoticed are recorded as unlocked.
+func (s Svc) pruneLoginFailures(now time.Time) (events []types.LockoutEvent) {
+	if now.Before(s.guard.pruned.Add(s.Lockouts.FailureWindow)) {
+		return nil
+	}
+	s.guard.pruned = now
+	cutoff := now.Add(-s.Lockouts.FailureWindow)
+	for key, f := range s.guard.failures {
+		if now.Before(f.lockedUntil) {
+			continue
+		}
+		if !f.lockedUntil.IsZero() {
+			delete(s.guard.failures, key)
+			events = append(events, newLockoutEvent(key, LOCKOUT_UNLOCKED, time.Time{}, ""))
+			continue
+		}
+		if f.expire(cutoff); len(f.times) == 0 {
+			delete(s.guard.failures, key)
+		}
+	}
+	return events
+}
+
+// Fails with TOO_MANY_REQUESTS, carrying how long to wait, if handle or
+// ip is locked out or has to back off before trying again
+func (s Svc) CheckLoginAllowed(handle, ip string) error {
+	var events []types.LockoutEvent
+	// Deferred first so that it runs after the unlock
+	defer func() { s.recordLockoutEvents(events) }()
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	now := query.Now()
+	for _, key := range []lockoutKey{{LOCKOUT_HANDLE, handle}, {LOCKOUT_IP, ip}} {
+		f, ok := s.guard.failures[key]
+		if !ok {
+			continue
+		}
+		if !f.lockedUntil.IsZero() {
+			if now.Before(f.lockedUntil) {
+				return types.TooManyRequests("login_locked",
+					"Too many failed logins, please try again later", f.lockedUntil.Sub(now))
+			}
+			// The lockout ran out, the next failure starts over
+			delete(s.guard.failures, key)
+			events = append(events, newLockoutEvent(key, LOCKOUT_UNLOCKED, time.Time{}, ""))
+			continue
+		}
+		f.expire(now.Add(-s.Lockouts.FailureWindow))
+		if len(f.times) == 0 {
+			continue
+		}
+		last := f.times[len(f.times)-1]
+		if wait := last.Add(s.backoffAfter(key.kind, len(f.times))).Sub(now); wait > 0 {
+			return types.TooManyRequests("login_throttled",
+				"Too many failed logins, please wait before trying again", wait)
+		}
+	}
+	return nil
+}
+
+// Counts a failed login against both handle and ip, locking out either
+// once it reaches its threshold within the window
+func (s Svc) RecordLoginFailure(handle, ip string) {
+	var events []types.LockoutEvent
+	defer func() { s.recordLockoutEvents(events) }()
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	now := query.Now()
+	events = s.pruneLoginFailures(now)
+	for _, key := range []lockoutKey{{LOCKOUT_HANDLE, handle}, {LOCKOUT_IP, ip}} {
+		f, ok := s.guard.failures[key]
+		if !ok {
+			f = &loginFailures{}
+			s.guard.failures[key] = f
+		}
+		f.expire(now.Add(-s.Lockouts.FailureWindow))
+		f.times = append(f.times, now)
+		if _, lockout := s.lockoutThresholds(key.kind); len(f.times) >= lockout && f.lockedUntil.IsZero() {
+			f.lockedUntil = now.Add(s.Lockouts.LockoutDuration)
+			events = append(events, newLockoutEvent(key, LOCKOUT_LOCKED, f.lockedUntil, ""))
+		}
+	}
+}
+
+// Forgets the failures of handle, and the oldest failure of ip: one good
+// password says little about what else is tried from there, but users
+// sharing the IP logging in should not let the count only grow.
+func (s Svc) RecordLoginSuccess(handle, ip string) {
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	delete(s.guard.failures, lockoutKey{LOCKOUT_HANDLE, handle})
+	key := lockoutKey{LOCKOUT_IP, ip}
+	if f, ok := s.guard.failures[key]; ok && f.lockedUntil.IsZero() {
+		if len(f.times) > 0 {
+			f.times = f.times[1:]
+		}
+		if len(f.times) == 0 {
+			delete(s.guard.failures, key)
+		}
+	}
+}
+
+// The handles and IPs currently locked out
+func (s Svc) GetLockouts() []types.Lockout {
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	now := query.Now()
+	lockouts := []types.Lockout{}
+	for key, f := range s.guard.failures {
+		if now.Before(f.lockedUntil) {
+			lockouts = append(lockouts, types.Lockout{
+				Kind:     key.kind,
+				Subject:  key.subject,
+				Failures: len(f.times),
+				Until:    f.lockedUntil,
+			})
+		}
+	}
+	return lockouts
+}
+
+func (s Svc) GetLockoutEvents(limit int) ([]types.LockoutEvent, error) {
+	return s.Query.GetLockoutEvents(limit)
+}
+
+// Lifts the lockout of subject on behalf of the admin by, along with
+// any backoff. Fails with NOT_FOUND if subject is not locked out.
+func (s Svc) ClearLockout(kind, subject, by string) error {
+	if kind != LOCKOUT_HANDLE && kind != LOCKOUT_IP {
+		return types.InvalidInput("invalid_lockout_kind", "Lockouts are of kind handle or ip, not "+kind)
+	}
+
+	key := lockoutKey{kind, subject}
+	s.guard.mu.Lock()
+	if f, ok := s.guard.failures[key]; !ok || !query.Now().Before(f.lockedUntil) {
+		s.guard.mu.Unlock()
+		return types.NotFound("lockout_not_found", "No lockout of "+kind+" "+subject)
+	}
+	delete(s.guard.failures, key)
+	s.guard.mu.Unlock()
+
+	s.recordLockoutEvents([]types.LockoutEvent{newLockoutEvent(key, LOCKOUT_CLEARED, time.Time{}, by)})
+	return nil
+}
+
+func (s Svc) resetLoginFailures() {
+	s.guard.mu.Lock()
+	defer s.guard.mu.Unlock()
+
+	s.guard.failures = map[lockoutKey]*loginFailures{}
+}
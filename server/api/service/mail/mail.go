@@ -0,0 +1,143 @@
+package mail
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Types
+//
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sender delivers mail on behalf of the service. Which one is used is a
+// deployment decision, see MemorySender, FileSender and SmtpSender.
+type Sender interface {
+	Send(m Message) error
+}
+
+//
+// Memory
+//
+
+// MemorySender keeps every message it is given, for tests
+type MemorySender struct {
+	mu   sync.Mutex
+	sent []Message
+}
+
+func NewMemorySender() *MemorySender {
+	return &MemorySender{}
+}
+
+func (s *MemorySender) Send(m Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = append(s.sent, m)
+	return nil
+}
+
+// The messages sent so far, oldest first
+func (s *MemorySender) Sent() []Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sent := make([]Message, len(s.sent))
+	copy(sent, s.sent)
+	return sent
+}
+
+// The latest message sent to the given address, ok is false if none was
+func (s *MemorySender) LastTo(to string) (m Message, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := len(s.sent) - 1; i >= 0; i-- {
+		if s.sent[i].To == to {
+			return s.sent[i], true
+		}
+	}
+	return Message{}, false
+}
+
+//
+// File
+//
+
+// FileSender writes every message to its own file in Dir, for local runs
+// where reading the mail out of a directory beats setting up a server
+type FileSender struct {
+	Dir string
+}
+
+func (s FileSender) Send(m Message) error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), sanitize(m.To))
+	return ioutil.WriteFile(filepath.Join(s.Dir, name), []byte(format("", m)), 0600)
+}
+
+func sanitize(address string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == '-', r == '_', r == '@':
+			return r
+		}
+		return '_'
+	}, address)
+}
+
+//
+// SMTP
+//
+
+// SmtpSender relays mail through an SMTP server at Addr ("host:port"),
+// authenticating with PLAIN auth when a Username is given
+type SmtpSender struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+func (s SmtpSender) Send(m Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host := s.Addr
+		if i := strings.LastIndex(host, ":"); i >= 0 {
+			host = host[:i]
+		}
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, []byte(format(s.From, m)))
+}
+
+//
+// Formatting
+//
+
+func format(from string, m Message) string {
+	headers := ""
+	if from != "" {
+		headers += "From: " + from + "\r\n"
+	}
+	headers += "To: " + m.To + "\r\n" +
+		"Subject: " + m.Subject + "\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n"
+	return headers + "\r\n" + m.Body
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"time"
+)
+
+//
+// Utility Functions
+//
+
+func MakeMutedUrl(handle string) string {
+	return MakeUserUrl(handle) + "/muted"
+}
+
+func checkMuteUntil(until time.Time) error {
+	if !until.IsZero() && !query.Now().Before(until) {
+		return types.InvalidInput("invalid_until", "Mutes cannot end in the past")
+	}
+	return nil
+}
+
+//
+// Muting
+//
+
+// Hides the messages of target from the feed of handle until until, or
+// until unmuted when it is zero. Unlike blocking, target stays in handle's
+// circles and is never told. Fails with FORBIDDEN for handle muting itself.
+func (s Svc) MuteUser(handle, target string, until time.Time) error {
+	if handle == target {
+		return types.Forbidden("self_mute", "You can not mute yourself")
+	}
+	if err := checkMuteUntil(until); err != nil {
+		return err
+	}
+	return s.Query.CreateMuteRelationFromTo(handle, target, until)
+}
+
+// Hides the messages published to circleid from the feed of handle until
+// until, or until unmuted when it is zero. The circle must be one handle
+// can see.
+func (s Svc) MuteCircle(handle, circleid string, until time.Time) error {
+	if err := checkMuteUntil(until); err != nil {
+		return err
+	}
+	if ok, err := s.CanSeeCircle(handle, circleid); err != nil {
+		return err
+	} else if !ok {
+		return circleNotVisible()
+	}
+	return s.Query.CreateMuteRelationToCircle(handle, circleid, until)
+}
+
+// Unmuting a user that is not muted is no error
+func (s Svc) UnmuteUser(handle, target string) error {
+	return s.Query.DeleteMuteRelationFromTo(handle, target)
+}
+
+// Unmuting a circle that is not muted is no error
+func (s Svc) UnmuteCircle(handle, circleid string) error {
+	return s.Query.DeleteMuteRelationToCircle(handle, circleid)
+}
+
+// The mutes of handle still in effect, newest first
+func (s Svc) GetMutes(handle string) ([]types.MuteView, error) {
+	mutes, err := s.Query.GetMutes(handle)
+	if err != nil {
+		return nil, err
+	}
+	for i := range mutes {
+		if mutes[i].Handle != "" {
+			mutes[i].Url = MakeUserUrl(mutes[i].Handle)
+		} else {
+			mutes[i].Url = MakeCircleUrl(mutes[i].CircleId)
+		}
+	}
+	return mutes, nil
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//
+// Constants
+//
+
+const (
+	// OAuth access tokens go in the Authorization header as RFC 6750 has it
+	OAUTH_TOKEN_PREFIX = "Bearer "
+
+	// OAuth defaults
+	OAUTH_CODE_DURATION  = 10 * time.Minute
+	OAUTH_TOKEN_DURATION = time.Hour
+
+	// The only PKCE method accepted, "plain" gives away the verifier
+	PKCE_METHOD = "S256"
+)
+
+//
+// Types
+//
+
+// How OAuth clients get access. Users approve or deny a client on the page
+// at ConsentUrl, which GET /oauth/authorize redirects to with the request
+// as query parameters; without one that endpoint answers with the request
+// in json for the client to render. Codes work for CodeDuration and buy an
+// access token good for TokenDuration.
+type OAuthPolicy struct {
+	ConsentUrl    string
+	CodeDuration  time.Duration
+	TokenDuration time.Duration
+}
+
+func DefaultOAuthPolicy() OAuthPolicy {
+	return OAuthPolicy{
+		CodeDuration:  OAUTH_CODE_DURATION,
+		TokenDuration: OAUTH_TOKEN_DURATION,
+	}
+}
+
+//
+// Utility Functions
+//
+
+func IsOAuthToken(authorization string) bool {
+	return strings.HasPrefix(authorization, OAUTH_TOKEN_PREFIX)
+}
+
+// The PKCE code challenge (RFC 7636) matching verifier
+func MakeCodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Errors carry the codes RFC 6749 defines, clients act on them
+func oauthError(code, reason string) error {
+	return types.InvalidInput(code, reason)
+}
+
+func formatOAuthClient(c query.OAuthClientRecord) types.OAuthClient {
+	return types.OAuthClient{
+		Id:           c.Id,
+		Name:         c.Name,
+		RedirectUris: c.RedirectUris,
+		Created:      c.Created,
+	}
+}
+
+// Scopes are requested space separated
+func parseScopes(scope string) ([]string, error) {
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, s := range strings.Fields(scope) {
+		if !isApiKeyScope(s) {
+			return nil, oauthError("invalid_scope", "No such scope "+s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, oauthError("invalid_scope",
+			"Request at least one of the scopes "+strings.Join(API_KEY_SCOPES, ", "))
+	}
+	return scopes, nil
+}
+
+func validRedirectUri(uri string) bool {
+	parsed, err := url.Parse(uri)
+	return err == nil && parsed.IsAbs() && parsed.Fragment == "" && parsed.Host != ""
+}
+
+// uri with params added to whatever query it already has
+func withQuery(uri string, params url.Values) string {
+	parsed, _ := url.Parse(uri)
+	query := parsed.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+//
+// Clients
+//
+
+// Registers a client owned by handle. Fails with INVALID_INPUT, coded
+// invalid_client_metadata as in RFC 7591, without a name or with redirect
+// uris that are not absolute or carry a fragment.
+func (s Svc) RegisterOAuthClient(handle string, request types.OAuthClientRequest) (types.OAuthClient, error) {
+	name := strings.TrimSpace(request.Name)
+	if name == "" {
+		return types.OAuthClient{}, oauthError("invalid_client_metadata", "OAuth clients need a name")
+	}
+	if len(request.RedirectUris) == 0 {
+		return types.OAuthClient{}, oauthError("invalid_client_metadata", "OAuth clients need at least one redirect uri")
+	}
+	for _, uri := range request.RedirectUris {
+		if !validRedirectUri(uri) {
+			return types.OAuthClient{}, oauthError("invalid_client_metadata",
+				"Redirect uris must be absolute and without a fragment, not "+uri)
+		}
+	}
+
+	client := query.OAuthClientRecord{
+		Id:           query.NewUUID(),
+		Name:         name,
+		Owner:        handle,
+		RedirectUris: request.RedirectUris,
+		Created:      query.Now(),
+	}
+	if err := s.Query.CreateOAuthClient(handle, client); err != nil {
+		return types.OAuthClient{}, err
+	}
+	return formatOAuthClient(client), nil
+}
+
+func (s Svc) GetOAuthClients(handle string) ([]types.OAuthClient, error) {
+	clients, err := s.Query.GetOAuthClientsByHandle(handle)
+	if err != nil {
+		return nil, err
+	}
+	formatted := make([]types.OAuthClient, len(clients))
+	for i, c := range clients {
+		formatted[i] = formatOAuthClient(c)
+	}
+	return formatted, nil
+}
+
+// Also ends every grant the client holds
+func (s Svc) DeleteOAuthClient(handle, clientid string) error {
+	return s.Query.DestroyOAuthClient(handle, clientid)
+}
+
+//
+// Authorization Code Grant
+//
+
+// Checks an authorization request, answering what the user is asked to
+// consent to. Fails with INVALID_INPUT, coded as in RFC 6749, for unknown
+// clients, unregistered redirect uris, unknown scopes and requests
+// without a S256 PKCE challenge.
+func (s Svc) CheckAuthorizationRequest(request types.OAuthAuthorizationRequest) (types.OAuthConsent, error) {
+	if request.ResponseType != "code" {
+		return types.OAuthConsent{}, oauthError("unsupported_response_type", "Only the response_type code is supported")
+	}
+
+	client, err := s.Query.GetOAuthClient(request.ClientId)
+	if types.IsNotFound(err) {
+		return types.OAuthConsent{}, oauthError("invalid_client", "No such OAuth client "+request.ClientId)
+	} else if err != nil {
+		return types.OAuthConsent{}, err
+	}
+
+	// The redirect uri may only be left out when there is no choice
+	redirectUri := request.RedirectUri
+	if redirectUri == "" && len(client.RedirectUris) == 1 {
+		redirectUri = client.RedirectUris[0]
+	}
+	registered := false
+	for _, uri := range client.RedirectUris {
+		registered = registered || uri == redirectUri
+	}
+	// Never redirected to, as it may not be the client's (RFC 6749 4.1.2.1)
+	if !registered {
+		return types.OAuthConsent{}, oauthError("invalid_request", "The redirect uri is not registered for this client")
+	}
+
+	if request.CodeChallengeMethod != PKCE_METHOD || len(request.CodeChallenge) != 43 {
+		return types.OAuthConsent{}, oauthError("invalid_request", "A PKCE code_challenge with code_challenge_method S256 is required")
+	}
+
+	scopes, err := parseScopes(request.Scope)
+	if err != nil {
+		return types.OAuthConsent{}, err
+	}
+
+	return types.OAuthConsent{
+		Client:      formatOAuthClient(client),
+		Scopes:      scopes,
+		RedirectUri: redirectUri,
+		State:       request.State,
+	}, nil
+}
+
+// Records the decision of handle on an authorization request, answering
+// where to send them next: back to the client with either a code or
+// access_denied.
+func (s Svc) AuthorizeOAuthClient(handle string, request types.OAuthAuthorizationRequest) (redirect string, err error) {
+	consent, err := s.CheckAuthorizationRequest(request)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	if consent.State != "" {
+		params.Set("state", consent.State)
+	}
+	if !request.Approve {
+		params.Set("error", "access_denied")
+		return withQuery(consent.RedirectUri, params), nil
+	}
+
+	code := query.NewOAuthToken()
+	if err := s.Query.CreateOAuthCode(handle, query.OAuthCodeRecord{
+		CodeHash:    s.hashToken(code),
+		ClientId:    consent.Client.Id,
+		RedirectUri: consent.RedirectUri,
+		Scopes:      consent.Scopes,
+		Challenge:   request.CodeChallenge,
+		Expires:     query.Now().Add(s.OAuth.CodeDuration),
+	}); err != nil {
+		return "", err
+	}
+	params.Set("code", code)
+	return withQuery(consent.RedirectUri, params), nil
+}
+
+// Trades an authorization code for an access token. The code is spent
+// whether or not the rest of the request checks out. Fails with
+// INVALID_INPUT, coded as in RFC 6749.
+func (s Svc) ExchangeOAuthCode(request types.OAuthTokenRequest) (types.OAuthAccessToken, error) {
+	if request.GrantType != "authorization_code" {
+		return types.OAuthAccessToken{}, oauthError("unsupported_grant_type", "Only the grant_type authorization_code is supported")
+	}
+	if request.Code == "" || request.CodeVerifier == "" {
+		return types.OAuthAccessToken{}, oauthError("invalid_request", "Both code and code_verifier are required")
+	}
+
+	handle, code, err := s.Query.ConsumeOAuthCode(s.hashToken(request.Code))
+	if types.IsNotFound(err) {
+		return types.OAuthAccessToken{}, oauthError("invalid_grant", "Missing, used or expired authorization code")
+	} else if err != nil {
+		return types.OAuthAccessToken{}, err
+	}
+
+	if code.ClientId != request.ClientId || code.RedirectUri != request.RedirectUri {
+		return types.OAuthAccessToken{}, oauthError("invalid_grant", "The code was issued to another client or redirect uri")
+	}
+	challenge := MakeCodeChallenge(request.CodeVerifier)
+	if subtle.ConstantTimeCompare([]byte(challenge), []byte(code.Challenge)) != 1 {
+		return types.OAuthAccessToken{}, oauthError("invalid_grant", "The code_verifier does not match the code_challenge")
+	}
+
+	token := query.NewOAuthToken()
+	if err := s.Query.CreateOAuthToken(handle, query.OAuthTokenRecord{
+		TokenHash: s.hashToken(token),
+		ClientId:  code.ClientId,
+		Scopes:    code.Scopes,
+		Expires:   query.Now().Add(s.OAuth.TokenDuration),
+	}); err != nil {
+		return types.OAuthAccessToken{}, err
+	}
+	return types.OAuthAccessToken{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(s.OAuth.TokenDuration / time.Second),
+		Scope:       strings.Join(code.Scopes, " "),
+	}, nil
+}
+
+// Resolves an OAuth access token to the user who granted it, for a route
+// needing scope. Fails like GetHandleFromApiKey.
+func (s Svc) GetHandleFromOAuthToken(authorization, scope string) (string, error) {
+	token := strings.TrimPrefix(authorization, OAUTH_TOKEN_PREFIX)
+	handle, scopes, err := s.Query.DeriveOAuthToken(s.hashToken(token))
+	if err != nil {
+		return "", err
+	}
+	if err := checkScope(scopes, scope); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
@@ -0,0 +1,262 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"fmt"
+	"golang.org/x/text/language"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+//
+// Constants
+//
+
+const (
+	// Profile field bounds
+	MAX_NAME_LENGTH      = 50
+	MAX_GENDER_LENGTH    = 32
+	MAX_BIO_LENGTH       = 500
+	MAX_INTERESTS_LENGTH = 500
+	MAX_LANGUAGES        = 10
+	MAX_LOCATION_PARTS   = 3
+	MAX_LOCATION_PART    = 60
+	MINIMUM_AGE          = 13
+	MAXIMUM_AGE          = 150
+
+	// Birthdays are given as ISO dates
+	BIRTHDAY_LAYOUT = "2006-01-02"
+
+	// Who may see a profile field, besides the id of one of the user's
+	// circles for its members only
+	VISIBILITY_PUBLIC  = "public"
+	VISIBILITY_PRIVATE = "private"
+)
+
+// Genders offered to pick from, anything else is kept as free text
+var genders = []string{"female", "male", "nonbinary", "other", "unspecified"}
+
+// How each profile field is checked and normalized before it is stored.
+// Empty values clear the field instead and are never checked.
+var profileFields = map[string]func(value string) (string, error){
+	"firstname": func(value string) (string, error) { return boundedText(value, MAX_NAME_LENGTH, false) },
+	"lastname":  func(value string) (string, error) { return boundedText(value, MAX_NAME_LENGTH, false) },
+	"gender":    normalizeGender,
+	"birthday":  normalizeBirthday,
+	"bio":       func(value string) (string, error) { return boundedText(value, MAX_BIO_LENGTH, true) },
+	"interests": func(value string) (string, error) { return boundedText(value, MAX_INTERESTS_LENGTH, true) },
+	"languages": normalizeLanguages,
+	"location":  normalizeLocation,
+}
+
+//
+// Normalization
+//
+
+// The value to store for resource, "" to clear it. Fails with INVALID_INPUT
+// naming the field when the value does not fit it.
+func (s Svc) NormalizeUserAttribute(resource, value string) (string, error) {
+	normalize, ok := profileFields[resource]
+	if !ok {
+		return "", types.InvalidInput("invalid_resource", "No such profile field "+resource)
+	}
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	normalized, err := normalize(value)
+	if err != nil {
+		return "", types.InvalidInput("invalid_"+resource, resource+" is invalid: "+err.Error())
+	}
+	return normalized, nil
+}
+
+// Text of at most max characters, spanning lines only if multiline
+func boundedText(value string, max int, multiline bool) (string, error) {
+	if n := utf8.RuneCountInString(value); n > max {
+		return "", fmt.Errorf("Too long, max length is %d", max)
+	}
+	for _, r := range value {
+		if r == '\n' && !multiline {
+			return "", fmt.Errorf("Must be a single line")
+		} else if unicode.IsControl(r) && r != '\n' {
+			return "", fmt.Errorf("Contains control characters")
+		}
+	}
+	return value, nil
+}
+
+// One of genders in lower case, or free text
+func normalizeGender(value string) (string, error) {
+	for _, gender := range genders {
+		if strings.EqualFold(value, gender) {
+			return gender, nil
+		}
+	}
+	return boundedText(value, MAX_GENDER_LENGTH, false)
+}
+
+// An ISO date, stored as midnight UTC in RFC 3339 like every other time,
+// of someone at least MINIMUM_AGE years old
+func normalizeBirthday(value string) (string, error) {
+	birthday, err := time.Parse(BIRTHDAY_LAYOUT, value)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a date like 1990-12-31", value)
+	}
+	now := query.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	if birthday.After(today.AddDate(-MINIMUM_AGE, 0, 0)) {
+		return "", fmt.Errorf("Users must be at least %d years old", MINIMUM_AGE)
+	}
+	if birthday.Before(today.AddDate(-MAXIMUM_AGE, 0, 0)) {
+		return "", fmt.Errorf("%s is more than %d years ago", value, MAXIMUM_AGE)
+	}
+	return birthday.Format(time.RFC3339), nil
+}
+
+// A comma separated list of BCP 47 language tags, stored in canonical form
+// without duplicates
+func normalizeLanguages(value string) (string, error) {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		tag, err := language.Parse(part)
+		if err != nil {
+			return "", fmt.Errorf("%s is not a BCP 47 language tag such as en or pt-BR", part)
+		}
+		if canonical := tag.String(); !seen[canonical] {
+			seen[canonical] = true
+			tags = append(tags, canonical)
+		}
+	}
+	if len(tags) > MAX_LANGUAGES {
+		return "", fmt.Errorf("Too many languages, max is %d", MAX_LANGUAGES)
+	}
+	return strings.Join(tags, ", "), nil
+}
+
+// Up to MAX_LOCATION_PARTS comma separated parts from the most to the
+// least specific, such as "San Francisco, CA, US"
+func normalizeLocation(value string) (string, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) > MAX_LOCATION_PARTS {
+		return "", fmt.Errorf("Too many parts, a location is at most locality, region and country")
+	}
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return "", fmt.Errorf("Parts of a location can not be empty")
+		}
+		normalized, err := boundedText(part, MAX_LOCATION_PART, false)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = normalized
+	}
+	return strings.Join(parts, ", "), nil
+}
+
+//
+// Visibility
+//
+
+// Who may see each profile field of handle: VISIBILITY_PUBLIC (the
+// default), VISIBILITY_PRIVATE or the id of a circle of handle
+func (s Svc) GetProfileVisibility(handle string) (map[string]string, error) {
+	stored, err := s.Query.GetProfileVisibility(handle)
+	if err != nil {
+		return nil, err
+	}
+	visibility := map[string]string{}
+	for field := range profileFields {
+		visibility[field] = VISIBILITY_PUBLIC
+		if setting, ok := stored[field]; ok {
+			visibility[field] = setting
+		}
+	}
+	return visibility, nil
+}
+
+// Changes who may see the fields in changes, leaving the others be, and
+// answers the settings of every field. Fails with INVALID_INPUT for
+// unknown fields and for circles handle does not own.
+func (s Svc) SetProfileVisibility(handle string, changes map[string]string) (map[string]string, error) {
+	stored, err := s.Query.GetProfileVisibility(handle)
+	if err != nil {
+		return nil, err
+	}
+	for field, setting := range changes {
+		if _, ok := profileFields[field]; !ok {
+			return nil, types.InvalidInput("invalid_resource", "No such profile field "+field)
+		}
+		switch setting {
+		case VISIBILITY_PUBLIC:
+			delete(stored, field)
+			continue
+		case VISIBILITY_PRIVATE:
+		default:
+			if circle, err := s.Query.GetCircleById(setting); types.IsNotFound(err) || err == nil && circle.Owner != handle {
+				return nil, types.InvalidInput("invalid_visibility",
+					field+" can be public, private or the id of one of your circles, not "+setting)
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		stored[field] = setting
+	}
+	if err := s.Query.SetProfileVisibility(handle, stored); err != nil {
+		return nil, err
+	}
+	return s.GetProfileVisibility(handle)
+}
+
+// Clears the fields of user that viewer may not see. Fields shown to a
+// circle that no longer exists are shown to nobody.
+func (s Svc) hideProfileFields(viewer string, user *types.UserView) error {
+	visibility, err := s.Query.GetProfileVisibility(user.Handle)
+	if err != nil {
+		return err
+	}
+	member := map[string]bool{}
+	for field, setting := range visibility {
+		if setting == VISIBILITY_PUBLIC {
+			continue
+		}
+		if setting != VISIBILITY_PRIVATE {
+			if _, ok := member[setting]; !ok {
+				if member[setting], err = s.Query.UserPartOfCircle(viewer, setting); err != nil {
+					return err
+				}
+			}
+			if member[setting] {
+				continue
+			}
+		}
+		switch field {
+		case "firstname":
+			user.FirstName = ""
+		case "lastname":
+			user.LastName = ""
+		case "gender":
+			user.Gender = ""
+		case "birthday":
+			user.Birthday = time.Time{}
+		case "bio":
+			user.Bio = ""
+		case "interests":
+			user.Interests = ""
+		case "languages":
+			user.Languages = ""
+		case "location":
+			user.Location = ""
+		}
+	}
+	return nil
+}
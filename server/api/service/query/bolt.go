@@ -0,0 +1,255 @@
+package query
+
+import (
+	"../../../types"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"reflect"
+	"time"
+)
+
+// BoltQuery is a Query implementation backed by a single bbolt database
+// file, for small deployments that would rather not run a Neo4j server.
+//
+// The graph is served from memory exactly as MemoryQuery does, and every
+// mutation is written to the file before returning, so the same
+// visibility rules apply and nothing is lost on restart. The whole graph
+// has to fit in memory.
+//
+// Each kind of node is kept in a bucket of its own, one key per node, and
+// lockout events in order under a sequence number. A write only puts the
+// nodes the mutation touched and deletes those it removed.
+type BoltQuery struct {
+	*MemoryQuery
+	db *bbolt.DB
+
+	// How many lockout events the file holds
+	lockouts int
+}
+
+var (
+	metaBucket    = []byte("meta")
+	lockoutBucket = []byte("lockouts")
+	nextIdKey     = []byte("next_id")
+)
+
+// The buckets nodes are kept in, each named after the kind of its node
+var nodeBuckets = []string{
+	kindUser, kindCircle, kindMessage, kindToken, kindReset, kindChallenge,
+	kindApiKey, kindClient, kindCode, kindGrant, kindFormer,
+}
+
+//
+// Initialization
+//
+
+// Constructor, opens (or creates) the database file at path and loads
+// the graph stored in it. Only one process may hold the file at a time.
+func NewBoltQuery(path string) (*BoltQuery, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, types.WrapError(types.UNAVAILABLE, "store_unavailable",
+			"Could not open database file "+path, err)
+	}
+	query := &BoltQuery{db: db}
+	g, err := query.load()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	query.MemoryQuery = &MemoryQuery{g: g, store: query}
+	if err := query.DatabaseInit(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return query, nil
+}
+
+func (q *BoltQuery) Close() error {
+	return q.db.Close()
+}
+
+//
+// Persistence
+//
+
+// The maps of g holding the nodes of each bucket
+func nodeMaps(g *graph) map[string]reflect.Value {
+	return map[string]reflect.Value{
+		kindUser:      reflect.ValueOf(g.Users),
+		kindCircle:    reflect.ValueOf(g.Circles),
+		kindMessage:   reflect.ValueOf(g.Messages),
+		kindToken:     reflect.ValueOf(g.Tokens),
+		kindReset:     reflect.ValueOf(g.Resets),
+		kindChallenge: reflect.ValueOf(g.Challenges),
+		kindApiKey:    reflect.ValueOf(g.ApiKeys),
+		kindClient:    reflect.ValueOf(g.Clients),
+		kindCode:      reflect.ValueOf(g.Codes),
+		kindGrant:     reflect.ValueOf(g.Grants),
+		kindFormer:    reflect.ValueOf(g.Former),
+	}
+}
+
+func lockoutKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// Reads the graph, remembering how many lockout events there are
+func (q *BoltQuery) load() (*graph, error) {
+	g := newGraph()
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(metaBucket); b != nil {
+			if data := b.Get(nextIdKey); data != nil {
+				if err := json.Unmarshal(data, &g.NextId); err != nil {
+					return err
+				}
+			}
+		}
+		maps := nodeMaps(g)
+		for _, name := range nodeBuckets {
+			b := tx.Bucket([]byte(name))
+			if b == nil {
+				continue
+			}
+			m := maps[name]
+			err := b.ForEach(func(k, v []byte) error {
+				node := reflect.New(m.Type().Elem().Elem())
+				if err := json.Unmarshal(v, node.Interface()); err != nil {
+					return err
+				}
+				m.SetMapIndex(reflect.ValueOf(string(k)), node)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if b := tx.Bucket(lockoutBucket); b != nil {
+			return b.ForEach(func(k, v []byte) error {
+				event := types.LockoutEvent{}
+				if err := json.Unmarshal(v, &event); err != nil {
+					return err
+				}
+				g.Lockouts = append(g.Lockouts, event)
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, types.WrapError(types.INTERNAL, "store_failure",
+			"Unexpected failure to read the database", err)
+	}
+	g.indexUsers()
+	q.lockouts = len(g.Lockouts)
+	return g, nil
+}
+
+// Writes the nodes g.changed names, deleting those no longer in g, and
+// the lockout events added since the last save, dropping the oldest past
+// LOCKOUT_EVENTS_KEPT
+func (q *BoltQuery) save(g *graph) error {
+	lockouts := q.lockouts
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		if g.changed.cleared {
+			buckets := [][]byte{metaBucket, lockoutBucket}
+			for _, name := range nodeBuckets {
+				buckets = append(buckets, []byte(name))
+			}
+			for _, name := range buckets {
+				if err := tx.DeleteBucket(name); err != nil && err != bbolt.ErrBucketNotFound {
+					return err
+				}
+			}
+			lockouts = 0
+		}
+
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		nextId, err := json.Marshal(g.NextId)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(meta.Get(nextIdKey), nextId) {
+			if err := meta.Put(nextIdKey, nextId); err != nil {
+				return err
+			}
+		}
+
+		maps := nodeMaps(g)
+		for _, name := range nodeBuckets {
+			keys := g.changed.nodes[name]
+			if len(keys) == 0 {
+				continue
+			}
+			b, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+			for key := range keys {
+				node := maps[name].MapIndex(reflect.ValueOf(key))
+				if !node.IsValid() {
+					if err := b.Delete([]byte(key)); err != nil {
+						return err
+					}
+					continue
+				}
+				data, err := json.Marshal(node.Interface())
+				if err != nil {
+					return err
+				}
+				if err := b.Put([]byte(key), data); err != nil {
+					return err
+				}
+			}
+		}
+
+		added := g.changed.lockouts
+		if added > len(g.Lockouts) {
+			added = len(g.Lockouts)
+		}
+		if added == 0 {
+			return nil
+		}
+		b, err := tx.CreateBucketIfNotExists(lockoutBucket)
+		if err != nil {
+			return err
+		}
+		for _, event := range g.Lockouts[len(g.Lockouts)-added:] {
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if err := b.Put(lockoutKey(seq), data); err != nil {
+				return err
+			}
+		}
+		// Only the latest events are kept, the oldest come first
+		lockouts += added
+		c := b.Cursor()
+		for ; lockouts > LOCKOUT_EVENTS_KEPT; lockouts-- {
+			k, _ := c.First()
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return types.WrapError(types.UNAVAILABLE, "store_unavailable",
+			"The database is unavailable, please try again later", err)
+	}
+	q.lockouts = lockouts
+	return nil
+}
@@ -0,0 +1,2477 @@
+package query
+
+import (
+	"../../../types"
+	"github.com/jmcvetta/neoism"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryQuery is a Query implementation that keeps the whole graph in
+// process memory. It follows the same rules as the Cypher statements in
+// Neo4jQuery, so the service behaves identically on top of either one.
+// On its own nothing is persisted, which suits tests and local development;
+// given a graphStore every mutation is written through, see BoltQuery.
+type MemoryQuery struct {
+	mu    sync.RWMutex
+	g     *graph
+	store graphStore
+}
+
+// A graphStore durably keeps a copy of the graph between restarts. save
+// only has to write what g.changed names.
+type graphStore interface {
+	load() (*graph, error)
+	save(g *graph) error
+}
+
+//
+// In-memory Graph
+//
+
+// The graph keeps nodes in maps keyed by their unique property, with the
+// relationships stored on the node they leave from:
+//
+//	(User)-[:OWNS]->(Circle)                     memCircle.Owner
+//	(User)-[:MEMBER_OF]->(Circle)                memCircle.Members
+//	(Circle)-[:PART_OF]->(PublicDomain)          memCircle.Public
+//	(User)-[:WROTE]->(Message)                   memMessage.Author
+//	(Message)-[:PUB_TO]->(Circle)                memMessage.PublishedTo
+//	(User)-[:BLOCKED]->(User)                    memUser.Blocked
+//	(User)-[:MUTED]->(User)                      memUser.Muted
+//	(User)-[:MUTED]->(Circle)                    memUser.MutedCircles
+//	(AuthToken)-[:SESSION_OF]->(User)            memToken.Handle
+//	(ApiKey)-[:KEY_OF]->(User)                   memApiKey.Handle
+//	(OAuthClient)-[:CLIENT_OF]->(User)           memOAuthClient.Owner
+//	(OAuthCode)-[:CODE_OF]->(User)               memOAuthCode.Handle
+//	(OAuthToken)-[:GRANT_OF]->(User)             memOAuthToken.Handle
+//	(PasswordReset)-[:RESET_OF]->(User)          memReset.Handle
+//	(LoginChallenge)-[:CHALLENGE_OF]->(User)     memChallenge.Handle
+//	(FormerHandle)-[:FORMER_HANDLE_OF]->(User)   memFormerHandle.Handle
+//
+// LockoutEvent nodes have no relationships and are kept in order in
+// graph.Lockouts. OAuth codes and tokens name their client by id.
+// Renaming a user rewrites every handle above, lockout events keep the
+// handle they were recorded under.
+//
+// Tokens are keyed by their hash, the store never sees a token itself.
+type graph struct {
+	NextId     int                         `json:"next_id"`
+	Users      map[string]*memUser         `json:"users"`
+	Circles    map[string]*memCircle       `json:"circles"`
+	Messages   map[string]*memMessage      `json:"messages"`
+	Tokens     map[string]*memToken        `json:"tokens"`
+	Resets     map[string]*memReset        `json:"resets"`
+	Challenges map[string]*memChallenge    `json:"challenges"`
+	ApiKeys    map[string]*memApiKey       `json:"apikeys"`
+	Clients    map[string]*memOAuthClient  `json:"oauthclients"`
+	Codes      map[string]*memOAuthCode    `json:"oauthcodes"`
+	Grants     map[string]*memOAuthToken   `json:"oauthtokens"`
+	Former     map[string]*memFormerHandle `json:"formerhandles"`
+	Lockouts   []types.LockoutEvent        `json:"lockouts"`
+
+	// Users by types.HandleKey of their handle, kept along with Users
+	byKey   map[string]*memUser
+	changed graphChanges
+}
+
+// The maps of graph nodes are kept in, by their json name
+const (
+	kindUser      = "users"
+	kindCircle    = "circles"
+	kindMessage   = "messages"
+	kindToken     = "tokens"
+	kindReset     = "resets"
+	kindChallenge = "challenges"
+	kindApiKey    = "apikeys"
+	kindClient    = "oauthclients"
+	kindCode      = "oauthcodes"
+	kindGrant     = "oauthtokens"
+	kindFormer    = "formerhandles"
+)
+
+// What changed since the graph was last committed: the keys of the nodes
+// created, changed or deleted in each map and how many lockout events were
+// added, or everything when cleared. Every mutation touches the nodes it
+// changes, NextId is simply compared.
+type graphChanges struct {
+	cleared  bool
+	nodes    map[string]map[string]bool
+	lockouts int
+}
+
+// Marks the node under key in the map kind as changed
+func (g *graph) touch(kind, key string) {
+	if g.changed.nodes == nil {
+		g.changed.nodes = map[string]map[string]bool{}
+	}
+	if g.changed.nodes[kind] == nil {
+		g.changed.nodes[kind] = map[string]bool{}
+	}
+	g.changed.nodes[kind][key] = true
+}
+
+type memUser struct {
+	Id          int               `json:"id"`
+	Handle      string            `json:"handle"`
+	Name        string            `json:"name"`
+	Email       string            `json:"email"`
+	Password    string            `json:"password"`
+	Unverified  bool              `json:"unverified,omitempty"`
+	Role        string            `json:"role,omitempty"`
+	Suspended   bool              `json:"suspended,omitempty"`
+	Deactivated time.Time         `json:"deactivated"`
+	Renamed     time.Time         `json:"renamed"`
+	Avatar      string            `json:"avatar,omitempty"`
+	Stir        int               `json:"stir,omitempty"`
+	Totp        *memTotp          `json:"totp,omitempty"`
+	Joined      time.Time         `json:"joined"`
+	LastUpdated time.Time         `json:"lastupdated"`
+	Attributes  map[string]string `json:"attributes"`
+	Visibility  map[string]string `json:"visibility,omitempty"`
+	Blocked     map[string]bool   `json:"blocked"`
+
+	Muted        map[string]memMute `json:"muted,omitempty"`
+	MutedCircles map[string]memMute `json:"mutedcircles,omitempty"`
+}
+
+// A MUTED relationship, for good when Until is zero
+type memMute struct {
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until"`
+}
+
+type memCircle struct {
+	Id          string               `json:"id"`
+	Name        string               `json:"name"`
+	Description string               `json:"description"`
+	Created     time.Time            `json:"created"`
+	Owner       string               `json:"owner"`
+	Public      bool                 `json:"public"`
+	Members     map[string]time.Time `json:"members"`
+}
+
+type memMessage struct {
+	Id          string               `json:"id"`
+	Author      string               `json:"author"`
+	Content     string               `json:"content"`
+	Created     time.Time            `json:"created"`
+	LastSaved   time.Time            `json:"lastsaved"`
+	PublishedTo map[string]time.Time `json:"published_to"`
+}
+
+type memToken struct {
+	Id        string    `json:"id"`
+	Hash      string    `json:"hash"`
+	Handle    string    `json:"handle"`
+	Expires   time.Time `json:"expires"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"lastused"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"useragent"`
+
+	RefreshHash    string    `json:"refreshhash"`
+	RefreshExpires time.Time `json:"refreshexpires"`
+	Spent          []string  `json:"spent"`
+}
+
+type memReset struct {
+	Hash    string    `json:"hash"`
+	Handle  string    `json:"handle"`
+	Expires time.Time `json:"expires"`
+	Created time.Time `json:"created"`
+}
+
+type memTotp struct {
+	Secret         string   `json:"secret"`
+	Enabled        bool     `json:"enabled"`
+	RecoveryHashes []string `json:"recovery"`
+	LastStep       int64    `json:"laststep"`
+}
+
+type memChallenge struct {
+	Hash      string    `json:"hash"`
+	Handle    string    `json:"handle"`
+	Expires   time.Time `json:"expires"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"useragent"`
+}
+
+type memApiKey struct {
+	Id       string    `json:"id"`
+	Hash     string    `json:"hash"`
+	Handle   string    `json:"handle"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"lastused"`
+}
+
+type memOAuthClient struct {
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	Owner        string    `json:"owner"`
+	RedirectUris []string  `json:"redirecturis"`
+	Created      time.Time `json:"created"`
+}
+
+type memOAuthCode struct {
+	Hash        string    `json:"hash"`
+	Handle      string    `json:"handle"`
+	ClientId    string    `json:"client"`
+	RedirectUri string    `json:"redirecturi"`
+	Scopes      []string  `json:"scopes"`
+	Challenge   string    `json:"challenge"`
+	Expires     time.Time `json:"expires"`
+}
+
+type memOAuthToken struct {
+	Hash     string    `json:"hash"`
+	Handle   string    `json:"handle"`
+	ClientId string    `json:"client"`
+	Scopes   []string  `json:"scopes"`
+	Expires  time.Time `json:"expires"`
+}
+
+// A handle given up by renaming, reserved for its user until Until
+type memFormerHandle struct {
+	Former string    `json:"former"`
+	Handle string    `json:"handle"`
+	Until  time.Time `json:"until"`
+}
+
+func newGraph() *graph {
+	return &graph{
+		Users:      map[string]*memUser{},
+		Circles:    map[string]*memCircle{},
+		Messages:   map[string]*memMessage{},
+		Tokens:     map[string]*memToken{},
+		Resets:     map[string]*memReset{},
+		Challenges: map[string]*memChallenge{},
+		ApiKeys:    map[string]*memApiKey{},
+		Clients:    map[string]*memOAuthClient{},
+		Codes:      map[string]*memOAuthCode{},
+		Grants:     map[string]*memOAuthToken{},
+		Former:     map[string]*memFormerHandle{},
+		byKey:      map[string]*memUser{},
+	}
+}
+
+//
+// Initialization
+//
+
+// Constructor, use this when creating a new MemoryQuery struct.
+func NewMemoryQuery() *MemoryQuery {
+	query := &MemoryQuery{g: newGraph()}
+	query.DatabaseInit()
+
+	return query
+}
+
+// The PublicDomain is implicit in memory, circles flag their PART_OF
+// relationship directly. All there is to do is log out any sessions
+// stored before tokens were hashed at rest.
+func (q *MemoryQuery) DatabaseInit() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	plaintext := 0
+	for key, a := range q.g.Tokens {
+		if a.Hash == "" {
+			delete(q.g.Tokens, key)
+			q.g.touch(kindToken, key)
+			plaintext++
+		}
+	}
+	if plaintext == 0 {
+		return nil
+	}
+	return q.commit()
+}
+
+//
+// Private Utilities
+//
+
+// Reports whether u has any relationship (OWNS or MEMBER_OF) to c,
+// the equivalent of matching (u:User)-[:MEMBER_OF|OWNS]->(c:Circle)
+func (c *memCircle) connectedTo(handle string) bool {
+	if c.Owner == handle {
+		return true
+	}
+	_, ok := c.Members[handle]
+	return ok
+}
+
+func (c *memCircle) rawView() RawCircleView {
+	view := RawCircleView{
+		Name:        c.Name,
+		Id:          c.Id,
+		Description: c.Description,
+		Created:     c.Created,
+		Owner:       c.Owner,
+	}
+	if c.Public {
+		view.Public = &neoism.Relationship{}
+	}
+	return view
+}
+
+func (m *memMessage) view() types.MessageView {
+	return types.MessageView{
+		Id:      m.Id,
+		Author:  m.Author,
+		Content: m.Content,
+		Created: m.Created,
+	}
+}
+
+func (m *memMessage) publishedView(circleid string) types.PublishedMessageView {
+	return types.PublishedMessageView{
+		Id:          m.Id,
+		Author:      m.Author,
+		Content:     m.Content,
+		Created:     m.Created,
+		Circleid:    circleid,
+		PublishedAt: m.PublishedTo[circleid],
+	}
+}
+
+func (u *memUser) view() types.UserView {
+	birthday, _ := time.Parse(time.RFC3339, u.Attributes["birthday"])
+	return types.UserView{
+		Handle:    u.Handle,
+		FirstName: u.Attributes["firstname"],
+		LastName:  u.Attributes["lastname"],
+		Gender:    u.Attributes["gender"],
+		Birthday:  birthday,
+		Bio:       u.Attributes["bio"],
+		Interests: u.Attributes["interests"],
+		Languages: u.Attributes["languages"],
+		Location:  u.Attributes["location"],
+		Avatar:    u.Avatar,
+	}
+}
+
+// The profile field, if the user shows it to everyone
+func (u *memUser) public(field string) string {
+	if _, restricted := u.Visibility[field]; restricted {
+		return ""
+	}
+	return u.Attributes[field]
+}
+
+func (u *memUser) searchView() types.UserSearchView {
+	return types.UserSearchView{
+		Handle:    u.Handle,
+		FirstName: u.public("firstname"),
+		LastName:  u.public("lastname"),
+		Avatar:    u.Avatar,
+		Stir:      u.Stir,
+		Joined:    u.Joined,
+	}
+}
+
+// Whether the handle or a public name of the user matches regex
+func (u *memUser) matchesName(regex *regexp.Regexp) bool {
+	first, last := u.public("firstname"), u.public("lastname")
+	for _, name := range []string{u.Handle, first, last} {
+		if name != "" && regex.MatchString(name) {
+			return true
+		}
+	}
+	return first != "" && last != "" && regex.MatchString(first+" "+last)
+}
+
+// Whether the mute holds, the zero mute of a missing key never does
+func (m memMute) inEffect() bool {
+	return !m.Since.IsZero() && (m.Until.IsZero() || Now().Before(m.Until))
+}
+
+func (u *memUser) role() string {
+	if u.Role == "" {
+		return DEFAULT_ROLE
+	}
+	return u.Role
+}
+
+// Whether handle is signed up and has not deleted their account
+func (g *graph) active(handle string) bool {
+	u, ok := g.Users[handle]
+	return ok && u.Deactivated.IsZero()
+}
+
+// Users in creation order, as Neo4j returns them when no order is given
+func (g *graph) usersByCreation() []*memUser {
+	users := make([]*memUser, 0, len(g.Users))
+	for _, u := range g.Users {
+		users = append(users, u)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Id < users[j].Id
+	})
+	return users
+}
+
+// Drops the mutes of u on circles that were deleted, as the MUTED
+// relationships go along with a deleted Circle node
+func (g *graph) forgetMutedCircles(u *memUser) {
+	for circleid := range u.MutedCircles {
+		if _, ok := g.Circles[circleid]; !ok {
+			delete(u.MutedCircles, circleid)
+			g.touch(kindUser, u.Handle)
+		}
+	}
+}
+
+// Whether handle owns or is a member of a circle called name
+func (g *graph) connectedToCircleNamed(handle, name string) bool {
+	for _, c := range g.Circles {
+		if c.Name == name && c.connectedTo(handle) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *graph) liveToken(tokenHash string) (*memToken, bool) {
+	a, ok := g.Tokens[tokenHash]
+	if !ok || !Now().Before(a.Expires) {
+		return nil, false
+	}
+	if _, ok := g.Users[a.Handle]; !ok {
+		return nil, false
+	}
+	return a, true
+}
+
+// Writes the changes to the graph through to the store, if there is one.
+// Must be called with the write lock held, as the last step of every
+// mutation. Should the write fail the graph is reloaded, undoing the
+// mutation in memory as well.
+func (q *MemoryQuery) commit() error {
+	if q.store == nil {
+		q.g.changed = graphChanges{}
+		return nil
+	}
+	if err := q.store.save(q.g); err != nil {
+		if g, lerr := q.store.load(); lerr == nil {
+			q.g = g
+		}
+		return err
+	}
+	q.g.changed = graphChanges{}
+	return nil
+}
+
+func (g *graph) destroyTokensOf(handle string) {
+	for hash, a := range g.Tokens {
+		if a.Handle == handle {
+			delete(g.Tokens, hash)
+			g.touch(kindToken, hash)
+		}
+	}
+}
+
+func (g *graph) destroyResetsOf(handle string) {
+	for hash, p := range g.Resets {
+		if p.Handle == handle {
+			delete(g.Resets, hash)
+			g.touch(kindReset, hash)
+		}
+	}
+}
+
+func (g *graph) liveApiKey(keyHash string) (*memApiKey, bool) {
+	k, ok := g.ApiKeys[keyHash]
+	if !ok || (!k.Expires.IsZero() && !Now().Before(k.Expires)) {
+		return nil, false
+	}
+	if _, ok := g.Users[k.Handle]; !ok {
+		return nil, false
+	}
+	return k, true
+}
+
+func (g *graph) destroyApiKeysOf(handle string) {
+	for hash, k := range g.ApiKeys {
+		if k.Handle == handle {
+			delete(g.ApiKeys, hash)
+			g.touch(kindApiKey, hash)
+		}
+	}
+}
+
+// Forgets the codes and tokens granted to clientid, or by handle when
+// clientid is empty
+func (g *graph) destroyGrants(handle, clientid string) {
+	for hash, c := range g.Codes {
+		if (clientid == "" && c.Handle == handle) || c.ClientId == clientid {
+			delete(g.Codes, hash)
+			g.touch(kindCode, hash)
+		}
+	}
+	for hash, t := range g.Grants {
+		if (clientid == "" && t.Handle == handle) || t.ClientId == clientid {
+			delete(g.Grants, hash)
+			g.touch(kindGrant, hash)
+		}
+	}
+}
+
+func (g *graph) destroyOAuthOf(handle string) {
+	g.destroyGrants(handle, "")
+	for id, c := range g.Clients {
+		if c.Owner == handle {
+			g.destroyGrants("", id)
+			delete(g.Clients, id)
+			g.touch(kindClient, id)
+		}
+	}
+}
+
+func (o *memOAuthClient) record() OAuthClientRecord {
+	return OAuthClientRecord{
+		Id:           o.Id,
+		Name:         o.Name,
+		Owner:        o.Owner,
+		RedirectUris: append([]string(nil), o.RedirectUris...),
+		Created:      o.Created,
+	}
+}
+
+func (g *graph) destroyChallengesOf(handle string) {
+	for hash, c := range g.Challenges {
+		if c.Handle == handle {
+			delete(g.Challenges, hash)
+			g.touch(kindChallenge, hash)
+		}
+	}
+}
+
+// The user whose handle has the same types.HandleKey as handle
+func (g *graph) userByKey(handle string) (*memUser, bool) {
+	if u, ok := g.Users[handle]; ok {
+		return u, true
+	}
+	u, ok := g.byKey[types.HandleKey(handle)]
+	return u, ok
+}
+
+func (g *graph) addUser(u *memUser) {
+	g.Users[u.Handle] = u
+	g.byKey[types.HandleKey(u.Handle)] = u
+}
+
+func (g *graph) removeUser(handle string) {
+	delete(g.Users, handle)
+	delete(g.byKey, types.HandleKey(handle))
+}
+
+// Builds byKey for users read from a store
+func (g *graph) indexUsers() {
+	g.byKey = make(map[string]*memUser, len(g.Users))
+	for _, u := range g.Users {
+		g.byKey[types.HandleKey(u.Handle)] = u
+	}
+}
+
+// The user a former handle still resolves to, if it is reserved
+func (g *graph) formerHandle(former string) (*memFormerHandle, bool) {
+	key := types.HandleKey(former)
+	for _, f := range g.Former {
+		if types.HandleKey(f.Former) == key && Now().Before(f.Until) {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Points every reference to handle at newHandle
+func (g *graph) renameUser(handle, newHandle string) {
+	u := g.Users[handle]
+	g.removeUser(handle)
+	u.Handle = newHandle
+	g.addUser(u)
+	g.touch(kindUser, handle)
+	g.touch(kindUser, newHandle)
+
+	for key, other := range g.Users {
+		if other.Blocked[handle] {
+			delete(other.Blocked, handle)
+			other.Blocked[newHandle] = true
+			g.touch(kindUser, key)
+		}
+		if mute, ok := other.Muted[handle]; ok {
+			delete(other.Muted, handle)
+			other.Muted[newHandle] = mute
+			g.touch(kindUser, key)
+		}
+	}
+	for id, c := range g.Circles {
+		if c.Owner == handle {
+			c.Owner = newHandle
+			g.touch(kindCircle, id)
+		}
+		if joined, ok := c.Members[handle]; ok {
+			delete(c.Members, handle)
+			c.Members[newHandle] = joined
+			g.touch(kindCircle, id)
+		}
+	}
+	for id, m := range g.Messages {
+		if m.Author == handle {
+			m.Author = newHandle
+			g.touch(kindMessage, id)
+		}
+	}
+	for hash, t := range g.Tokens {
+		if t.Handle == handle {
+			t.Handle = newHandle
+			g.touch(kindToken, hash)
+		}
+	}
+	for hash, r := range g.Resets {
+		if r.Handle == handle {
+			r.Handle = newHandle
+			g.touch(kindReset, hash)
+		}
+	}
+	for hash, c := range g.Challenges {
+		if c.Handle == handle {
+			c.Handle = newHandle
+			g.touch(kindChallenge, hash)
+		}
+	}
+	for hash, k := range g.ApiKeys {
+		if k.Handle == handle {
+			k.Handle = newHandle
+			g.touch(kindApiKey, hash)
+		}
+	}
+	for id, o := range g.Clients {
+		if o.Owner == handle {
+			o.Owner = newHandle
+			g.touch(kindClient, id)
+		}
+	}
+	for hash, c := range g.Codes {
+		if c.Handle == handle {
+			c.Handle = newHandle
+			g.touch(kindCode, hash)
+		}
+	}
+	for hash, t := range g.Grants {
+		if t.Handle == handle {
+			t.Handle = newHandle
+			g.touch(kindGrant, hash)
+		}
+	}
+	for former, f := range g.Former {
+		if f.Handle == handle {
+			f.Handle = newHandle
+			g.touch(kindFormer, former)
+		}
+	}
+}
+
+func sortCirclesByCreated(circles []RawCircleView, descending bool) {
+	sort.SliceStable(circles, func(i, j int) bool {
+		if descending {
+			return circles[i].Created.After(circles[j].Created)
+		}
+		return circles[i].Created.Before(circles[j].Created)
+	})
+}
+
+func sortByPublishedAt(messages []types.PublishedMessageView, descending bool) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		if descending {
+			return messages[i].PublishedAt.After(messages[j].PublishedAt)
+		}
+		return messages[i].PublishedAt.Before(messages[j].PublishedAt)
+	})
+}
+
+//
+// Create
+//
+
+func (q *MemoryQuery) CreateUser(handle, email, passwordHash string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.userByKey(handle); ok {
+		return types.Conflict("handle_taken", "Sorry, handle or email is already taken")
+	}
+	for _, u := range q.g.Users {
+		if u.Email == email {
+			return types.Conflict("email_taken", "Sorry, handle or email is already taken")
+		}
+	}
+	q.g.NextId++
+	q.g.addUser(&memUser{
+		Id:         q.g.NextId,
+		Handle:     handle,
+		Email:      email,
+		Password:   passwordHash,
+		Unverified: true,
+		Joined:     Now(),
+		Attributes: map[string]string{},
+		Blocked:    map[string]bool{},
+	})
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateDefaultCirclesForUser(handle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+	now := Now()
+	gold := &memCircle{
+		Id:      NewUUID(),
+		Name:    types.GOLD,
+		Created: now,
+		Owner:   handle,
+		Members: map[string]time.Time{},
+	}
+	broadcast := &memCircle{
+		Id:      NewUUID(),
+		Name:    types.BROADCAST,
+		Created: now,
+		Owner:   handle,
+		Public:  true,
+		Members: map[string]time.Time{},
+	}
+	q.g.Circles[gold.Id] = gold
+	q.g.Circles[broadcast.Id] = broadcast
+	q.g.touch(kindCircle, gold.Id)
+	q.g.touch(kindCircle, broadcast.Id)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateCircle(handle, circleName string, isPublic bool) (RawCircleView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return RawCircleView{}, userNotFound(handle)
+	}
+	c := &memCircle{
+		Id:      NewUUID(),
+		Name:    circleName,
+		Created: Now(),
+		Owner:   handle,
+		Public:  isPublic,
+		Members: map[string]time.Time{},
+	}
+	q.g.Circles[c.Id] = c
+	q.g.touch(kindCircle, c.Id)
+	return c.rawView(), q.commit()
+}
+
+func (q *MemoryQuery) CreateMessage(handle, content string) (types.MessageView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return types.MessageView{}, userNotFound(handle)
+	}
+	now := Now()
+	m := &memMessage{
+		Id:          NewUUID(),
+		Author:      handle,
+		Content:     content,
+		Created:     now,
+		LastSaved:   now,
+		PublishedTo: map[string]time.Time{},
+	}
+	q.g.Messages[m.Id] = m
+	q.g.touch(kindMessage, m.Id)
+	return m.view(), q.commit()
+}
+
+func (q *MemoryQuery) CreatePublishedRelation(messageid, circleid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m, ok := q.g.Messages[messageid]
+	if _, found := q.g.Circles[circleid]; !ok || !found {
+		return messageOrCircleNotFound(messageid, circleid)
+	}
+	m.PublishedTo[circleid] = Now()
+	q.g.touch(kindMessage, messageid)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateMemberOfRelation(handle, circleid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.g.Circles[circleid]
+	if _, found := q.g.Users[handle]; !ok || !found {
+		return userOrCircleNotFound(handle, circleid)
+	}
+	c.Members[handle] = Now()
+	q.g.touch(kindCircle, circleid)
+	return q.commit()
+}
+
+func (q *MemoryQuery) JoinBroadcastCircleOfUser(handle, target string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return usersNotFound(handle, target)
+	}
+	for id, c := range q.g.Circles {
+		if c.Owner == target && c.Name == types.BROADCAST {
+			c.Members[handle] = Now()
+			q.g.touch(kindCircle, id)
+			return q.commit()
+		}
+	}
+	return usersNotFound(handle, target)
+}
+
+func (q *MemoryQuery) CreateBlockRelationFromTo(handle, target string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if _, found := q.g.Users[target]; !ok || !found {
+		return usersNotFound(handle, target)
+	}
+	u.Blocked[target] = true
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateMuteRelationFromTo(handle, target string, until time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if _, found := q.g.Users[target]; !ok || !found {
+		return usersNotFound(handle, target)
+	}
+	if u.Muted == nil {
+		u.Muted = map[string]memMute{}
+	}
+	u.Muted[target] = memMute{Since: Now(), Until: until}
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateMuteRelationToCircle(handle, circleid string, until time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if _, found := q.g.Circles[circleid]; !ok || !found {
+		return userOrCircleNotFound(handle, circleid)
+	}
+	if u.MutedCircles == nil {
+		u.MutedCircles = map[string]memMute{}
+	}
+	u.MutedCircles[circleid] = memMute{Since: Now(), Until: until}
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+// Issues a reset token for handle, replacing any earlier one so that only
+// the latest mail sent can be used
+func (q *MemoryQuery) CreatePasswordResetToken(handle, tokenHash string, expires time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+	q.g.destroyResetsOf(handle)
+	q.g.Resets[tokenHash] = &memReset{
+		Hash:    tokenHash,
+		Handle:  handle,
+		Expires: expires,
+		Created: Now(),
+	}
+	q.g.touch(kindReset, tokenHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateLoginChallenge(handle string, challenge ChallengeRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+	q.g.destroyChallengesOf(handle)
+	q.g.Challenges[challenge.TokenHash] = &memChallenge{
+		Hash:      challenge.TokenHash,
+		Handle:    handle,
+		Expires:   challenge.Expires,
+		Device:    challenge.Device,
+		UserAgent: challenge.UserAgent,
+	}
+	q.g.touch(kindChallenge, challenge.TokenHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateApiKey(handle string, key ApiKeyRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+	q.g.ApiKeys[key.KeyHash] = &memApiKey{
+		Id:      key.Id,
+		Hash:    key.KeyHash,
+		Handle:  handle,
+		Name:    key.Name,
+		Scopes:  append([]string(nil), key.Scopes...),
+		Created: Now(),
+		Expires: key.Expires,
+	}
+	q.g.touch(kindApiKey, key.KeyHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateOAuthClient(handle string, client OAuthClientRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+	q.g.Clients[client.Id] = &memOAuthClient{
+		Id:           client.Id,
+		Name:         client.Name,
+		Owner:        handle,
+		RedirectUris: append([]string(nil), client.RedirectUris...),
+		Created:      Now(),
+	}
+	q.g.touch(kindClient, client.Id)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateOAuthCode(handle string, code OAuthCodeRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+	if _, ok := q.g.Clients[code.ClientId]; !ok {
+		return oauthClientNotFound(code.ClientId)
+	}
+	q.g.Codes[code.CodeHash] = &memOAuthCode{
+		Hash:        code.CodeHash,
+		Handle:      handle,
+		ClientId:    code.ClientId,
+		RedirectUri: code.RedirectUri,
+		Scopes:      append([]string(nil), code.Scopes...),
+		Challenge:   code.Challenge,
+		Expires:     code.Expires,
+	}
+	q.g.touch(kindCode, code.CodeHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateOAuthToken(handle string, token OAuthTokenRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+	if _, ok := q.g.Clients[token.ClientId]; !ok {
+		return oauthClientNotFound(token.ClientId)
+	}
+	q.g.Grants[token.TokenHash] = &memOAuthToken{
+		Hash:     token.TokenHash,
+		Handle:   handle,
+		ClientId: token.ClientId,
+		Scopes:   append([]string(nil), token.Scopes...),
+		Expires:  token.Expires,
+	}
+	q.g.touch(kindGrant, token.TokenHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) CreateLockoutEvent(event types.LockoutEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.g.Lockouts = append(q.g.Lockouts, event)
+	if extra := len(q.g.Lockouts) - LOCKOUT_EVENTS_KEPT; extra > 0 {
+		q.g.Lockouts = q.g.Lockouts[extra:]
+	}
+	q.g.changed.lockouts++
+	return q.commit()
+}
+
+//
+// Read
+//
+
+// Checks //
+
+func (q *MemoryQuery) UserExistsByHandle(handle string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	_, ok := q.g.Users[handle]
+	return ok, nil
+}
+
+func (q *MemoryQuery) CircleLinkedToPublicDomain(circleid string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	c, ok := q.g.Circles[circleid]
+	return ok && c.Public, nil
+}
+
+func (q *MemoryQuery) UserPartOfCircle(handle, circleid string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	c, ok := q.g.Circles[circleid]
+	return ok && c.connectedTo(handle), nil
+}
+
+func (q *MemoryQuery) MessageIsPublished(handle, messageid, circleid string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	m, ok := q.g.Messages[messageid]
+	if !ok || m.Author != handle {
+		return false, nil
+	}
+	_, ok = m.PublishedTo[circleid]
+	return ok, nil
+}
+
+func (q *MemoryQuery) GetMessageById(messageid string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	_, ok := q.g.Messages[messageid]
+	return ok, nil
+}
+
+func (q *MemoryQuery) HandleExists(handle string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if _, ok := q.g.userByKey(handle); ok {
+		return true, nil
+	}
+	_, ok := q.g.formerHandle(handle)
+	return ok, nil
+}
+
+func (q *MemoryQuery) EmailExists(email string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, u := range q.g.Users {
+		if u.Email == email {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (q *MemoryQuery) AuthTokenBelongsToSomeUser(tokenHash string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	_, ok := q.g.liveToken(tokenHash)
+	return ok, nil
+}
+
+func (q *MemoryQuery) BlockExistsFromTo(handle, target string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if _, found := q.g.Users[target]; !ok || !found {
+		return false, nil
+	}
+	return u.Blocked[target], nil
+}
+
+// Mirrors the bi-directional match of the Cypher query: true when either
+// user has blocked the other.
+func (q *MemoryQuery) NoBlockingRelationshipBetween(handle, target string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	t, found := q.g.Users[target]
+	if !ok || !found {
+		return false, nil
+	}
+	return !u.Blocked[target] && !t.Blocked[handle], nil
+}
+
+func (q *MemoryQuery) UserIsSuspended(handle string) (bool, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	return ok && u.Suspended, nil
+}
+
+func (q *MemoryQuery) GetUserDeactivation(handle string) (time.Time, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return time.Time{}, userNotFound(handle)
+	}
+	return u.Deactivated, nil
+}
+
+func (q *MemoryQuery) GetUserAvatar(handle string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return "", userNotFound(handle)
+	}
+	return u.Avatar, nil
+}
+
+func (q *MemoryQuery) GetProfileVisibility(handle string) (map[string]string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return nil, userNotFound(handle)
+	}
+	visibility := map[string]string{}
+	for field, setting := range u.Visibility {
+		visibility[field] = setting
+	}
+	return visibility, nil
+}
+
+func (q *MemoryQuery) GetUserRenamed(handle string) (time.Time, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return time.Time{}, userNotFound(handle)
+	}
+	return u.Renamed, nil
+}
+
+// Users //
+
+// Sorts the matches by sortBy, ties going by handle, and answers the page
+// from skip along with how many matched in all
+func (q *MemoryQuery) SearchForUsers(circle, namePrefix string, skip, limit int, sortBy string, descending bool,
+) (users []types.UserSearchView, total int, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	// Cypher's =~ must match the whole string
+	regex := regexp.MustCompile("^(?:(?i)" + regexp.QuoteMeta(namePrefix) + ".*)$")
+
+	users = []types.UserSearchView{}
+	for _, u := range q.g.Users {
+		if !u.Deactivated.IsZero() || !u.matchesName(regex) {
+			continue
+		}
+		if circle != "" && !q.g.connectedToCircleNamed(u.Handle, circle) {
+			continue
+		}
+		users = append(users, u.searchView())
+	}
+	sort.Slice(users, func(i, j int) bool {
+		a, b := users[i], users[j]
+		order := 0
+		switch sortBy {
+		case SORT_BY_JOINED:
+			if a.Joined.Before(b.Joined) {
+				order = -1
+			} else if a.Joined.After(b.Joined) {
+				order = 1
+			}
+		default:
+			order = strings.Compare(types.HandleKey(a.Handle), types.HandleKey(b.Handle))
+		}
+		if descending {
+			order = -order
+		}
+		if order == 0 {
+			return types.HandleKey(a.Handle) < types.HandleKey(b.Handle)
+		}
+		return order < 0
+	})
+
+	total = len(users)
+	if skip > len(users) {
+		skip = len(users)
+	}
+	users = users[skip:]
+	if limit < len(users) {
+		users = users[:limit]
+	}
+	return users, total, nil
+}
+
+func (q *MemoryQuery) GetPasswordHash(handle string) ([]byte, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if u, ok := q.g.Users[handle]; !ok {
+		return []byte{}, userNotFound(handle)
+	} else {
+		return []byte(u.Password), nil
+	}
+}
+
+func (q *MemoryQuery) GetHandleByEmail(email string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, u := range q.g.Users {
+		if u.Email == email {
+			return u.Handle, nil
+		}
+	}
+	return "", types.NotFound("user_not_found", "No user with email "+email)
+}
+
+func (q *MemoryQuery) GetLockoutEvents(limit int) ([]types.LockoutEvent, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	events := []types.LockoutEvent{}
+	for i := len(q.g.Lockouts) - 1; i >= 0 && len(events) < limit; i-- {
+		events = append(events, q.g.Lockouts[i])
+	}
+	return events, nil
+}
+
+func (q *MemoryQuery) GetTotp(handle string) (TotpRecord, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return TotpRecord{}, userNotFound(handle)
+	}
+	if u.Totp == nil {
+		return TotpRecord{}, nil
+	}
+	return TotpRecord{
+		Secret:         u.Totp.Secret,
+		Enabled:        u.Totp.Enabled,
+		RecoveryHashes: append([]string(nil), u.Totp.RecoveryHashes...),
+		LastStep:       u.Totp.LastStep,
+	}, nil
+}
+
+func (q *MemoryQuery) GetLoginChallenge(tokenHash string) (handle string, challenge ChallengeRecord, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	c, ok := q.g.Challenges[tokenHash]
+	if !ok || !Now().Before(c.Expires) {
+		return "", ChallengeRecord{}, challengeNotFound()
+	}
+	return c.Handle, ChallengeRecord{
+		TokenHash: c.Hash,
+		Expires:   c.Expires,
+		Device:    c.Device,
+		UserAgent: c.UserAgent,
+	}, nil
+}
+
+func (q *MemoryQuery) DeriveApiKey(keyHash string) (handle string, scopes []string, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	k, ok := q.g.liveApiKey(keyHash)
+	if !ok {
+		return "", nil, apiKeyNotFound()
+	}
+	return k.Handle, append([]string(nil), k.Scopes...), nil
+}
+
+// Lists the API keys of handle, expired ones included, newest first
+func (q *MemoryQuery) GetApiKeysByHandle(handle string) ([]types.ApiKeyView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	keys := []types.ApiKeyView{}
+	for _, k := range q.g.ApiKeys {
+		if k.Handle != handle {
+			continue
+		}
+		keys = append(keys, types.ApiKeyView{
+			Id:       k.Id,
+			Name:     k.Name,
+			Scopes:   append([]string(nil), k.Scopes...),
+			Created:  k.Created,
+			Expires:  k.Expires,
+			LastUsed: k.LastUsed,
+		})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.After(keys[j].Created)
+	})
+	return keys, nil
+}
+
+func (q *MemoryQuery) GetOAuthClient(clientid string) (OAuthClientRecord, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	c, ok := q.g.Clients[clientid]
+	if !ok {
+		return OAuthClientRecord{}, oauthClientNotFound(clientid)
+	}
+	return c.record(), nil
+}
+
+// Lists the clients handle registered, newest first
+func (q *MemoryQuery) GetOAuthClientsByHandle(handle string) ([]OAuthClientRecord, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	clients := []OAuthClientRecord{}
+	for _, c := range q.g.Clients {
+		if c.Owner == handle {
+			clients = append(clients, c.record())
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Created.After(clients[j].Created)
+	})
+	return clients, nil
+}
+
+func (q *MemoryQuery) DeriveOAuthToken(tokenHash string) (handle string, scopes []string, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	t, ok := q.g.Grants[tokenHash]
+	if !ok || !Now().Before(t.Expires) {
+		return "", nil, oauthTokenNotFound()
+	}
+	if _, ok := q.g.Users[t.Handle]; !ok {
+		return "", nil, oauthTokenNotFound()
+	}
+	return t.Handle, append([]string(nil), t.Scopes...), nil
+}
+
+func (q *MemoryQuery) GetEmailVerification(handle string) (email string, verified bool, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return "", false, userNotFound(handle)
+	}
+	return u.Email, !u.Unverified, nil
+}
+
+func (q *MemoryQuery) GetUserRole(handle string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return "", userNotFound(handle)
+	}
+	return u.role(), nil
+}
+
+// Lists the users whose handle or email starts with prefix, ignoring case,
+// ordered by handle, along with how many there are in all
+func (q *MemoryQuery) SearchAccounts(prefix string, skip, limit int) (accounts []types.AccountView, total int, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	prefix = strings.ToLower(prefix)
+	accounts = []types.AccountView{}
+	for _, u := range q.g.Users {
+		if !strings.HasPrefix(strings.ToLower(u.Handle), prefix) &&
+			!strings.HasPrefix(strings.ToLower(u.Email), prefix) {
+			continue
+		}
+		accounts = append(accounts, types.AccountView{
+			Handle:    u.Handle,
+			Email:     u.Email,
+			Role:      u.role(),
+			Suspended: u.Suspended,
+			Verified:  !u.Unverified,
+			Joined:    u.Joined,
+		})
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].Handle < accounts[j].Handle
+	})
+
+	total = len(accounts)
+	if skip > len(accounts) {
+		skip = len(accounts)
+	}
+	accounts = accounts[skip:]
+	if limit < len(accounts) {
+		accounts = accounts[:limit]
+	}
+	return accounts, total, nil
+}
+
+func (q *MemoryQuery) GetUsersDeactivatedBefore(cutoff time.Time) ([]string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	handles := []string{}
+	for _, u := range q.g.usersByCreation() {
+		if !u.Deactivated.IsZero() && u.Deactivated.Before(cutoff) {
+			handles = append(handles, u.Handle)
+		}
+	}
+	return handles, nil
+}
+
+func (q *MemoryQuery) GetVisibleUserByHandle(handle, target string) (types.UserView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	t, ok := q.g.Users[target]
+	if !ok || !t.Deactivated.IsZero() {
+		return types.UserView{}, userNotFound(target)
+	}
+	if _, ok := q.g.Users[handle]; !ok || t.Blocked[handle] {
+		return types.UserView{}, userNotFound(target)
+	}
+	return t.view(), nil
+}
+
+func (q *MemoryQuery) GetHandleRenamedFrom(former string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	f, ok := q.g.formerHandle(former)
+	if !ok {
+		return "", userNotFound(former)
+	}
+	return f.Handle, nil
+}
+
+func (q *MemoryQuery) GetUserHandle(handle string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.userByKey(handle)
+	if !ok {
+		return "", userNotFound(handle)
+	}
+	return u.Handle, nil
+}
+
+func (q *MemoryQuery) GetConfusableHandle(handle string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	skeleton := types.HandleSkeleton(handle)
+	for _, u := range q.g.Users {
+		if types.HandleSkeleton(u.Handle) == skeleton {
+			return u.Handle, nil
+		}
+	}
+	for _, f := range q.g.Former {
+		if types.HandleSkeleton(f.Former) == skeleton && Now().Before(f.Until) {
+			return f.Former, nil
+		}
+	}
+	return "", userNotFound(handle)
+}
+
+func (q *MemoryQuery) GetBlockedUsers(handle string, skip, limit int) (users []types.UserSearchView, total int, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return nil, 0, userNotFound(handle)
+	}
+	users = []types.UserSearchView{}
+	for target := range u.Blocked {
+		if t, ok := q.g.Users[target]; ok {
+			users = append(users, t.searchView())
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return types.HandleKey(users[i].Handle) < types.HandleKey(users[j].Handle)
+	})
+
+	total = len(users)
+	if skip > len(users) {
+		skip = len(users)
+	}
+	users = users[skip:]
+	if limit < len(users) {
+		users = users[:limit]
+	}
+	return users, total, nil
+}
+
+// Newest first
+func (q *MemoryQuery) GetMutes(handle string) ([]types.MuteView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return nil, userNotFound(handle)
+	}
+	mutes := []types.MuteView{}
+	for target, mute := range u.Muted {
+		if _, ok := q.g.Users[target]; ok && mute.inEffect() {
+			mutes = append(mutes, types.MuteView{Handle: target, Since: mute.Since, Until: mute.Until})
+		}
+	}
+	for circleid, mute := range u.MutedCircles {
+		if c, ok := q.g.Circles[circleid]; ok && mute.inEffect() {
+			mutes = append(mutes, types.MuteView{CircleId: circleid, Circle: c.Name, Since: mute.Since, Until: mute.Until})
+		}
+	}
+	sort.Slice(mutes, func(i, j int) bool {
+		return mutes[i].Since.After(mutes[j].Since)
+	})
+	return mutes, nil
+}
+
+func (q *MemoryQuery) DeriveHandleFromAuthToken(tokenHash string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if a, ok := q.g.liveToken(tokenHash); ok {
+		return a.Handle, nil
+	} else {
+		return "", tokenNotFound()
+	}
+}
+
+// Lists the live sessions of handle, marking the one tokenHash belongs to
+func (q *MemoryQuery) GetSessionsByHandle(handle, tokenHash string) ([]types.SessionView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	sessions := []types.SessionView{}
+	now := Now()
+	for _, a := range q.g.Tokens {
+		if a.Handle != handle || !now.Before(a.Expires) {
+			continue
+		}
+		sessions = append(sessions, types.SessionView{
+			Id:        a.Id,
+			Device:    a.Device,
+			UserAgent: a.UserAgent,
+			Created:   a.CreatedAt,
+			LastUsed:  a.LastUsed,
+			Expires:   a.Expires,
+			Current:   a.Hash == tokenHash,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed.After(sessions[j].LastUsed)
+	})
+	return sessions, nil
+}
+
+// Circles //
+
+func (q *MemoryQuery) SearchCircles(user string, before time.Time, limit int) ([]RawCircleView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	found := []RawCircleView{}
+	for _, c := range q.g.Circles {
+		if !c.Created.Before(before) {
+			continue
+		}
+		if user != "" && c.Owner != user {
+			continue
+		}
+		found = append(found, c.rawView())
+	}
+	sortCirclesByCreated(found, true)
+	if limit < len(found) {
+		found = found[:limit]
+	}
+	return found, nil
+}
+
+func (q *MemoryQuery) GetCircleIdByName(handle, circleName string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	for _, c := range q.g.Circles {
+		if c.Owner == handle && c.Name == circleName {
+			return c.Id, nil
+		}
+	}
+	return "", types.NotFound("circle_not_found", "No circle "+circleName+" owned by "+handle)
+}
+
+func (q *MemoryQuery) GetCircleById(circleid string) (RawCircleView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	c, ok := q.g.Circles[circleid]
+	if !ok {
+		return RawCircleView{}, circleNotFound(circleid)
+	}
+	return c.rawView(), nil
+}
+
+func (q *MemoryQuery) GetPublicCirclesByHandle(handle string) (circles []RawCircleView, count int, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	circles = []RawCircleView{}
+	for _, c := range q.g.Circles {
+		if c.Owner == handle && c.Public {
+			circles = append(circles, c.rawView())
+		}
+	}
+	sortCirclesByCreated(circles, false)
+	return circles, len(circles), nil
+}
+
+func (q *MemoryQuery) GetJoinedCirclesByHandle(handle string, before time.Time, limit int) (circles []RawCircleView, count int, err error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	circles = []RawCircleView{}
+	for _, c := range q.g.Circles {
+		if c.connectedTo(handle) && c.Created.Before(before) {
+			circles = append(circles, c.rawView())
+		}
+	}
+	sortCirclesByCreated(circles, false)
+	if limit < len(circles) {
+		circles = circles[:limit]
+	}
+	return circles, len(circles), nil
+}
+
+// Messages //
+
+func (q *MemoryQuery) GetAllMessagesByHandle(target string) ([]types.MessageView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	messages := []types.MessageView{}
+	if !q.g.active(target) {
+		return messages, nil
+	}
+	for _, m := range q.g.Messages {
+		if m.Author == target {
+			messages = append(messages, m.view())
+		}
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Created.After(messages[j].Created)
+	})
+	return messages, nil
+}
+
+func (q *MemoryQuery) GetPublicPublishedMessagesByAuthor(target string) ([]types.PublishedMessageView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	messages := []types.PublishedMessageView{}
+	if !q.g.active(target) {
+		return messages, nil
+	}
+	for _, m := range q.g.Messages {
+		if m.Author != target {
+			continue
+		}
+		for circleid := range m.PublishedTo {
+			if c, ok := q.g.Circles[circleid]; ok && c.Public {
+				messages = append(messages, m.publishedView(circleid))
+			}
+		}
+	}
+	sortByPublishedAt(messages, false)
+	return messages, nil
+}
+
+// Every publication of a message handle wrote, to any circle, oldest first
+func (q *MemoryQuery) GetPublicationsByAuthor(handle string) ([]types.PublishedMessageView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	messages := []types.PublishedMessageView{}
+	for _, m := range q.g.Messages {
+		if m.Author != handle {
+			continue
+		}
+		for circleid := range m.PublishedTo {
+			messages = append(messages, m.publishedView(circleid))
+		}
+	}
+	sortByPublishedAt(messages, false)
+	return messages, nil
+}
+
+func (q *MemoryQuery) GetMessagesByHandleInCircle(target, circleid string) ([]types.PublishedMessageView, error) {
+	return []types.PublishedMessageView{}, nil
+}
+
+func (q *MemoryQuery) GetMessageFeedOfCircle(circleid string) ([]types.PublishedMessageView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	messages := []types.PublishedMessageView{}
+	for _, m := range q.g.Messages {
+		if _, ok := m.PublishedTo[circleid]; ok {
+			if q.g.active(m.Author) {
+				messages = append(messages, m.publishedView(circleid))
+			}
+		}
+	}
+	sortByPublishedAt(messages, true)
+	return messages, nil
+}
+
+func (q *MemoryQuery) GetMessageFeedOfHandle(handle string) ([]types.PublishedMessageView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	muted, mutedCircles := map[string]memMute{}, map[string]memMute{}
+	if u, ok := q.g.Users[handle]; ok {
+		muted, mutedCircles = u.Muted, u.MutedCircles
+	}
+	messages := []types.PublishedMessageView{}
+	for _, m := range q.g.Messages {
+		if !q.g.active(m.Author) || muted[m.Author].inEffect() {
+			continue
+		}
+		for circleid := range m.PublishedTo {
+			if c, ok := q.g.Circles[circleid]; ok && c.connectedTo(handle) && !mutedCircles[circleid].inEffect() {
+				messages = append(messages, m.publishedView(circleid))
+			}
+		}
+	}
+	sortByPublishedAt(messages, true)
+	return messages, nil
+}
+
+func (q *MemoryQuery) GetVisibleMessageById(handle, messageid string) (types.MessageView, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if m, ok := q.g.Messages[messageid]; ok && q.g.active(m.Author) {
+		for circleid := range m.PublishedTo {
+			if c, ok := q.g.Circles[circleid]; ok && c.connectedTo(handle) {
+				return m.view(), nil
+			}
+		}
+	}
+	return types.MessageView{}, messageNotFound(messageid)
+}
+
+func (q *MemoryQuery) GetMessageAuthor(messageid string) (string, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	m, ok := q.g.Messages[messageid]
+	if !ok {
+		return "", messageNotFound(messageid)
+	}
+	return m.Author, nil
+}
+
+//
+// Update
+//
+
+// Starts a new session for handle, leaving any others in place
+func (q *MemoryQuery) CreateAuthTokenForUser(handle string, session SessionRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return userNotFound(handle)
+	}
+
+	now := Now()
+	q.g.Tokens[session.TokenHash] = &memToken{
+		Id:             NewUUID(),
+		Hash:           session.TokenHash,
+		Handle:         handle,
+		Expires:        session.Expires,
+		CreatedAt:      now,
+		LastUsed:       now,
+		Device:         session.Device,
+		UserAgent:      session.UserAgent,
+		RefreshHash:    session.RefreshHash,
+		RefreshExpires: session.RefreshExpires,
+	}
+	q.g.touch(kindToken, session.TokenHash)
+	return q.commit()
+}
+
+// Moves the session holding the live refreshHash on to the hashes and
+// expiries of next, returning whose session it is. Spent refresh hashes
+// are remembered, presenting one again revokes the session it belonged to.
+func (q *MemoryQuery) RotateAuthToken(refreshHash string, next SessionRecord) (handle string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := Now()
+	for tokenHash, a := range q.g.Tokens {
+		if a.RefreshHash == refreshHash && now.Before(a.RefreshExpires) {
+			delete(q.g.Tokens, tokenHash)
+			a.Spent = append(a.Spent, a.RefreshHash)
+			a.Hash = next.TokenHash
+			a.Expires = next.Expires
+			a.RefreshHash = next.RefreshHash
+			a.RefreshExpires = next.RefreshExpires
+			a.LastUsed = now
+			q.g.Tokens[a.Hash] = a
+			q.g.touch(kindToken, tokenHash)
+			q.g.touch(kindToken, a.Hash)
+			return a.Handle, q.commit()
+		}
+	}
+	for tokenHash, a := range q.g.Tokens {
+		for _, spent := range a.Spent {
+			if spent == refreshHash {
+				delete(q.g.Tokens, tokenHash)
+				q.g.touch(kindToken, tokenHash)
+				if err := q.commit(); err != nil {
+					return "", err
+				}
+				return "", refreshTokenReused()
+			}
+		}
+	}
+	return "", tokenNotFound()
+}
+
+// Records that the token was just used, at most once per SESSION_TOUCH_INTERVAL.
+// A non-zero slideTo also moves the expiry of the token forward to it.
+func (q *MemoryQuery) UpdateSessionLastUsed(tokenHash string, slideTo time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := Now()
+	a, ok := q.g.Tokens[tokenHash]
+	if !ok || now.Sub(a.LastUsed) < SESSION_TOUCH_INTERVAL {
+		return nil
+	}
+	a.LastUsed = now
+	if slideTo.After(a.Expires) {
+		a.Expires = slideTo
+	}
+	q.g.touch(kindToken, tokenHash)
+	return q.commit()
+}
+
+// Records that the key was just used, at most once per SESSION_TOUCH_INTERVAL
+func (q *MemoryQuery) UpdateApiKeyLastUsed(keyHash string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := Now()
+	k, ok := q.g.ApiKeys[keyHash]
+	if !ok || now.Sub(k.LastUsed) < SESSION_TOUCH_INTERVAL {
+		return nil
+	}
+	k.LastUsed = now
+	q.g.touch(kindApiKey, keyHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) UpdatePassword(handle, newPasswordHash string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Password = newPasswordHash
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) SetEmailVerified(handle string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Unverified = false
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) SetTotp(handle string, totp TotpRecord) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Totp = &memTotp{
+		Secret:         totp.Secret,
+		Enabled:        totp.Enabled,
+		RecoveryHashes: append([]string(nil), totp.RecoveryHashes...),
+		LastStep:       totp.LastStep,
+	}
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+// Moves LastStep up to step, failing if step or a later one was used
+func (q *MemoryQuery) ConsumeTotpStep(handle string, step int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	} else if u.Totp == nil || step <= u.Totp.LastStep {
+		return secondFactorUsed()
+	}
+	u.Totp.LastStep = step
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+// Removes a recovery code hash, failing if it is not (or no longer) there
+func (q *MemoryQuery) ConsumeRecoveryHash(handle, hash string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	} else if u.Totp == nil {
+		return secondFactorUsed()
+	}
+	for i, h := range u.Totp.RecoveryHashes {
+		if h == hash {
+			u.Totp.RecoveryHashes = append(u.Totp.RecoveryHashes[:i:i], u.Totp.RecoveryHashes[i+1:]...)
+			q.g.touch(kindUser, handle)
+			return q.commit()
+		}
+	}
+	return secondFactorUsed()
+}
+
+func (q *MemoryQuery) SetUserRole(handle, role string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Role = role
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) SetUserSuspended(handle string, suspended bool) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Suspended = suspended
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) SetUserDeactivated(handle string, at time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Deactivated = at
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) SetUserAvatar(handle, avatarid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Avatar = avatarid
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) RenameUser(handle, newHandle string, reservedUntil time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	if holder, taken := q.g.userByKey(newHandle); taken && holder != u {
+		return types.Conflict("handle_taken", "Sorry, "+newHandle+" is already taken")
+	}
+	if f, reserved := q.g.formerHandle(newHandle); reserved && f.Handle != handle {
+		return types.Conflict("handle_taken", "Sorry, "+newHandle+" is already taken")
+	}
+	key := types.HandleKey(newHandle)
+	for former := range q.g.Former {
+		if types.HandleKey(former) == key {
+			delete(q.g.Former, former)
+			q.g.touch(kindFormer, former)
+		}
+	}
+	q.g.renameUser(handle, newHandle)
+	u.Renamed = Now()
+	q.g.Former[handle] = &memFormerHandle{
+		Former: handle,
+		Handle: newHandle,
+		Until:  reservedUntil,
+	}
+	q.g.touch(kindFormer, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) SetProfileVisibility(handle string, visibility map[string]string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.Visibility = map[string]string{}
+	for field, setting := range visibility {
+		u.Visibility[field] = setting
+	}
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) SetGetUserName(handle, newName string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return "", userNotFound(handle)
+	}
+	u.Name = newName
+	q.g.touch(kindUser, handle)
+	return u.Name, q.commit()
+}
+
+func (q *MemoryQuery) UpdateMessageContent(messageid, newContent string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m, ok := q.g.Messages[messageid]
+	if !ok {
+		return messageNotFound(messageid)
+	}
+	m.Content = newContent
+	m.LastSaved = Now()
+	q.g.touch(kindMessage, messageid)
+	return q.commit()
+}
+
+func (q *MemoryQuery) UpdateCircle(circleid, name, description string) (RawCircleView, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.g.Circles[circleid]
+	if !ok {
+		return RawCircleView{}, circleNotFound(circleid)
+	}
+	c.Name = name
+	c.Description = description
+	q.g.touch(kindCircle, circleid)
+	return c.rawView(), q.commit()
+}
+
+func (q *MemoryQuery) UpdateUserAttribute(handle, resource, value string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if !ok {
+		return userNotFound(handle)
+	}
+	u.LastUpdated = Now()
+	if value == "" {
+		delete(u.Attributes, resource)
+	} else {
+		u.Attributes[resource] = value
+	}
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+//
+// Delete
+//
+
+func (q *MemoryQuery) DeleteAllNodesAndRelations() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.g = newGraph()
+	q.g.changed.cleared = true
+	return q.commit()
+}
+
+func (q *MemoryQuery) DisconnectTargetFromAllHeldCircles(handle, target string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for id, c := range q.g.Circles {
+		if _, ok := c.Members[target]; ok && c.Owner == handle {
+			delete(c.Members, target)
+			q.g.touch(kindCircle, id)
+		}
+	}
+	return q.commit()
+}
+
+func (q *MemoryQuery) DeleteBlockRelationFromTo(handle, target string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if _, found := q.g.Users[target]; !ok || !found {
+		return usersNotFound(handle, target)
+	}
+	delete(u.Blocked, target)
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) DeleteMuteRelationFromTo(handle, target string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if _, found := q.g.Users[target]; !ok || !found {
+		return usersNotFound(handle, target)
+	}
+	delete(u.Muted, target)
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) DeleteMuteRelationToCircle(handle, circleid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u, ok := q.g.Users[handle]
+	if _, found := q.g.Circles[circleid]; !ok || !found {
+		return userOrCircleNotFound(handle, circleid)
+	}
+	delete(u.MutedCircles, circleid)
+	q.g.touch(kindUser, handle)
+	return q.commit()
+}
+
+func (q *MemoryQuery) DeleteUser(handle string) (types.DeletionSummary, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Users[handle]; !ok {
+		return types.DeletionSummary{}, userNotFound(handle)
+	}
+	summary := types.DeletionSummary{Handle: handle}
+	for _, a := range q.g.Tokens {
+		if a.Handle == handle {
+			summary.Sessions++
+		}
+	}
+	q.g.destroyTokensOf(handle)
+	q.g.destroyResetsOf(handle)
+	q.g.destroyChallengesOf(handle)
+	q.g.destroyApiKeysOf(handle)
+	q.g.destroyOAuthOf(handle)
+	for id, m := range q.g.Messages {
+		if m.Author == handle {
+			summary.Messages++
+			summary.Publications += len(m.PublishedTo)
+			delete(q.g.Messages, id)
+			q.g.touch(kindMessage, id)
+		}
+	}
+	for id, c := range q.g.Circles {
+		if c.Owner == handle {
+			summary.Circles++
+			delete(q.g.Circles, id)
+			q.g.touch(kindCircle, id)
+			for messageid, m := range q.g.Messages {
+				if _, ok := m.PublishedTo[id]; ok {
+					summary.Publications++
+					delete(m.PublishedTo, id)
+					q.g.touch(kindMessage, messageid)
+				}
+			}
+		} else if _, ok := c.Members[handle]; ok {
+			summary.Memberships++
+			delete(c.Members, handle)
+			q.g.touch(kindCircle, id)
+		}
+	}
+	for key, u := range q.g.Users {
+		if u.Handle == handle {
+			summary.Blocks += len(u.Blocked)
+		} else if u.Blocked[handle] {
+			summary.Blocks++
+			delete(u.Blocked, handle)
+			q.g.touch(kindUser, key)
+		}
+		if _, ok := u.Muted[handle]; ok {
+			delete(u.Muted, handle)
+			q.g.touch(kindUser, key)
+		}
+		q.g.forgetMutedCircles(u)
+	}
+	for former, f := range q.g.Former {
+		if f.Handle == handle {
+			delete(q.g.Former, former)
+			q.g.touch(kindFormer, former)
+		}
+	}
+	q.g.removeUser(handle)
+	q.g.touch(kindUser, handle)
+	return summary, q.commit()
+}
+
+func (q *MemoryQuery) DeletePublishedRelation(messageid, circleid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	m, ok := q.g.Messages[messageid]
+	if !ok {
+		return publicationNotFound(messageid, circleid)
+	}
+	if _, ok := m.PublishedTo[circleid]; !ok {
+		return publicationNotFound(messageid, circleid)
+	}
+	delete(m.PublishedTo, circleid)
+	q.g.touch(kindMessage, messageid)
+	return q.commit()
+}
+
+// Deletes the circle along with its members and publications, the
+// messages published to it stay
+func (q *MemoryQuery) DeleteCircle(circleid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Circles[circleid]; !ok {
+		return circleNotFound(circleid)
+	}
+	delete(q.g.Circles, circleid)
+	q.g.touch(kindCircle, circleid)
+	for id, m := range q.g.Messages {
+		if _, ok := m.PublishedTo[circleid]; ok {
+			delete(m.PublishedTo, circleid)
+			q.g.touch(kindMessage, id)
+		}
+	}
+	for key, u := range q.g.Users {
+		if _, ok := u.MutedCircles[circleid]; ok {
+			delete(u.MutedCircles, circleid)
+			q.g.touch(kindUser, key)
+		}
+	}
+	return q.commit()
+}
+
+func (q *MemoryQuery) DeleteMessage(messageid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Messages[messageid]; !ok {
+		return messageNotFound(messageid)
+	}
+	delete(q.g.Messages, messageid)
+	q.g.touch(kindMessage, messageid)
+	return q.commit()
+}
+
+func (q *MemoryQuery) DestroyAuthToken(tokenHash string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	a, ok := q.g.Tokens[tokenHash]
+	if !ok {
+		return tokenNotFound()
+	}
+	if _, ok := q.g.Users[a.Handle]; !ok {
+		return tokenNotFound()
+	}
+	delete(q.g.Tokens, tokenHash)
+	q.g.touch(kindToken, tokenHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) DestroySessionById(handle, sessionid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for hash, a := range q.g.Tokens {
+		if a.Handle == handle && a.Id == sessionid {
+			delete(q.g.Tokens, hash)
+			q.g.touch(kindToken, hash)
+			return q.commit()
+		}
+	}
+	return sessionNotFound(sessionid)
+}
+
+// Revokes every session of handle other than the one tokenHash belongs to
+func (q *MemoryQuery) DestroySessionsExcept(handle, tokenHash string) (count int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for hash, a := range q.g.Tokens {
+		if a.Handle == handle && hash != tokenHash {
+			delete(q.g.Tokens, hash)
+			q.g.touch(kindToken, hash)
+			count++
+		}
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	return count, q.commit()
+}
+
+// Deletes the reset token, answering whose it was if it had not expired
+func (q *MemoryQuery) ConsumePasswordResetToken(tokenHash string) (handle string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, ok := q.g.Resets[tokenHash]
+	if !ok {
+		return "", resetTokenNotFound()
+	}
+	delete(q.g.Resets, tokenHash)
+	q.g.touch(kindReset, tokenHash)
+	if err := q.commit(); err != nil {
+		return "", err
+	}
+	if !Now().Before(p.Expires) {
+		return "", resetTokenNotFound()
+	}
+	return p.Handle, nil
+}
+
+func (q *MemoryQuery) DestroyLoginChallenge(tokenHash string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.g.Challenges[tokenHash]; !ok {
+		return challengeNotFound()
+	}
+	delete(q.g.Challenges, tokenHash)
+	q.g.touch(kindChallenge, tokenHash)
+	return q.commit()
+}
+
+func (q *MemoryQuery) DestroyApiKey(handle, keyid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for hash, k := range q.g.ApiKeys {
+		if k.Handle == handle && k.Id == keyid {
+			delete(q.g.ApiKeys, hash)
+			q.g.touch(kindApiKey, hash)
+			return q.commit()
+		}
+	}
+	return apiKeyNotFound()
+}
+
+// Unregisters the client along with every code and token granted to it
+func (q *MemoryQuery) DestroyOAuthClient(handle, clientid string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.g.Clients[clientid]
+	if !ok || c.Owner != handle {
+		return oauthClientNotFound(clientid)
+	}
+	q.g.destroyGrants("", clientid)
+	delete(q.g.Clients, clientid)
+	q.g.touch(kindClient, clientid)
+	return q.commit()
+}
+
+// Deletes the code, answering who granted it and what if it had not expired
+func (q *MemoryQuery) ConsumeOAuthCode(codeHash string) (handle string, code OAuthCodeRecord, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	c, ok := q.g.Codes[codeHash]
+	if !ok {
+		return "", OAuthCodeRecord{}, oauthCodeNotFound()
+	}
+	delete(q.g.Codes, codeHash)
+	q.g.touch(kindCode, codeHash)
+	if err := q.commit(); err != nil {
+		return "", OAuthCodeRecord{}, err
+	}
+	if !Now().Before(c.Expires) {
+		return "", OAuthCodeRecord{}, oauthCodeNotFound()
+	}
+	return c.Handle, OAuthCodeRecord{
+		CodeHash:    c.Hash,
+		ClientId:    c.ClientId,
+		RedirectUri: c.RedirectUri,
+		Scopes:      append([]string(nil), c.Scopes...),
+		Challenge:   c.Challenge,
+		Expires:     c.Expires,
+	}, nil
+}
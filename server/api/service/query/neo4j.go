@@ -0,0 +1,3308 @@
+package query
+
+import (
+	"../../../types"
+	"encoding/json"
+	"errors"
+	"github.com/jmcvetta/neoism"
+	"net"
+	"regexp"
+	"time"
+)
+
+// Neo4jQuery is the Query implementation backed by a Neo4j database,
+// reached over its REST interface through neoism.
+type Neo4jQuery struct {
+	Db *neoism.Database
+}
+
+//
+// Initialization
+//
+
+// Constructor, use this when creating a new Neo4jQuery struct.
+func NewNeo4jQuery(uri string) (*Neo4jQuery, error) {
+	neo4jdb, err := neoism.Connect(uri)
+	if err != nil {
+		return nil, storeError(err)
+	}
+
+	query := Neo4jQuery{neo4jdb}
+	if err := query.DatabaseInit(); err != nil {
+		return nil, err
+	}
+
+	return &query, nil
+}
+
+// Initializes the Neo4j Database
+func (q Neo4jQuery) DatabaseInit() error {
+	if _, err := q.CreateUniquePublicDomain(); err != nil {
+		return err
+	}
+	if err := q.backfillHandleKeys(); err != nil {
+		return err
+	}
+	return q.DestroyPlaintextAuthTokens()
+}
+
+// Gives handles stored before they were compared by key and skeleton
+// their handlekey and skeleton, which Cypher can not compute itself
+func (q Neo4jQuery) backfillHandleKeys() error {
+	missing := []struct {
+		Id     int    `json:"id(n)"`
+		Handle string `json:"n.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (n)
+            WHERE   (n:User OR n:FormerHandle)
+            AND     n.handlekey IS NULL
+            RETURN  id(n), n.handle
+        `,
+		Result: &missing,
+	}); err != nil {
+		return err
+	}
+	for _, m := range missing {
+		if err := q.cypher(&neoism.CypherQuery{
+			Statement: `
+                MATCH   (n)
+                WHERE   id(n) = {id}
+                SET     n.handlekey = {handlekey}
+                      , n.skeleton  = {skeleton}
+            `,
+			Parameters: neoism.Props{
+				"id":        m.Id,
+				"handlekey": types.HandleKey(m.Handle),
+				"skeleton":  types.HandleSkeleton(m.Handle),
+			},
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//
+// Private Utilities
+//
+
+// Preforms a Cypher query, reporting any failure as a *types.Error.
+func (q Neo4jQuery) cypher(query *neoism.CypherQuery) error {
+	if err := q.Db.Cypher(query); err != nil {
+		return storeError(err)
+	}
+	return nil
+}
+
+// Wraps an error coming from neoism, telling a database that could not be
+// reached apart from one that rejected the query.
+func storeError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return types.WrapError(types.UNAVAILABLE, "store_unavailable",
+			"The database is unavailable, please try again later", err)
+	}
+	return types.WrapError(types.INTERNAL, "store_failure", "Unexpected database failure", err)
+}
+
+// The until property of a MUTED relationship, left out for mutes that
+// hold for good. Kept in local time like Now(), times compare as strings.
+func muteUntil(until time.Time) interface{} {
+	if until.IsZero() {
+		return nil
+	}
+	return until.Local()
+}
+
+//
+// Create
+//
+
+func (q Neo4jQuery) CreateUniquePublicDomain() (*neoism.Node, error) {
+	// Initialize PublicDomain node
+	// Nodes must have at least one property to allow unique creation
+	if pd, _, err := q.Db.GetOrCreateNode("PublicDomain", "iam", neoism.Props{
+		"iam": "PublicDomain",
+	}); err != nil {
+		return nil, storeError(err)
+	} else {
+		// Label (has to be) added separately
+		if err := pd.AddLabel("PublicDomain"); err != nil {
+			return nil, storeError(err)
+		}
+		return pd, nil
+	}
+}
+
+// Checks the handle and email are free in the same statement that takes
+// them, answering CONFLICT as the other stores do
+func (q Neo4jQuery) CreateUser(handle, email, passwordHash string) error {
+	taken := []struct {
+		Handles int `json:"handles"`
+		Emails  int `json:"emails"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            OPTIONAL MATCH  (h:User)
+            WHERE           h.handlekey = {handlekey}
+            OPTIONAL MATCH  (e:User)
+            WHERE           e.email     = {email}
+            WITH            count(h) AS handles, count(e) AS emails
+            FOREACH (_ IN CASE WHEN handles + emails = 0 THEN [1] ELSE [] END |
+                CREATE (u:User {
+                    handle:    {handle},
+                    handlekey: {handlekey},
+                    skeleton:  {skeleton},
+                    name:      "",
+                    email:    {email},
+                    verified: false,
+                    password: {password},
+                    joined:   {joined}
+                })
+            )
+            RETURN handles, emails
+        `,
+		Parameters: neoism.Props{
+			"handle":    handle,
+			"handlekey": types.HandleKey(handle),
+			"skeleton":  types.HandleSkeleton(handle),
+			"email":     email,
+			"password":  passwordHash,
+			"joined":    Now(),
+		},
+		Result: &taken,
+	}); err != nil {
+		return err
+	}
+	if len(taken) == 0 {
+		return types.NewError(types.INTERNAL, "store_failure", "Unexpected failure to create new user")
+	} else if taken[0].Handles > 0 {
+		return types.Conflict("handle_taken", "Sorry, handle or email is already taken")
+	} else if taken[0].Emails > 0 {
+		return types.Conflict("email_taken", "Sorry, handle or email is already taken")
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateDefaultCirclesForUser(handle string) error {
+	created := []struct {
+		Handle    string `json:"u.handle"`
+		Gold      string `json:"g.name"`
+		Broadcast string `json:"br.name"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH         (p:PublicDomain)
+            WHERE         p.iam    = "PublicDomain"
+            MATCH         (u:User)
+            WHERE         u.handle = {handle}
+            CREATE        (g:Circle  {
+            	name:    {gold},
+            	id:      {gold_id},
+            	created: {now}
+            })
+            CREATE        (br:Circle {
+            	name:    {broadcast},
+            	id:      {broadcast_id},
+            	created: {now}
+            })
+            CREATE 	      (u)-[:OWNS]->(g)
+            CREATE        (u)-[:OWNS]->(br)
+            CREATE UNIQUE (br)-[:PART_OF]->(p)
+            RETURN        u.handle, g.name, br.name
+        `,
+		Parameters: neoism.Props{
+			"handle":       handle,
+			"gold":         types.GOLD,
+			"broadcast":    types.BROADCAST,
+			"gold_id":      NewUUID(),
+			"broadcast_id": NewUUID(),
+			"now":          Now(),
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateCircle(handle, circleName string, isPublic bool) (RawCircleView, error) {
+	created := []RawCircleView{}
+
+	query := `
+        MATCH   (u:User), (p:PublicDomain)
+        WHERE   u.handle      = {handle}
+        AND     p.iam         = "PublicDomain"
+        CREATE  (u)-[:OWNS]->(c:Circle)
+        SET     c.name        = {name}
+        SET     c.id          = {id}
+        SET     c.created     = {now}
+        SET     c.description = ""
+
+    `
+	if isPublic {
+		query = query + `
+            CREATE  (c)-[:PART_OF]->(p)
+        `
+	}
+	query = query + `
+	    WITH    u, c, p
+		OPTIONAL MATCH (c)-[r:PART_OF]->(p)
+        RETURN  c.name        AS name
+             ,  c.id          AS id
+             ,  c.description AS description
+             ,  c.created     AS created
+             ,  u.handle      AS owner
+             ,  r             AS public
+    `
+
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: query,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"name":   circleName,
+			"id":     NewUUID(),
+			"now":    Now(),
+		},
+		Result: &created,
+	}); err != nil {
+		return RawCircleView{}, err
+	}
+
+	if len(created) == 0 {
+		return RawCircleView{}, userNotFound(handle)
+	}
+	return created[0], nil
+}
+
+func (q Neo4jQuery) CreateMessage(handle, content string) (types.MessageView, error) {
+	created := make([]types.MessageView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            CREATE  (m:Message {
+                content:   {content}
+              , created:   {now}
+              , lastsaved: {now}
+              , id:        {id}
+            })
+            CREATE  (u)-[r:WROTE]->(m)
+            RETURN  m.id      AS id
+                 ,  m.content AS content
+                 ,  u.handle  AS author
+                 ,  m.created AS created
+        `,
+		Parameters: neoism.Props{
+			"handle":  handle,
+			"content": content,
+			"now":     Now(),
+			"id":      NewUUID(),
+		},
+		Result: &created,
+	}); err != nil {
+		return types.MessageView{}, err
+	}
+
+	if len(created) == 0 {
+		return types.MessageView{}, userNotFound(handle)
+	}
+	return created[0], nil
+}
+
+func (q Neo4jQuery) CreatePublishedRelation(messageid, circleid string) error {
+	created := []struct {
+		R neoism.Relationship `json:"r"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (m:Message), (c:Circle)
+            WHERE   m.id           = {messageid}
+            AND     c.id           = {circleid}
+            CREATE  (m)-[r:PUB_TO]->(c)
+            SET     r.published_at = {now}
+            RETURN  r
+        `,
+		Parameters: neoism.Props{
+			"messageid": messageid,
+			"circleid":  circleid,
+			"now":       Now(),
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return messageOrCircleNotFound(messageid, circleid)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateMemberOfRelation(handle, circleid string) error {
+	joined := []struct {
+		At time.Time `json:"r.at"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User), (c:Circle)
+            WHERE   u.handle = {handle}
+            AND     c.id     = {id}
+            CREATE  (u)-[r:MEMBER_OF]->(c)
+            SET     r.at     = {now}
+            RETURN  r.at
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"id":     circleid,
+			"now":    Now(),
+		},
+		Result: &joined,
+	}); err != nil {
+		return err
+	}
+	if len(joined) == 0 {
+		return userOrCircleNotFound(handle, circleid)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) JoinBroadcastCircleOfUser(handle, target string) error {
+	created := []struct {
+		At time.Time `json:"r.at"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH          (u:User)
+            WHERE          u.handle = {handle}
+            MATCH          (t:User)-[:OWNS]->(c:Circle)
+            WHERE          t.handle = {target}
+            AND            c.name   = {broadcast}
+            CREATE UNIQUE  (u)-[r:MEMBER_OF]->(c)
+            SET            r.at     = {now}
+            RETURN         r.at
+        `,
+		Parameters: neoism.Props{
+			"handle":    handle,
+			"broadcast": types.BROADCAST,
+			"target":    target,
+			"now":       Now(),
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return usersNotFound(handle, target)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateBlockRelationFromTo(handle, target string) error {
+	res := []struct {
+		Handle string              `json:"u.handle"`
+		Target string              `json:"t.handle"`
+		R      neoism.Relationship `json:"r"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH (u:User), (t:User)
+            WHERE         u.handle = {handle}
+            AND           t.handle = {target}
+            CREATE UNIQUE (u)-[r:BLOCKED]->(t)
+            RETURN        u.handle, t.handle, r
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+		},
+		Result: &res,
+	}); err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return usersNotFound(handle, target)
+	}
+	return nil
+}
+
+// Muting again replaces the mute, a zero until leaves out the property
+func (q Neo4jQuery) CreateMuteRelationFromTo(handle, target string, until time.Time) error {
+	res := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH (u:User), (t:User)
+            WHERE         u.handle = {handle}
+            AND           t.handle = {target}
+            CREATE UNIQUE (u)-[m:MUTED]->(t)
+            SET           m.since  = {now}
+                        , m.until  = {until}
+            RETURN        u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+			"now":    Now(),
+			"until":  muteUntil(until),
+		},
+		Result: &res,
+	}); err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return usersNotFound(handle, target)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateMuteRelationToCircle(handle, circleid string, until time.Time) error {
+	res := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH (u:User), (c:Circle)
+            WHERE         u.handle = {handle}
+            AND           c.id     = {circleid}
+            CREATE UNIQUE (u)-[m:MUTED]->(c)
+            SET           m.since  = {now}
+                        , m.until  = {until}
+            RETURN        u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":   handle,
+			"circleid": circleid,
+			"now":      Now(),
+			"until":    muteUntil(until),
+		},
+		Result: &res,
+	}); err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return userOrCircleNotFound(handle, circleid)
+	}
+	return nil
+}
+
+// Issues a reset token for handle, replacing any earlier one so that only
+// the latest mail sent can be used
+func (q Neo4jQuery) CreatePasswordResetToken(handle, tokenHash string, expires time.Time) error {
+	created := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            WITH    u
+            OPTIONAL MATCH (u)<-[old_r:RESET_OF]-(old:PasswordReset)
+            DELETE  old_r, old
+            WITH    u
+            CREATE  (u)<-[:RESET_OF]-(p:PasswordReset)
+            SET     p.hash    = {hash}
+            SET     p.expires = {expires}
+            SET     p.created = {now}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":  handle,
+			"hash":    tokenHash,
+			"expires": expires,
+			"now":     Now(),
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+// Lockout events are kept for admins to review and are not tied to any
+// user, the subject may be an IP address or a handle nobody has
+// Also drops the oldest events past LOCKOUT_EVENTS_KEPT
+func (q Neo4jQuery) CreateLockoutEvent(event types.LockoutEvent) error {
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            CREATE  (e:LockoutEvent {
+                id:      {id},
+                kind:    {kind},
+                subject: {subject},
+                event:   {event},
+                at:      {at},
+                until:   {until},
+                by:      {by}
+            })
+            WITH    e
+            MATCH   (old:LockoutEvent)
+            WITH    old
+            ORDER BY old.at DESC
+            SKIP    {kept}
+            DELETE  old
+        `,
+		Parameters: neoism.Props{
+			"kept":    LOCKOUT_EVENTS_KEPT,
+			"id":      event.Id,
+			"kind":    event.Kind,
+			"subject": event.Subject,
+			"event":   event.Event,
+			"at":      event.At,
+			"until":   event.Until,
+			"by":      event.By,
+		},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Replaces any challenge still open for handle
+func (q Neo4jQuery) CreateLoginChallenge(handle string, challenge ChallengeRecord) error {
+	created := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            WITH    u
+            OPTIONAL MATCH (u)<-[old_r:CHALLENGE_OF]-(old:LoginChallenge)
+            DELETE  old_r, old
+            WITH    u
+            CREATE  (u)<-[:CHALLENGE_OF]-(c:LoginChallenge)
+            SET     c.hash      = {hash}
+            SET     c.expires   = {expires}
+            SET     c.device    = {device}
+            SET     c.useragent = {useragent}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":    handle,
+			"hash":      challenge.TokenHash,
+			"expires":   challenge.Expires,
+			"device":    challenge.Device,
+			"useragent": challenge.UserAgent,
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+// Keys that never expire have no expires property
+func (q Neo4jQuery) CreateApiKey(handle string, key ApiKeyRecord) error {
+	created := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	var expires interface{}
+	if !key.Expires.IsZero() {
+		expires = key.Expires
+	}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            CREATE  (u)<-[:KEY_OF]-(k:ApiKey)
+            SET     k.id       = {id}
+            SET     k.hash     = {hash}
+            SET     k.name     = {name}
+            SET     k.scopes   = {scopes}
+            SET     k.created  = {now}
+            SET     k.expires  = {expires}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":  handle,
+			"id":      key.Id,
+			"hash":    key.KeyHash,
+			"name":    key.Name,
+			"scopes":  key.Scopes,
+			"now":     Now(),
+			"expires": expires,
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateOAuthClient(handle string, client OAuthClientRecord) error {
+	created := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            CREATE  (u)<-[:CLIENT_OF]-(c:OAuthClient)
+            SET     c.id           = {id}
+            SET     c.name         = {name}
+            SET     c.redirecturis = {redirecturis}
+            SET     c.created      = {now}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":       handle,
+			"id":           client.Id,
+			"name":         client.Name,
+			"redirecturis": client.RedirectUris,
+			"now":          Now(),
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateOAuthCode(handle string, code OAuthCodeRecord) error {
+	created := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User), (c:OAuthClient)
+            WHERE   u.handle = {handle}
+            AND     c.id     = {client}
+            CREATE  (u)<-[:CODE_OF]-(x:OAuthCode)
+            SET     x.hash        = {hash}
+            SET     x.client      = {client}
+            SET     x.redirecturi = {redirecturi}
+            SET     x.scopes      = {scopes}
+            SET     x.challenge   = {challenge}
+            SET     x.expires     = {expires}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":      handle,
+			"hash":        code.CodeHash,
+			"client":      code.ClientId,
+			"redirecturi": code.RedirectUri,
+			"scopes":      code.Scopes,
+			"challenge":   code.Challenge,
+			"expires":     code.Expires,
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userOrClientNotFound(handle, code.ClientId)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) CreateOAuthToken(handle string, token OAuthTokenRecord) error {
+	created := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User), (c:OAuthClient)
+            WHERE   u.handle = {handle}
+            AND     c.id     = {client}
+            CREATE  (u)<-[:GRANT_OF]-(t:OAuthToken)
+            SET     t.hash    = {hash}
+            SET     t.client  = {client}
+            SET     t.scopes  = {scopes}
+            SET     t.expires = {expires}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":  handle,
+			"hash":    token.TokenHash,
+			"client":  token.ClientId,
+			"scopes":  token.Scopes,
+			"expires": token.Expires,
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userOrClientNotFound(handle, token.ClientId)
+	}
+	return nil
+}
+
+//
+// Read
+//
+
+// Checks //
+
+func (q Neo4jQuery) UserExistsByHandle(handle string) (bool, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) CircleLinkedToPublicDomain(circleid string) (bool, error) {
+	found := []struct {
+		Id string `json:"c.id"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (c:Circle)-[:PART_OF]->(p:PublicDomain)
+            WHERE   c.id = {id}
+            RETURN  c.id
+        `,
+		Parameters: neoism.Props{
+			"id": circleid,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) UserPartOfCircle(handle, circleid string) (bool, error) {
+	found := []struct {
+		Id string `json:"c.id"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)-[:MEMBER_OF|OWNS]->(c:Circle)
+			WHERE   u.handle = {handle}
+			AND     c.id     = {id}
+			RETURN  c.id
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"id":     circleid,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) MessageIsPublished(handle, messageid, circleid string) (bool, error) {
+	found := []struct {
+		R *neoism.Relationship `json:"r"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)-[:WROTE]->(m:Message)-[r:PUB_TO]->(c:Circle)
+            WHERE   u.handle = {handle}
+            AND     m.id     = {messageid}
+            AND     c.id     = {circleid}
+            RETURN  r
+        `,
+		Parameters: neoism.Props{
+			"handle":    handle,
+			"messageid": messageid,
+			"circleid":  circleid,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) GetMessageById(messageid string) (bool, error) {
+	found := []struct {
+		Id int `json:"m.id"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (m:Message)
+            WHERE   m.id = {id}
+            RETURN  m.id
+        `,
+		Parameters: neoism.Props{
+			"id": messageid,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) HandleExists(handle string) (bool, error) {
+	_, err := q.GetUserHandle(handle)
+	if types.IsNotFound(err) {
+		_, err = q.GetHandleRenamedFrom(handle)
+	}
+	if types.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (q Neo4jQuery) EmailExists(email string) (bool, error) {
+	found := []struct {
+		Email string `json:"u.email"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.email = {email}
+            RETURN  u.email
+        `,
+		Parameters: neoism.Props{
+			"email": email,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) AuthTokenBelongsToSomeUser(tokenHash string) (bool, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[:SESSION_OF]-(a:AuthToken)
+            WHERE   a.hash   = {hash}
+            AND     a.expires > {now}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"hash": tokenHash,
+			"now":  Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) == 1, nil
+}
+
+func (q Neo4jQuery) BlockExistsFromTo(handle, target string) (bool, error) {
+	found := []struct {
+		Relation int `json:"r"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User), (t:User)
+            WHERE   u.handle = {handle}
+            AND     t.handle = {target}
+            MATCH   (u)-[r:BLOCKED]->(t)
+            RETURN  r
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) NoBlockingRelationshipBetween(handle, target string) (bool, error) {
+	found := []struct {
+		Relation neoism.Relationship `json:"r"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		// use of bi-directional match here
+		Statement: `
+			MATCH   (u:User)-[r:BLOCKED]-(t:User)
+            WHERE   u.handle = {handle}
+            AND     t.handle = {target}
+            RETURN  r
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) == 0, nil
+}
+
+func (q Neo4jQuery) UserIsSuspended(handle string) (bool, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle    = {handle}
+            AND     u.suspended = true
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
+func (q Neo4jQuery) GetUserDeactivation(handle string) (time.Time, error) {
+	found := []struct {
+		Deactivated *time.Time `json:"u.deactivated"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  u.deactivated
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return time.Time{}, err
+	}
+	if len(found) == 0 {
+		return time.Time{}, userNotFound(handle)
+	}
+	if found[0].Deactivated == nil {
+		return time.Time{}, nil
+	}
+	return *found[0].Deactivated, nil
+}
+
+func (q Neo4jQuery) GetUserAvatar(handle string) (string, error) {
+	found := []struct {
+		Avatar string `json:"u.avatar"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  u.avatar
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", userNotFound(handle)
+	}
+	return found[0].Avatar, nil
+}
+
+func (q Neo4jQuery) GetUserRenamed(handle string) (time.Time, error) {
+	found := []struct {
+		Renamed *time.Time `json:"u.renamed"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  u.renamed
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return time.Time{}, err
+	}
+	if len(found) == 0 {
+		return time.Time{}, userNotFound(handle)
+	}
+	if found[0].Renamed == nil {
+		return time.Time{}, nil
+	}
+	return *found[0].Renamed, nil
+}
+
+// The settings are kept as a json object in a single property, Neo4j has
+// no map properties
+func (q Neo4jQuery) GetProfileVisibility(handle string) (map[string]string, error) {
+	found := []struct {
+		Visibility string `json:"u.visibility"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  u.visibility
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, userNotFound(handle)
+	}
+	visibility := map[string]string{}
+	if found[0].Visibility != "" {
+		if err := json.Unmarshal([]byte(found[0].Visibility), &visibility); err != nil {
+			return nil, types.WrapError(types.INTERNAL, "internal_error", "Unexpected failure to decode profile visibility", err)
+		}
+	}
+	return visibility, nil
+}
+
+// Users //
+
+// Names only count, and are only returned, when the user shows them to
+// everyone: the visibility settings hold the fields that are not public
+func (q Neo4jQuery) SearchForUsers(circle, namePrefix string, skip, limit int, sortBy string, descending bool,
+) (users []types.UserSearchView, total int, err error) {
+	match := `
+        MATCH   (u:User)
+        WHERE   u.deactivated IS NULL
+    `
+	if circle != "" {
+		match += `
+        AND     (u)-[:MEMBER_OF|OWNS]->(:Circle {name: {circle}})
+        `
+	}
+	match += `
+        WITH    u
+              , CASE WHEN u.visibility CONTAINS '"firstname"' THEN null ELSE u.firstname END AS firstname
+              , CASE WHEN u.visibility CONTAINS '"lastname"'  THEN null ELSE u.lastname  END AS lastname
+        WHERE   u.handle                     =~ {regex}
+        OR      firstname                    =~ {regex}
+        OR      lastname                     =~ {regex}
+        OR      firstname + ' ' + lastname   =~ {regex}
+    `
+	props := neoism.Props{
+		"circle": circle,
+		"regex":  "(?iu)" + regexp.QuoteMeta(namePrefix) + ".*",
+		"skip":   skip,
+		"limit":  limit,
+	}
+
+	counted := []struct {
+		Total int `json:"total"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement:  match + `RETURN count(u) AS total`,
+		Parameters: props,
+		Result:     &counted,
+	}); err != nil {
+		return nil, 0, err
+	}
+	if len(counted) > 0 {
+		total = counted[0].Total
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+	order := "u.handlekey " + direction
+	switch sortBy {
+	case SORT_BY_JOINED:
+		order = "u.joined " + direction + ", u.handlekey"
+	}
+
+	found := []struct {
+		Handle    string    `json:"u.handle"`
+		FirstName string    `json:"firstname"`
+		LastName  string    `json:"lastname"`
+		Avatar    string    `json:"u.avatar"`
+		Stir      int       `json:"stir"`
+		Joined    time.Time `json:"u.joined"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: match + `
+        RETURN  u.handle, u.handlekey, firstname, lastname, u.avatar, coalesce(u.stir, 0) AS stir, u.joined
+        ORDER BY ` + order + `
+        SKIP    {skip}
+        LIMIT   {limit}
+    `,
+		Parameters: props,
+		Result:     &found,
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	users = make([]types.UserSearchView, len(found))
+	for i, f := range found {
+		users[i] = types.UserSearchView{
+			Handle:    f.Handle,
+			FirstName: f.FirstName,
+			LastName:  f.LastName,
+			Avatar:    f.Avatar,
+			Stir:      f.Stir,
+			Joined:    f.Joined,
+		}
+	}
+	return users, total, nil
+}
+
+func (q Neo4jQuery) GetPasswordHash(handle string) ([]byte, error) {
+	found := []struct {
+		PasswordHash string `json:"u.password"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  u.password
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return []byte{}, err
+	}
+
+	if len(found) == 0 {
+		return []byte{}, userNotFound(handle)
+	}
+	return []byte(found[0].PasswordHash), nil
+}
+
+func (q Neo4jQuery) GetHandleByEmail(email string) (string, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.email = {email}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"email": email,
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", types.NotFound("user_not_found", "No user with email "+email)
+	}
+	return found[0].Handle, nil
+}
+
+// Users created before email verification have no verified property
+// and count as verified
+func (q Neo4jQuery) GetEmailVerification(handle string) (email string, verified bool, err error) {
+	found := []struct {
+		Email    string `json:"u.email"`
+		Verified bool   `json:"verified"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  u.email, coalesce(u.verified, true) AS verified
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return "", false, err
+	}
+	if len(found) == 0 {
+		return "", false, userNotFound(handle)
+	}
+	return found[0].Email, found[0].Verified, nil
+}
+
+func (q Neo4jQuery) GetUserRole(handle string) (string, error) {
+	found := []struct {
+		Role string `json:"role"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  coalesce(u.role, {default}) AS role
+        `,
+		Parameters: neoism.Props{
+			"handle":  handle,
+			"default": DEFAULT_ROLE,
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", userNotFound(handle)
+	}
+	return found[0].Role, nil
+}
+
+// Lists the users whose handle or email starts with prefix, ignoring case,
+// ordered by handle, along with how many there are in all
+func (q Neo4jQuery) SearchAccounts(prefix string, skip, limit int) (accounts []types.AccountView, total int, err error) {
+	match := `
+            MATCH     (u:User)
+            WHERE     u.handle =~ {regex}
+            OR        u.email  =~ {regex}
+    `
+	props := neoism.Props{
+		"regex":   "(?i)" + regexp.QuoteMeta(prefix) + ".*",
+		"default": DEFAULT_ROLE,
+		"skip":    skip,
+		"limit":   limit,
+	}
+
+	counted := []struct {
+		Total int `json:"total"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement:  match + `RETURN count(u) AS total`,
+		Parameters: props,
+		Result:     &counted,
+	}); err != nil {
+		return nil, 0, err
+	}
+	if len(counted) > 0 {
+		total = counted[0].Total
+	}
+
+	accounts = []types.AccountView{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: match + `
+            RETURN    u.handle                       AS handle
+                    , u.email                        AS email
+                    , coalesce(u.role, {default})    AS role
+                    , coalesce(u.suspended, false)   AS suspended
+                    , coalesce(u.verified, true)     AS verified
+                    , u.joined                       AS joined
+            ORDER BY  u.handle
+            SKIP      {skip}
+            LIMIT     {limit}
+        `,
+		Parameters: props,
+		Result:     &accounts,
+	}); err != nil {
+		return nil, 0, err
+	}
+	return accounts, total, nil
+}
+
+// The latest limit lockout events, newest first
+func (q Neo4jQuery) GetLockoutEvents(limit int) ([]types.LockoutEvent, error) {
+	events := []types.LockoutEvent{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (e:LockoutEvent)
+            RETURN  e.id      AS id
+                 ,  e.kind    AS kind
+                 ,  e.subject AS subject
+                 ,  e.event   AS event
+                 ,  e.at      AS at
+                 ,  e.until   AS until
+                 ,  e.by      AS by
+            ORDER BY e.at DESC
+            LIMIT   {limit}
+        `,
+		Parameters: neoism.Props{
+			"limit": limit,
+		},
+		Result: &events,
+	}); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// Users that never enrolled have no totp properties and get a zero record
+func (q Neo4jQuery) GetTotp(handle string) (TotpRecord, error) {
+	found := []struct {
+		Secret   string   `json:"secret"`
+		Enabled  bool     `json:"enabled"`
+		Recovery []string `json:"recovery"`
+		LastStep int64    `json:"laststep"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            RETURN  coalesce(u.totpsecret, "")    AS secret
+                 ,  coalesce(u.totpenabled, false) AS enabled
+                 ,  coalesce(u.totprecovery, [])   AS recovery
+                 ,  coalesce(u.totplaststep, 0)    AS laststep
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return TotpRecord{}, err
+	}
+	if len(found) == 0 {
+		return TotpRecord{}, userNotFound(handle)
+	}
+	return TotpRecord{
+		Secret:         found[0].Secret,
+		Enabled:        found[0].Enabled,
+		RecoveryHashes: found[0].Recovery,
+		LastStep:       found[0].LastStep,
+	}, nil
+}
+
+func (q Neo4jQuery) GetLoginChallenge(tokenHash string) (handle string, challenge ChallengeRecord, err error) {
+	found := []struct {
+		Handle    string    `json:"u.handle"`
+		Expires   time.Time `json:"c.expires"`
+		Device    string    `json:"c.device"`
+		UserAgent string    `json:"c.useragent"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[:CHALLENGE_OF]-(c:LoginChallenge)
+            WHERE   c.hash = {hash}
+            RETURN  u.handle, c.expires, c.device, c.useragent
+        `,
+		Parameters: neoism.Props{
+			"hash": tokenHash,
+		},
+		Result: &found,
+	}); err != nil {
+		return "", ChallengeRecord{}, err
+	}
+	if len(found) == 0 || !Now().Before(found[0].Expires) {
+		return "", ChallengeRecord{}, challengeNotFound()
+	}
+	return found[0].Handle, ChallengeRecord{
+		TokenHash: tokenHash,
+		Expires:   found[0].Expires,
+		Device:    found[0].Device,
+		UserAgent: found[0].UserAgent,
+	}, nil
+}
+
+func (q Neo4jQuery) GetUsersDeactivatedBefore(cutoff time.Time) ([]string, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.deactivated < {cutoff}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"cutoff": cutoff,
+		},
+		Result: &found,
+	}); err != nil {
+		return nil, err
+	}
+	handles := make([]string, len(found))
+	for i, f := range found {
+		handles[i] = f.Handle
+	}
+	return handles, nil
+}
+
+func (q Neo4jQuery) GetVisibleUserByHandle(handle, target string) (types.UserView, error) {
+	users := make([]types.UserView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (t:User), (u:User)
+            WHERE   not((u)<-[:BLOCKED]-(t))
+            AND     t.handle = {target}
+            AND     t.deactivated IS NULL
+            AND     u.handle = {handle}
+            RETURN  t.handle    AS handle
+                  , t.firstname AS firstname
+                  , t.lastname  AS lastname
+                  , t.gender    AS gender
+                  , t.birthday  AS birthday
+                  , t.bio       AS bio
+                  , t.interests AS interests
+                  , t.languages AS languages
+                  , t.location  AS location
+                  , t.avatar    AS avatar
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+		},
+		Result: &users,
+	}); err != nil {
+		return types.UserView{}, err
+	}
+	if len(users) == 0 {
+		return types.UserView{}, userNotFound(target)
+	}
+	return users[0], nil
+}
+
+func (q Neo4jQuery) GetHandleRenamedFrom(former string) (string, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (f:FormerHandle)-[:FORMER_HANDLE_OF]->(u:User)
+            WHERE   f.handlekey = {key}
+            AND     f.until     > {now}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"key": types.HandleKey(former),
+			"now": Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", userNotFound(former)
+	}
+	return found[0].Handle, nil
+}
+
+func (q Neo4jQuery) GetUserHandle(handle string) (string, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handlekey = {key}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"key": types.HandleKey(handle),
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", userNotFound(handle)
+	}
+	return found[0].Handle, nil
+}
+
+func (q Neo4jQuery) GetConfusableHandle(handle string) (string, error) {
+	found := []struct {
+		Handle string `json:"n.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (n)
+            WHERE   (n:User OR n:FormerHandle AND n.until > {now})
+            AND     n.skeleton = {skeleton}
+            RETURN  n.handle
+            LIMIT   1
+        `,
+		Parameters: neoism.Props{
+			"skeleton": types.HandleSkeleton(handle),
+			"now":      Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", userNotFound(handle)
+	}
+	return found[0].Handle, nil
+}
+
+func (q Neo4jQuery) GetBlockedUsers(handle string, skip, limit int) (users []types.UserSearchView, total int, err error) {
+	counted := []struct {
+		Total int `json:"total"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            OPTIONAL MATCH (u)-[b:BLOCKED]->(:User)
+            RETURN  count(b) AS total
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &counted,
+	}); err != nil {
+		return nil, 0, err
+	}
+	if len(counted) == 0 {
+		return nil, 0, userNotFound(handle)
+	}
+
+	found := []struct {
+		Handle    string    `json:"t.handle"`
+		FirstName string    `json:"firstname"`
+		LastName  string    `json:"lastname"`
+		Avatar    string    `json:"t.avatar"`
+		Stir      int       `json:"stir"`
+		Joined    time.Time `json:"t.joined"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)-[:BLOCKED]->(t:User)
+            WHERE   u.handle = {handle}
+            RETURN  t.handle, t.handlekey
+                  , CASE WHEN t.visibility CONTAINS '"firstname"' THEN null ELSE t.firstname END AS firstname
+                  , CASE WHEN t.visibility CONTAINS '"lastname"'  THEN null ELSE t.lastname  END AS lastname
+                  , t.avatar, coalesce(t.stir, 0) AS stir, t.joined
+            ORDER BY t.handlekey
+            SKIP    {skip}
+            LIMIT   {limit}
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"skip":   skip,
+			"limit":  limit,
+		},
+		Result: &found,
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	users = make([]types.UserSearchView, len(found))
+	for i, f := range found {
+		users[i] = types.UserSearchView{
+			Handle:    f.Handle,
+			FirstName: f.FirstName,
+			LastName:  f.LastName,
+			Avatar:    f.Avatar,
+			Stir:      f.Stir,
+			Joined:    f.Joined,
+		}
+	}
+	return users, counted[0].Total, nil
+}
+
+// Newest first. The row of a user without mutes has neither a handle nor
+// a circle id.
+func (q Neo4jQuery) GetMutes(handle string) ([]types.MuteView, error) {
+	found := []types.MuteView{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            OPTIONAL MATCH (u)-[m:MUTED]->(x)
+            WHERE   m.until IS NULL
+            OR      m.until > {now}
+            RETURN  CASE WHEN x:User   THEN x.handle END AS handle
+                 ,  CASE WHEN x:Circle THEN x.id     END AS circleid
+                 ,  CASE WHEN x:Circle THEN x.name   END AS circle
+                 ,  m.since  AS since
+                 ,  m.until  AS until
+            ORDER BY m.since DESC
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"now":    Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, userNotFound(handle)
+	}
+	mutes := []types.MuteView{}
+	for _, mute := range found {
+		if mute.Handle != "" || mute.CircleId != "" {
+			mutes = append(mutes, mute)
+		}
+	}
+	return mutes, nil
+}
+
+func (q Neo4jQuery) DeriveHandleFromAuthToken(tokenHash string) (string, error) {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)<-[:SESSION_OF]-(a:AuthToken)
+			WHERE   a.hash  = {hash}
+			AND     {now}    < a.expires
+			RETURN  u.handle
+		`,
+		Parameters: neoism.Props{
+			"hash": tokenHash,
+			"now":  Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", tokenNotFound()
+	}
+	return found[0].Handle, nil
+}
+
+func (q Neo4jQuery) DeriveApiKey(keyHash string) (handle string, scopes []string, err error) {
+	found := []struct {
+		Handle string   `json:"u.handle"`
+		Scopes []string `json:"k.scopes"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)<-[:KEY_OF]-(k:ApiKey)
+			WHERE   k.hash = {hash}
+			AND     (k.expires IS NULL OR {now} < k.expires)
+			RETURN  u.handle, k.scopes
+		`,
+		Parameters: neoism.Props{
+			"hash": keyHash,
+			"now":  Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return "", nil, err
+	}
+	if len(found) == 0 {
+		return "", nil, apiKeyNotFound()
+	}
+	return found[0].Handle, found[0].Scopes, nil
+}
+
+// Lists the API keys of handle, expired ones included, newest first
+func (q Neo4jQuery) GetApiKeysByHandle(handle string) ([]types.ApiKeyView, error) {
+	found := []struct {
+		Id       string    `json:"k.id"`
+		Name     string    `json:"k.name"`
+		Scopes   []string  `json:"k.scopes"`
+		Created  time.Time `json:"k.created"`
+		Expires  time.Time `json:"k.expires"`
+		LastUsed time.Time `json:"k.lastused"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)<-[:KEY_OF]-(k:ApiKey)
+			WHERE   u.handle = {handle}
+			RETURN  k.id, k.name, k.scopes, k.created, k.expires, k.lastused
+			ORDER BY k.created DESC
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return nil, err
+	}
+	keys := make([]types.ApiKeyView, len(found))
+	for i, f := range found {
+		keys[i] = types.ApiKeyView(f)
+	}
+	return keys, nil
+}
+
+type neo4jOAuthClient struct {
+	Id           string    `json:"c.id"`
+	Name         string    `json:"c.name"`
+	Owner        string    `json:"u.handle"`
+	RedirectUris []string  `json:"c.redirecturis"`
+	Created      time.Time `json:"c.created"`
+}
+
+func (q Neo4jQuery) GetOAuthClient(clientid string) (OAuthClientRecord, error) {
+	found := []neo4jOAuthClient{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)<-[:CLIENT_OF]-(c:OAuthClient)
+			WHERE   c.id = {clientid}
+			RETURN  c.id, c.name, u.handle, c.redirecturis, c.created
+		`,
+		Parameters: neoism.Props{
+			"clientid": clientid,
+		},
+		Result: &found,
+	}); err != nil {
+		return OAuthClientRecord{}, err
+	}
+	if len(found) == 0 {
+		return OAuthClientRecord{}, oauthClientNotFound(clientid)
+	}
+	return OAuthClientRecord(found[0]), nil
+}
+
+// Lists the clients handle registered, newest first
+func (q Neo4jQuery) GetOAuthClientsByHandle(handle string) ([]OAuthClientRecord, error) {
+	found := []neo4jOAuthClient{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)<-[:CLIENT_OF]-(c:OAuthClient)
+			WHERE   u.handle = {handle}
+			RETURN  c.id, c.name, u.handle, c.redirecturis, c.created
+			ORDER BY c.created DESC
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &found,
+	}); err != nil {
+		return nil, err
+	}
+	clients := make([]OAuthClientRecord, len(found))
+	for i, f := range found {
+		clients[i] = OAuthClientRecord(f)
+	}
+	return clients, nil
+}
+
+func (q Neo4jQuery) DeriveOAuthToken(tokenHash string) (handle string, scopes []string, err error) {
+	found := []struct {
+		Handle string   `json:"u.handle"`
+		Scopes []string `json:"t.scopes"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)<-[:GRANT_OF]-(t:OAuthToken)
+			WHERE   t.hash = {hash}
+			AND     {now}  < t.expires
+			RETURN  u.handle, t.scopes
+		`,
+		Parameters: neoism.Props{
+			"hash": tokenHash,
+			"now":  Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return "", nil, err
+	}
+	if len(found) == 0 {
+		return "", nil, oauthTokenNotFound()
+	}
+	return found[0].Handle, found[0].Scopes, nil
+}
+
+// Lists the live sessions of handle, marking the one tokenHash belongs to
+func (q Neo4jQuery) GetSessionsByHandle(handle, tokenHash string) ([]types.SessionView, error) {
+	found := []struct {
+		Id        string    `json:"a.id"`
+		Device    string    `json:"a.device"`
+		UserAgent string    `json:"a.useragent"`
+		Created   time.Time `json:"a.created"`
+		LastUsed  time.Time `json:"a.lastused"`
+		Expires   time.Time `json:"a.expires"`
+		Current   bool      `json:"current"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)<-[:SESSION_OF]-(a:AuthToken)
+			WHERE   u.handle = {handle}
+			AND     {now}    < a.expires
+			RETURN  a.id, a.device, a.useragent, a.created, a.lastused, a.expires,
+			        a.hash = {hash} AS current
+			ORDER BY a.lastused DESC
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"hash":   tokenHash,
+			"now":    Now(),
+		},
+		Result: &found,
+	}); err != nil {
+		return nil, err
+	}
+	sessions := make([]types.SessionView, len(found))
+	for i, f := range found {
+		sessions[i] = types.SessionView(f)
+	}
+	return sessions, nil
+}
+
+// Circles //
+
+func (q Neo4jQuery) SearchCircles(user string, before time.Time, limit int) ([]RawCircleView, error) {
+	found := make([]RawCircleView, 0)
+
+	props := neoism.Props{
+		"limit":  limit,
+		"before": before,
+	}
+	query := `
+        MATCH     (u:User)-[:MEMBER_OF|OWNS]->(c:Circle)
+        MATCH     (c)<-[:OWNS]-(owner:User)
+		WHERE     c.created < {before}
+	`
+	if user != "" {
+		query = query + `
+		AND       owner.handle  = {user}
+		`
+		props = neoism.Props{
+			"user":   user,
+			"limit":  limit,
+			"before": before,
+		}
+	}
+	query = query + `
+        OPTIONAL MATCH (c)-[partOf:PART_OF]->(pd:PublicDomain)
+		RETURN    c.name, c.id, c.description, c.created, owner.handle as ownerName, partOf
+        ORDER BY  c.created DESC
+        LIMIT     {limit}
+    `
+
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement:  query,
+		Parameters: props,
+		Result:     &found,
+	}); err != nil {
+		return []RawCircleView{}, err
+	}
+
+	return found, nil
+}
+
+func (q Neo4jQuery) GetCircleIdByName(handle, circleName string) (string, error) {
+	found := []struct {
+		Id string `json:"c.id"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (u:User)-[:OWNS]->(c:Circle)
+			WHERE   u.handle = {handle}
+			AND     c.name   = {circle}
+			RETURN  c.id
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"circle": circleName,
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", types.NotFound("circle_not_found", "No circle "+circleName+" owned by "+handle)
+	}
+	return found[0].Id, nil
+}
+
+func (q Neo4jQuery) GetCircleById(circleid string) (RawCircleView, error) {
+	found := []RawCircleView{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH           (owner:User)-[:OWNS]->(c:Circle)
+            WHERE           c.id = {id}
+            OPTIONAL MATCH  (c)-[partOf:PART_OF]->(pd:PublicDomain)
+            RETURN          c.name        AS name
+                          , c.id          AS id
+                          , c.description AS description
+                          , c.created     AS created
+                          , owner.handle  AS owner
+                          , partOf        AS public
+        `,
+		Parameters: neoism.Props{
+			"id": circleid,
+		},
+		Result: &found,
+	}); err != nil {
+		return RawCircleView{}, err
+	}
+	if len(found) == 0 {
+		return RawCircleView{}, circleNotFound(circleid)
+	}
+	return found[0], nil
+}
+
+func (q Neo4jQuery) GetPublicCirclesByHandle(handle string) (circles []RawCircleView, count int, err error) {
+	circles = make([]RawCircleView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH (t:User)-[:OWNS]-(c:Circle)-[partOf:PART_OF]->(pd:PublicDomain)
+            WHERE pd.iam = "PublicDomain"
+            AND   t.handle = {handle}
+            RETURN c.name AS name
+                 , c.id AS id
+                 , c.description AS description
+                 , t.handle AS owner
+                 , c.created AS created
+                 , partOf AS public
+
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &circles,
+	}); err != nil {
+		return []RawCircleView{}, 0, err
+	}
+	return circles, len(circles), nil
+}
+
+func (q Neo4jQuery) GetJoinedCirclesByHandle(handle string, before time.Time, limit int) (circles []RawCircleView, count int, err error) {
+	circles = make([]RawCircleView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH           (u:User)-[:MEMBER_OF|OWNS]->(c:Circle)
+            WHERE           u.handle      = {handle}
+            AND             c.created     < {before}
+            MATCH           (c)<-[:OWNS]-(owner:User)
+            OPTIONAL MATCH  (c)-[partOf:PART_OF]->(pd:PublicDomain)
+            RETURN          c.name        AS name
+                          , c.id          AS id
+                          , c.description AS description
+                          , c.created     AS created
+                          , owner.handle  AS owner
+                          , partOf        AS public
+            ORDER BY        c.created
+            LIMIT           {limit}
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"before": before,
+			"limit":  limit,
+		},
+		Result: &circles,
+	}); err != nil {
+		return []RawCircleView{}, 0, err
+	}
+	return circles, len(circles), nil
+}
+
+// Messages //
+
+func (q Neo4jQuery) GetAllMessagesByHandle(target string) ([]types.MessageView, error) {
+	messages := make([]types.MessageView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH     (t:User)-[:WROTE]->(m:Message)
+            WHERE     t.handle  = {target}
+            AND       t.deactivated IS NULL
+            RETURN    m.id      AS id
+                 ,    t.handle  AS author
+                 ,    m.content AS content
+                 ,    m.created AS created
+            ORDER BY  m.created DESC
+        `,
+		Parameters: neoism.Props{
+			"target": target,
+		},
+		Result: &messages,
+	}); err != nil {
+		return []types.MessageView{}, err
+	}
+	return messages, nil
+}
+
+func (q Neo4jQuery) GetPublicPublishedMessagesByAuthor(target string) ([]types.PublishedMessageView, error) {
+	messages := make([]types.PublishedMessageView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH (t:User)-[:WROTE]->(m:Message)-[p:PUB_TO]->(c:Circle)-[]->(pd:PublicDomain)
+			WHERE     t.handle       =  {target}
+			AND       t.deactivated  IS NULL
+			RETURN    m.id           AS id
+                 ,    t.handle       AS author
+                 ,    m.content      AS content
+                 ,    m.created      AS created
+                 ,    c.id           AS circleid
+                 ,    p.published_at AS published_at
+            ORDER BY  p.published_at
+		`,
+		Parameters: neoism.Props{
+			"target": target,
+		},
+		Result: &messages,
+	}); err != nil {
+		return []types.PublishedMessageView{}, err
+	}
+	return messages, nil
+}
+
+// Every publication of a message handle wrote, to any circle, oldest first
+func (q Neo4jQuery) GetPublicationsByAuthor(handle string) ([]types.PublishedMessageView, error) {
+	messages := make([]types.PublishedMessageView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH (t:User)-[:WROTE]->(m:Message)-[p:PUB_TO]->(c:Circle)
+			WHERE     t.handle       =  {handle}
+			RETURN    m.id           AS id
+                 ,    t.handle       AS author
+                 ,    m.content      AS content
+                 ,    m.created      AS created
+                 ,    c.id           AS circleid
+                 ,    p.published_at AS published_at
+            ORDER BY  p.published_at
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &messages,
+	}); err != nil {
+		return []types.PublishedMessageView{}, err
+	}
+	return messages, nil
+}
+
+func (q Neo4jQuery) GetMessagesByHandleInCircle(target, circleid string) ([]types.PublishedMessageView, error) {
+	return []types.PublishedMessageView{}, nil
+}
+
+func (q Neo4jQuery) GetMessageFeedOfCircle(circleid string) ([]types.PublishedMessageView, error) {
+	messages := []types.PublishedMessageView{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH     (c:Circle)<-[p:PUB_TO]-(m:Message)<-[:WROTE]-(a:User)
+			WHERE     c.id           =  {circleid}
+			AND       a.deactivated  IS NULL
+			RETURN    m.id           AS id
+                 ,    a.handle       AS author
+                 ,    m.content      AS content
+                 ,    m.created      AS created
+                 ,    c.id           AS circleid
+                 ,    p.published_at AS published_at
+            ORDER BY  p.published_at DESC
+		`,
+		Parameters: neoism.Props{
+			"circleid": circleid,
+		},
+		Result: &messages,
+	}); err != nil {
+		return []types.PublishedMessageView{}, err
+	}
+	return messages, nil
+}
+
+func (q Neo4jQuery) GetMessageFeedOfHandle(handle string) ([]types.PublishedMessageView, error) {
+	messages := []types.PublishedMessageView{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH (u:User)-[:MEMBER_OF|OWNS]->(c:Circle)<-[p:PUB_TO]-(m:Message)<-[:WROTE]-(a:User)
+			WHERE     u.handle       =  {handle}
+			AND       a.deactivated  IS NULL
+			OPTIONAL MATCH (u)-[mu:MUTED]->(a)
+			OPTIONAL MATCH (u)-[mc:MUTED]->(c)
+			WITH      m, a, c, p, mu, mc
+			WHERE     (mu IS NULL OR mu.until IS NOT NULL AND mu.until <= {now})
+			AND       (mc IS NULL OR mc.until IS NOT NULL AND mc.until <= {now})
+			RETURN    m.id           AS id
+                 ,    a.handle       AS author
+                 ,    m.content      AS content
+                 ,    m.created      AS created
+                 ,    c.id           AS circleid
+                 ,    p.published_at AS published_at
+            ORDER BY  p.published_at DESC
+		`,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"now":    Now(),
+		},
+		Result: &messages,
+	}); err != nil {
+		return []types.PublishedMessageView{}, err
+	}
+	return messages, nil
+}
+
+func (q Neo4jQuery) GetVisibleMessageById(handle, messageid string) (types.MessageView, error) {
+	messages := make([]types.MessageView, 0)
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+			MATCH   (t:User)-[:WROTE]->(m:Message)-[:PUB_TO]->(c:Circle)<-[:MEMBER_OF|OWNS]-(u:User)
+			WHERE   u.handle = {handle}
+            AND     m.id     = {messageid}
+            AND     t.deactivated IS NULL
+			RETURN  m.id      AS id
+                 ,  t.handle  AS author
+                 ,  m.content AS content
+                 ,  m.created AS created
+		`,
+		Parameters: neoism.Props{
+			"handle":    handle,
+			"messageid": messageid,
+		},
+		Result: &messages,
+	}); err != nil {
+		return types.MessageView{}, err
+	}
+	if len(messages) == 0 {
+		return types.MessageView{}, messageNotFound(messageid)
+	}
+	return messages[0], nil
+}
+
+func (q Neo4jQuery) GetMessageAuthor(messageid string) (string, error) {
+	found := []struct {
+		Author string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)-[:WROTE]->(m:Message)
+            WHERE   m.id = {messageid}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"messageid": messageid,
+		},
+		Result: &found,
+	}); err != nil {
+		return "", err
+	}
+	if len(found) == 0 {
+		return "", messageNotFound(messageid)
+	}
+	return found[0].Author, nil
+}
+
+//
+// Update
+//
+
+// Starts a new session for handle, leaving any others in place
+func (q Neo4jQuery) CreateAuthTokenForUser(handle string, session SessionRecord) error {
+	created := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	now := Now()
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+                MATCH   (u:User)
+                WHERE   u.handle     = {handle}
+                CREATE  (u)<-[r:SESSION_OF]-(a:AuthToken)
+                SET     r.created_at = {now}
+                SET     a.id         = {id}
+                SET     a.hash       = {hash}
+                SET     a.expires    = {expires}
+                SET     a.refreshhash    = {refreshhash}
+                SET     a.refreshexpires = {refreshexpires}
+                SET     a.spent      = []
+                SET     a.created    = {now}
+                SET     a.lastused   = {now}
+                SET     a.device     = {device}
+                SET     a.useragent  = {useragent}
+                RETURN  u.handle
+            `,
+		Parameters: neoism.Props{
+			"handle":         handle,
+			"id":             NewUUID(),
+			"hash":           session.TokenHash,
+			"expires":        session.Expires,
+			"refreshhash":    session.RefreshHash,
+			"refreshexpires": session.RefreshExpires,
+			"now":            now,
+			"device":         session.Device,
+			"useragent":      session.UserAgent,
+		},
+		Result: &created,
+	}); err != nil {
+		return err
+	}
+	if len(created) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+// Moves the session holding the live refreshHash on to the hashes and
+// expiries of next, returning whose session it is. Spent refresh hashes
+// are remembered, presenting one again revokes the session it belonged to.
+func (q Neo4jQuery) RotateAuthToken(refreshHash string, next SessionRecord) (handle string, err error) {
+	rotated := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	now := Now()
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[:SESSION_OF]-(a:AuthToken)
+            WHERE   a.refreshhash = {refreshhash}
+            AND     {now}     < a.refreshexpires
+            SET     a.spent   = a.spent + a.refreshhash
+            SET     a.hash    = {hash}
+            SET     a.expires = {expires}
+            SET     a.refreshhash    = {newrefreshhash}
+            SET     a.refreshexpires = {refreshexpires}
+            SET     a.lastused = {now}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"refreshhash":    refreshHash,
+			"now":            now,
+			"hash":           next.TokenHash,
+			"expires":        next.Expires,
+			"newrefreshhash": next.RefreshHash,
+			"refreshexpires": next.RefreshExpires,
+		},
+		Result: &rotated,
+	}); err != nil {
+		return "", err
+	}
+	if len(rotated) > 0 {
+		return rotated[0].Handle, nil
+	}
+
+	revoked := []struct {
+		Count int `json:"count(a)"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (a:AuthToken)-[so:SESSION_OF]->(:User)
+            WHERE   {refreshhash} IN a.spent
+            DELETE  so, a
+            RETURN  count(a)
+        `,
+		Parameters: neoism.Props{
+			"refreshhash": refreshHash,
+		},
+		Result: &revoked,
+	}); err != nil {
+		return "", err
+	}
+	if len(revoked) > 0 && revoked[0].Count > 0 {
+		return "", refreshTokenReused()
+	}
+	return "", tokenNotFound()
+}
+
+// Records that the token was just used, at most once per SESSION_TOUCH_INTERVAL.
+// A non-zero slideTo also moves the expiry of the token forward to it.
+func (q Neo4jQuery) UpdateSessionLastUsed(tokenHash string, slideTo time.Time) error {
+	now := Now()
+	return q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (a:AuthToken)
+            WHERE   a.hash    = {hash}
+            AND     a.lastused < {stale}
+            SET     a.lastused = {now}
+            SET     a.expires  = CASE WHEN {slide} AND a.expires < {slideto}
+                                      THEN {slideto} ELSE a.expires END
+        `,
+		Parameters: neoism.Props{
+			"hash":    tokenHash,
+			"stale":   now.Add(-SESSION_TOUCH_INTERVAL),
+			"now":     now,
+			"slide":   !slideTo.IsZero(),
+			"slideto": slideTo,
+		},
+	})
+}
+
+// Records that the key was just used, at most once per SESSION_TOUCH_INTERVAL
+func (q Neo4jQuery) UpdateApiKeyLastUsed(keyHash string) error {
+	now := Now()
+	return q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (k:ApiKey)
+            WHERE   k.hash = {hash}
+            AND     (k.lastused IS NULL OR k.lastused < {stale})
+            SET     k.lastused = {now}
+        `,
+		Parameters: neoism.Props{
+			"hash":  keyHash,
+			"stale": now.Add(-SESSION_TOUCH_INTERVAL),
+			"now":   now,
+		},
+	})
+}
+
+func (q Neo4jQuery) UpdatePassword(handle, newPasswordHash string) error {
+	updated := []struct {
+		Password string `json:"u.password"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle   = {handle}
+            SET     u.password = {new_pass}
+            RETURN  u.password
+        `,
+		Parameters: neoism.Props{
+			"handle":   handle,
+			"new_pass": newPasswordHash,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) SetEmailVerified(handle string) error {
+	updated := []struct {
+		Verified bool `json:"u.verified"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle   = {handle}
+            SET     u.verified = true
+            RETURN  u.verified
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) SetTotp(handle string, totp TotpRecord) error {
+	if totp.RecoveryHashes == nil {
+		totp.RecoveryHashes = []string{}
+	}
+	updated := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle       = {handle}
+            SET     u.totpsecret   = {secret}
+            SET     u.totpenabled  = {enabled}
+            SET     u.totprecovery = {recovery}
+            SET     u.totplaststep = {laststep}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":   handle,
+			"secret":   totp.Secret,
+			"enabled":  totp.Enabled,
+			"recovery": totp.RecoveryHashes,
+			"laststep": totp.LastStep,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+// The WHERE on the old value makes the check and the update one step, so
+// two logins racing with the same code cannot both pass
+func (q Neo4jQuery) ConsumeTotpStep(handle string, step int64) error {
+	updated := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+              AND   coalesce(u.totplaststep, 0) < {step}
+            SET     u.totplaststep = {step}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"step":   step,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return secondFactorUsed()
+	}
+	return nil
+}
+
+func (q Neo4jQuery) ConsumeRecoveryHash(handle, hash string) error {
+	updated := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+              AND   {hash} IN coalesce(u.totprecovery, [])
+            SET     u.totprecovery = [h IN u.totprecovery WHERE h <> {hash}]
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"hash":   hash,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return secondFactorUsed()
+	}
+	return nil
+}
+
+func (q Neo4jQuery) SetUserRole(handle, role string) error {
+	updated := []struct {
+		Role string `json:"u.role"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            SET     u.role   = {role}
+            RETURN  u.role
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"role":   role,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) SetUserSuspended(handle string, suspended bool) error {
+	updated := []struct {
+		Suspended bool `json:"u.suspended"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle    = {handle}
+            SET     u.suspended = {suspended}
+            RETURN  u.suspended
+        `,
+		Parameters: neoism.Props{
+			"handle":    handle,
+			"suspended": suspended,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+// A zero at reactivates the user
+func (q Neo4jQuery) SetUserDeactivated(handle string, at time.Time) error {
+	var deactivated interface{}
+	if !at.IsZero() {
+		deactivated = at
+	}
+	updated := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle      = {handle}
+            SET     u.deactivated = {deactivated}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":      handle,
+			"deactivated": deactivated,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) SetUserAvatar(handle, avatarid string) error {
+	var avatar interface{}
+	if avatarid != "" {
+		avatar = avatarid
+	}
+	updated := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            SET     u.avatar = {avatar}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"avatar": avatar,
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+// Relationships follow the node, only the handle itself and the
+// reservations change
+func (q Neo4jQuery) RenameUser(handle, newHandle string, reservedUntil time.Time) error {
+	if holder, err := q.GetUserHandle(newHandle); err == nil && holder != handle {
+		return types.Conflict("handle_taken", "Sorry, "+newHandle+" is already taken")
+	} else if err != nil && !types.IsNotFound(err) {
+		return err
+	}
+	if holder, err := q.GetHandleRenamedFrom(newHandle); err == nil && holder != handle {
+		return types.Conflict("handle_taken", "Sorry, "+newHandle+" is already taken")
+	} else if err != nil && !types.IsNotFound(err) {
+		return err
+	}
+
+	renamed := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            OPTIONAL MATCH (f:FormerHandle)-[fr:FORMER_HANDLE_OF]->(:User)
+            WHERE   f.handlekey = {newkey}
+            DELETE  f, fr
+            WITH    DISTINCT u
+            SET     u.handle    = {newhandle}
+                  , u.handlekey = {newkey}
+                  , u.skeleton  = {newskeleton}
+                  , u.renamed   = {now}
+            CREATE  (:FormerHandle {
+                        handle:    {handle},
+                        handlekey: {key},
+                        skeleton:  {skeleton},
+                        until:     {until}
+                    })-[:FORMER_HANDLE_OF]->(u)
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":      handle,
+			"key":         types.HandleKey(handle),
+			"skeleton":    types.HandleSkeleton(handle),
+			"newhandle":   newHandle,
+			"newkey":      types.HandleKey(newHandle),
+			"newskeleton": types.HandleSkeleton(newHandle),
+			"now":         Now(),
+			"until":       reservedUntil,
+		},
+		Result: &renamed,
+	}); err != nil {
+		return err
+	}
+	if len(renamed) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) SetProfileVisibility(handle string, visibility map[string]string) error {
+	encoded, err := json.Marshal(visibility)
+	if err != nil {
+		return types.WrapError(types.INTERNAL, "internal_error", "Unexpected failure to encode profile visibility", err)
+	}
+	updated := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle     = {handle}
+            SET     u.visibility = {visibility}
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":     handle,
+			"visibility": string(encoded),
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) SetGetUserName(handle, newName string) (string, error) {
+	updated := []struct {
+		Name string `json:"u.name"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            SET     u.name   = {name}
+            RETURN  u.name
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"name":   newName,
+		},
+		Result: &updated,
+	}); err != nil {
+		return "", err
+	}
+	if len(updated) == 0 {
+		return "", userNotFound(handle)
+	}
+	return updated[0].Name, nil
+}
+
+func (q Neo4jQuery) UpdateMessageContent(messageid, newContent string) error {
+	updated := []struct {
+		Content string
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (m:Message)
+            WHERE   m.id        = {messageid}
+            SET     m.content   = {content}
+            SET     m.lastsaved = {now}
+            RETURN  m.content
+        `,
+		Parameters: neoism.Props{
+			"messageid": messageid,
+			"content":   newContent,
+			"now":       Now(),
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return messageNotFound(messageid)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) UpdateCircle(circleid, name, description string) (RawCircleView, error) {
+	updated := []RawCircleView{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH           (owner:User)-[:OWNS]->(c:Circle)
+            WHERE           c.id          = {id}
+            SET             c.name        = {name}
+            SET             c.description = {description}
+            WITH            owner, c
+            OPTIONAL MATCH  (c)-[partOf:PART_OF]->(pd:PublicDomain)
+            RETURN          c.name        AS name
+                          , c.id          AS id
+                          , c.description AS description
+                          , c.created     AS created
+                          , owner.handle  AS owner
+                          , partOf        AS public
+        `,
+		Parameters: neoism.Props{
+			"id":          circleid,
+			"name":        name,
+			"description": description,
+		},
+		Result: &updated,
+	}); err != nil {
+		return RawCircleView{}, err
+	}
+	if len(updated) == 0 {
+		return RawCircleView{}, circleNotFound(circleid)
+	}
+	return updated[0], nil
+}
+
+func (q Neo4jQuery) UpdateUserAttribute(handle, resource, value string) error {
+	updated := []struct {
+		User string `json:"u.handle"`
+	}{}
+
+	// Setting a property to null removes it
+	changes := types.Json{
+		resource: nil,
+	}
+	if value != "" {
+		changes[resource] = value
+	}
+	query := `
+        MATCH   (u:User)
+        WHERE   u.handle      =  {handle}
+        SET     u.lastupdated =  {now}
+        SET     u             += {changes}
+        RETURN  u.handle`
+
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: query,
+		Parameters: neoism.Props{
+			"handle":  handle,
+			"changes": changes,
+			"now":     Now(),
+		},
+		Result: &updated,
+	}); err != nil {
+		return err
+	}
+	if len(updated) == 0 {
+		return userNotFound(handle)
+	}
+	return nil
+}
+
+//
+// Delete
+//
+
+func (q Neo4jQuery) DeleteAllNodesAndRelations() error {
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH           (n)
+            OPTIONAL MATCH  (n)-[r]-()
+            DELETE          n, r
+        `,
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (q Neo4jQuery) DisconnectTargetFromAllHeldCircles(handle, target string) error {
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)
+            WHERE   u.handle = {handle}
+            MATCH   (t:User)
+            WHERE   t.handle = {target}
+            OPTIONAL MATCH (u)-[:OWNS]->(c:Circle)
+            OPTIONAL MATCH (t)-[r:MEMBER_OF]->(c)
+            DELETE  r
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+		},
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (q Neo4jQuery) DeleteBlockRelationFromTo(handle, target string) error {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User), (t:User)
+            WHERE   u.handle = {handle}
+            AND     t.handle = {target}
+            OPTIONAL MATCH (u)-[b:BLOCKED]->(t)
+            DELETE  b
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+		},
+		Result: &found,
+	}); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return usersNotFound(handle, target)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) DeleteMuteRelationFromTo(handle, target string) error {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User), (t:User)
+            WHERE   u.handle = {handle}
+            AND     t.handle = {target}
+            OPTIONAL MATCH (u)-[m:MUTED]->(t)
+            DELETE  m
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"target": target,
+		},
+		Result: &found,
+	}); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return usersNotFound(handle, target)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) DeleteMuteRelationToCircle(handle, circleid string) error {
+	found := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User), (c:Circle)
+            WHERE   u.handle = {handle}
+            AND     c.id     = {circleid}
+            OPTIONAL MATCH (u)-[m:MUTED]->(c)
+            DELETE  m
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":   handle,
+			"circleid": circleid,
+		},
+		Result: &found,
+	}); err != nil {
+		return err
+	}
+	if len(found) == 0 {
+		return userOrCircleNotFound(handle, circleid)
+	}
+	return nil
+}
+
+// Every clause is optional, users are deleted whatever they have. The
+// counts are carried along from one step to the next.
+func (q Neo4jQuery) DeleteUser(handle string) (types.DeletionSummary, error) {
+	deleted := []struct {
+		Sessions     int `json:"sessions"`
+		Messages     int `json:"messages"`
+		Publications int `json:"publications"`
+		Memberships  int `json:"memberships"`
+		Blocks       int `json:"blocks"`
+		Circles      int `json:"circles"`
+		CirclePubs   int `json:"circlepubs"`
+		Count        int `json:"count"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+                MATCH   (u:User)
+                WHERE   u.handle = {handle}
+                WITH    u
+                OPTIONAL MATCH (a:AuthToken)-[r:SESSION_OF]->(u)
+                DELETE  a, r
+                WITH    u, count(DISTINCT a) AS sessions
+                OPTIONAL MATCH (p:PasswordReset)-[rr:RESET_OF]->(u)
+                DELETE  p, rr
+                WITH    u, sessions
+                OPTIONAL MATCH (lc:LoginChallenge)-[cr:CHALLENGE_OF]->(u)
+                DELETE  lc, cr
+                WITH    u, sessions
+                OPTIONAL MATCH (k:ApiKey)-[kr:KEY_OF]->(u)
+                DELETE  k, kr
+                WITH    u, sessions
+                OPTIONAL MATCH (x)-[xr:CODE_OF|GRANT_OF]->(u)
+                DELETE  x, xr
+                WITH    u, sessions
+                OPTIONAL MATCH (oc:OAuthClient)-[ocr:CLIENT_OF]->(u)
+                OPTIONAL MATCH (g)-[gr:CODE_OF|GRANT_OF]->(:User)
+                WHERE   g.client = oc.id
+                DELETE  g, gr
+                WITH    u, sessions, oc, ocr
+                DELETE  oc, ocr
+                WITH    DISTINCT u, sessions
+                OPTIONAL MATCH (u)-[:WROTE]->(:Message)-[pt:PUB_TO]->(:Circle)
+                DELETE  pt
+                WITH    u, sessions, count(pt) AS publications
+                OPTIONAL MATCH (u)-[wr:WROTE]->(m:Message)
+                DELETE  wr, m
+                WITH    u, sessions, publications, count(m) AS messages
+                OPTIONAL MATCH (u)-[mo:MEMBER_OF]->(:Circle)
+                DELETE  mo
+                WITH    u, sessions, publications, messages, count(mo) AS memberships
+                OPTIONAL MATCH (u)-[b:BLOCKED]-(:User)
+                DELETE  b
+                WITH    u, sessions, publications, messages, memberships, count(b) AS blocks
+                OPTIONAL MATCH (u)-[:OWNS]->(c:Circle)
+                OPTIONAL MATCH (c)-[cr]-()
+                WITH    u, sessions, publications, messages, memberships, blocks, c,
+                        collect(cr) AS rels,
+                        sum(CASE WHEN type(cr) = 'PUB_TO' THEN 1 ELSE 0 END) AS pubs
+                FOREACH (r IN rels | DELETE r)
+                DELETE  c
+                WITH    u, sessions, publications, messages, memberships, blocks,
+                        count(c) AS circles, sum(pubs) AS circlepubs
+                OPTIONAL MATCH (f:FormerHandle)-[fr:FORMER_HANDLE_OF]->(u)
+                DELETE  f, fr
+                WITH    DISTINCT u, sessions, publications, messages, memberships, blocks,
+                        circles, circlepubs
+                OPTIONAL MATCH (u)-[ur]-()
+                DELETE  ur, u
+                RETURN  sessions, messages, publications, memberships, blocks,
+                        circles, circlepubs, count(DISTINCT u) AS count
+            `,
+		Parameters: neoism.Props{
+			"handle": handle,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return types.DeletionSummary{}, err
+	}
+	if len(deleted) == 0 || deleted[0].Count == 0 {
+		return types.DeletionSummary{}, userNotFound(handle)
+	}
+	d := deleted[0]
+	return types.DeletionSummary{
+		Handle:       handle,
+		Sessions:     d.Sessions,
+		Messages:     d.Messages,
+		Publications: d.Publications + d.CirclePubs,
+		Memberships:  d.Memberships,
+		Blocks:       d.Blocks,
+		Circles:      d.Circles,
+	}, nil
+}
+
+func (q Neo4jQuery) DeletePublishedRelation(messageid, circleid string) error {
+	deleted := []struct {
+		Count int `json:"count(r)"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (m:Message)-[r:PUB_TO]->(c:Circle)
+            WHERE   m.id = {messageid}
+            AND     c.id = {circleid}
+            DELETE  r
+            RETURN  count(r)
+        `,
+		Parameters: neoism.Props{
+			"messageid": messageid,
+			"circleid":  circleid,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 || deleted[0].Count == 0 {
+		return publicationNotFound(messageid, circleid)
+	}
+	return nil
+}
+
+// Deletes the circle along with its members and publications, the
+// messages published to it stay
+func (q Neo4jQuery) DeleteCircle(circleid string) error {
+	deleted := []struct {
+		Count int `json:"count(DISTINCT c)"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (c:Circle)
+            WHERE   c.id = {id}
+            OPTIONAL MATCH (c)-[r]-()
+            DELETE  r, c
+            RETURN  count(DISTINCT c)
+        `,
+		Parameters: neoism.Props{
+			"id": circleid,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 || deleted[0].Count == 0 {
+		return circleNotFound(circleid)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) DeleteMessage(messageid string) error {
+	deleted := []struct {
+		Count int `json:"count(DISTINCT m)"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (m:Message)
+            WHERE   m.id = {id}
+            OPTIONAL MATCH (m)-[r]-()
+            DELETE  r, m
+            RETURN  count(DISTINCT m)
+        `,
+		Parameters: neoism.Props{
+			"id": messageid,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 || deleted[0].Count == 0 {
+		return messageNotFound(messageid)
+	}
+	return nil
+}
+
+func (q Neo4jQuery) DestroyAuthToken(tokenHash string) error {
+	deleted := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[so:SESSION_OF]-(a:AuthToken)
+            WHERE   a.hash = {hash}
+            DELETE  so, a
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"hash": tokenHash,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return tokenNotFound()
+	}
+	return nil
+}
+
+// AuthTokens from before tokens were hashed at rest hold their token in
+// plaintext, and are logged out rather than trusted
+func (q Neo4jQuery) DestroyPlaintextAuthTokens() error {
+	return q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (a:AuthToken)-[so:SESSION_OF]->(:User)
+            WHERE   a.hash IS NULL
+            DELETE  so, a
+        `,
+	})
+}
+
+func (q Neo4jQuery) DestroySessionById(handle, sessionid string) error {
+	deleted := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[so:SESSION_OF]-(a:AuthToken)
+            WHERE   u.handle = {handle}
+            AND     a.id     = {sessionid}
+            DELETE  so, a
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":    handle,
+			"sessionid": sessionid,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return sessionNotFound(sessionid)
+	}
+	return nil
+}
+
+// Revokes every session of handle other than the one tokenHash belongs to
+func (q Neo4jQuery) DestroySessionsExcept(handle, tokenHash string) (count int, err error) {
+	deleted := []struct {
+		Count int `json:"count(a)"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[so:SESSION_OF]-(a:AuthToken)
+            WHERE   u.handle = {handle}
+            AND     a.hash <> {hash}
+            DELETE  so, a
+            RETURN  count(a)
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"hash":   tokenHash,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return 0, err
+	}
+	if len(deleted) == 0 {
+		return 0, nil
+	}
+	return deleted[0].Count, nil
+}
+
+// Deletes the reset token, answering whose it was if it had not expired
+func (q Neo4jQuery) ConsumePasswordResetToken(tokenHash string) (handle string, err error) {
+	consumed := []struct {
+		Handle  string    `json:"u.handle"`
+		Expires time.Time `json:"expires"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[r:RESET_OF]-(p:PasswordReset)
+            WHERE   p.hash = {hash}
+            WITH    u, r, p, p.expires AS expires
+            DELETE  r, p
+            RETURN  u.handle, expires
+        `,
+		Parameters: neoism.Props{
+			"hash": tokenHash,
+		},
+		Result: &consumed,
+	}); err != nil {
+		return "", err
+	}
+	if len(consumed) == 0 || !Now().Before(consumed[0].Expires) {
+		return "", resetTokenNotFound()
+	}
+	return consumed[0].Handle, nil
+}
+
+func (q Neo4jQuery) DestroyLoginChallenge(tokenHash string) error {
+	deleted := []struct {
+		Count int `json:"count(c)"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (:User)<-[r:CHALLENGE_OF]-(c:LoginChallenge)
+            WHERE   c.hash = {hash}
+            DELETE  r, c
+            RETURN  count(c)
+        `,
+		Parameters: neoism.Props{
+			"hash": tokenHash,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 || deleted[0].Count == 0 {
+		return challengeNotFound()
+	}
+	return nil
+}
+
+func (q Neo4jQuery) DestroyApiKey(handle, keyid string) error {
+	deleted := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[r:KEY_OF]-(k:ApiKey)
+            WHERE   u.handle = {handle}
+            AND     k.id     = {keyid}
+            DELETE  r, k
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle": handle,
+			"keyid":  keyid,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return apiKeyNotFound()
+	}
+	return nil
+}
+
+// Unregisters the client along with every code and token granted to it
+func (q Neo4jQuery) DestroyOAuthClient(handle, clientid string) error {
+	deleted := []struct {
+		Handle string `json:"u.handle"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[r:CLIENT_OF]-(c:OAuthClient)
+            WHERE   u.handle = {handle}
+            AND     c.id     = {clientid}
+            OPTIONAL MATCH (g)-[gr:CODE_OF|GRANT_OF]->(:User)
+            WHERE   g.client = c.id
+            DELETE  g, gr
+            WITH    u, r, c
+            DELETE  r, c
+            RETURN  u.handle
+        `,
+		Parameters: neoism.Props{
+			"handle":   handle,
+			"clientid": clientid,
+		},
+		Result: &deleted,
+	}); err != nil {
+		return err
+	}
+	if len(deleted) == 0 {
+		return oauthClientNotFound(clientid)
+	}
+	return nil
+}
+
+// Deletes the code, answering who granted it and what if it had not expired
+func (q Neo4jQuery) ConsumeOAuthCode(codeHash string) (handle string, code OAuthCodeRecord, err error) {
+	consumed := []struct {
+		Handle      string    `json:"u.handle"`
+		ClientId    string    `json:"client"`
+		RedirectUri string    `json:"redirecturi"`
+		Scopes      []string  `json:"scopes"`
+		Challenge   string    `json:"challenge"`
+		Expires     time.Time `json:"expires"`
+	}{}
+	if err := q.cypher(&neoism.CypherQuery{
+		Statement: `
+            MATCH   (u:User)<-[r:CODE_OF]-(x:OAuthCode)
+            WHERE   x.hash = {hash}
+            WITH    u, r, x, x.client AS client, x.redirecturi AS redirecturi,
+                    x.scopes AS scopes, x.challenge AS challenge, x.expires AS expires
+            DELETE  r, x
+            RETURN  u.handle, client, redirecturi, scopes, challenge, expires
+        `,
+		Parameters: neoism.Props{
+			"hash": codeHash,
+		},
+		Result: &consumed,
+	}); err != nil {
+		return "", OAuthCodeRecord{}, err
+	}
+	if len(consumed) == 0 || !Now().Before(consumed[0].Expires) {
+		return "", OAuthCodeRecord{}, oauthCodeNotFound()
+	}
+	f := consumed[0]
+	return f.Handle, OAuthCodeRecord{
+		CodeHash:    codeHash,
+		ClientId:    f.ClientId,
+		RedirectUri: f.RedirectUri,
+		Scopes:      f.Scopes,
+		Challenge:   f.Challenge,
+		Expires:     f.Expires,
+	}, nil
+}
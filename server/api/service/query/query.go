@@ -2,55 +2,151 @@ package query
 
 import (
 	"../../../types"
-	"encoding/json"
-	"fmt"
 	"github.com/dchest/uniuri"
 	"github.com/jmcvetta/neoism"
 	"time"
 )
 
-type Query struct {
-	Db *neoism.Database
-}
-
 //
-// Initialization
+// Storage Interface
 //
 
-// Constructor, use this when creating a new Query struct.
-func NewQuery(uri string) *Query {
-	neo4jdb, err := neoism.Connect(uri)
-	panicIfErr(err)
-
-	query := Query{neo4jdb}
-	query.DatabaseInit()
-
-	return &query
-}
-
-// Initializes the Neo4j Database
-func (q Query) DatabaseInit() {
-	if publicDomain := q.CreateUniquePublicDomain(); publicDomain == nil {
-		fmt.Println("Unexpected database state, possible lack of PublicDomain")
-	}
-}
-
+// Query is the storage layer of the service: every read and write of the
+// graph of users, circles, messages and the sessions, keys, grants and
+// events around them goes through one of these methods. Neo4jQuery is the
+// production implementation; MemoryQuery keeps the same graph in process
+// memory and BoltQuery writes it through to a file.
 //
-// Private Utilities
+// Tokens never reach the store, only the hashes the service made of them.
+// Handles are kept as spelled but compared by types.HandleKey wherever the
+// store looks for one that is taken, reserved former handles included.
+// Deactivated users and mutes that ended are left out as if gone.
 //
-
-// Preforms a Cypher query, catching any unexpected behavior in a panic.
-// It is ok to panic in this case as a panic at the db query level almost
-// always indicates an incorrectly constructed query.
-func (q Query) cypherOrPanic(query *neoism.CypherQuery) {
-	panicIfErr(q.Db.Cypher(query))
-}
-
-// Asserts that err is non-nil then panics if so
-func panicIfErr(err error) {
-	if err != nil {
-		panic(err)
-	}
+// Failures are reported as *types.Error: NOT_FOUND when a node the call
+// depends on is missing, CONFLICT when a unique property is taken, and
+// UNAVAILABLE or INTERNAL when the store itself fails. Checks answer
+// false rather than NOT_FOUND.
+type Query interface {
+	// Initialization
+	DatabaseInit() error
+
+	// Create
+	CreateUser(handle, email, passwordHash string) error
+	CreateDefaultCirclesForUser(handle string) error
+	CreateCircle(handle, circleName string, isPublic bool) (RawCircleView, error)
+	CreateMessage(handle, content string) (types.MessageView, error)
+	CreatePublishedRelation(messageid, circleid string) error
+	CreateMemberOfRelation(handle, circleid string) error
+	JoinBroadcastCircleOfUser(handle, target string) error
+	CreateBlockRelationFromTo(handle, target string) error
+	CreateMuteRelationFromTo(handle, target string, until time.Time) error
+	CreateMuteRelationToCircle(handle, circleid string, until time.Time) error
+	CreatePasswordResetToken(handle, tokenHash string, expires time.Time) error
+	CreateLockoutEvent(event types.LockoutEvent) error
+	CreateLoginChallenge(handle string, challenge ChallengeRecord) error
+	CreateApiKey(handle string, key ApiKeyRecord) error
+	CreateOAuthClient(handle string, client OAuthClientRecord) error
+	CreateOAuthCode(handle string, code OAuthCodeRecord) error
+	CreateOAuthToken(handle string, token OAuthTokenRecord) error
+
+	// Checks
+	UserExistsByHandle(handle string) (bool, error)
+	CircleLinkedToPublicDomain(circleid string) (bool, error)
+	UserPartOfCircle(handle, circleid string) (bool, error)
+	MessageIsPublished(handle, messageid, circleid string) (bool, error)
+	GetMessageById(messageid string) (bool, error)
+	HandleExists(handle string) (bool, error)
+	EmailExists(email string) (bool, error)
+	AuthTokenBelongsToSomeUser(tokenHash string) (bool, error)
+	BlockExistsFromTo(handle, target string) (bool, error)
+	NoBlockingRelationshipBetween(handle, target string) (bool, error)
+	UserIsSuspended(handle string) (bool, error)
+	GetUserDeactivation(handle string) (time.Time, error)
+	GetUserAvatar(handle string) (string, error)
+	GetProfileVisibility(handle string) (map[string]string, error)
+	GetUserRenamed(handle string) (time.Time, error)
+
+	// Users
+	SearchForUsers(circle, namePrefix string, skip, limit int, sortBy string, descending bool) (users []types.UserSearchView, total int, err error)
+	GetPasswordHash(handle string) ([]byte, error)
+	GetHandleByEmail(email string) (string, error)
+	GetEmailVerification(handle string) (email string, verified bool, err error)
+	GetUserRole(handle string) (string, error)
+	SearchAccounts(prefix string, skip, limit int) (accounts []types.AccountView, total int, err error)
+	GetUsersDeactivatedBefore(cutoff time.Time) ([]string, error)
+	GetVisibleUserByHandle(handle, target string) (types.UserView, error)
+	GetHandleRenamedFrom(former string) (string, error)
+	GetUserHandle(handle string) (string, error)
+	GetConfusableHandle(handle string) (string, error)
+	GetBlockedUsers(handle string, skip, limit int) (users []types.UserSearchView, total int, err error)
+	GetMutes(handle string) ([]types.MuteView, error)
+	DeriveHandleFromAuthToken(tokenHash string) (string, error)
+	GetSessionsByHandle(handle, tokenHash string) ([]types.SessionView, error)
+	GetLockoutEvents(limit int) ([]types.LockoutEvent, error)
+	GetTotp(handle string) (TotpRecord, error)
+	GetLoginChallenge(tokenHash string) (handle string, challenge ChallengeRecord, err error)
+	DeriveApiKey(keyHash string) (handle string, scopes []string, err error)
+	GetApiKeysByHandle(handle string) ([]types.ApiKeyView, error)
+	GetOAuthClient(clientid string) (OAuthClientRecord, error)
+	GetOAuthClientsByHandle(handle string) ([]OAuthClientRecord, error)
+	DeriveOAuthToken(tokenHash string) (handle string, scopes []string, err error)
+
+	// Circles
+	SearchCircles(user string, before time.Time, limit int) ([]RawCircleView, error)
+	GetCircleIdByName(handle, circleName string) (string, error)
+	GetCircleById(circleid string) (RawCircleView, error)
+	GetPublicCirclesByHandle(handle string) (circles []RawCircleView, count int, err error)
+	GetJoinedCirclesByHandle(handle string, before time.Time, limit int) (circles []RawCircleView, count int, err error)
+
+	// Messages
+	GetAllMessagesByHandle(target string) ([]types.MessageView, error)
+	GetPublicPublishedMessagesByAuthor(target string) ([]types.PublishedMessageView, error)
+	GetPublicationsByAuthor(handle string) ([]types.PublishedMessageView, error)
+	GetMessagesByHandleInCircle(target, circleid string) ([]types.PublishedMessageView, error)
+	GetMessageFeedOfCircle(circleid string) ([]types.PublishedMessageView, error)
+	GetMessageFeedOfHandle(handle string) ([]types.PublishedMessageView, error)
+	GetVisibleMessageById(handle, messageid string) (types.MessageView, error)
+	GetMessageAuthor(messageid string) (string, error)
+
+	// Update
+	CreateAuthTokenForUser(handle string, session SessionRecord) error
+	RotateAuthToken(refreshHash string, next SessionRecord) (handle string, err error)
+	UpdateSessionLastUsed(tokenHash string, slideTo time.Time) error
+	UpdateApiKeyLastUsed(keyHash string) error
+	UpdatePassword(handle, newPasswordHash string) error
+	SetEmailVerified(handle string) error
+	SetTotp(handle string, totp TotpRecord) error
+	ConsumeTotpStep(handle string, step int64) error
+	ConsumeRecoveryHash(handle, hash string) error
+	SetUserRole(handle, role string) error
+	SetUserSuspended(handle string, suspended bool) error
+	SetUserDeactivated(handle string, at time.Time) error
+	SetUserAvatar(handle, avatarid string) error
+	SetProfileVisibility(handle string, visibility map[string]string) error
+	RenameUser(handle, newHandle string, reservedUntil time.Time) error
+	SetGetUserName(handle, newName string) (string, error)
+	UpdateMessageContent(messageid, newContent string) error
+	UpdateCircle(circleid, name, description string) (RawCircleView, error)
+	UpdateUserAttribute(handle, resource, value string) error
+
+	// Delete
+	DeleteAllNodesAndRelations() error
+	DisconnectTargetFromAllHeldCircles(handle, target string) error
+	DeleteBlockRelationFromTo(handle, target string) error
+	DeleteMuteRelationFromTo(handle, target string) error
+	DeleteMuteRelationToCircle(handle, circleid string) error
+	DeleteUser(handle string) (types.DeletionSummary, error)
+	DeletePublishedRelation(messageid, circleid string) error
+	DeleteCircle(circleid string) error
+	DeleteMessage(messageid string) error
+	DestroyAuthToken(tokenHash string) error
+	DestroySessionById(handle, sessionid string) error
+	DestroySessionsExcept(handle, tokenHash string) (count int, err error)
+	ConsumePasswordResetToken(tokenHash string) (handle string, err error)
+	DestroyLoginChallenge(tokenHash string) error
+	DestroyApiKey(handle, keyid string) error
+	DestroyOAuthClient(handle, clientid string) error
+	ConsumeOAuthCode(codeHash string) (handle string, code OAuthCodeRecord, err error)
 }
 
 //
@@ -65,1109 +161,189 @@ func NewUUID() string {
 	return uniuri.NewLen(uniuri.UUIDLen)
 }
 
-// Constants //
-const (
-	AUTH_TOKEN_DURATION = time.Hour
-)
-
-// Return types //
-
-type RawCircleView struct {
-	Name        string               `json:"name"`
-	Id          string               `json:"id"`
-	Description string               `json:"description"`
-	Created     time.Time            `json:"created"`
-	Owner       string               `json:"owner"`
-	Public      *neoism.Relationship `json:"public"`
-}
-
-//
-// Create
-//
-
-func (q Query) CreateUniquePublicDomain() *neoism.Node {
-	// Initialize PublicDomain node
-	// Nodes must have at least one property to allow unique creation
-	if pd, _, err := q.Db.GetOrCreateNode("PublicDomain", "iam", neoism.Props{
-		"iam": "PublicDomain",
-	}); err != nil {
-		panic(err)
-	} else {
-		// Label (has to be) added separately
-		panicIfErr(pd.AddLabel("PublicDomain"))
-		return pd
-	}
-}
-
-func (q Query) CreateUser(handle, email, passwordHash string) bool {
-	newUser := []struct {
-		Handle string    `json:"u.handle"`
-		Email  string    `json:"u.email"`
-		Joined time.Time `json:"u.joined"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            CREATE (u:User {
-                handle:   {handle},
-                name:     "",
-                email:    {email},
-                password: {password},
-                joined:   {joined}
-            })
-            RETURN u.handle, u.email, u.joined
-        `,
-		Parameters: neoism.Props{
-			"handle":   handle,
-			"email":    email,
-			"password": passwordHash,
-			"joined":   Now(),
-		},
-		Result: &newUser,
-	})
-	return len(newUser) > 0
-}
-
-func (q Query) CreateDefaultCirclesForUser(handle string) bool {
-	created := []struct {
-		Handle    string `json:"u.handle"`
-		Gold      string `json:"g.name"`
-		Broadcast string `json:"br.name"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH         (p:PublicDomain)
-            WHERE         p.iam    = "PublicDomain"
-            MATCH         (u:User)
-            WHERE         u.handle = {handle}
-            CREATE        (g:Circle  {
-            	name:    {gold},
-            	id:      {gold_id},
-            	created: {now}
-            })
-            CREATE        (br:Circle {
-            	name:    {broadcast},
-            	id:      {broadcast_id},
-            	created: {now}
-            })
-            CREATE 	      (u)-[:OWNS]->(g)
-            CREATE        (u)-[:OWNS]->(br)
-            CREATE UNIQUE (br)-[:PART_OF]->(p)
-            RETURN        u.handle, g.name, br.name
-        `,
-		Parameters: neoism.Props{
-			"handle":       handle,
-			"gold":         types.GOLD,
-			"broadcast":    types.BROADCAST,
-			"gold_id":      NewUUID(),
-			"broadcast_id": NewUUID(),
-			"now":          Now(),
-		},
-		Result: &created,
-	})
-	return len(created) > 0
-}
-
-func (q Query) CreateCircle(handle, circleName string, isPublic bool) (RawCircleView, bool) {
-	created := []RawCircleView{}
-
-	query := `
-        MATCH   (u:User), (p:PublicDomain)
-        WHERE   u.handle      = {handle}
-        AND     p.iam         = "PublicDomain"
-        CREATE  (u)-[:OWNS]->(c:Circle)
-        SET     c.name        = {name}
-        SET     c.id          = {id}
-        SET     c.created     = {now}
-        SET     c.description = ""
-
-    `
-	if isPublic {
-		query = query + `
-            CREATE  (c)-[:PART_OF]->(p)
-        `
-	}
-	query = query + `
-	    WITH    u, c, p
-		OPTIONAL MATCH (c)-[r:PART_OF]->(p)
-        RETURN  c.name        AS name
-             ,  c.id          AS id
-             ,  c.description AS description
-             ,  c.created     AS created
-             ,  u.handle      AS owner
-             ,  r             AS public
-    `
-
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: query,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"name":   circleName,
-			"id":     NewUUID(),
-			"now":    Now(),
-		},
-		Result: &created,
-	})
-
-	if ok := len(created) > 0; ok {
-		return created[0], ok
-	} else {
-		return RawCircleView{}, ok
-	}
-}
-
-func (q Query) CreateMessage(handle, content string) (message types.MessageView, ok bool) {
-	created := make([]types.MessageView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)
-            WHERE   u.handle = {handle}
-            CREATE  (m:Message {
-                content:   {content}
-              , created:   {now}
-              , lastsaved: {now}
-              , id:        {id}
-            })
-            CREATE  (u)-[r:WROTE]->(m)
-            RETURN  m.id      AS id
-                 ,  m.content AS content
-                 ,  u.handle  AS author
-                 ,  m.created AS created
-        `,
-		Parameters: neoism.Props{
-			"handle":  handle,
-			"content": content,
-			"now":     Now(),
-			"id":      NewUUID(),
-		},
-		Result: &created,
-	})
-
-	if ok = len(created) > 0; ok {
-		return created[0], ok
-	} else {
-		return types.MessageView{}, ok
-	}
-}
-
-func (q Query) CreatePublishedRelation(messageid, circleid string) bool {
-	created := []struct {
-		R neoism.Relationship `json:"r"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (m:Message), (c:Circle)
-            WHERE   m.id           = {messageid}
-            AND     c.id           = {circleid}
-            CREATE  (m)-[r:PUB_TO]->(c)
-            SET     r.published_at = {now}
-            RETURN  r
-        `,
-		Parameters: neoism.Props{
-			"messageid": messageid,
-			"circleid":  circleid,
-			"now":       Now(),
-		},
-		Result: &created,
-	})
-	return len(created) > 0
-}
-
-func (q Query) CreateMemberOfRelation(handle, circleid string) bool {
-	joined := []struct {
-		At time.Time `json:"r.at"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User), (c:Circle)
-            WHERE   u.handle = {handle}
-            AND     c.id     = {id}
-            CREATE  (u)-[r:MEMBER_OF]->(c)
-            SET     r.at     = {now}
-            RETURN  r.at
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"id":     circleid,
-			"now":    Now(),
-		},
-		Result: &joined,
-	})
-	return len(joined) > 0
-}
-
-func (q Query) JoinBroadcastCircleOfUser(handle, target string) bool {
-	created := []struct {
-		At time.Time `json:"r.at"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH          (u:User)
-            WHERE          u.handle = {handle}
-            MATCH          (t:User)-[:OWNS]->(c:Circle)
-            WHERE          t.handle = {target}
-            AND            c.name   = {broadcast}
-            CREATE UNIQUE  (u)-[r:MEMBER_OF]->(c)
-            SET            r.at     = {now}
-            RETURN         r.at
-        `,
-		Parameters: neoism.Props{
-			"handle":    handle,
-			"broadcast": types.BROADCAST,
-			"target":    target,
-			"now":       Now(),
-		},
-		Result: &created,
-	})
-	return len(created) > 0
-}
-
-func (q Query) CreateBlockRelationFromTo(handle, target string) bool {
-	res := []struct {
-		Handle string              `json:"u.handle"`
-		Target string              `json:"t.handle"`
-		R      neoism.Relationship `json:"r"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH (u:User), (t:User)
-            WHERE         u.handle = {handle}
-            AND           t.handle = {target}
-            CREATE UNIQUE (u)-[r:BLOCKED]->(t)
-            RETURN        u.handle, t.handle, r
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"target": target,
-		},
-		Result: &res,
-	})
-	return len(res) > 0
-}
-
-//
-// Read
-//
-
-// Checks //
-
-func (q Query) UserExistsByHandle(handle string) bool {
-	found := []struct {
-		Handle string `json:"u.handle"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)
-            WHERE   u.handle = {handle}
-            RETURN  u.handle
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
-}
-
-func (q Query) CircleLinkedToPublicDomain(circleid string) bool {
-	found := []struct {
-		Id string `json:"c.id"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (c:Circle)-[:PART_OF]->(p:PublicDomain)
-            WHERE   c.id = {id}
-            RETURN  c.id
-        `,
-		Parameters: neoism.Props{
-			"id": circleid,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
+func NewRefreshToken() string {
+	return uniuri.NewLen(REFRESH_TOKEN_LENGTH)
 }
 
-func (q Query) UserPartOfCircle(handle, circleid string) bool {
-	found := []struct {
-		Id string `json:"c.id"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-			MATCH   (u:User)-[:MEMBER_OF|OWNS]->(c:Circle)
-			WHERE   u.handle = {handle}
-			AND     c.id     = {id}
-			RETURN  c.id
-		`,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"id":     circleid,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
+func NewResetToken() string {
+	return uniuri.NewLen(RESET_TOKEN_LENGTH)
 }
 
-func (q Query) MessageIsPublished(handle, messageid, circleid string) bool {
-	found := []struct {
-		R *neoism.Relationship `json:"r"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)-[:WROTE]->(m:Message)-[r:PUB_TO]->(c:Circle)
-            WHERE   u.handle = {handle}
-            AND     m.id     = {messageid}
-            AND     c.id     = {circleid}
-            RETURN  r
-        `,
-		Parameters: neoism.Props{
-			"handle":    handle,
-			"messageid": messageid,
-			"circleid":  circleid,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
+func NewApiKey() string {
+	return uniuri.NewLen(API_KEY_LENGTH)
 }
 
-func (q Query) GetMessageById(messageid string) bool {
-	found := []struct {
-		Id int `json:"m.id"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (m:Message)
-            WHERE   m.id = {id}
-            RETURN  m.id
-        `,
-		Parameters: neoism.Props{
-			"id": messageid,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
+func NewOAuthToken() string {
+	return uniuri.NewLen(OAUTH_TOKEN_LENGTH)
 }
 
-func (q Query) HandleExists(handle string) bool {
-	return q.UserExistsByHandle(handle)
-}
+// Constants //
+const (
+	REFRESH_TOKEN_LENGTH = 32
+	RESET_TOKEN_LENGTH   = 32
+	API_KEY_LENGTH       = 40
+	OAUTH_TOKEN_LENGTH   = 32
+	// How stale a session's last-used time may get before a request
+	// refreshes it, sparing the store a write on every request
+	SESSION_TOUCH_INTERVAL = time.Minute
+	// The role of users that were never given one
+	DEFAULT_ROLE = "user"
+	// How many of the latest lockout events the stores keep
+	LOCKOUT_EVENTS_KEPT = 10000
+	// What SearchForUsers sorts by, ties going by handle
+	SORT_BY_HANDLE = "handle"
+	SORT_BY_JOINED = "joined"
+)
 
-func (q Query) EmailExists(email string) bool {
-	found := []struct {
-		Email string `json:"u.email"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)
-            WHERE   u.email = {email}
-            RETURN  u.email
-        `,
-		Parameters: neoism.Props{
-			"email": email,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
-}
+// Errors //
 
-func (q Query) AuthTokenBelongsToSomeUser(token string) bool {
-	found := []struct {
-		Handle string `json:"u.handle"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)<-[:SESSION_OF]-(a:AuthToken)
-            WHERE   a.value   = {token}
-            AND     a.expires > {now}
-            RETURN  u.handle
-        `,
-		Parameters: neoism.Props{
-			"token": token,
-			"now":   Now(),
-		},
-		Result: &found,
-	})
-	return len(found) == 1
+func userNotFound(handle string) error {
+	return types.NotFound("user_not_found", "No such user "+handle)
 }
 
-func (q Query) BlockExistsFromTo(handle, target string) bool {
-	found := []struct {
-		Relation int `json:"r"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User), (t:User)
-            WHERE   u.handle = {handle}
-            AND     t.handle = {target}
-            MATCH   (u)-[r:BLOCKED]->(t)
-            RETURN  r
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"target": target,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
+func circleNotFound(circleid string) error {
+	return types.NotFound("circle_not_found", "No such circle "+circleid)
 }
 
-func (q Query) NoBlockingRelationshipBetween(handle, target string) bool {
-	found := []struct {
-		Relation neoism.Relationship `json:"r"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		// use of bi-directional match here
-		Statement: `
-			MATCH   (u:User)-[r:BLOCKED]-(t:User)
-            WHERE   u.handle = {handle}
-            AND     t.handle = {target}
-            RETURN  r
-		`,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"target": target,
-		},
-		Result: &found,
-	})
-	return len(found) > 0
+func messageNotFound(messageid string) error {
+	return types.NotFound("message_not_found", "No such message with id "+messageid+" could be found")
 }
 
-// Users //
-
-func (q Query) SearchForUsers(circle, namePrefix string, skip, limit int, sortBy string,
-) (results string, count int) {
-	res := []struct {
-		Handle string `json:"u.handle"`
-		Name   string `json:"u.name"`
-		Id     int    `json:"id(u)"`
-	}{}
-
-	var query string
-	props := neoism.Props{}
-	regex := "(?i)" + namePrefix + ".*"
-
-	if circle != "" {
-		query = `
-			MATCH  (u:User)-[]->(c:Circle)
-			WHERE  c.name   =  {circle}
-			AND    u.handle =~ {regex}
-		`
-		props = neoism.Props{
-			"circle": circle,
-			"regex":  regex,
-			"skip":   skip,
-			"limit":  limit,
-			"sort":   sortBy,
-		}
-	} else {
-		query = `
-			MATCH  (u:User)
-			WHERE  u.handle =~ {regex}
-		`
-		props = neoism.Props{
-			"regex": regex,
-			"skip":  skip,
-			"limit": limit,
-			"sort":  sortBy,
-		}
-	}
-	query = query + `
-        RETURN  u.handle, u.name, id(u)
-        SKIP    {skip}
-        LIMIT   {limit}
-	`
-
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement:  query,
-		Parameters: props,
-		Result:     &res,
-	})
-
-	if len(res) == 0 {
-		return "", 0
-	} else {
-		bytes, err := json.Marshal(res)
-		panicIfErr(err)
-		return string(bytes), len(res)
-	}
+func usersNotFound(handle, target string) error {
+	return types.NotFound("user_not_found", "No such user "+handle+" or "+target)
 }
 
-func (q Query) GetPasswordHash(handle string) (passwordHash []byte, ok bool) {
-	found := []struct {
-		PasswordHash string `json:"u.password"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)
-            WHERE   u.handle = {handle}
-            RETURN  u.password
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-		},
-		Result: &found,
-	})
-
-	if ok := len(found) > 0; !ok {
-		return []byte{}, ok
-	} else {
-		return []byte(found[0].PasswordHash), ok
-	}
+func userOrClientNotFound(handle, clientid string) error {
+	return types.NotFound("user_or_client_not_found", "No such user "+handle+" or OAuth client "+clientid)
 }
 
-func (q Query) GetVisibleUserByHandle(handle, target string) (user types.UserView, found bool) {
-	users := make([]types.UserView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (t:User), (u:User)
-            WHERE   not((u)<-[:BLOCKED]-(t))
-            AND     t.handle = {target}
-            AND     u.handle = {handle}
-            RETURN  t.handle    AS handle
-                  , t.firstname AS firstname
-                  , t.lastname  AS lastname
-                  , t.gender    AS gender
-                  , t.birthday  AS birthday
-                  , t.bio       AS bio
-                  , t.interests AS interests
-                  , t.languages AS languages
-                  , t.location  AS location
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"target": target,
-		},
-		Result: &users,
-	})
-	if ok := len(users) > 0; ok {
-		return users[0], ok
-	} else {
-		return types.UserView{}, ok
-	}
+func userOrCircleNotFound(handle, circleid string) error {
+	return types.NotFound("user_or_circle_not_found", "No such user "+handle+" or circle "+circleid)
 }
 
-func (q Query) GetBlockedUsers(handle string) (users []types.UserView, count int) {
-	users = make([]types.UserView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH (u:User)-[:BLOCKED]->(t:User)
-            WHERE u.handle = {handle}
-            RETURN t.handle AS handle
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-		},
-		Result: &users,
-	})
-	count = len(users)
-	if count > 0 {
-		return users, count
-	} else {
-		return []types.UserView{}, count
-	}
+func messageOrCircleNotFound(messageid, circleid string) error {
+	return types.NotFound("message_or_circle_not_found", "No such message "+messageid+" or circle "+circleid)
 }
 
-func (q Query) DeriveHandleFromAuthToken(token string) (handle string, ok bool) {
-	found := []struct {
-		Handle string `json:"u.handle"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-			MATCH   (u:User)<-[:SESSION_OF]-(a:AuthToken)
-			WHERE   a.value  = {token}
-			AND     {now}    < a.expires
-			RETURN  u.handle
-		`,
-		Parameters: neoism.Props{
-			"token": token,
-			"now":   Now(),
-		},
-		Result: &found,
-	})
-	if ok = len(found) > 0; ok {
-		return found[0].Handle, ok
-	} else {
-		return "", ok
-	}
+func publicationNotFound(messageid, circleid string) error {
+	return types.NotFound("publication_not_found", "Message "+messageid+" is not published to circle "+circleid)
 }
 
-// Circles //
-
-func (q Query) SearchCircles(user string, before time.Time, limit int) (found []RawCircleView) {
-	found = make([]RawCircleView, 0)
-
-	props := neoism.Props{
-		"limit":  limit,
-		"before": before,
-	}
-	query := `
-        MATCH     (u:User)-[]->(c:Circle)
-        MATCH     (c)<-[:OWNS]-(owner:User)
-		WHERE     c.created < {before}
-	`
-	if user != "" {
-		query = query + `
-		AND       owner.handle  = {user}
-		`
-		props = neoism.Props{
-			"user":   user,
-			"limit":  limit,
-			"before": before,
-		}
-	}
-	query = query + `
-        OPTIONAL MATCH (c)-[partOf:PART_OF]->(pd:PublicDomain)
-		RETURN    c.name, c.id, c.description, c.created, owner.handle as ownerName, partOf
-        ORDER BY  c.created DESC
-        LIMIT     {limit}
-    `
-
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement:  query,
-		Parameters: props,
-		Result:     &found,
-	})
-
-	if len(found) == 0 {
-		return []RawCircleView{}
-	} else {
-		return found
-	}
+func sessionNotFound(sessionid string) error {
+	return types.NotFound("session_not_found", "No such session "+sessionid)
 }
 
-func (q Query) GetCircleIdByName(handle, circleName string) (circleid string) {
-	found := []struct {
-		Id string `json:"c.id"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-			MATCH   (u:User)-[:OWNS]->(c:Circle)
-			WHERE   u.handle = {handle}
-			AND     c.name   = {circle}
-			RETURN  c.id
-		`,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"circle": circleName,
-		},
-		Result: &found,
-	})
-	if len(found) > 0 {
-		return found[0].Id
-	} else {
-		return ""
-	}
+func refreshTokenReused() error {
+	return types.Unauthenticated("refresh_token_reused",
+		"Refresh token was already used, the session has been revoked")
 }
 
-func (q Query) GetPublicCirclesByHandle(handle string) (circles []RawCircleView, count int) {
-	circles = make([]RawCircleView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH (t:User)-[:OWNS]-(c:Circle)-[partOf:PART_OF]->(pd:PublicDomain)
-            WHERE pd.iam = "PublicDomain"
-            AND   t.handle = {handle}
-            RETURN c.name AS name
-                 , c.id AS id
-                 , c.description AS description
-                 , t.handle AS owner
-                 , c.created AS created
-                 , partOf AS public
-
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-		},
-		Result: &circles,
-	})
-	if len(circles) > 0 {
-		return circles, len(circles)
-	} else {
-		return []RawCircleView{}, len(circles)
-	}
+func secondFactorUsed() error {
+	return types.Forbidden("invalid_code", "Invalid or already used two-factor code")
 }
 
-func (q Query) GetJoinedCirclesByHandle(handle string, before time.Time, limit int) (circles []RawCircleView, count int) {
-	circles = make([]RawCircleView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH           (u:User)-[:MEMBER_OF|OWNS]->(c:Circle)
-            WHERE           u.handle      = {handle}
-            AND             c.created     < {before}
-            MATCH           (c)<-[:OWNS]-(owner:User)
-            OPTIONAL MATCH  (c)-[partOf:PART_OF]->(pd:PublicDomain)
-            RETURN          c.name        AS name
-                          , c.id          AS id
-                          , c.description AS description
-                          , c.created     AS created
-                          , owner.handle  AS owner
-                          , partOf        AS public
-            ORDER BY        c.created
-            LIMIT           {limit}
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"before": before,
-			"limit":  limit,
-		},
-		Result: &circles,
-	})
-	if count = len(circles); count > 0 {
-		return circles, count
-	} else {
-		return []RawCircleView{}, count
-	}
+func challengeNotFound() error {
+	return types.NotFound("challenge_not_found", "No such login challenge, it may have expired")
 }
 
-// Messages //
-
-func (q Query) GetAllMessagesByHandle(target string) []types.MessageView {
-	messages := make([]types.MessageView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH     (t:User)-[:WROTE]->(m:Message)
-            WHERE     t.handle  = {target}
-            RETURN    m.id      AS id
-                 ,    t.handle  AS author
-                 ,    m.content AS content
-                 ,    m.created AS created
-            ORDER BY  m.created DESC
-        `,
-		Parameters: neoism.Props{
-			"target": target,
-		},
-		Result: &messages,
-	})
-	return messages
+func apiKeyNotFound() error {
+	return types.NotFound("api_key_not_found", "No such API key, it may have expired or been revoked")
 }
 
-func (q Query) GetPublicPublishedMessagesByAuthor(target string) []types.PublishedMessageView {
-	messages := make([]types.PublishedMessageView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-			MATCH (t:User)-[:WROTE]->(m:Message)-[p:PUB_TO]->(c:Circle)-[]->(pd:PublicDomain)
-			WHERE     t.handle       =  {target}
-			RETURN    m.id           AS id
-                 ,    t.handle       AS author
-                 ,    m.content      AS content
-                 ,    m.created      AS created
-                 ,    c.id           AS circleid
-                 ,    p.published_at AS published_at
-            ORDER BY  p.published_at
-		`,
-		Parameters: neoism.Props{
-			"target": target,
-		},
-		Result: &messages,
-	})
-	return messages
-}
-func (q Query) GetMessagesByHandleInCircle(target, circleid string) []types.PublishedMessageView {
-	return []types.PublishedMessageView{}
+func oauthClientNotFound(clientid string) error {
+	return types.NotFound("client_not_found", "No such OAuth client "+clientid)
 }
 
-
-func (q Query) GetMessageFeedOfCircle(circleid string) []types.PublishedMessageView {
-	messages := []types.PublishedMessageView{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-			MATCH     (c:Circle)<-[p:PUB_TO]-(m:Message)<-[:WROTE]-(a:User)
-			WHERE     c.id           =  {circleid}
-			RETURN    m.id           AS id
-                 ,    a.handle       AS author
-                 ,    m.content      AS content
-                 ,    m.created      AS created
-                 ,    c.id           AS circleid
-                 ,    p.published_at AS published_at
-            ORDER BY  p.published_at DESC
-		`,
-		Parameters: neoism.Props{
-			"circleid": circleid,
-		},
-		Result: &messages,
-	})
-	return messages
+func oauthCodeNotFound() error {
+	return types.NotFound("code_not_found", "No such authorization code, it may have expired or been used")
 }
 
-func (q Query) GetMessageFeedOfHandle(handle string) []types.PublishedMessageView {
-	messages := []types.PublishedMessageView{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-			MATCH (u:User)-[]->(c:Circle)<-[p:PUB_TO]-(m:Message)<-[:WROTE]-(a:User)
-			WHERE     u.handle       =  {handle}
-			RETURN    m.id           AS id
-                 ,    a.handle       AS author
-                 ,    m.content      AS content
-                 ,    m.created      AS created
-                 ,    c.id           AS circleid
-                 ,    p.published_at AS published_at
-            ORDER BY  p.published_at DESC
-		`,
-		Parameters: neoism.Props{
-			"handle": handle,
-		},
-		Result: &messages,
-	})
-	return messages
+func oauthTokenNotFound() error {
+	return types.NotFound("oauth_token_not_found", "No such OAuth access token, it may have expired")
 }
 
-func (q Query) GetVisibleMessageById(handle, messageid string) (message types.MessageView, ok bool) {
-	messages := make([]types.MessageView, 0)
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-			MATCH   (t:User)-[:WROTE]->(m:Message)-[:PUB_TO]->(c:Circle)<-[:MEMBER_OF|OWNS]-(u:User)
-			WHERE   u.handle = {handle}
-            AND     m.id     = {messageid}
-			RETURN  m.id      AS id
-                 ,  t.handle  AS author
-                 ,  m.content AS content
-                 ,  m.created AS created
-		`,
-		Parameters: neoism.Props{
-			"handle":    handle,
-			"messageid": messageid,
-		},
-		Result: &messages,
-	})
-	if ok = len(messages) > 0; ok {
-		return messages[0], ok
-	} else {
-		return types.MessageView{}, ok
-	}
+func resetTokenNotFound() error {
+	return types.NotFound("reset_token_not_found", "No such password reset token, it may have expired or been used")
 }
 
-//
-// Update
-//
-
-func (q Query) SetGetNewAuthTokenForUser(handle string) (string, bool) {
-	created := []struct {
-		Token string `json:"a.value"`
-	}{}
-	now := Now()
-	token := "Token " + NewUUID()
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-                MATCH   (u:User)
-                WHERE   u.handle     = {handle}
-                WITH    u
-                OPTIONAL MATCH (u)<-[old_r:SESSION_OF]-(old_a:AuthToken)
-                DELETE  old_r, old_a
-                WITH    u
-                CREATE  (u)<-[r:SESSION_OF]-(a:AuthToken)
-                SET     r.created_at = {now}
-                SET     a.value      = {token}
-                SET     a.expires    = {time}
-                RETURN  a.value
-            `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"token":  token,
-			"time":   now.Add(AUTH_TOKEN_DURATION),
-			"now":    now,
-		},
-		Result: &created,
-	})
-	if ok := len(created) > 0; ok {
-		return created[0].Token, ok
-	} else {
-		return "", ok
-	}
+func tokenNotFound() error {
+	return types.NotFound("token_not_found", "No such Authorization token")
 }
 
-func (q Query) UpdatePassword(handle, newPasswordHash string) bool {
-	updated := []struct {
-		Password string `json:"u.password"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)
-            WHERE   u.handle   = {handle}
-            SET     u.password = {new_pass}
-            RETURN  u.password
-        `,
-		Parameters: neoism.Props{
-			"handle":   handle,
-			"new_pass": newPasswordHash,
-		},
-		Result: &updated,
-	})
-	return len(updated) > 0
-}
-
-func (q Query) SetGetUserName(handle, newName string) (string, bool) {
-	updated := []struct {
-		Name string `json:"u.name"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)
-            WHERE   u.handle = {handle}
-            SET     u.name   = {name}
-            RETURN  u.name
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"name":   newName,
-		},
-		Result: &updated,
-	})
-	if ok := len(updated) > 0; ok {
-		return updated[0].Name, ok
-	} else {
-		return "", ok
-	}
-}
-
-func (q Query) UpdateMessageContent(messageid, newContent string) bool {
-	updated := []struct {
-		Content string
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (m:Message)
-            WHERE   m.id        = {messageid}
-            SET     m.content   = {content}
-            SET     m.lastsaved = {now}
-            RETURN  m.content
-        `,
-		Parameters: neoism.Props{
-			"messageid": messageid,
-			"content":   newContent,
-			"now":       Now(),
-		},
-		Result: &updated,
-	})
-	return len(updated) > 0
-}
-
-func (q Query) UpdateUserAttribute(handle, resource, value string) bool {
-	updated := []struct {
-		User string `json:"u.handle"`
-	}{}
-
-	changes := types.Json{
-		resource: value,
-	}
-	query := `
-        MATCH   (u:User)
-        WHERE   u.handle      =  {handle}
-        SET     u.lastupdated =  {now}
-        SET     u             += {changes}
-        RETURN  u.handle`
-
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: query,
-		Parameters: neoism.Props{
-			"handle":  handle,
-			"changes": changes,
-			"now":     Now(),
-		},
-		Result: &updated,
-	})
-	return len(updated) > 0
-}
-
-//
-// Delete
-//
-
-func (q Query) DeleteAllNodesAndRelations() {
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH           (n)
-            OPTIONAL MATCH  (n)-[r]-()
-            DELETE          n, r
-        `,
-	})
-}
-
-func (q Query) DisconnectTargetFromAllHeldCircles(handle, target string) {
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)
-            WHERE   u.handle = {handle}
-            MATCH   (t:User)
-            WHERE   t.handle = {target}
-            OPTIONAL MATCH (u)-[:OWNS]->(c:Circle)
-            OPTIONAL MATCH (t)-[r:MEMBER_OF]->(c)
-            DELETE  r
-        `,
-		Parameters: neoism.Props{
-			"handle": handle,
-			"target": target,
-		},
-	})
-}
-
-func (q Query) DeleteUser(handle string) bool {
-	deleted := []struct {
-		Count int `json:"count(u)"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-                MATCH   (u:User)
-                WHERE   u.handle = {handle}
-                WITH    u
-                OPTIONAL MATCH (a:AuthToken)-[r:SESSION_OF]->(u)
-                DELETE  a, r
-                WITH    u
-                MATCH   (u)-[wr:WROTE]->(m:Message)-[pt:PUB_TO]->(:Circle)
-                DELETE  pt, m, wr
-                WITH    u
-                MATCH   (u)-[mo:MEMBER_OF]->(:Circle)
-                DELETE  mo
-                WITH    u
-                MATCH   (u)-[b:BLOCKED]->(:User)
-                DELETE  b
-                WITH    u
-                MATCH   (u)-[co_my:OWNS]->(c:Circle)-[po_my:PART_OF]->(:PublicDomain)
-                MATCH   (c)<-[mo_my:MEMBER_OF]-(:User)
-                MATCH   (c)<-[pt_my:PUB_TO]-(:Message)
-                DELETE  pt_my, mo_my, co_my, po_my, c, u
-                RETURN  count(u)
-            `,
-		Parameters: neoism.Props{
-			"handle": handle,
-		},
-		Result: &deleted,
-	})
-	return len(deleted) > 0 && deleted[0].Count > 0
-}
+// Return types //
 
-func (q Query) DeletePublishedRelation(messageid, circleid string) bool {
-	deleted := []struct {
-		Count int `json:"count(r)"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (m:Message)-[r:PUB_TO]->(c:Circle)
-            WHERE   m.id = {messageid}
-            AND     c.id = {circleid}
-            DELETE  r
-            RETURN  count(r)
-        `,
-		Parameters: neoism.Props{
-			"messageid": messageid,
-			"circleid":  circleid,
-		},
-		Result: &deleted,
-	})
-	return len(deleted) > 0 && deleted[0].Count > 0
+// A session as the store keeps it, holding only hashes of its tokens
+type SessionRecord struct {
+	TokenHash      string
+	Expires        time.Time
+	RefreshHash    string
+	RefreshExpires time.Time
+	Device         string
+	UserAgent      string
+}
+
+// An API key as the store keeps it. A zero Expires never expires.
+type ApiKeyRecord struct {
+	Id      string
+	KeyHash string
+	Name    string
+	Scopes  []string
+	Expires time.Time
+}
+
+// An application registered by its Owner to request access on behalf of
+// users, sending them back to one of RedirectUris
+type OAuthClientRecord struct {
+	Id           string
+	Name         string
+	Owner        string
+	RedirectUris []string
+	Created      time.Time
+}
+
+// An authorization code a user granted ClientId, good for one access
+// token. Challenge is the PKCE code challenge, to be matched by the
+// verifier the client sends along with the code.
+type OAuthCodeRecord struct {
+	CodeHash    string
+	ClientId    string
+	RedirectUri string
+	Scopes      []string
+	Challenge   string
+	Expires     time.Time
+}
+
+// An access token a user granted ClientId through an authorization code
+type OAuthTokenRecord struct {
+	TokenHash string
+	ClientId  string
+	Scopes    []string
+	Expires   time.Time
+}
+
+// The TOTP second factor of a user. Secret is set on enrollment and only
+// counts once Enabled. LastStep is the time step of the latest code used,
+// so that no code works twice.
+type TotpRecord struct {
+	Secret         string
+	Enabled        bool
+	RecoveryHashes []string
+	LastStep       int64
+}
+
+// A login waiting for its second factor
+type ChallengeRecord struct {
+	TokenHash string
+	Expires   time.Time
+	Device    string
+	UserAgent string
 }
 
-func (q Query) DestroyAuthToken(token string) bool {
-	deleted := []struct {
-		Handle string `json:"u.handle"`
-	}{}
-	q.cypherOrPanic(&neoism.CypherQuery{
-		Statement: `
-            MATCH   (u:User)<-[so:SESSION_OF]-(a:AuthToken)
-            WHERE   a.value = {token}
-            DELETE  so, a
-            RETURN  u.handle
-        `,
-		Parameters: neoism.Props{
-			"token": token,
-		},
-		Result: &deleted,
-	})
-	return len(deleted) > 0
+type RawCircleView struct {
+	Name        string               `json:"name"`
+	Id          string               `json:"id"`
+	Description string               `json:"description"`
+	Created     time.Time            `json:"created"`
+	Owner       string               `json:"owner"`
+	Public      *neoism.Relationship `json:"public"`
 }
@@ -2,8 +2,15 @@ package service
 
 import (
 	"../../types"
+	"./blob"
+	"./mail"
 	"./query"
-	"fmt"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -17,6 +24,16 @@ const (
 	DOMAIN         = "cherami.io"
 	CHERAMI_URL    = CHERAMI_PREFIX + DOMAIN
 	API_URL        = CHERAMI_URL + "/api"
+
+	// Session defaults
+	AUTH_TOKEN_DURATION    = time.Hour
+	REFRESH_TOKEN_DURATION = 30 * 24 * time.Hour
+
+	// How long a mailed password reset token can be used
+	PASSWORD_RESET_DURATION = time.Hour
+
+	// How long an email verification link works
+	VERIFICATION_LINK_DURATION = 7 * 24 * time.Hour
 )
 
 //
@@ -24,28 +41,118 @@ const (
 //
 
 type Svc struct {
-	Query *query.Query
+	Query        query.Query
+	Sessions     SessionPolicy
+	Mail         mail.Sender
+	Verification VerificationPolicy
+	Lockouts     LockoutPolicy
+	OAuth        OAuthPolicy
+	Deletion     DeletionPolicy
+	Avatars      AvatarPolicy
+	Renames      RenamePolicy
+	Blobs        blob.Store
+	guard        *loginGuard
+	exports      *exportJobs
+}
+
+// How long the tokens of a session live. With SlidingExpiry every use of
+// an access token pushes its expiry AccessTokenDuration into the future.
+// TokenPepper is a server-side secret mixed into every stored token hash.
+// PasswordResetDuration bounds how long a mailed reset code works.
+type SessionPolicy struct {
+	AccessTokenDuration   time.Duration
+	RefreshTokenDuration  time.Duration
+	SlidingExpiry         bool
+	TokenPepper           string
+	PasswordResetDuration time.Duration
+}
+
+// How email verification links are signed and what users that have not
+// followed theirs yet may do. Links are signed with Secret and work for
+// LinkDuration; the Unverified fields open up what is otherwise reserved
+// to verified users.
+type VerificationPolicy struct {
+	Secret                  string
+	LinkDuration            time.Duration
+	UnverifiedPublishPublic bool
+	UnverifiedPublicCircles bool
+}
+
+func DefaultSessionPolicy() SessionPolicy {
+	return SessionPolicy{
+		AccessTokenDuration:   AUTH_TOKEN_DURATION,
+		RefreshTokenDuration:  REFRESH_TOKEN_DURATION,
+		PasswordResetDuration: PASSWORD_RESET_DURATION,
+	}
 }
 
 //
 // Utility Functions
 //
 
+// The secret is made up on the spot, so links only outlive the process
+// if a secret is configured
+func DefaultVerificationPolicy() VerificationPolicy {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		panic(err)
+	}
+	return VerificationPolicy{
+		Secret:       hex.EncodeToString(secret),
+		LinkDuration: VERIFICATION_LINK_DURATION,
+	}
+}
+
 /**
  * Service instances must be initialized using this method in
  * order to ensure data integrity. Do not instantiate Svc directly.
+ * The given Query decides where the graph is stored, see
+ * query.NewNeo4jQuery and query.NewMemoryQuery. Mail is kept in memory
+ * until a real sender is set.
  */
-func NewService(uri string) *Svc {
+func NewService(q query.Query) *Svc {
 	s := &Svc{
-		query.NewQuery(uri),
+		Query:        q,
+		Sessions:     DefaultSessionPolicy(),
+		Mail:         mail.NewMemorySender(),
+		Verification: DefaultVerificationPolicy(),
+		Lockouts:     DefaultLockoutPolicy(),
+		OAuth:        DefaultOAuthPolicy(),
+		Deletion:     DefaultDeletionPolicy(),
+		Avatars:      DefaultAvatarPolicy(),
+		Renames:      DefaultRenamePolicy(),
+		Blobs:        blob.NewMemoryStore(),
+		guard:        newLoginGuard(),
+		exports:      newExportJobs(),
 	}
 	return s
 }
 
-func panicIfErr(err error) {
-	if err != nil {
-		panic(err)
-	}
+// Tokens are stored as their HMAC-SHA256 under the pepper, so a copy of
+// the database alone is not enough to impersonate anyone
+func (s Svc) hashToken(token string) string {
+	mac := hmac.New(sha256.New, []byte(s.Sessions.TokenPepper))
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Signs the claim that handle owns email until expires, so a verification
+// link needs nothing stored to be checked
+func (s Svc) signVerification(handle, email string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(s.Verification.Secret))
+	mac.Write([]byte("verify\n" + handle + "\n" + email + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func MakeVerificationUrl(handle string, expires int64, signature string) string {
+	params := url.Values{}
+	params.Set("expires", strconv.FormatInt(expires, 10))
+	params.Set("signature", signature)
+	return API_URL + "/users/" + url.PathEscape(handle) + "/verify?" + params.Encode()
+}
+
+func MakeUserUrl(handle string) string {
+	return API_URL + "/users/" + url.PathEscape(handle)
 }
 
 func MakeCircleUrl(circleid string) string {
@@ -98,100 +205,168 @@ func formatCircleView(c query.RawCircleView) types.CircleResponse {
 	return formatted
 }
 
+//
+// Errors
+//
+
+func circleNotVisible() error {
+	return types.NotFound("circle_not_found", "Could not find circle or you lack access rights")
+}
+
+func emailUnverified(reason string) error {
+	return types.Forbidden("email_unverified", reason)
+}
+
 //
 // Checks
 //
 
-func (s Svc) UserExists(handle string) bool {
+func (s Svc) UserExists(handle string) (bool, error) {
 	return s.Query.UserExistsByHandle(handle)
 }
 
 // Returned whether the target user exists and has not blocked handle
-func (s Svc) UserExistsAndNoBlocking(handle, target string) bool {
-	return s.Query.UserExistsByHandle(target) &&
-		s.Query.NoBlockingRelationshipBetween(handle, target)
+func (s Svc) UserExistsAndNoBlocking(handle, target string) (bool, error) {
+	if exists, err := s.Query.UserExistsByHandle(target); err != nil || !exists {
+		return false, err
+	}
+	return s.Query.NoBlockingRelationshipBetween(handle, target)
 }
 
-func (s Svc) CircleExistsInPublicDomain(circleid string) bool {
+func (s Svc) CircleExistsInPublicDomain(circleid string) (bool, error) {
 	return s.Query.CircleLinkedToPublicDomain(circleid)
 }
 
-func (s Svc) CanSeeCircle(fromPerspectiveOf string, circleid string) bool {
-	if s.Query.CircleLinkedToPublicDomain(circleid) ||
-		s.Query.UserPartOfCircle(fromPerspectiveOf, circleid) {
-		return true
+func (s Svc) CanSeeCircle(fromPerspectiveOf string, circleid string) (bool, error) {
+	if public, err := s.Query.CircleLinkedToPublicDomain(circleid); err != nil || public {
+		return public, err
 	}
-	return false
+	return s.Query.UserPartOfCircle(fromPerspectiveOf, circleid)
 }
 
-func (s Svc) UserCanPublishTo(handle, circleid string) bool {
+func (s Svc) UserCanPublishTo(handle, circleid string) (bool, error) {
 	return s.Query.UserPartOfCircle(handle, circleid)
 }
 
-func (s Svc) UserCanRetractPublication(handle, messageid, circleid string) bool {
+func (s Svc) UserCanRetractPublication(handle, messageid, circleid string) (bool, error) {
 	return s.Query.MessageIsPublished(handle, messageid, circleid)
 }
 
-func (s Svc) MessageExists(messageid string) bool {
+func (s Svc) MessageExists(messageid string) (bool, error) {
 	return s.Query.GetMessageById(messageid)
 }
 
-func (s Svc) HandleIsUnique(handle string) bool {
-	return !s.Query.HandleExists(handle)
+func (s Svc) HandleIsUnique(handle string) (bool, error) {
+	exists, err := s.Query.HandleExists(handle)
+	return !exists, err
 }
 
-func (s Svc) EmailIsUnique(email string) bool {
-	return !s.Query.EmailExists(email)
+func (s Svc) EmailIsUnique(email string) (bool, error) {
+	exists, err := s.Query.EmailExists(email)
+	return !exists, err
 }
 
-func (s Svc) VerifyAuthToken(token string) bool {
-	return s.Query.AuthTokenBelongsToSomeUser(token)
+func (s Svc) VerifyAuthToken(token string) (bool, error) {
+	return s.Query.AuthTokenBelongsToSomeUser(s.hashToken(token))
 }
 
-func (s Svc) BlockExistsFromTo(handle, target string) bool {
+func (s Svc) BlockExistsFromTo(handle, target string) (bool, error) {
 	return s.Query.BlockExistsFromTo(handle, target)
 }
 
+func (s Svc) EmailIsVerified(handle string) (bool, error) {
+	_, verified, err := s.Query.GetEmailVerification(handle)
+	return verified, err
+}
+
+// Fails with FORBIDDEN if circleid is public and handle may not publish
+// there before verifying their email
+func (s Svc) CheckMayPublishTo(handle, circleid string) error {
+	if s.Verification.UnverifiedPublishPublic {
+		return nil
+	}
+	if public, err := s.Query.CircleLinkedToPublicDomain(circleid); err != nil || !public {
+		return err
+	}
+	if verified, err := s.EmailIsVerified(handle); err != nil {
+		return err
+	} else if !verified {
+		return emailUnverified("Please verify your email before publishing to public circles")
+	}
+	return nil
+}
+
+// Fails with FORBIDDEN if handle may not create a public circle before
+// verifying their email
+func (s Svc) CheckMayCreateCircle(handle string, isPublic bool) error {
+	if !isPublic || s.Verification.UnverifiedPublicCircles {
+		return nil
+	}
+	if verified, err := s.EmailIsVerified(handle); err != nil {
+		return err
+	} else if !verified {
+		return emailUnverified("Please verify your email before creating public circles")
+	}
+	return nil
+}
+
 //
 // Creation
 //
 
-func (s Svc) CreateNewUser(handle, email, passwordHash string) bool {
+// Fails with CONFLICT if either the handle or the email is already taken,
+// or if the handle is easily mistaken for one that is
+func (s Svc) CreateNewUser(handle, email, passwordHash string) error {
+	if unique, err := s.HandleIsUnique(handle); err != nil {
+		return err
+	} else if !unique {
+		return types.Conflict("handle_taken", "Sorry, handle or email is already taken")
+	}
+	if err := s.checkNotConfusable(handle, ""); err != nil {
+		return err
+	}
+	if unique, err := s.EmailIsUnique(email); err != nil {
+		return err
+	} else if !unique {
+		return types.Conflict("email_taken", "Sorry, handle or email is already taken")
+	}
 	return s.Query.CreateUser(handle, email, passwordHash)
 }
 
-func (s Svc) MakeDefaultCirclesFor(handle string) bool {
+func (s Svc) MakeDefaultCirclesFor(handle string) error {
 	return s.Query.CreateDefaultCirclesForUser(handle)
 }
 
-func (s Svc) NewCircle(handle, circleName string, isPublic bool) (types.CircleResponse, bool) {
-	view, ok := s.Query.CreateCircle(handle, circleName, isPublic)
-	return formatCircleView(view), ok
+func (s Svc) NewCircle(handle, circleName string, isPublic bool) (types.CircleResponse, error) {
+	view, err := s.Query.CreateCircle(handle, circleName, isPublic)
+	if err != nil {
+		return types.CircleResponse{}, err
+	}
+	return formatCircleView(view), nil
 }
 
-func (s Svc) NewMessage(handle, content string) (message types.MessageView, ok bool) {
-	m, ok := s.Query.CreateMessage(handle, content)
-	if ok {
-		return addMessageUrlDepracated(m), ok
-	} else {
-		return types.MessageView{}, ok
+func (s Svc) NewMessage(handle, content string) (types.MessageView, error) {
+	m, err := s.Query.CreateMessage(handle, content)
+	if err != nil {
+		return types.MessageView{}, err
 	}
+	return addMessageUrlDepracated(m), nil
 }
 
-func (s Svc) PublishMessageToCircle(messageid, circleid string) bool {
+func (s Svc) PublishMessageToCircle(messageid, circleid string) error {
 	return s.Query.CreatePublishedRelation(messageid, circleid)
 }
 
-func (s Svc) JoinCircle(handle, circleid string) bool {
+func (s Svc) JoinCircle(handle, circleid string) error {
 	// [TODO] check that `handle` is not the cheif of the circle here
 	return s.Query.CreateMemberOfRelation(handle, circleid)
 }
 
-func (s Svc) JoinBroadcast(handle, target string) bool {
+func (s Svc) JoinBroadcast(handle, target string) error {
 	return s.Query.JoinBroadcastCircleOfUser(handle, target)
 }
 
-func (s Svc) CreateBlockFromTo(handle, target string) bool {
+func (s Svc) CreateBlockFromTo(handle, target string) error {
 	return s.Query.CreateBlockRelationFromTo(handle, target)
 }
 
@@ -199,20 +374,36 @@ func (s Svc) CreateBlockFromTo(handle, target string) bool {
 // Deletion
 //
 
-func (s Svc) FreshInitialState() {
-	s.Query.DeleteAllNodesAndRelations()
-	s.Query.DatabaseInit()
+func (s Svc) FreshInitialState() error {
+	s.resetLoginFailures()
+	if err := s.Query.DeleteAllNodesAndRelations(); err != nil {
+		return err
+	}
+	return s.Query.DatabaseInit()
 }
 
-func (s Svc) KickTargetFromCircles(handle, target string) {
-	s.Query.DisconnectTargetFromAllHeldCircles(handle, target)
+func (s Svc) KickTargetFromCircles(handle, target string) error {
+	return s.Query.DisconnectTargetFromAllHeldCircles(handle, target)
 }
 
-func (s Svc) DeleteUser(handle string) bool {
-	return s.Query.DeleteUser(handle)
+// Deletes handle for good with everything they own or wrote, their
+// sessions and credentials, memberships and blocks, answering how much
+// went. Users deleting their account are deactivated first, see
+// DeactivateUser.
+func (s Svc) DeleteUser(handle string) (types.DeletionSummary, error) {
+	avatarid, err := s.Query.GetUserAvatar(handle)
+	if err != nil {
+		return types.DeletionSummary{}, err
+	}
+	summary, err := s.Query.DeleteUser(handle)
+	if err != nil {
+		return summary, err
+	}
+	s.deleteAvatar(avatarid)
+	return summary, nil
 }
 
-func (s Svc) UnpublishMessageFromCircle(messageid, circleid string) bool {
+func (s Svc) UnpublishMessageFromCircle(messageid, circleid string) error {
 	return s.Query.DeletePublishedRelation(messageid, circleid)
 }
 
@@ -220,145 +411,358 @@ func (s Svc) UnpublishMessageFromCircle(messageid, circleid string) bool {
 // Get
 //
 
-func (s Svc) SearchForUsers(circle, nameprefix string, skip, limit int, sort string,
-) (results string, count int) {
-	return s.Query.SearchForUsers(circle, nameprefix, skip, limit, sort)
+// A page of the active users whose handle or public name starts with
+// nameprefix, along with how many there are in all
+func (s Svc) SearchForUsers(circle, nameprefix string, skip, limit int, sortBy string, descending bool,
+) (results []types.UserSearchView, total int, err error) {
+	results, total, err = s.Query.SearchForUsers(circle, nameprefix, skip, limit, sortBy, descending)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range results {
+		results[i].Url = MakeUserUrl(results[i].Handle)
+		results[i].Avatar = MakeAvatarUrl(results[i].Avatar)
+	}
+	return results, total, nil
 }
 
-func (s Svc) SearchCircles(user string, before time.Time, limit int) (results []types.CircleResponse, count int) {
-	circles := s.Query.SearchCircles(user, before, limit)
+func (s Svc) SearchCircles(user string, before time.Time, limit int) (results []types.CircleResponse, count int, err error) {
+	circles, err := s.Query.SearchCircles(user, before, limit)
+	if err != nil {
+		return nil, 0, err
+	}
 	formatted := make([]types.CircleResponse, len(circles))
 	for i, c := range circles {
 		formatted[i] = formatCircleView(c)
 	}
-	return formatted, len(formatted)
+	return formatted, len(formatted), nil
 }
 
-func (s Svc) CirclesUserIsPartOf(user string, before time.Time, limit int) (results []types.CircleResponse, count int) {
-	circles, _ := s.Query.GetJoinedCirclesByHandle(user, before, limit)
+func (s Svc) CirclesUserIsPartOf(user string, before time.Time, limit int) (results []types.CircleResponse, count int, err error) {
+	circles, _, err := s.Query.GetJoinedCirclesByHandle(user, before, limit)
+	if err != nil {
+		return nil, 0, err
+	}
 	formatted := make([]types.CircleResponse, len(circles))
 	for i, c := range circles {
 		formatted[i] = formatCircleView(c)
 	}
-	return formatted, len(formatted)
+	return formatted, len(formatted), nil
 }
 
-func (s Svc) GetPasswordHash(handle string) (passwordHash []byte, ok bool) {
+func (s Svc) GetPasswordHash(handle string) (passwordHash []byte, err error) {
 	return s.Query.GetPasswordHash(handle)
 }
 
-func (s Svc) GetCircleId(handle, circleName string) (circleid string) {
+func (s Svc) GetCircleId(handle, circleName string) (circleid string, err error) {
 	return s.Query.GetCircleIdByName(handle, circleName)
 }
 
-func (s Svc) GetPublicMessagesByHandle(self, target string) ([]types.PublishedMessageView, bool) {
-	if ok := s.UserExistsAndNoBlocking(target, self); ok {
-		messages := addMessageUrlToArray(s.Query.GetPublicPublishedMessagesByAuthor(target))
-		return messages, ok
-	} else {
-		return []types.PublishedMessageView{}, ok
+// The circle circleid, if handle can see it: public circles and those
+// handle is part of. Fails with NOT_FOUND alike for circles that are
+// missing and those handle can not see.
+func (s Svc) GetCircle(handle, circleid string) (types.CircleResponse, error) {
+	if ok, err := s.CanSeeCircle(handle, circleid); err != nil {
+		return types.CircleResponse{}, err
+	} else if !ok {
+		return types.CircleResponse{}, circleNotVisible()
+	}
+	circle, err := s.Query.GetCircleById(circleid)
+	if types.IsNotFound(err) {
+		return types.CircleResponse{}, circleNotVisible()
+	} else if err != nil {
+		return types.CircleResponse{}, err
 	}
+	return formatCircleView(circle), nil
 }
 
-func (s Svc) GetMessagesByTargetInCircle(self, target, circleid string) ([]types.PublishedMessageView, bool) {
-	if ok := s.CanSeeCircle(self, circleid) && s.UserExistsAndNoBlocking(target, self); ok {
-		messages := addMessageUrlToArray(s.Query.GetMessagesByHandleInCircle(target, circleid))
-		return messages, ok
-	} else {
-		return []types.PublishedMessageView{}, ok
+func (s Svc) GetPublicMessagesByHandle(self, target string) ([]types.PublishedMessageView, error) {
+	if ok, err := s.UserExistsAndNoBlocking(target, self); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, circleNotVisible()
+	}
+	messages, err := s.Query.GetPublicPublishedMessagesByAuthor(target)
+	if err != nil {
+		return nil, err
 	}
+	return addMessageUrlToArray(messages), nil
 }
 
-func (s Svc) GetMessagesInCircle(self, circleid string) ([]types.PublishedMessageView, bool) {
-	if ok := s.CanSeeCircle(self, circleid); ok {
-		messages := addMessageUrlToArray(s.Query.GetMessageFeedOfCircle(circleid))
-		return messages, ok
-	} else {
-		return []types.PublishedMessageView{}, ok
+func (s Svc) GetMessagesByTargetInCircle(self, target, circleid string) ([]types.PublishedMessageView, error) {
+	if ok, err := s.CanSeeCircle(self, circleid); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, circleNotVisible()
+	}
+	if ok, err := s.UserExistsAndNoBlocking(target, self); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, circleNotVisible()
+	}
+	messages, err := s.Query.GetMessagesByHandleInCircle(target, circleid)
+	if err != nil {
+		return nil, err
 	}
+	return addMessageUrlToArray(messages), nil
+}
+
+func (s Svc) GetMessagesInCircle(self, circleid string) ([]types.PublishedMessageView, error) {
+	if ok, err := s.CanSeeCircle(self, circleid); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, circleNotVisible()
+	}
+	messages, err := s.Query.GetMessageFeedOfCircle(circleid)
+	if err != nil {
+		return nil, err
+	}
+	return addMessageUrlToArray(messages), nil
 }
 
 // Should only be used on the logged-in user
 // retrieves the personalized feed of the user
-func (s Svc) GetMessageFeedOfSelf(handle string) ([]types.PublishedMessageView, bool) {
-	if ok := s.UserExists(handle); ok {
-		messages := addMessageUrlToArray(s.Query.GetMessageFeedOfHandle(handle))
-		return messages, ok
-	} else {
-		return []types.PublishedMessageView{}, ok
+func (s Svc) GetMessageFeedOfSelf(handle string) ([]types.PublishedMessageView, error) {
+	messages, err := s.Query.GetMessageFeedOfHandle(handle)
+	if err != nil {
+		return nil, err
 	}
+	return addMessageUrlToArray(messages), nil
 }
 
 // THIS IS TEMPORARY (DEMO HACK)
-func (s Svc) GetAllMessages(handle string) ([]types.MessageView, bool) {
-	if ok := s.UserExists(handle); ok {
-		messages := s.Query.GetAllMessagesByHandle(handle)
-		return messages, ok
-	} else {
-		return []types.MessageView{}, ok
-	}
+func (s Svc) GetAllMessages(handle string) ([]types.MessageView, error) {
+	return s.Query.GetAllMessagesByHandle(handle)
 }
 
-func (s Svc) GetVisibleMessageById(handle, messageid string) (message types.MessageView, ok bool) {
-	if message, ok := s.Query.GetVisibleMessageById(handle, messageid); ok {
-		return addMessageUrlDepracated(message), ok
-	} else {
-		return types.MessageView{}, ok
+func (s Svc) GetVisibleMessageById(handle, messageid string) (types.MessageView, error) {
+	message, err := s.Query.GetVisibleMessageById(handle, messageid)
+	if err != nil {
+		return types.MessageView{}, err
 	}
+	return addMessageUrlDepracated(message), nil
+}
 
+func (s Svc) GetHandleFromAuthorization(token string) (handle string, err error) {
+	return s.Query.DeriveHandleFromAuthToken(s.hashToken(token))
 }
 
-func (s Svc) GetHandleFromAuthorization(token string) (handle string, ok bool) {
-	return s.Query.DeriveHandleFromAuthToken(token)
+func (s Svc) GetSessions(handle, token string) ([]types.SessionView, error) {
+	return s.Query.GetSessionsByHandle(handle, s.hashToken(token))
 }
 
-func (s Svc) GetVisibleUser(handle, target string) (result types.UserView, ok bool) {
-	if user, ok := s.Query.GetVisibleUserByHandle(handle, target); !ok {
-		return types.UserView{}, ok
-	} else {
-		// var blockedUsers types.UserView
-		if handle == target {
-			if blocked, count := s.Query.GetBlockedUsers(handle); count > 0 {
-				user.Blocked = blocked
-			}
-		}
-		fmt.Printf("%+v", user)
-		circles, _ := s.Query.GetPublicCirclesByHandle(handle)
-		formatted := make([]types.CircleResponse, len(circles))
-		for i, c := range circles {
-			formatted[i] = formatCircleView(c)
+func (s Svc) GetVisibleUser(handle, target string) (types.UserView, error) {
+	user, err := s.Query.GetVisibleUserByHandle(handle, target)
+	if err != nil {
+		return types.UserView{}, err
+	}
+	user.Avatar = MakeAvatarUrl(user.Avatar)
+	if types.HandleKey(handle) != types.HandleKey(target) {
+		if err := s.hideProfileFields(handle, &user); err != nil {
+			return types.UserView{}, err
 		}
-		user.Circles = formatted
-		return user, true
+	} else {
+		user.Blocked = MakeBlockedUrl(handle)
+	}
+	circles, _, err := s.Query.GetPublicCirclesByHandle(target)
+	if err != nil {
+		return types.UserView{}, err
 	}
+	formatted := make([]types.CircleResponse, len(circles))
+	for i, c := range circles {
+		formatted[i] = formatCircleView(c)
+	}
+	user.Circles = formatted
+	return user, nil
 }
 
 //
 // Node Attributes
 //
 
+// Issues a fresh pair of tokens, the store only gets to see their hashes
+func (s Svc) newSessionTokens(handle string) (types.SessionTokens, query.SessionRecord) {
+	now := query.Now()
+	tokens := types.SessionTokens{
+		Handle:         handle,
+		Token:          "Token " + query.NewUUID(),
+		Expires:        now.Add(s.Sessions.AccessTokenDuration),
+		RefreshToken:   query.NewRefreshToken(),
+		RefreshExpires: now.Add(s.Sessions.RefreshTokenDuration),
+	}
+	record := query.SessionRecord{
+		TokenHash:      s.hashToken(tokens.Token),
+		Expires:        tokens.Expires,
+		RefreshHash:    s.hashToken(tokens.RefreshToken),
+		RefreshExpires: tokens.RefreshExpires,
+	}
+	return tokens, record
+}
+
 // Creates a new AuthToken node that points to a particular user
-// returning the value of the token created
-func (s Svc) SetGetNewAuthToken(handle string) (string, bool) {
-	return s.Query.SetGetNewAuthTokenForUser(handle)
+// returning the tokens of the session created. Fails with FORBIDDEN if
+// the user is suspended. Restores accounts deleted within the grace period.
+func (s Svc) SetGetNewAuthToken(handle, device, userAgent string) (types.SessionTokens, error) {
+	if err := s.CheckNotSuspended(handle); err != nil {
+		return types.SessionTokens{}, err
+	}
+	if err := s.recoverAccount(handle); err != nil {
+		return types.SessionTokens{}, err
+	}
+	tokens, record := s.newSessionTokens(handle)
+	record.Device = device
+	record.UserAgent = userAgent
+	if err := s.Query.CreateAuthTokenForUser(handle, record); err != nil {
+		return types.SessionTokens{}, err
+	}
+	return tokens, nil
+}
+
+// Exchanges a refresh token for new tokens, failing with UNAUTHENTICATED
+// when the refresh token is unknown, expired or already spent
+func (s Svc) RefreshSession(refreshToken string) (types.SessionTokens, error) {
+	tokens, record := s.newSessionTokens("")
+	handle, err := s.Query.RotateAuthToken(s.hashToken(refreshToken), record)
+	if types.IsNotFound(err) {
+		return types.SessionTokens{}, types.Unauthenticated("invalid_refresh_token", "Missing, illegal or expired refresh token")
+	} else if err != nil {
+		return types.SessionTokens{}, err
+	}
+	tokens.Handle = handle
+	return tokens, nil
+}
+
+func (s Svc) TouchSession(token string) error {
+	var slideTo time.Time
+	if s.Sessions.SlidingExpiry {
+		slideTo = query.Now().Add(s.Sessions.AccessTokenDuration)
+	}
+	return s.Query.UpdateSessionLastUsed(s.hashToken(token), slideTo)
 }
 
-func (s Svc) SetNewPassword(handle, newPasswordHash string) bool {
+func (s Svc) SetNewPassword(handle, newPasswordHash string) error {
 	return s.Query.UpdatePassword(handle, newPasswordHash)
 }
 
-func (s Svc) DestroyAuthToken(token string) bool {
-	return s.Query.DestroyAuthToken(token)
+// Mails handle a signed link that verifies their current email address.
+// Fails with CONFLICT if it is already verified.
+func (s Svc) SendVerificationMail(handle string) error {
+	email, verified, err := s.Query.GetEmailVerification(handle)
+	if err != nil {
+		return err
+	} else if verified {
+		return types.Conflict("already_verified", "The email of "+handle+" is already verified")
+	}
+
+	expires := query.Now().Add(s.Verification.LinkDuration)
+	link := MakeVerificationUrl(handle, expires.Unix(), s.signVerification(handle, email, expires.Unix()))
+	return s.Mail.Send(mail.Message{
+		To:      email,
+		Subject: "Verify your CherAmi email address",
+		Body: "Welcome to CherAmi, " + handle + "!\n\n" +
+			"Please confirm this is your address by following the link below.\n\n" +
+			"Verification link: " + link + "\n\n" +
+			"The link works until " + expires.Format(time.RFC1123) + ".\n",
+	})
+}
+
+// Marks the email of handle as verified given the expiry and signature
+// of a link sent by SendVerificationMail. Fails with FORBIDDEN if the link
+// was not signed for the current address of handle or has expired.
+func (s Svc) VerifyEmail(handle string, expires int64, signature string) error {
+	email, verified, err := s.Query.GetEmailVerification(handle)
+	if types.IsNotFound(err) {
+		return types.Forbidden("invalid_verification_link", "Invalid or expired verification link")
+	} else if err != nil {
+		return err
+	}
+
+	expected := s.signVerification(handle, email, expires)
+	if !hmac.Equal([]byte(signature), []byte(expected)) || query.Now().Unix() >= expires {
+		return types.Forbidden("invalid_verification_link", "Invalid or expired verification link")
+	}
+	if verified {
+		return nil
+	}
+	return s.Query.SetEmailVerified(handle)
+}
+
+// Sets the new password of a logged in user and signs out every other
+// session, leaving the one token belongs to
+func (s Svc) ChangePassword(handle, token, newPasswordHash string) error {
+	if err := s.Query.UpdatePassword(handle, newPasswordHash); err != nil {
+		return err
+	}
+	_, err := s.Query.DestroySessionsExcept(handle, s.hashToken(token))
+	return err
+}
+
+// Mails a single use reset token to the owner of email. Unknown addresses
+// succeed silently so the endpoint does not reveal who is signed up.
+func (s Svc) RequestPasswordReset(email string) error {
+	handle, err := s.Query.GetHandleByEmail(email)
+	if types.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	token := query.NewResetToken()
+	expires := query.Now().Add(s.Sessions.PasswordResetDuration)
+	if err := s.Query.CreatePasswordResetToken(handle, s.hashToken(token), expires); err != nil {
+		return err
+	}
+	return s.Mail.Send(mail.Message{
+		To:      email,
+		Subject: "Resetting your CherAmi password",
+		Body: "Someone, hopefully you, asked to reset the password of " + handle + ".\n\n" +
+			"Reset code: " + token + "\n\n" +
+			"The code can be used once until " + expires.Format(time.RFC1123) + ".\n" +
+			"If you did not ask for this, you can ignore this message.\n",
+	})
+}
+
+// Spends a reset token on a new password, signing out every session of
+// its user. Fails with FORBIDDEN if the token is unknown, used or expired.
+func (s Svc) ResetPassword(token, newPasswordHash string) (handle string, err error) {
+	handle, err = s.Query.ConsumePasswordResetToken(s.hashToken(token))
+	if types.IsNotFound(err) {
+		return "", types.Forbidden("invalid_reset_token", "Invalid or expired password reset token")
+	} else if err != nil {
+		return "", err
+	}
+	if err := s.Query.UpdatePassword(handle, newPasswordHash); err != nil {
+		return "", err
+	}
+	if _, err := s.Query.DestroySessionsExcept(handle, ""); err != nil {
+		return "", err
+	}
+	return handle, nil
+}
+
+func (s Svc) DestroyAuthToken(token string) error {
+	return s.Query.DestroyAuthToken(s.hashToken(token))
+}
+
+func (s Svc) RevokeSession(handle, sessionid string) error {
+	return s.Query.DestroySessionById(handle, sessionid)
+}
+
+// Revokes every session of handle except the one token belongs to
+func (s Svc) RevokeOtherSessions(handle, token string) (count int, err error) {
+	return s.Query.DestroySessionsExcept(handle, s.hashToken(token))
 }
 
-func (s Svc) SetGetName(handle, newName string) (string, bool) {
+func (s Svc) SetGetName(handle, newName string) (string, error) {
 	return s.Query.SetGetUserName(handle, newName)
 }
 
-func (s Svc) UpdateContentOfMessage(messageid, content string) bool {
+func (s Svc) UpdateContentOfMessage(messageid, content string) error {
 	return s.Query.UpdateMessageContent(messageid, content)
 }
 
-func (s Svc) UpdateUserAttribute(handle, resource, content string) bool {
+// Stores a value answered by NormalizeUserAttribute, clearing the field
+// when it is empty
+func (s Svc) UpdateUserAttribute(handle, resource, content string) error {
 	return s.Query.UpdateUserAttribute(handle, resource, content)
 }
@@ -0,0 +1,276 @@
+package service
+
+import (
+	"../../types"
+	"./query"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//
+// Constants
+//
+
+const (
+	// RFC 6238 parameters, the defaults every authenticator app supports
+	TOTP_ISSUER        = "CherAmi"
+	TOTP_DIGITS        = 6
+	TOTP_PERIOD        = 30 * time.Second
+	TOTP_SECRET_LENGTH = 20
+	// Codes of this many steps before or after now are still accepted,
+	// allowing for clocks that drift
+	TOTP_SKEW = 1
+
+	RECOVERY_CODE_COUNT  = 10
+	RECOVERY_CODE_LENGTH = 10
+
+	// How long the second step of a two-step login may take
+	LOGIN_CHALLENGE_DURATION = 5 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//
+// Errors
+//
+
+func invalidSecondFactor() error {
+	return types.Forbidden("invalid_code", "Invalid or already used two-factor code")
+}
+
+//
+// RFC 6238
+//
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTP_PERIOD/time.Second)
+}
+
+// The HOTP value (RFC 4226) of key at counter step
+func hotp(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, value%modulo)
+}
+
+// The code an authenticator app shows at t for the base32 secret
+func TotpCode(secret string, t time.Time) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, totpStep(t)), nil
+}
+
+// The time step code belongs to if it is valid around now and newer than
+// after, ok is false otherwise
+func matchTotp(secret, code string, after int64) (step int64, ok bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	now := totpStep(query.Now())
+	for s := now - TOTP_SKEW; s <= now+TOTP_SKEW; s++ {
+		if s > after && hmac.Equal([]byte(hotp(key, s)), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+func MakeTotpUri(handle, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", TOTP_ISSUER)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprint(TOTP_DIGITS))
+	params.Set("period", fmt.Sprint(int(TOTP_PERIOD/time.Second)))
+	label := url.PathEscape(TOTP_ISSUER + ":" + handle)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Recovery codes are shown grouped, "abcde-fghij", but compared without
+// the dash or case
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func newRecoveryCode() string {
+	code := strings.ToLower(totpEncoding.EncodeToString(randomBytes(RECOVERY_CODE_LENGTH)))[:RECOVERY_CODE_LENGTH]
+	return code[:RECOVERY_CODE_LENGTH/2] + "-" + code[RECOVERY_CODE_LENGTH/2:]
+}
+
+//
+// Two-Factor Authentication
+//
+
+func (s Svc) TotpEnabled(handle string) (bool, error) {
+	totp, err := s.Query.GetTotp(handle)
+	return totp.Enabled, err
+}
+
+// Starts enrolling handle with a fresh secret, replacing any enrollment
+// left unconfirmed. Fails with CONFLICT if 2FA is already enabled.
+func (s Svc) EnrollTotp(handle string) (types.TotpEnrollment, error) {
+	if enabled, err := s.TotpEnabled(handle); err != nil {
+		return types.TotpEnrollment{}, err
+	} else if enabled {
+		return types.TotpEnrollment{}, types.Conflict("totp_enabled", "Two-factor authentication is already enabled")
+	}
+
+	secret := totpEncoding.EncodeToString(randomBytes(TOTP_SECRET_LENGTH))
+	if err := s.Query.SetTotp(handle, query.TotpRecord{Secret: secret}); err != nil {
+		return types.TotpEnrollment{}, err
+	}
+	return types.TotpEnrollment{
+		Secret: secret,
+		Uri:    MakeTotpUri(handle, secret),
+	}, nil
+}
+
+// Enables 2FA once handle proves their app has the secret, answering with
+// recovery codes that are never shown again
+func (s Svc) ConfirmTotp(handle, code string) ([]string, error) {
+	totp, err := s.Query.GetTotp(handle)
+	if err != nil {
+		return nil, err
+	} else if totp.Enabled {
+		return nil, types.Conflict("totp_enabled", "Two-factor authentication is already enabled")
+	} else if totp.Secret == "" {
+		return nil, types.Conflict("totp_not_enrolled", "Enroll in two-factor authentication first")
+	}
+
+	step, ok := matchTotp(totp.Secret, code, 0)
+	if !ok {
+		return nil, invalidSecondFactor()
+	}
+
+	codes := make([]string, RECOVERY_CODE_COUNT)
+	hashes := make([]string, RECOVERY_CODE_COUNT)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		hashes[i] = s.hashToken(normalizeRecoveryCode(codes[i]))
+	}
+	totp.Enabled = true
+	totp.RecoveryHashes = hashes
+	totp.LastStep = step
+	if err := s.Query.SetTotp(handle, totp); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Accepts either a current code from the app or an unused recovery code,
+// using it up. Fails with FORBIDDEN otherwise.
+func (s Svc) checkSecondFactor(handle, code string) error {
+	totp, err := s.Query.GetTotp(handle)
+	if err != nil {
+		return err
+	} else if !totp.Enabled {
+		return invalidSecondFactor()
+	}
+
+	// The store checks the step or hash again as it uses it up, so a code
+	// raced through two logins only works once
+	code = strings.TrimSpace(code)
+	if step, ok := matchTotp(totp.Secret, code, totp.LastStep); ok {
+		return s.Query.ConsumeTotpStep(handle, step)
+	}
+
+	hash := s.hashToken(normalizeRecoveryCode(code))
+	for _, h := range totp.RecoveryHashes {
+		if hmac.Equal([]byte(h), []byte(hash)) {
+			return s.Query.ConsumeRecoveryHash(handle, hash)
+		}
+	}
+	return invalidSecondFactor()
+}
+
+// Turns 2FA off given a code; the api checks the password
+func (s Svc) DisableTotp(handle, code string) error {
+	if enabled, err := s.TotpEnabled(handle); err != nil {
+		return err
+	} else if !enabled {
+		return types.Conflict("totp_not_enabled", "Two-factor authentication is not enabled")
+	}
+	if err := s.checkSecondFactor(handle, code); err != nil {
+		return err
+	}
+	return s.Query.SetTotp(handle, query.TotpRecord{})
+}
+
+// The first step of logging in with 2FA, once the password checked out
+func (s Svc) NewLoginChallenge(handle, device, userAgent string) (types.LoginChallenge, error) {
+	if err := s.CheckNotSuspended(handle); err != nil {
+		return types.LoginChallenge{}, err
+	}
+	challenge := types.LoginChallenge{
+		Handle:    handle,
+		Challenge: query.NewRefreshToken(),
+		Expires:   query.Now().Add(LOGIN_CHALLENGE_DURATION),
+	}
+	if err := s.Query.CreateLoginChallenge(handle, query.ChallengeRecord{
+		TokenHash: s.hashToken(challenge.Challenge),
+		Expires:   challenge.Expires,
+		Device:    device,
+		UserAgent: userAgent,
+	}); err != nil {
+		return types.LoginChallenge{}, err
+	}
+	return challenge, nil
+}
+
+// Whose login challenge this is, failing with UNAUTHENTICATED if it is
+// unknown or expired
+func (s Svc) GetLoginChallengeHandle(challenge string) (string, error) {
+	handle, _, err := s.Query.GetLoginChallenge(s.hashToken(challenge))
+	if types.IsNotFound(err) {
+		return "", types.Unauthenticated("invalid_challenge", "Missing, illegal or expired login challenge")
+	}
+	return handle, err
+}
+
+// The second step of logging in with 2FA, starting the session the
+// challenge was issued for if code checks out
+func (s Svc) CompleteLoginChallenge(challenge, code string) (types.SessionTokens, error) {
+	hash := s.hashToken(challenge)
+	handle, record, err := s.Query.GetLoginChallenge(hash)
+	if types.IsNotFound(err) {
+		return types.SessionTokens{}, types.Unauthenticated("invalid_challenge", "Missing, illegal or expired login challenge")
+	} else if err != nil {
+		return types.SessionTokens{}, err
+	}
+
+	if err := s.checkSecondFactor(handle, code); err != nil {
+		return types.SessionTokens{}, err
+	}
+	if err := s.Query.DestroyLoginChallenge(hash); err != nil {
+		return types.SessionTokens{}, err
+	}
+	return s.SetGetNewAuthToken(handle, record.Device, record.UserAgent)
+}
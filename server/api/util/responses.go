@@ -3,6 +3,9 @@ package util
 import (
 	"../../types"
 	"github.com/ant0ine/go-json-rest/rest"
+	"log"
+	"strconv"
+	"time"
 )
 
 //
@@ -31,18 +34,12 @@ func (u Util) SimpleJsonResponse(w rest.ResponseWriter, code int, message string
 	})
 }
 
-func (u Util) SimpleJsonReason(w rest.ResponseWriter, code int, message string) {
-	w.WriteHeader(code)
-	w.WriteJson(types.Json{
-		"reason": message,
-	})
-}
-
 func (u Util) SimpleJsonValidationReason(w rest.ResponseWriter, code int, err []error) {
 	errorMessage := decodeValidatorErrors(err)
 	w.WriteHeader(code)
 	w.WriteJson(types.Json{
 		"reason": errorMessage,
+		"code":   "validation_failed",
 	})
 }
 
@@ -52,14 +49,71 @@ func (u Util) PatchValidationReason(w rest.ResponseWriter, code int, err []error
 	w.WriteJson(types.Json{
 		"index":  index,
 		"reason": errorMessage,
+		"code":   "validation_failed",
 	})
 }
 
+// Answers with the status matching the kind of err, along with its reason
+// and machine-readable code. Internal causes are logged, not sent.
+func (u Util) ErrorResponse(w rest.ResponseWriter, err error) {
+	e := types.AsError(err)
+	if e.Err != nil {
+		log.Printf("%s: %v", e.Code, e.Err)
+	}
+	if e.RetryAfter > 0 {
+		// Whole seconds, rounded up so clients never come back too early
+		seconds := (e.RetryAfter + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(seconds), 10))
+	}
+	w.WriteHeader(StatusOf(e.Kind))
+	w.WriteJson(types.Json{
+		"reason": e.Reason,
+		"code":   e.Code,
+	})
+}
+
+// Like ErrorResponse, but shaped as RFC 6749 has the token endpoint
+// answer invalid requests
+func (u Util) OAuthErrorResponse(w rest.ResponseWriter, err error) {
+	e := types.AsError(err)
+	if e.Kind != types.INVALID_INPUT {
+		u.ErrorResponse(w, err)
+		return
+	}
+	w.WriteHeader(400)
+	w.WriteJson(types.Json{
+		"error":             e.Code,
+		"error_description": e.Reason,
+	})
+}
+
+func StatusOf(kind types.ErrorKind) int {
+	switch kind {
+	case types.NOT_FOUND:
+		return 404
+	case types.CONFLICT:
+		return 409
+	case types.FORBIDDEN:
+		return 403
+	case types.UNAVAILABLE:
+		return 503
+	case types.INVALID_INPUT:
+		return 400
+	case types.UNAUTHENTICATED:
+		return 401
+	case types.TOO_MANY_REQUESTS:
+		return 429
+	default:
+		return 500
+	}
+}
+
 func (u Util) FailedToAuthenticate(w rest.ResponseWriter) {
 	w.WriteHeader(401)
 	w.WriteJson(types.Json{
 		"response": "Failed to authenticate user request",
 		"reason":   "Missing, illegal or expired token",
+		"code":     "unauthenticated",
 	})
 }
 
@@ -67,5 +121,6 @@ func (u Util) FailedToDetermineHandleFromAuthToken(w rest.ResponseWriter) {
 	w.WriteHeader(500)
 	w.WriteJson(types.Json{
 		"reason": "Unexpected failure to retrieve owner of Authentication token",
+		"code":   "token_owner_unknown",
 	})
 }
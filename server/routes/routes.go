@@ -3,6 +3,7 @@ package routes
 import (
 	cheramiapi "../api"
 	"github.com/ant0ine/go-json-rest/rest"
+	"net/url"
 )
 
 func MakeHandler(api cheramiapi.Api, disableLogs bool) (rest.ResourceHandler, error) {
@@ -11,24 +12,90 @@ func MakeHandler(api cheramiapi.Api, disableLogs bool) (rest.ResourceHandler, er
 		DisableLogger:            disableLogs,
 	}
 
-	err := handler.SetRoutes(
+	routes := []*rest.Route{
 		&rest.Route{"POST", "/signup", api.Signup},
+		&rest.Route{"POST", "/changepassword", api.ChangePassword},
+		&rest.Route{"POST", "/forgotpassword", api.ForgotPassword},
+		&rest.Route{"POST", "/resetpassword", api.ResetPassword},
+		&rest.Route{"POST", "/2fa/enroll", api.EnrollTotp},
+		&rest.Route{"POST", "/2fa/confirm", api.ConfirmTotp},
+		&rest.Route{"POST", "/2fa/disable", api.DisableTotp},
 		&rest.Route{"POST", "/sessions", api.Login},
 		&rest.Route{"DELETE", "/sessions", api.Logout},
+		&rest.Route{"GET", "/sessions", api.GetSessions},
+		&rest.Route{"POST", "/sessions/refresh", api.RefreshSession},
+		&rest.Route{"POST", "/sessions/2fa", api.CompleteLogin},
+		&rest.Route{"DELETE", "/sessions/:id", api.DeleteSession},
+		&rest.Route{"GET", "/keys", api.GetApiKeys},
+		&rest.Route{"POST", "/keys", api.NewApiKey},
+		&rest.Route{"DELETE", "/keys/:id", api.RevokeApiKey},
+		&rest.Route{"POST", "/oauth/clients", api.RegisterOAuthClient},
+		&rest.Route{"GET", "/oauth/clients", api.GetOAuthClients},
+		&rest.Route{"DELETE", "/oauth/clients/:id", api.DeleteOAuthClient},
+		&rest.Route{"GET", "/oauth/authorize", api.GetOAuthConsent},
+		&rest.Route{"POST", "/oauth/authorize", api.AuthorizeOAuthClient},
+		&rest.Route{"POST", "/oauth/token", api.ExchangeOAuthCode},
 		&rest.Route{"GET", "/users/:handle", api.GetUser},
 		&rest.Route{"PATCH", "/users/:handle", api.EditUser},
+		&rest.Route{"DELETE", "/users/:handle", api.DeleteUser},
+		&rest.Route{"PUT", "/users/:handle/handle", api.RenameUser},
+		&rest.Route{"GET", "/users/:handle/blocked", api.GetBlockedUsers},
+		&rest.Route{"PATCH", "/users/:handle/blocked", api.PatchBlockedUsers},
+		&rest.Route{"GET", "/users/:handle/muted", api.GetMutes},
+		&rest.Route{"PATCH", "/users/:handle/muted", api.PatchMutes},
+		&rest.Route{"GET", "/users/:handle/privacy", api.GetProfileVisibility},
+		&rest.Route{"PATCH", "/users/:handle/privacy", api.SetProfileVisibility},
+		&rest.Route{"GET", "/users/:handle/verify", api.FollowVerificationLink},
+		&rest.Route{"POST", "/users/:handle/verify", api.VerifyEmail},
+		&rest.Route{"POST", "/users/:handle/verify/resend", api.ResendVerification},
+		&rest.Route{"POST", "/users/:handle/export", api.StartExport},
+		&rest.Route{"GET", "/users/:handle/export/:id", api.GetExport},
+		&rest.Route{"GET", "/users/:handle/export/:id/archive", api.GetExportArchive},
+		&rest.Route{"PUT", "/users/:handle/avatar", api.SetAvatar},
+		&rest.Route{"GET", "/avatars/:id", api.GetAvatar},
 		&rest.Route{"GET", "/users", api.SearchForUsers},
 		&rest.Route{"GET", "/messages", api.GetMessages},
 		&rest.Route{"GET", "/messages/:id", api.GetMessageById},
 		&rest.Route{"POST", "/messages", api.NewMessage},
 		&rest.Route{"PATCH", "/messages/:id", api.EditMessage},
-		&rest.Route{"DELETE", "/messages", api.DeleteMessage},
+		&rest.Route{"DELETE", "/messages/:id", api.DeleteMessage},
 		&rest.Route{"POST", "/joindefault", api.JoinDefault},
 		&rest.Route{"POST", "/join", api.Join},
 		&rest.Route{"POST", "/block", api.BlockUser},
 		&rest.Route{"POST", "/circles", api.NewCircle},
 		&rest.Route{"GET", "/circles", api.SearchCircles},
-	)
+		&rest.Route{"GET", "/circles/:id", api.GetCircleById},
+		&rest.Route{"PATCH", "/circles/:id", api.EditCircle},
+		&rest.Route{"DELETE", "/circles/:id", api.DeleteCircle},
+		&rest.Route{"GET", "/admin/lockouts", api.GetLockouts},
+		&rest.Route{"DELETE", "/admin/lockouts/:kind/#subject", api.ClearLockout},
+		&rest.Route{"GET", "/admin/users", api.GetAccounts},
+		&rest.Route{"PUT", "/admin/users/:handle/role", api.SetUserRole},
+		&rest.Route{"POST", "/admin/users/:handle/suspension", api.SuspendUser},
+		&rest.Route{"DELETE", "/admin/users/:handle/suspension", api.ReinstateUser},
+		&rest.Route{"DELETE", "/admin/users/:handle/sessions", api.ForceLogout},
+		&rest.Route{"PATCH", "/admin/circles/:id", api.AdminEditCircle},
+		&rest.Route{"DELETE", "/admin/circles/:id", api.AdminDeleteCircle},
+		&rest.Route{"PATCH", "/admin/messages/:id", api.AdminEditMessage},
+		&rest.Route{"DELETE", "/admin/messages/:id", api.AdminDeleteMessage},
+	}
+	for _, route := range routes {
+		route.Func = unescapePathParams(route.Func)
+	}
+	err := handler.SetRoutes(routes...)
 
 	return handler, err
 }
+
+// The router matches paths as escaped and leaves their parameters so, a
+// handle such as pelé would reach the api as pel%C3%A9
+func unescapePathParams(handler rest.HandlerFunc) rest.HandlerFunc {
+	return func(w rest.ResponseWriter, r *rest.Request) {
+		for name, value := range r.PathParams {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				r.PathParams[name] = unescaped
+			}
+		}
+		handler(w, r)
+	}
+}
@@ -1,8 +1,15 @@
 package api_test
 
 import (
+	"../api/service"
+	"../types"
 	"./helper"
 	. "gopkg.in/check.v1"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 //
@@ -91,7 +98,9 @@ func (s *TestSuite) TestSignupHandleTaken(c *C) {
 		c.Error(err)
 	}
 
-	c.Check(helper.GetJsonReasonMessage(response), Equals, "Sorry, handle or email is already taken")
+	reason, code := helper.GetJsonReasonAndCode(response)
+	c.Check(reason, Equals, "Sorry, handle or email is already taken")
+	c.Check(code, Equals, "handle_taken")
 	c.Check(response.StatusCode, Equals, 409)
 }
 
@@ -103,10 +112,40 @@ func (s *TestSuite) TestSignupEmailTaken(c *C) {
 		c.Error(err)
 	}
 
-	c.Check(helper.GetJsonReasonMessage(response), Equals, "Sorry, handle or email is already taken")
+	reason, code := helper.GetJsonReasonAndCode(response)
+	c.Check(reason, Equals, "Sorry, handle or email is already taken")
+	c.Check(code, Equals, "email_taken")
 	c.Check(response.StatusCode, Equals, 409)
 }
 
+func (s *TestSuite) TestSignupHandleTakenInAnyForm(c *C) {
+	req.PostSignup("Pel\u00e9", "pele@test.io", "password1", "password1")
+
+	// Decomposed, and in other casings
+	for i, handle := range []string{"Pele\u0301", "pel\u00e9", "PEL\u00c9"} {
+		response, _ := req.PostSignup(handle, "test"+strconv.Itoa(i)+"@test.io", "password1", "password1")
+		_, code := helper.GetJsonReasonAndCode(response)
+		c.Check(code, Equals, "handle_taken", Commentf("Handle %q", handle))
+		c.Check(response.StatusCode, Equals, 409)
+	}
+}
+
+func (s *TestSuite) TestSignupHandleConfusable(c *C) {
+	req.PostSignup("paypal", "paypal@test.io", "password1", "password1")
+	req.PostSignup("Ian", "ian@test.io", "password1", "password1")
+
+	// Cyrillic, Greek capitals and Latin look-alikes
+	for i, handle := range []string{"\u0440\u0430\u0443\u0440\u0430l", "\u03a1\u0391\u03a5\u03a1\u0391L", "lan", "PAYPA1"} {
+		response, _ := req.PostSignup(handle, "test"+strconv.Itoa(i)+"@test.io", "password1", "password1")
+		_, code := helper.GetJsonReasonAndCode(response)
+		c.Check(code, Equals, "handle_confusable", Commentf("Handle %q", handle))
+		c.Check(response.StatusCode, Equals, 409)
+	}
+
+	response, _ := req.PostSignup("paypals", "paypals@test.io", "password1", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
 func (s *TestSuite) TestSignupCreated(c *C) {
 	response, err := req.PostSignup("handleA", "test@test.io", "password1", "password1")
 	if err != nil {
@@ -173,6 +212,18 @@ func (s *TestSuite) TestLoginOK(c *C) {
 	c.Check(response.StatusCode, Equals, 201)
 }
 
+func (s *TestSuite) TestLoginAnyCasing(c *C) {
+	req.PostSignup("Pel\u00e9", "test@test.io", "password1", "password1")
+
+	response, _ := req.PostSessions("PELE\u0301", "password1")
+	c.Assert(response.StatusCode, Equals, 201)
+	res := struct {
+		Handle string
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(res.Handle, Equals, "Pel\u00e9")
+}
+
 //
 // Logout Tests:
 //
@@ -200,3 +251,1660 @@ func (s *TestSuite) TestLogoutOK(c *C) {
 
 	c.Check(response.StatusCode, Equals, 204)
 }
+
+//
+// Session Tests:
+//
+
+func getSessions(c *C, token string) []types.SessionView {
+	response, err := req.GetSessions(token)
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 200)
+	res := struct {
+		Results []types.SessionView
+		Count   int
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(res.Count, Equals, len(res.Results))
+	return res.Results
+}
+
+func (s *TestSuite) TestLoginKeepsOtherSessions(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	web := req.PostSessionGetAuthToken("handleA", "password1")
+	response, err := req.PostSessionsFromDevice("handleA", "password1", "android")
+	if err != nil {
+		c.Error(err)
+	}
+	android := helper.GetAuthTokenFromResponse(response)
+
+	sessions := getSessions(c, web)
+	c.Assert(len(sessions), Equals, 2)
+	for _, session := range sessions {
+		c.Check(session.Id, Not(Equals), "")
+		c.Check(session.UserAgent, Not(Equals), "")
+		c.Check(session.Current, Equals, session.Device == "")
+	}
+
+	response, err = req.DeleteSessions(android)
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 204)
+	c.Check(len(getSessions(c, web)), Equals, 1)
+}
+
+func (s *TestSuite) TestDeleteSessionById(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password2", "password2")
+
+	first := req.PostSessionGetAuthToken("handleA", "password1")
+	second := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password2")
+
+	var firstId string
+	for _, session := range getSessions(c, second) {
+		if !session.Current {
+			firstId = session.Id
+		}
+	}
+
+	// Sessions of other users cannot be revoked
+	response, err := req.DeleteSession(firstId, other)
+	if err != nil {
+		c.Error(err)
+	}
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "session_not_found")
+	c.Check(response.StatusCode, Equals, 404)
+
+	response, err = req.DeleteSession(firstId, second)
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 204)
+
+	response, _ = req.GetSessions(first)
+	c.Check(response.StatusCode, Equals, 401)
+	c.Check(len(getSessions(c, second)), Equals, 1)
+}
+
+func (s *TestSuite) TestDeleteOtherSessions(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	first := req.PostSessionGetAuthToken("handleA", "password1")
+	second := req.PostSessionGetAuthToken("handleA", "password1")
+	current := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, err := req.DeleteSession("others", current)
+	if err != nil {
+		c.Error(err)
+	}
+	res := struct {
+		Response string
+		Count    int
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(res.Count, Equals, 2)
+
+	for _, token := range []string{first, second} {
+		response, _ := req.GetSessions(token)
+		c.Check(response.StatusCode, Equals, 401)
+	}
+	sessions := getSessions(c, current)
+	c.Assert(len(sessions), Equals, 1)
+	c.Check(sessions[0].Current, Equals, true)
+}
+
+//
+// Refresh Tests:
+//
+
+func (s *TestSuite) TestRefreshRotatesTokens(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	login := req.PostSessionGetTokens("handleA", "password1")
+	c.Check(login.RefreshToken, Not(Equals), "")
+	c.Check(login.RefreshExpires.After(login.Expires), Equals, true)
+
+	response, err := req.PostSessionsRefresh(login.RefreshToken)
+	if err != nil {
+		c.Error(err)
+	}
+	refreshed := types.SessionTokens{}
+	helper.Unmarshal(response, &refreshed)
+	c.Check(response.StatusCode, Equals, 201)
+	c.Check(refreshed.Handle, Equals, "handleA")
+	c.Check(refreshed.Token, Not(Equals), login.Token)
+	c.Check(refreshed.RefreshToken, Not(Equals), login.RefreshToken)
+
+	// The old access token went with the rotation, the session did not
+	response, _ = req.GetSessions(login.Token)
+	c.Check(response.StatusCode, Equals, 401)
+	c.Check(len(getSessions(c, refreshed.Token)), Equals, 1)
+}
+
+func (s *TestSuite) TestRefreshReuseRevokesSession(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	login := req.PostSessionGetTokens("handleA", "password1")
+	response, _ := req.PostSessionsRefresh(login.RefreshToken)
+	refreshed := types.SessionTokens{}
+	helper.Unmarshal(response, &refreshed)
+
+	response, err := req.PostSessionsRefresh(login.RefreshToken)
+	if err != nil {
+		c.Error(err)
+	}
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "refresh_token_reused")
+	c.Check(response.StatusCode, Equals, 401)
+
+	response, _ = req.GetSessions(refreshed.Token)
+	c.Check(response.StatusCode, Equals, 401)
+	response, _ = req.PostSessionsRefresh(refreshed.RefreshToken)
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+func (s *TestSuite) TestRefreshUnknownToken(c *C) {
+	response, err := req.PostSessionsRefresh("not-a-refresh-token")
+	if err != nil {
+		c.Error(err)
+	}
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_refresh_token")
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+func (s *TestSuite) TestRefreshAfterAccessTokenExpired(c *C) {
+	defer func(policy service.SessionPolicy) {
+		a.Svc.Sessions = policy
+	}(a.Svc.Sessions)
+	a.Svc.Sessions.AccessTokenDuration = -time.Minute
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	login := req.PostSessionGetTokens("handleA", "password1")
+
+	response, _ := req.GetSessions(login.Token)
+	c.Check(response.StatusCode, Equals, 401)
+
+	a.Svc.Sessions.AccessTokenDuration = time.Hour
+	response, _ = req.PostSessionsRefresh(login.RefreshToken)
+	refreshed := types.SessionTokens{}
+	helper.Unmarshal(response, &refreshed)
+	c.Check(response.StatusCode, Equals, 201)
+
+	response, _ = req.GetSessions(refreshed.Token)
+	c.Check(response.StatusCode, Equals, 200)
+}
+
+func (s *TestSuite) TestTokensAreHashedAtRest(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	login := req.PostSessionGetTokens("handleA", "password1")
+
+	_, err := a.Svc.Query.DeriveHandleFromAuthToken(login.Token)
+	c.Check(types.IsNotFound(err), Equals, true)
+
+	handle, err := a.Svc.GetHandleFromAuthorization(login.Token)
+	c.Check(err, IsNil)
+	c.Check(handle, Equals, "handleA")
+}
+
+//
+// Password Tests:
+//
+
+func (s *TestSuite) TestChangePasswordWrongOldPassword(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, err := req.PostChangePassword(token, "password2", "password3", "password3")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+func (s *TestSuite) TestChangePasswordMismatch(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, err := req.PostChangePassword(token, "password1", "password2", "password3")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 403)
+	c.Check(helper.GetJsonReasonMessage(response), Equals, "Passwords do not match")
+}
+
+func (s *TestSuite) TestChangePasswordUnauthenticated(c *C) {
+	response, err := req.PostChangePassword("Token nope", "password1", "password2", "password2")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+func (s *TestSuite) TestChangePasswordRevokesOtherSessions(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	other := req.PostSessionGetAuthToken("handleA", "password1")
+	current := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, err := req.PostChangePassword(current, "password1", "password2", "password2")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 200)
+
+	response, _ = req.GetSessions(other)
+	c.Check(response.StatusCode, Equals, 401)
+	c.Check(len(getSessions(c, current)), Equals, 1)
+
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostSessions("handleA", "password2")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+// Requests a reset for email and reads the code out of the mail sent
+func requestResetCode(c *C, email string) string {
+	response, err := req.PostForgotPassword(email)
+	if err != nil {
+		c.Error(err)
+	}
+	c.Assert(response.StatusCode, Equals, 202)
+
+	message, ok := mailbox.LastTo(email)
+	c.Assert(ok, Equals, true)
+	for _, line := range strings.Split(message.Body, "\n") {
+		if strings.HasPrefix(line, "Reset code: ") {
+			return strings.TrimPrefix(line, "Reset code: ")
+		}
+	}
+	c.Fatalf("No reset code in %q", message.Body)
+	return ""
+}
+
+func (s *TestSuite) TestResetPasswordOK(c *C) {
+	req.PostSignup("handleA", "reset@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	code := requestResetCode(c, "reset@test.io")
+	response, err := req.PostResetPassword(code, "password2", "password2")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 200)
+
+	// Every session goes, whoever asked for the reset may not be the owner
+	response, _ = req.GetSessions(token)
+	c.Check(response.StatusCode, Equals, 401)
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostSessions("handleA", "password2")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+func (s *TestSuite) TestResetPasswordSingleUse(c *C) {
+	req.PostSignup("handleA", "reset@test.io", "password1", "password1")
+
+	reset := requestResetCode(c, "reset@test.io")
+	response, _ := req.PostResetPassword(reset, "password2", "password2")
+	c.Check(response.StatusCode, Equals, 200)
+
+	response, err := req.PostResetPassword(reset, "password3", "password3")
+	if err != nil {
+		c.Error(err)
+	}
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_reset_token")
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+func (s *TestSuite) TestResetPasswordOnlyLatestCodeWorks(c *C) {
+	req.PostSignup("handleA", "reset@test.io", "password1", "password1")
+
+	first := requestResetCode(c, "reset@test.io")
+	second := requestResetCode(c, "reset@test.io")
+
+	response, _ := req.PostResetPassword(first, "password2", "password2")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostResetPassword(second, "password2", "password2")
+	c.Check(response.StatusCode, Equals, 200)
+}
+
+func (s *TestSuite) TestResetPasswordExpired(c *C) {
+	defer func(policy service.SessionPolicy) {
+		a.Svc.Sessions = policy
+	}(a.Svc.Sessions)
+	a.Svc.Sessions.PasswordResetDuration = -time.Minute
+
+	req.PostSignup("handleA", "reset@test.io", "password1", "password1")
+
+	code := requestResetCode(c, "reset@test.io")
+	response, err := req.PostResetPassword(code, "password2", "password2")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+func (s *TestSuite) TestForgotPasswordUnknownEmail(c *C) {
+	sent := len(mailbox.Sent())
+
+	response, err := req.PostForgotPassword("nobody@test.io")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 202)
+	c.Check(len(mailbox.Sent()), Equals, sent)
+}
+
+//
+// Verification Tests:
+//
+
+// Reads the verification link out of the latest mail sent to email
+func verificationLink(c *C, email string) string {
+	message, ok := mailbox.LastTo(email)
+	c.Assert(ok, Equals, true)
+	for _, line := range strings.Split(message.Body, "\n") {
+		if strings.HasPrefix(line, "Verification link: ") {
+			return strings.TrimPrefix(line, "Verification link: ")
+		}
+	}
+	c.Fatalf("No verification link in %q", message.Body)
+	return ""
+}
+
+// Restores the restrictions on unverified users that the suite lifts
+func restrictUnverified() func() {
+	policy := a.Svc.Verification
+	a.Svc.Verification.UnverifiedPublishPublic = false
+	a.Svc.Verification.UnverifiedPublicCircles = false
+	return func() {
+		a.Svc.Verification = policy
+	}
+}
+
+func (s *TestSuite) TestSignupStartsUnverified(c *C) {
+	req.PostSignup("handleA", "verify@test.io", "password1", "password1")
+
+	verified, err := a.Svc.EmailIsVerified("handleA")
+	c.Check(err, IsNil)
+	c.Check(verified, Equals, false)
+}
+
+func (s *TestSuite) TestFollowVerificationLink(c *C) {
+	req.PostSignup("handleA", "verify@test.io", "password1", "password1")
+
+	response, err := req.GetVerificationLink(verificationLink(c, "verify@test.io"))
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 200)
+
+	verified, _ := a.Svc.EmailIsVerified("handleA")
+	c.Check(verified, Equals, true)
+
+	// Following the link again is harmless
+	response, _ = req.GetVerificationLink(verificationLink(c, "verify@test.io"))
+	c.Check(response.StatusCode, Equals, 200)
+}
+
+func (s *TestSuite) TestPostVerifyTamperedSignature(c *C) {
+	req.PostSignup("handleA", "verify@test.io", "password1", "password1")
+	req.PostSignup("handleB", "other@test.io", "password1", "password1")
+
+	link, _ := url.Parse(verificationLink(c, "verify@test.io"))
+	expires, _ := strconv.ParseInt(link.Query().Get("expires"), 10, 64)
+	signature := link.Query().Get("signature")
+
+	// Neither a longer lifetime nor someone else's handle carry the signature
+	for _, attempt := range []struct {
+		handle  string
+		expires int64
+	}{
+		{"handleA", expires + 3600},
+		{"handleB", expires},
+	} {
+		response, err := req.PostVerify(attempt.handle, attempt.expires, signature)
+		if err != nil {
+			c.Error(err)
+		}
+		_, code := helper.GetJsonReasonAndCode(response)
+		c.Check(code, Equals, "invalid_verification_link")
+		c.Check(response.StatusCode, Equals, 403)
+	}
+
+	response, _ := req.PostVerify("handleA", expires, signature)
+	c.Check(response.StatusCode, Equals, 200)
+	verified, _ := a.Svc.EmailIsVerified("handleB")
+	c.Check(verified, Equals, false)
+}
+
+func (s *TestSuite) TestVerificationLinkExpired(c *C) {
+	defer func(policy service.VerificationPolicy) {
+		a.Svc.Verification = policy
+	}(a.Svc.Verification)
+	a.Svc.Verification.LinkDuration = -time.Minute
+
+	req.PostSignup("handleA", "verify@test.io", "password1", "password1")
+
+	response, err := req.GetVerificationLink(verificationLink(c, "verify@test.io"))
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+func (s *TestSuite) TestResendVerification(c *C) {
+	req.PostSignup("handleA", "verify@test.io", "password1", "password1")
+	req.PostSignup("handleB", "other@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	sent := len(mailbox.Sent())
+
+	response, err := req.PostResendVerification(token, "handleB")
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostResendVerification(token, "handleA")
+	c.Check(response.StatusCode, Equals, 202)
+	c.Check(len(mailbox.Sent()), Equals, sent+1)
+
+	req.GetVerificationLink(verificationLink(c, "verify@test.io"))
+	response, _ = req.PostResendVerification(token, "handleA")
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "already_verified")
+	c.Check(response.StatusCode, Equals, 409)
+}
+
+func (s *TestSuite) TestUnverifiedCannotPublishPublicly(c *C) {
+	defer restrictUnverified()()
+
+	req.PostSignup("handleA", "verify@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	broadcast, _ := a.Svc.GetCircleId("handleA", types.BROADCAST)
+	gold, _ := a.Svc.GetCircleId("handleA", types.GOLD)
+
+	response, err := req.PostMessageWithCircles("Hello world", token, []string{broadcast})
+	if err != nil {
+		c.Error(err)
+	}
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "email_unverified")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostMessageWithCircles("Hello friends", token, []string{gold})
+	c.Check(response.StatusCode, Equals, 201)
+
+	req.GetVerificationLink(verificationLink(c, "verify@test.io"))
+	response, _ = req.PostMessageWithCircles("Hello world", token, []string{broadcast})
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+func (s *TestSuite) TestUnverifiedCannotCreatePublicCircle(c *C) {
+	defer restrictUnverified()()
+
+	req.PostSignup("handleA", "verify@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, err := req.PostCircles(token, "Agora", true)
+	if err != nil {
+		c.Error(err)
+	}
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostCircles(token, "Hearth", false)
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+//
+// Lockout Tests:
+//
+
+func (s *TestSuite) TestLoginBacksOffAfterFreeFailures(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFreeFailures = 1
+	a.Svc.Lockouts.Backoff = time.Minute
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	response, _ := req.PostSessions("handleA", "password2")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostSessions("handleA", "password2")
+	c.Check(response.StatusCode, Equals, 403)
+
+	// Even the right password has to wait out the backoff
+	response, err := req.PostSessions("handleA", "password1")
+	if err != nil {
+		c.Error(err)
+	}
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "login_throttled")
+	c.Check(response.StatusCode, Equals, 429)
+	c.Check(response.Header.Get("Retry-After"), Equals, "60")
+}
+
+func (s *TestSuite) TestLoginLocksOutHandle(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFailures = 3
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+
+	for i := 0; i < 3; i++ {
+		response, _ := req.PostSessions("handleA", "password2")
+		c.Check(response.StatusCode, Equals, 403)
+	}
+
+	response, err := req.PostSessions("handleA", "password1")
+	if err != nil {
+		c.Error(err)
+	}
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "login_locked")
+	c.Check(response.StatusCode, Equals, 429)
+	retry, _ := strconv.Atoi(response.Header.Get("Retry-After"))
+	c.Check(retry > 0, Equals, true)
+
+	response, _ = req.PostSessions("handleB", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+func (s *TestSuite) TestLoginLocksOutIP(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFreeFailures = 10
+	a.Svc.Lockouts.IPFailures = 3
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	for _, handle := range []string{"handleB", "handleC", "handleD"} {
+		response, _ := req.PostSessions(handle, "password1")
+		c.Check(response.StatusCode, Equals, 403)
+	}
+
+	response, _ := req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 429)
+}
+
+func (s *TestSuite) TestLoginSuccessForgetsFailures(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFreeFailures = 2
+	a.Svc.Lockouts.Backoff = time.Minute
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 2; i++ {
+			response, _ := req.PostSessions("handleA", "password2")
+			c.Check(response.StatusCode, Equals, 403)
+		}
+		response, _ := req.PostSessions("handleA", "password1")
+		c.Check(response.StatusCode, Equals, 201)
+	}
+}
+
+func (s *TestSuite) TestLoginFailuresLeaveTheWindow(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFreeFailures = 1
+	a.Svc.Lockouts.HandleFailures = 2
+	a.Svc.Lockouts.Backoff = time.Minute
+	a.Svc.Lockouts.FailureWindow = -time.Minute
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	// Every failure is out of the window by the next attempt
+	for i := 0; i < 3; i++ {
+		response, _ := req.PostSessions("handleA", "password2")
+		c.Check(response.StatusCode, Equals, 403)
+	}
+	response, _ := req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+	c.Check(len(a.Svc.GetLockouts()), Equals, 0)
+}
+
+func (s *TestSuite) TestLoginSuccessWearsDownIPFailures(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFreeFailures = 10
+	a.Svc.Lockouts.IPFailures = 3
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	// Users behind the same IP logging in keep it below the lockout
+	for _, handle := range []string{"handleB", "handleC", "handleD", "handleE"} {
+		response, _ := req.PostSessions(handle, "password1")
+		c.Check(response.StatusCode, Equals, 403)
+		if handle == "handleC" || handle == "handleD" {
+			response, _ = req.PostSessions("handleA", "password1")
+			c.Check(response.StatusCode, Equals, 201)
+		}
+	}
+	response, _ := req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+func (s *TestSuite) TestLockoutRunsOut(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFailures = 1
+	a.Svc.Lockouts.LockoutDuration = -time.Minute
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	req.PostSessions("handleA", "password2")
+
+	response, _ := req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+
+	events, err := a.Svc.GetLockoutEvents(10)
+	c.Assert(err, IsNil)
+	c.Assert(len(events), Equals, 2)
+	c.Check(events[0].Event, Equals, "unlocked")
+	c.Check(events[1].Event, Equals, "locked")
+	c.Check(events[1].Subject, Equals, "handleA")
+}
+
+func (s *TestSuite) TestAdminClearsLockout(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFailures = 1
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleB")
+	admin := req.PostSessionGetAuthToken("handleB", "password1")
+	req.PostSessions("handleA", "password2")
+
+	response, err := req.GetLockouts(admin)
+	if err != nil {
+		c.Error(err)
+	}
+	res := struct {
+		Results []types.Lockout
+		Events  []types.LockoutEvent
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Assert(len(res.Results), Equals, 1)
+	c.Check(res.Results[0].Kind, Equals, "handle")
+	c.Check(res.Results[0].Subject, Equals, "handleA")
+	c.Assert(len(res.Events), Equals, 1)
+	c.Check(res.Events[0].Event, Equals, "locked")
+
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 429)
+
+	response, _ = req.DeleteLockout(admin, "handle", "handleA")
+	c.Check(response.StatusCode, Equals, 204)
+	response, _ = req.DeleteLockout(admin, "handle", "handleA")
+	c.Check(response.StatusCode, Equals, 404)
+
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	events, _ := a.Svc.GetLockoutEvents(1)
+	c.Assert(len(events), Equals, 1)
+	c.Check(events[0].Event, Equals, "cleared")
+	c.Check(events[0].By, Equals, "handleB")
+
+	// Only admins get to see or clear lockouts
+	response, _ = req.GetLockouts(token)
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.DeleteLockout(token, "ip", "127.0.0.1")
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+//
+// Two-Factor Tests:
+//
+
+// Enrolls and confirms handle in 2FA with a code for now, answering with
+// the secret and the recovery codes
+func enableTotp(c *C, token string) (secret string, recovery []string) {
+	response, err := req.PostTotpEnroll(token)
+	if err != nil {
+		c.Fatal(err)
+	}
+	enrollment := types.TotpEnrollment{}
+	helper.Unmarshal(response, &enrollment)
+	c.Assert(response.StatusCode, Equals, 201)
+
+	code, err := service.TotpCode(enrollment.Secret, time.Now())
+	c.Assert(err, IsNil)
+	response, err = req.PostTotpConfirm(token, code)
+	if err != nil {
+		c.Fatal(err)
+	}
+	res := struct{ RecoveryCodes []string }{}
+	helper.Unmarshal(response, &res)
+	c.Assert(response.StatusCode, Equals, 200)
+	return enrollment.Secret, res.RecoveryCodes
+}
+
+// The challenge answered by logging in with 2FA enabled
+func loginChallenge(c *C, handle, password string) string {
+	response, err := req.PostSessions(handle, password)
+	if err != nil {
+		c.Fatal(err)
+	}
+	res := types.LoginChallenge{}
+	helper.Unmarshal(response, &res)
+	c.Assert(response.StatusCode, Equals, 200)
+	c.Assert(res.Challenge, Not(Equals), "")
+	return res.Challenge
+}
+
+// A code one step ahead, as the one for now is spent by enableTotp
+func nextTotpCode(c *C, secret string) string {
+	code, err := service.TotpCode(secret, time.Now().Add(service.TOTP_PERIOD))
+	c.Assert(err, IsNil)
+	return code
+}
+
+func (s *TestSuite) TestTotpEnrollment(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, err := req.PostTotpEnroll(token)
+	if err != nil {
+		c.Error(err)
+	}
+	enrollment := types.TotpEnrollment{}
+	helper.Unmarshal(response, &enrollment)
+	c.Check(response.StatusCode, Equals, 201)
+	c.Check(strings.HasPrefix(enrollment.Uri, "otpauth://totp/CherAmi:handleA?"), Equals, true)
+	uri, _ := url.Parse(enrollment.Uri)
+	c.Check(uri.Query().Get("secret"), Equals, enrollment.Secret)
+	c.Check(uri.Query().Get("issuer"), Equals, "CherAmi")
+
+	// Logging in is unchanged until the enrollment is confirmed
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+
+	response, _ = req.PostTotpConfirm(token, "000000")
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_code")
+	c.Check(response.StatusCode, Equals, 403)
+
+	good, _ := service.TotpCode(enrollment.Secret, time.Now())
+	response, _ = req.PostTotpConfirm(token, good)
+	res := struct{ RecoveryCodes []string }{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(len(res.RecoveryCodes), Equals, service.RECOVERY_CODE_COUNT)
+
+	response, _ = req.PostTotpEnroll(token)
+	c.Check(response.StatusCode, Equals, 409)
+}
+
+func (s *TestSuite) TestTotpTwoStepLogin(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	secret, _ := enableTotp(c, req.PostSessionGetAuthToken("handleA", "password1"))
+
+	response, err := req.PostSessions("handleA", "password1")
+	if err != nil {
+		c.Error(err)
+	}
+	res := types.Json{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(res["token"], IsNil)
+	challenge, _ := res["challenge"].(string)
+
+	response, err = req.PostSessionsChallenge(challenge, nextTotpCode(c, secret))
+	if err != nil {
+		c.Error(err)
+	}
+	tokens := types.SessionTokens{}
+	helper.Unmarshal(response, &tokens)
+	c.Check(response.StatusCode, Equals, 201)
+	c.Check(tokens.Handle, Equals, "handleA")
+	c.Check(tokens.Token, Not(Equals), "")
+	c.Check(tokens.RefreshToken, Not(Equals), "")
+
+	// A challenge buys one session
+	response, _ = req.PostSessionsChallenge(challenge, nextTotpCode(c, secret))
+	c.Check(response.StatusCode, Equals, 401)
+	response, _ = req.PostSessionsChallenge("bogus", nextTotpCode(c, secret))
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+func (s *TestSuite) TestTotpCodeCannotBeReplayed(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	secret, _ := enableTotp(c, req.PostSessionGetAuthToken("handleA", "password1"))
+	spent, _ := service.TotpCode(secret, time.Now())
+
+	challenge := loginChallenge(c, "handleA", "password1")
+	response, _ := req.PostSessionsChallenge(challenge, spent)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_code")
+	c.Check(response.StatusCode, Equals, 403)
+
+	// A wrong code leaves the challenge standing
+	response, _ = req.PostSessionsChallenge(challenge, nextTotpCode(c, secret))
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+func (s *TestSuite) TestTotpRecoveryCodeSingleUse(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	_, recovery := enableTotp(c, req.PostSessionGetAuthToken("handleA", "password1"))
+
+	response, _ := req.PostSessionsChallenge(loginChallenge(c, "handleA", "password1"), strings.ToUpper(recovery[0]))
+	c.Check(response.StatusCode, Equals, 201)
+
+	response, _ = req.PostSessionsChallenge(loginChallenge(c, "handleA", "password1"), recovery[0])
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostSessionsChallenge(loginChallenge(c, "handleA", "password1"), recovery[1])
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+// The store refuses a step or recovery hash already used, whatever the
+// caller read before
+func (s *TestSuite) TestTotpStoreUsesCodesUpOnce(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	enableTotp(c, req.PostSessionGetAuthToken("handleA", "password1"))
+	totp, err := a.Svc.Query.GetTotp("handleA")
+	c.Assert(err, IsNil)
+
+	c.Check(a.Svc.Query.ConsumeTotpStep("handleA", totp.LastStep+1), IsNil)
+	err = a.Svc.Query.ConsumeTotpStep("handleA", totp.LastStep+1)
+	c.Check(types.IsKind(err, types.FORBIDDEN), Equals, true)
+	err = a.Svc.Query.ConsumeTotpStep("handleA", totp.LastStep)
+	c.Check(types.IsKind(err, types.FORBIDDEN), Equals, true)
+
+	c.Check(a.Svc.Query.ConsumeRecoveryHash("handleA", totp.RecoveryHashes[0]), IsNil)
+	err = a.Svc.Query.ConsumeRecoveryHash("handleA", totp.RecoveryHashes[0])
+	c.Check(types.IsKind(err, types.FORBIDDEN), Equals, true)
+
+	after, _ := a.Svc.Query.GetTotp("handleA")
+	c.Check(after.LastStep, Equals, totp.LastStep+1)
+	c.Check(after.RecoveryHashes, DeepEquals, totp.RecoveryHashes[1:])
+}
+
+func (s *TestSuite) TestTotpCodeRacedThroughLoginsWorksOnce(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	secret, recovery := enableTotp(c, req.PostSessionGetAuthToken("handleA", "password1"))
+
+	for _, code := range []string{nextTotpCode(c, secret), recovery[0]} {
+		challenges := make([]string, 4)
+		for i := range challenges {
+			challenges[i] = loginChallenge(c, "handleA", "password1")
+		}
+
+		statuses := make(chan int, len(challenges))
+		var wg sync.WaitGroup
+		for _, challenge := range challenges {
+			wg.Add(1)
+			go func(challenge string) {
+				defer wg.Done()
+				response, err := req.PostSessionsChallenge(challenge, code)
+				if err != nil {
+					statuses <- 0
+					return
+				}
+				statuses <- response.StatusCode
+			}(challenge)
+		}
+		wg.Wait()
+		close(statuses)
+
+		passed := 0
+		for status := range statuses {
+			if status == 201 {
+				passed++
+			}
+		}
+		c.Check(passed, Equals, 1)
+	}
+}
+
+func (s *TestSuite) TestTotpWrongCodesCountAsFailedLogins(c *C) {
+	defer func(policy service.LockoutPolicy) {
+		a.Svc.Lockouts = policy
+	}(a.Svc.Lockouts)
+	a.Svc.Lockouts.HandleFailures = 2
+
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	secret, _ := enableTotp(c, req.PostSessionGetAuthToken("handleA", "password1"))
+
+	challenge := loginChallenge(c, "handleA", "password1")
+	for i := 0; i < 2; i++ {
+		response, _ := req.PostSessionsChallenge(challenge, "abcde-fghij")
+		c.Check(response.StatusCode, Equals, 403)
+	}
+
+	response, _ := req.PostSessionsChallenge(challenge, nextTotpCode(c, secret))
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "login_locked")
+	c.Check(response.StatusCode, Equals, 429)
+}
+
+func (s *TestSuite) TestTotpDisable(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	_, recovery := enableTotp(c, token)
+
+	response, _ := req.PostTotpDisable(token, "password2", recovery[0])
+	c.Check(helper.GetJsonReasonMessage(response), Equals, "Password is incorrect")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostTotpDisable(token, "password1", "000000")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostTotpDisable(token, "password1", recovery[0])
+	c.Check(response.StatusCode, Equals, 200)
+
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+	response, _ = req.PostTotpDisable(token, "password1", recovery[1])
+	c.Check(response.StatusCode, Equals, 409)
+}
+
+//
+// API Key Tests:
+//
+
+func (s *TestSuite) TestApiKeyCreateAndList(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, err := req.PostApiKey(token, "announcer", []string{"messages:post", "feed:read"}, "")
+	if err != nil {
+		c.Error(err)
+	}
+	created := struct {
+		Key    string
+		Id     string
+		Name   string
+		Scopes []string
+	}{}
+	helper.Unmarshal(response, &created)
+	c.Check(response.StatusCode, Equals, 201)
+	c.Check(strings.HasPrefix(created.Key, "Key "), Equals, true)
+	c.Check(created.Name, Equals, "announcer")
+	c.Check(created.Scopes, DeepEquals, []string{"messages:post", "feed:read"})
+
+	// Using the key shows in the listing, the key itself never does
+	response, _ = req.PostMessage("Meeting at noon", created.Key)
+	c.Check(response.StatusCode, Equals, 201)
+
+	response, _ = req.GetApiKeys(token)
+	res := struct {
+		Results []types.Json
+		Count   int
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Assert(res.Count, Equals, 1)
+	c.Check(res.Results[0]["id"], Equals, created.Id)
+	c.Check(res.Results[0]["key"], IsNil)
+	lastUsed, _ := time.Parse(time.RFC3339, res.Results[0]["lastused"].(string))
+	c.Check(lastUsed.IsZero(), Equals, false)
+}
+
+func (s *TestSuite) TestApiKeyScopeEnforced(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	key := req.PostApiKeyGetKey(token, "reader", []string{"feed:read"})
+
+	response, _ := req.GetMessages(types.Json{"token": key})
+	c.Check(response.StatusCode, Equals, 200)
+
+	response, _ = req.PostMessage("Not allowed", key)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "insufficient_scope")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostCircles(key, "MyCircle", false)
+	c.Check(response.StatusCode, Equals, 403)
+
+	// Account management takes a session whatever the scopes
+	response, _ = req.GetSessions(key)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "session_required")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostApiKey(key, "another", []string{"feed:read"}, "")
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+func (s *TestSuite) TestApiKeyManagesCircles(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	key := req.PostApiKeyGetKey(token, "organizer", []string{"circles:manage"})
+
+	response, _ := req.PostCircles(key, "MyCircle", false)
+	c.Check(response.StatusCode, Equals, 201)
+	response, _ = req.GetCircles(types.Json{"token": key})
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+func (s *TestSuite) TestApiKeyInvalidRequests(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.PostApiKey(token, "bot", []string{"feed:write"}, "")
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_scope")
+	c.Check(response.StatusCode, Equals, 400)
+
+	response, _ = req.PostApiKey(token, "bot", []string{}, "")
+	c.Check(response.StatusCode, Equals, 400)
+
+	response, _ = req.PostApiKey(token, " ", []string{"feed:read"}, "")
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "missing_key_name")
+	c.Check(response.StatusCode, Equals, 400)
+
+	response, _ = req.PostApiKey(token, "bot", []string{"feed:read"}, time.Now().Add(-time.Hour).Format(time.RFC3339))
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_expiry")
+	c.Check(response.StatusCode, Equals, 400)
+}
+
+func (s *TestSuite) TestApiKeyExpires(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.PostApiKey(token, "shortlived", []string{"feed:read"},
+		time.Now().Add(time.Second).Format(time.RFC3339Nano))
+	created := struct{ Key string }{}
+	helper.Unmarshal(response, &created)
+	c.Assert(response.StatusCode, Equals, 201)
+
+	response, _ = req.GetMessages(types.Json{"token": created.Key})
+	c.Check(response.StatusCode, Equals, 200)
+
+	time.Sleep(1100 * time.Millisecond)
+	response, _ = req.GetMessages(types.Json{"token": created.Key})
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+func (s *TestSuite) TestApiKeyRevoke(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+
+	response, _ := req.PostApiKey(token, "bot", []string{"feed:read"}, "")
+	created := struct{ Key, Id string }{}
+	helper.Unmarshal(response, &created)
+
+	// Only the owner gets to revoke a key
+	response, _ = req.DeleteApiKey(other, created.Id)
+	c.Check(response.StatusCode, Equals, 404)
+
+	response, _ = req.DeleteApiKey(token, created.Id)
+	c.Check(response.StatusCode, Equals, 204)
+	response, _ = req.DeleteApiKey(token, created.Id)
+	c.Check(response.StatusCode, Equals, 404)
+
+	response, _ = req.GetMessages(types.Json{"token": created.Key})
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+//
+// OAuth Tests:
+//
+
+const (
+	oauthRedirect = "https://client.example/callback"
+	oauthVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+// Registers a client for token, answering with its id
+func registerOAuthClient(c *C, token string) string {
+	response, _ := req.PostOAuthClient(token, "Client", []string{oauthRedirect})
+	c.Assert(response.StatusCode, Equals, 201)
+	client := struct{ ClientId string }{}
+	helper.Unmarshal(response, &client)
+	return client.ClientId
+}
+
+func oauthRequest(clientid, scope string) types.Json {
+	return types.Json{
+		"response_type":         "code",
+		"client_id":             clientid,
+		"redirect_uri":          oauthRedirect,
+		"scope":                 scope,
+		"state":                 "xyz",
+		"code_challenge":        service.MakeCodeChallenge(oauthVerifier),
+		"code_challenge_method": "S256",
+	}
+}
+
+// Has token approve clientid for scope, answering with the code the
+// client is sent back with
+func authorizeOAuthClient(c *C, token, clientid, scope string) string {
+	params := oauthRequest(clientid, scope)
+	params["approve"] = true
+	response, _ := req.PostOAuthAuthorize(token, params)
+	c.Assert(response.StatusCode, Equals, 200)
+	res := struct{ Redirect string }{}
+	helper.Unmarshal(response, &res)
+	redirect, err := url.Parse(res.Redirect)
+	c.Assert(err, IsNil)
+	c.Check(redirect.Query().Get("state"), Equals, "xyz")
+	return redirect.Query().Get("code")
+}
+
+func oauthTokenRequest(clientid, code string) types.Json {
+	return types.Json{
+		"grant_type":    "authorization_code",
+		"code":          code,
+		"redirect_uri":  oauthRedirect,
+		"client_id":     clientid,
+		"code_verifier": oauthVerifier,
+	}
+}
+
+func (s *TestSuite) TestOAuthAuthorizationCodeFlow(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	clientid := registerOAuthClient(c, token)
+
+	// The consent screen gets what the client asks for
+	response, _ := req.GetOAuthAuthorize(oauthRequest(clientid, "feed:read"))
+	consent := struct {
+		Client      types.OAuthClient
+		Scopes      []string
+		RedirectUri string `json:"redirect_uri"`
+	}{}
+	helper.Unmarshal(response, &consent)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(consent.Client.Name, Equals, "Client")
+	c.Check(consent.Scopes, DeepEquals, []string{"feed:read"})
+	c.Check(consent.RedirectUri, Equals, oauthRedirect)
+
+	code := authorizeOAuthClient(c, token, clientid, "feed:read")
+	response, _ = req.PostOAuthToken(oauthTokenRequest(clientid, code))
+	granted := types.OAuthAccessToken{}
+	helper.Unmarshal(response, &granted)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(response.Header.Get("Cache-Control"), Equals, "no-store")
+	c.Check(granted.TokenType, Equals, "Bearer")
+	c.Check(granted.Scope, Equals, "feed:read")
+	c.Check(granted.ExpiresIn > 0, Equals, true)
+
+	// The access token authenticates like an API key with its scopes
+	bearer := "Bearer " + granted.AccessToken
+	response, _ = req.GetMessages(types.Json{"token": bearer})
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.PostMessage("Not allowed", bearer)
+	_, errCode := helper.GetJsonReasonAndCode(response)
+	c.Check(errCode, Equals, "insufficient_scope")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.GetSessions(bearer)
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+func (s *TestSuite) TestOAuthCodeUsedOnce(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	clientid := registerOAuthClient(c, token)
+
+	code := authorizeOAuthClient(c, token, clientid, "feed:read")
+	response, _ := req.PostOAuthToken(oauthTokenRequest(clientid, code))
+	c.Check(response.StatusCode, Equals, 200)
+
+	response, _ = req.PostOAuthToken(oauthTokenRequest(clientid, code))
+	res := struct{ Error string }{}
+	helper.Unmarshal(response, &res)
+	c.Check(res.Error, Equals, "invalid_grant")
+	c.Check(response.StatusCode, Equals, 400)
+}
+
+func (s *TestSuite) TestOAuthWrongVerifier(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	clientid := registerOAuthClient(c, token)
+
+	code := authorizeOAuthClient(c, token, clientid, "feed:read")
+	params := oauthTokenRequest(clientid, code)
+	params["code_verifier"] = strings.Repeat("a", 43)
+	response, _ := req.PostOAuthToken(params)
+	res := struct{ Error string }{}
+	helper.Unmarshal(response, &res)
+	c.Check(res.Error, Equals, "invalid_grant")
+	c.Check(response.StatusCode, Equals, 400)
+
+	// A failed attempt spends the code
+	response, _ = req.PostOAuthToken(oauthTokenRequest(clientid, code))
+	c.Check(response.StatusCode, Equals, 400)
+}
+
+func (s *TestSuite) TestOAuthDenied(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	clientid := registerOAuthClient(c, token)
+
+	params := oauthRequest(clientid, "feed:read")
+	params["approve"] = false
+	response, _ := req.PostOAuthAuthorize(token, params)
+	res := struct{ Redirect string }{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	redirect, _ := url.Parse(res.Redirect)
+	c.Check(redirect.Query().Get("error"), Equals, "access_denied")
+	c.Check(redirect.Query().Get("code"), Equals, "")
+}
+
+func (s *TestSuite) TestOAuthInvalidRequests(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	clientid := registerOAuthClient(c, token)
+
+	response, _ := req.PostOAuthClient(token, "Client", []string{"/relative"})
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_client_metadata")
+	c.Check(response.StatusCode, Equals, 400)
+
+	// PKCE is required
+	params := oauthRequest(clientid, "feed:read")
+	delete(params, "code_challenge")
+	response, _ = req.GetOAuthAuthorize(params)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_request")
+	c.Check(response.StatusCode, Equals, 400)
+
+	params = oauthRequest(clientid, "feed:read")
+	params["redirect_uri"] = "https://attacker.example/callback"
+	response, _ = req.GetOAuthAuthorize(params)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_request")
+	c.Check(response.StatusCode, Equals, 400)
+	c.Check(response.Request.URL.Host, Not(Equals), "attacker.example")
+
+	response, _ = req.GetOAuthAuthorize(oauthRequest(clientid, "feed:write"))
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_scope")
+	c.Check(response.StatusCode, Equals, 400)
+
+	response, _ = req.GetOAuthAuthorize(oauthRequest("nosuchclient", "feed:read"))
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_client")
+	c.Check(response.StatusCode, Equals, 400)
+}
+
+func (s *TestSuite) TestOAuthDeleteClient(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	clientid := registerOAuthClient(c, token)
+
+	response, _ := req.GetOAuthClients(token)
+	res := struct {
+		Results []types.OAuthClient
+		Count   int
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Assert(res.Count, Equals, 1)
+	c.Check(res.Results[0].Id, Equals, clientid)
+
+	code := authorizeOAuthClient(c, other, clientid, "feed:read")
+	response, _ = req.PostOAuthToken(oauthTokenRequest(clientid, code))
+	granted := types.OAuthAccessToken{}
+	helper.Unmarshal(response, &granted)
+	bearer := "Bearer " + granted.AccessToken
+
+	// Only the owner deletes a client, ending the grants it holds
+	response, _ = req.DeleteOAuthClient(other, clientid)
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.DeleteOAuthClient(token, clientid)
+	c.Check(response.StatusCode, Equals, 204)
+
+	response, _ = req.GetMessages(types.Json{"token": bearer})
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+//
+// Admin Tests:
+//
+
+func makeAdmin(c *C, handle string) {
+	missing, err := a.Svc.SeedAdmins([]string{handle})
+	c.Assert(err, IsNil)
+	c.Assert(len(missing), Equals, 0)
+}
+
+func (s *TestSuite) TestAdminSearchesAccounts(c *C) {
+	req.PostSignup("admin", "admin@test.io", "password1", "password1")
+	req.PostSignup("cat", "cat@test.io", "password1", "password1")
+	req.PostSignup("catwoman", "selina@test.io", "password1", "password1")
+	req.PostSignup("bat", "bruce@test.io", "password1", "password1")
+	makeAdmin(c, "admin")
+	admin := req.PostSessionGetAuthToken("admin", "password1")
+
+	res := struct {
+		Results []types.AccountView
+		Count   int
+	}{}
+	response, _ := req.GetAccounts(admin, types.Json{})
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Assert(res.Count, Equals, 4)
+	c.Check(res.Results[0].Handle, Equals, "admin")
+	c.Check(res.Results[0].Role, Equals, "admin")
+	c.Check(res.Results[1].Handle, Equals, "bat")
+	c.Check(res.Results[1].Role, Equals, "user")
+	c.Check(res.Results[1].Email, Equals, "bruce@test.io")
+
+	// By handle or email, a page at a time, counting every match
+	response, _ = req.GetAccounts(admin, types.Json{"q": "CAT", "skip": 1, "limit": 1})
+	helper.Unmarshal(response, &res)
+	c.Check(res.Count, Equals, 2)
+	c.Assert(res.Results, HasLen, 1)
+	c.Check(res.Results[0].Handle, Equals, "catwoman")
+	response, _ = req.GetAccounts(admin, types.Json{"q": "bruce"})
+	helper.Unmarshal(response, &res)
+	c.Assert(res.Count, Equals, 1)
+	c.Check(res.Results[0].Handle, Equals, "bat")
+
+	response, _ = req.GetAccounts(admin, types.Json{"limit": 0})
+	c.Check(response.StatusCode, Equals, 400)
+
+	token := req.PostSessionGetAuthToken("cat", "password1")
+	response, _ = req.GetAccounts(token, types.Json{})
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+func (s *TestSuite) TestAdminGrantsRoles(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	token := req.PostSessionGetAuthToken("handleB", "password1")
+
+	response, _ := req.GetLockouts(token)
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PutRole(token, "handleB", "admin")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PutRole(admin, "handleB", "root")
+	c.Check(response.StatusCode, Equals, 400)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_role")
+	response, _ = req.PutRole(admin, "nobody", "admin")
+	c.Check(response.StatusCode, Equals, 404)
+
+	response, _ = req.PutRole(admin, "handleB", "admin")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.GetLockouts(token)
+	c.Check(response.StatusCode, Equals, 200)
+
+	// Admins demote others but never themselves
+	response, _ = req.PutRole(admin, "handleA", "user")
+	c.Check(response.StatusCode, Equals, 403)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "own_account")
+	response, _ = req.PutRole(token, "handleA", "user")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.GetLockouts(admin)
+	c.Check(response.StatusCode, Equals, 403)
+}
+
+func (s *TestSuite) TestAdminSuspendsAndReinstates(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	token := req.PostSessionGetAuthToken("handleB", "password1")
+	key := req.PostApiKeyGetKey(token, "bot", []string{"feed:read"})
+
+	response, _ := req.PostSuspension(token, "handleA")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostSuspension(admin, "handleA")
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "own_account")
+
+	response, _ = req.PostSuspension(admin, "handleB")
+	c.Check(response.StatusCode, Equals, 200)
+
+	// Suspension ends the sessions, refuses new ones and the API keys
+	response, _ = req.GetMessages(types.Json{"token": token})
+	c.Check(response.StatusCode, Equals, 401)
+	response, _ = req.GetMessages(types.Json{"token": key})
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PostSessions("handleB", "password1")
+	c.Check(response.StatusCode, Equals, 403)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "account_suspended")
+
+	res := struct {
+		Results []types.AccountView
+	}{}
+	response, _ = req.GetAccounts(admin, types.Json{"q": "handleB"})
+	helper.Unmarshal(response, &res)
+	c.Assert(len(res.Results), Equals, 1)
+	c.Check(res.Results[0].Suspended, Equals, true)
+
+	response, _ = req.DeleteSuspension(admin, "handleB")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.GetMessages(types.Json{"token": key})
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.PostSessions("handleB", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+
+	response, _ = req.PostSuspension(admin, "nobody")
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestAdminRoutesTakeHandleInAnyCasing(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	req.PostSessionGetAuthToken("handleB", "password1")
+
+	response, _ := req.PostSuspension(admin, "HANDLEB")
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(helper.GetJsonResponseMessage(response), Equals, "handleB has been suspended")
+	response, _ = req.DeleteSuspension(admin, "HandleB")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.DeleteUserSessions(admin, "HANDLEB")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.PutRole(admin, "HANDLEB", "admin")
+	c.Check(response.StatusCode, Equals, 200)
+
+	// The guards against acting on oneself see through casing too
+	response, _ = req.PostSuspension(admin, "HANDLEA")
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "own_account")
+	response, _ = req.PutRole(admin, "HandleA", "user")
+	c.Check(response.StatusCode, Equals, 403)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "own_account")
+}
+
+func (s *TestSuite) TestAdminForcesLogout(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	first := req.PostSessionGetAuthToken("handleB", "password1")
+	second := req.PostSessionGetAuthToken("handleB", "password1")
+
+	response, _ := req.DeleteUserSessions(first, "handleA")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.DeleteUserSessions(admin, "handleB")
+	res := struct {
+		Count int
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(res.Count, Equals, 2)
+	for _, token := range []string{first, second} {
+		response, _ = req.GetMessages(types.Json{"token": token})
+		c.Check(response.StatusCode, Equals, 401)
+	}
+
+	// Unlike a suspension, logging back in works
+	response, _ = req.PostSessions("handleB", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+	response, _ = req.DeleteUserSessions(admin, "nobody")
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestAdminEditsAndDeletesCircles(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	token := req.PostSessionGetAuthToken("handleB", "password1")
+	circleid := req.PostCircleGetCircleId(token, "Offensive", true)
+
+	response, _ := req.AdminPatchCircle(token, circleid, types.Json{"name": "Mine"})
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.AdminPatchCircle(admin, circleid, types.Json{"name": "Renamed", "description": "Tidied up"})
+	circle := types.CircleResponse{}
+	helper.Unmarshal(response, &circle)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(circle.Name, Equals, "Renamed")
+	c.Check(circle.Description, Equals, "Tidied up")
+	c.Check(circle.Owner, Equals, "handleB")
+
+	// The circles every user starts with keep their names and stay
+	gold, err := a.Svc.Query.GetCircleIdByName("handleB", types.GOLD)
+	c.Assert(err, IsNil)
+	response, _ = req.AdminPatchCircle(admin, gold, types.Json{"name": "Silver"})
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.AdminPatchCircle(admin, circleid, types.Json{"name": types.BROADCAST})
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.AdminDeleteCircle(admin, gold)
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "reserved_circle")
+
+	response, _ = req.AdminDeleteCircle(admin, circleid)
+	c.Check(response.StatusCode, Equals, 204)
+	response, _ = req.AdminDeleteCircle(admin, circleid)
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestAdminEditsAndDeletesMessages(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	token := req.PostSessionGetAuthToken("handleB", "password1")
+	circleid := req.PostCircleGetCircleId(token, "Friends", true)
+	messageid := req.PostMessageWithCirclesGetMessageId("Something rude", token, []string{circleid})
+
+	response, _ := req.AdminPatchMessage(token, messageid, "Something nice")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.AdminPatchMessage(admin, messageid, "Something nice")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.GetMessageById(messageid, token)
+	message := types.MessageView{}
+	helper.Unmarshal(response, &message)
+	c.Check(message.Content, Equals, "Something nice")
+	c.Check(message.Author, Equals, "handleB")
+
+	// The PATCH every author has takes admins too
+	patch := types.Json{"op": "update", "resource": "content", "value": "Moderated"}
+	response, _ = req.EditMessage(types.JsonArray{patch}, messageid, admin)
+	c.Check(response.StatusCode, Equals, 200)
+
+	response, _ = req.AdminDeleteMessage(admin, messageid)
+	c.Check(response.StatusCode, Equals, 204)
+	response, _ = req.GetMessageById(messageid, token)
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.AdminPatchMessage(admin, messageid, "Gone")
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestOnlyAuthorsEditMessages(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	messageid := req.PostMessageGetMessageId("Hello, world!", token)
+
+	patch := types.Json{"op": "update", "resource": "content", "value": "Hijacked"}
+	response, _ := req.EditMessage(types.JsonArray{patch}, messageid, other)
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "not_message_author")
+}
+
+func (s *TestSuite) TestAuthorDeletesMessage(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	messageid := req.PostMessageGetMessageId("Hello, world!", token)
+
+	response, _ := req.DeleteMessage(messageid, other)
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "not_message_author")
+
+	response, _ = req.DeleteMessage(messageid, token)
+	c.Check(response.StatusCode, Equals, 204)
+	response, _ = req.GetMessageById(messageid, token)
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.DeleteMessage(messageid, token)
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestAdminDeletesMessageOfOthers(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	token := req.PostSessionGetAuthToken("handleB", "password1")
+	messageid := req.PostMessageGetMessageId("Something rude", token)
+
+	response, _ := req.DeleteMessage(messageid, admin)
+	c.Check(response.StatusCode, Equals, 204)
+	response, _ = req.GetMessageById(messageid, token)
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestAdminEditsOtherUsers(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+
+	patch := types.Json{"resource": "bio", "value": "Edited by someone else"}
+	response, _ := req.EditUser(types.JsonArray{patch}, "handleA", other)
+	c.Check(response.StatusCode, Equals, 403)
+
+	makeAdmin(c, "handleB")
+	response, _ = req.EditUser(types.JsonArray{patch}, "handleA", other)
+	c.Check(response.StatusCode, Equals, 200)
+
+	response, _ = req.EditUser(types.JsonArray{patch}, "handleB", token)
+	c.Check(response.StatusCode, Equals, 403)
+}
@@ -2,6 +2,9 @@ package api_test
 
 import (
 	"../api"
+	"../api/service/blob"
+	"../api/service/mail"
+	"../api/service/query"
 	"../routes"
 	"./requester"
 	"flag"
@@ -18,6 +21,12 @@ var (
 	req    *requester.Requester
 	// Flag for local testing.
 	local = flag.Bool("local", false, "For local testing")
+	// Flags for testing without a database.
+	memory = flag.Bool("memory", false, "For testing against an in-memory store")
+	bolt   = flag.Bool("bolt", false, "For testing against a temporary bolt file")
+	store  *query.BoltQuery
+	// Catches the mail the service sends.
+	mailbox *mail.MemorySender
 )
 
 //
@@ -46,16 +55,41 @@ var _ = Suite(&TestSuite{})
 //
 
 func (s *TestSuite) SetUpSuite(c *C) {
-	config, err := goconfig.ReadConfigFile("../../config.cfg")
-	var location string
-	if *local {
-		location = "local-test"
+	if *memory {
+		a = api.NewApi(query.NewMemoryQuery())
+	} else if *bolt {
+		q, err := query.NewBoltQuery(c.MkDir() + "/cherami.db")
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = q
+		a = api.NewApi(q)
 	} else {
-		location = "api-test"
+		config, err := goconfig.ReadConfigFile("../../config.cfg")
+		var location string
+		if *local {
+			location = "local-test"
+		} else {
+			location = "api-test"
+		}
+		uri, err := config.GetString(location, "url")
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		q, err := query.NewNeo4jQuery(uri)
+		if err != nil {
+			log.Fatal(err)
+		}
+		a = api.NewApi(q)
 	}
-	uri, err := config.GetString(location, "url")
 
-	a = api.NewApi(uri)
+	mailbox = mail.NewMemorySender()
+	a.Svc.Mail = mailbox
+
+	// Most tests never verify the users they sign up
+	a.Svc.Verification.UnverifiedPublishPublic = true
+	a.Svc.Verification.UnverifiedPublicCircles = true
 
 	handler, err := routes.MakeHandler(*a, true)
 	if err != nil {
@@ -71,6 +105,8 @@ func (s *TestSuite) SetUpSuite(c *C) {
 //
 
 func (s *TestSuite) SetUpTest(c *C) {
+	// Blobs are not part of the store, so they are not reset with it
+	a.Svc.Blobs = blob.NewMemoryStore()
 }
 
 //
@@ -87,4 +123,7 @@ func (s *TestSuite) TearDownTest(c *C) {
 
 func (s *TestSuite) TearDownSuite(c *C) {
 	server.Close()
+	if store != nil {
+		store.Close()
+	}
 }
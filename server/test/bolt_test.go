@@ -0,0 +1,121 @@
+package api_test
+
+import (
+	"../api/service/query"
+	"../types"
+	boltdb "go.etcd.io/bbolt"
+	. "gopkg.in/check.v1"
+	"strconv"
+	"time"
+)
+
+//
+// Bolt Store Tests:
+//
+
+func (s *TestSuite) TestBoltStoreSurvivesReopen(c *C) {
+	path := c.MkDir() + "/reopen.db"
+
+	q, err := query.NewBoltQuery(path)
+	c.Assert(err, IsNil)
+	c.Assert(q.CreateUser("handleA", "handleA@test.io", "hash"), IsNil)
+	c.Assert(q.CreateDefaultCirclesForUser("handleA"), IsNil)
+	circle, err := q.CreateCircle("handleA", "friends", true)
+	c.Assert(err, IsNil)
+	message, err := q.CreateMessage("handleA", "Still here after a restart")
+	c.Assert(err, IsNil)
+	c.Assert(q.CreatePublishedRelation(message.Id, circle.Id), IsNil)
+	c.Assert(q.Close(), IsNil)
+
+	q, err = query.NewBoltQuery(path)
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	exists, err := q.UserExistsByHandle("handleA")
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, true)
+
+	public, err := q.CircleLinkedToPublicDomain(circle.Id)
+	c.Check(err, IsNil)
+	c.Check(public, Equals, true)
+
+	id, err := q.GetCircleIdByName("handleA", types.GOLD)
+	c.Check(err, IsNil)
+	c.Check(id, Not(Equals), "")
+
+	feed, err := q.GetMessageFeedOfCircle(circle.Id)
+	c.Check(err, IsNil)
+	c.Assert(len(feed), Equals, 1)
+	c.Check(feed[0].Content, Equals, "Still here after a restart")
+}
+
+func (s *TestSuite) TestBoltStoreFileIsExclusive(c *C) {
+	path := c.MkDir() + "/locked.db"
+
+	q, err := query.NewBoltQuery(path)
+	c.Assert(err, IsNil)
+	defer q.Close()
+
+	_, err = query.NewBoltQuery(path)
+	c.Check(types.IsKind(err, types.UNAVAILABLE), Equals, true)
+}
+
+func (s *TestSuite) TestBoltStoreDropsPlaintextTokens(c *C) {
+	path := c.MkDir() + "/plaintext.db"
+
+	// A session as stored before tokens were hashed at rest
+	db, err := boltdb.Open(path, 0600, nil)
+	c.Assert(err, IsNil)
+	expires := time.Now().Add(time.Hour).Format(time.RFC3339)
+	c.Assert(db.Update(func(tx *boltdb.Tx) error {
+		users, err := tx.CreateBucketIfNotExists([]byte("users"))
+		if err != nil {
+			return err
+		}
+		if err := users.Put([]byte("handleA"), []byte(`{"id": 1, "handle": "handleA"}`)); err != nil {
+			return err
+		}
+		tokens, err := tx.CreateBucketIfNotExists([]byte("tokens"))
+		if err != nil {
+			return err
+		}
+		return tokens.Put([]byte("Token abc"), []byte(`{"handle": "handleA", "expires": "`+expires+`"}`))
+	}), IsNil)
+	c.Assert(db.Close(), IsNil)
+
+	q, err := query.NewBoltQuery(path)
+	c.Assert(err, IsNil)
+	sessions, err := q.GetSessionsByHandle("handleA", "")
+	c.Check(err, IsNil)
+	c.Check(len(sessions), Equals, 0)
+	c.Assert(q.Close(), IsNil)
+
+	// Gone from the file as well
+	db, err = boltdb.Open(path, 0600, nil)
+	c.Assert(err, IsNil)
+	defer db.Close()
+	c.Check(db.View(func(tx *boltdb.Tx) error {
+		c.Check(tx.Bucket([]byte("tokens")).Get([]byte("Token abc")), IsNil)
+		return nil
+	}), IsNil)
+}
+
+// A write to a store of a thousand users, each with their default circles
+// and a message. Run with -check.b.
+func (s *TestSuite) BenchmarkBoltStoreWrite(c *C) {
+	q, err := query.NewBoltQuery(c.MkDir() + "/bench.db")
+	c.Assert(err, IsNil)
+	defer q.Close()
+	for i := 0; i < 1000; i++ {
+		handle := "user" + strconv.Itoa(i)
+		c.Assert(q.CreateUser(handle, handle+"@test.io", "hash"), IsNil)
+		c.Assert(q.CreateDefaultCirclesForUser(handle), IsNil)
+		_, err := q.CreateMessage(handle, "Hello from "+handle)
+		c.Assert(err, IsNil)
+	}
+
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		c.Assert(q.SetUserSuspended("user0", i%2 == 0), IsNil)
+	}
+}
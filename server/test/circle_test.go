@@ -4,6 +4,8 @@ import (
 	"../types"
 	"./helper"
 	. "gopkg.in/check.v1"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -361,9 +363,10 @@ func (s *TestSuite) TestPostBlockUserNoExist(c *C) {
 	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
 	req.PostSignup("handleB", "testB@test.io", "password2", "password2")
 
-	// This will be dangling, not belonging to handleA or any other user
+	// This will be dangling once revoked from another session
 	sessionid := req.PostSessionGetAuthToken("handleA", "password1")
-	_ = req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleA", "password1")
+	req.DeleteSession("others", other)
 
 	response, err := req.PostBlock(sessionid, "handleB")
 	if err != nil {
@@ -420,6 +423,376 @@ func (s *TestSuite) TestPostBlockOK(c *C) {
 	c.Check(response.StatusCode, Equals, 200)
 }
 
+func (s *TestSuite) TestPostBlockSelf(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	sessionid := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.PostBlock(sessionid, "handleA")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PatchBlocked(sessionid, "handleA", "handleA", "block")
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "self_block")
+}
+
+//
+// Circle By Id Tests:
+//
+
+func circleOf(c *C, token, circleid string) types.CircleResponse {
+	response, _ := req.GetCircle(token, circleid)
+	c.Assert(response.StatusCode, Equals, 200)
+	circle := types.CircleResponse{}
+	helper.Unmarshal(response, &circle)
+	return circle
+}
+
+func (s *TestSuite) TestGetCircleById(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	tokenA := req.PostSessionGetAuthToken("handleA", "password1")
+	tokenB := req.PostSessionGetAuthToken("handleB", "password1")
+	open := req.PostCircleGetCircleId(tokenB, "Open", true)
+	secret := req.PostCircleGetCircleId(tokenB, "Secret", false)
+
+	circle := circleOf(c, tokenA, open)
+	c.Check(circle.Name, Equals, "Open")
+	c.Check(circle.Owner, Equals, "handleB")
+	c.Check(circle.Visibility, Equals, "public")
+	c.Check(strings.HasSuffix(circle.Url, "/circles/"+open), Equals, true)
+	c.Check(circleOf(c, tokenB, secret).Visibility, Equals, "private")
+
+	// Circles others can not see are as good as missing
+	response, _ := req.GetCircle(tokenA, secret)
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.GetCircle(tokenA, "nosuchcircle")
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestEditCircle(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	req.PostSignup("admin", "admin@test.io", "password1", "password1")
+	makeAdmin(c, "admin")
+	tokenA := req.PostSessionGetAuthToken("handleA", "password1")
+	tokenB := req.PostSessionGetAuthToken("handleB", "password1")
+	admin := req.PostSessionGetAuthToken("admin", "password1")
+	open := req.PostCircleGetCircleId(tokenB, "Open", true)
+	secret := req.PostCircleGetCircleId(tokenB, "Secret", false)
+
+	response, _ := req.PatchCircle(tokenB, open, types.Json{"name": " Opener ", "description": "Everyone welcome"})
+	c.Check(response.StatusCode, Equals, 204)
+	circle := circleOf(c, tokenA, open)
+	c.Check(circle.Name, Equals, "Opener")
+	c.Check(circle.Description, Equals, "Everyone welcome")
+
+	// Fields left out stay as they are
+	response, _ = req.PatchCircle(tokenB, open, types.Json{"description": "Mind your manners"})
+	c.Check(response.StatusCode, Equals, 204)
+	circle = circleOf(c, tokenA, open)
+	c.Check(circle.Name, Equals, "Opener")
+	c.Check(circle.Description, Equals, "Mind your manners")
+
+	// An empty description clears it, an empty name is refused
+	response, _ = req.PatchCircle(tokenB, open, types.Json{"description": ""})
+	c.Check(response.StatusCode, Equals, 204)
+	circle = circleOf(c, tokenA, open)
+	c.Check(circle.Name, Equals, "Opener")
+	c.Check(circle.Description, Equals, "")
+	response, _ = req.PatchCircle(tokenB, open, types.Json{"name": " "})
+	c.Check(response.StatusCode, Equals, 400)
+	c.Check(circleOf(c, tokenA, open).Name, Equals, "Opener")
+
+	response, _ = req.PatchCircle(tokenA, open, types.Json{"name": "Mine"})
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PatchCircle(tokenA, secret, types.Json{"name": "Mine"})
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.PatchCircle(admin, secret, types.Json{"description": "Moderated"})
+	c.Check(response.StatusCode, Equals, 204)
+	c.Check(circleOf(c, tokenB, secret).Description, Equals, "Moderated")
+
+	// Gold and Broadcast keep their names, and no other circle takes them
+	gold, err := a.Svc.Query.GetCircleIdByName("handleB", types.GOLD)
+	c.Assert(err, IsNil)
+	response, _ = req.PatchCircle(tokenB, gold, types.Json{"name": "Silver"})
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PatchCircle(tokenB, open, types.Json{"name": types.BROADCAST})
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "reserved_circle")
+	response, _ = req.PatchCircle(tokenB, gold, types.Json{"description": "The inner circle"})
+	c.Check(response.StatusCode, Equals, 204)
+}
+
+func (s *TestSuite) TestDeleteCircle(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	tokenA := req.PostSessionGetAuthToken("handleA", "password1")
+	tokenB := req.PostSessionGetAuthToken("handleB", "password1")
+	open := req.PostCircleGetCircleId(tokenB, "Open", true)
+	req.PostJoin(tokenA, "handleB", "Open")
+	messageid := req.PostMessageWithCirclesGetMessageId("Hello all", tokenB, []string{open})
+	c.Assert(feedOf(c, tokenA), HasLen, 1)
+
+	response, _ := req.DeleteCircle(tokenA, open)
+	c.Check(response.StatusCode, Equals, 403)
+	for _, reserved := range []string{types.GOLD, types.BROADCAST} {
+		circleid, err := a.Svc.Query.GetCircleIdByName("handleB", reserved)
+		c.Assert(err, IsNil)
+		response, _ = req.DeleteCircle(tokenB, circleid)
+		c.Check(response.StatusCode, Equals, 403)
+	}
+
+	response, _ = req.DeleteCircle(tokenB, open)
+	c.Check(response.StatusCode, Equals, 204)
+	response, _ = req.GetCircle(tokenB, open)
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.DeleteCircle(tokenB, open)
+	c.Check(response.StatusCode, Equals, 404)
+
+	// Members and publications go with it, the message stays
+	member, err := a.Svc.Query.UserPartOfCircle("handleA", open)
+	c.Check(err, IsNil)
+	c.Check(member, Equals, false)
+	c.Check(feedOf(c, tokenA), HasLen, 0)
+	exists, err := a.Svc.Query.GetMessageById(messageid)
+	c.Check(err, IsNil)
+	c.Check(exists, Equals, true)
+}
+
+//
+// Blocked Users Tests:
+//
+
+// The handles blocked by handle on the page, and how many there are in all
+func blockedHandles(c *C, token, handle string, skip, limit int) ([]string, int) {
+	response, _ := req.GetBlocked(token, handle, skip, limit)
+	c.Assert(response.StatusCode, Equals, 200)
+	data := struct {
+		Results []types.UserSearchView
+		Count   int
+	}{}
+	helper.Unmarshal(response, &data)
+	handles := []string{}
+	for _, user := range data.Results {
+		handles = append(handles, user.Handle)
+	}
+	return handles, data.Count
+}
+
+func (s *TestSuite) TestBlockAndUnblock(c *C) {
+	for _, handle := range []string{"handleA", "delta", "Bravo", "charlie"} {
+		req.PostSignup(handle, handle+"@test.io", "password1", "password1")
+	}
+	sessionid := req.PostSessionGetAuthToken("handleA", "password1")
+	bravo := req.PostSessionGetAuthToken("Bravo", "password1")
+
+	for _, target := range []string{"delta", "bravo", "charlie"} {
+		response, _ := req.PatchBlocked(sessionid, "handleA", target, "block")
+		c.Check(response.StatusCode, Equals, 204)
+	}
+
+	handles, total := blockedHandles(c, sessionid, "handleA", 0, 2)
+	c.Check(handles, DeepEquals, []string{"Bravo", "charlie"})
+	c.Check(total, Equals, 3)
+	handles, _ = blockedHandles(c, sessionid, "handleA", 2, 2)
+	c.Check(handles, DeepEquals, []string{"delta"})
+
+	response, _ := req.PostJoinDefault(bravo, "handleA")
+	c.Check(response.StatusCode, Equals, 403)
+
+	// Unblocking lets them join again, and is no error twice
+	for i := 0; i < 2; i++ {
+		response, _ = req.PatchBlocked(sessionid, "handleA", "Bravo", "unblock")
+		c.Check(response.StatusCode, Equals, 204)
+	}
+	handles, total = blockedHandles(c, sessionid, "handleA", 0, 20)
+	c.Check(handles, DeepEquals, []string{"charlie", "delta"})
+	c.Check(total, Equals, 2)
+	response, _ = req.PostJoinDefault(bravo, "handleA")
+	c.Check(response.StatusCode, Equals, 201)
+
+	// Only the link to the list comes along with the user
+	user := types.UserView{}
+	response, _ = req.GetUser(sessionid, "handleA")
+	helper.Unmarshal(response, &user)
+	c.Check(strings.HasSuffix(user.Blocked, "/users/handleA/blocked"), Equals, true)
+}
+
+func (s *TestSuite) TestBlockedUsersArePrivate(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	req.PostSignup("admin", "admin@test.io", "password1", "password1")
+	makeAdmin(c, "admin")
+	sessionid := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	admin := req.PostSessionGetAuthToken("admin", "password1")
+	req.PatchBlocked(sessionid, "handleA", "handleB", "block")
+
+	response, _ := req.GetBlocked(other, "handleA", 0, 20)
+	c.Check(response.StatusCode, Equals, 403)
+	handles, _ := blockedHandles(c, admin, "handleA", 0, 20)
+	c.Check(handles, DeepEquals, []string{"handleB"})
+
+	user := types.UserView{}
+	response, _ = req.GetUser(other, "handleA")
+	helper.Unmarshal(response, &user)
+	c.Check(user.Blocked, Equals, "")
+
+	response, _ = req.PatchBlocked(other, "handleA", "admin", "block")
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PatchBlocked(sessionid, "handleA", "nobody", "block")
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.PatchBlocked(sessionid, "handleA", "handleB", "ignore")
+	c.Check(response.StatusCode, Equals, 400)
+	response, _ = req.GetBlocked(sessionid, "handleA", 0, 101)
+	c.Check(response.StatusCode, Equals, 400)
+}
+
+//
+// Mute Tests:
+//
+
+// Who wrote each message of the feed of token, and to which circle
+func feedOf(c *C, token string) []string {
+	response, _ := req.GetMessages(types.Json{"token": token})
+	c.Assert(response.StatusCode, Equals, 200)
+	messages := []types.PublishedMessageView{}
+	helper.Unmarshal(response, &messages)
+	feed := []string{}
+	for _, message := range messages {
+		feed = append(feed, message.Author+" in "+message.Circleid)
+	}
+	sort.Strings(feed)
+	return feed
+}
+
+// Entries as feedOf lists them
+func feedEntries(entries ...string) []string {
+	sort.Strings(entries)
+	return entries
+}
+
+func mutesOf(c *C, token, handle string) []types.MuteView {
+	response, _ := req.GetMutes(token, handle)
+	c.Assert(response.StatusCode, Equals, 200)
+	data := struct {
+		Results []types.MuteView
+		Count   int
+	}{}
+	helper.Unmarshal(response, &data)
+	c.Check(data.Count, Equals, len(data.Results))
+	return data.Results
+}
+
+// Alpha in Bravo's circle baja and Charlie's circle cabo, where everyone
+// has posted
+func setupFeed(c *C) (alpha, bravo, baja, cabo string) {
+	req.PostSignup("Alpha", "testA@test.io", "password1", "password1")
+	req.PostSignup("Bravo", "testB@test.io", "password2", "password2")
+	req.PostSignup("Charlie", "testC@test.io", "password3", "password3")
+	alpha = req.PostSessionGetAuthToken("Alpha", "password1")
+	bravo = req.PostSessionGetAuthToken("Bravo", "password2")
+	charlie := req.PostSessionGetAuthToken("Charlie", "password3")
+
+	baja = req.PostCircleGetCircleId(bravo, "Baja", true)
+	cabo = req.PostCircleGetCircleId(charlie, "Cabo", true)
+	req.PostJoin(alpha, "Bravo", "Baja")
+	req.PostJoin(alpha, "Charlie", "Cabo")
+
+	req.PostMessageWithCircles("Yo, sup", alpha, []string{baja, cabo})
+	req.PostMessageWithCircles("Yo, dawg", bravo, []string{baja})
+	req.PostMessageWithCircles("Yo, dude", charlie, []string{cabo})
+	c.Assert(feedOf(c, alpha), HasLen, 4)
+	return
+}
+
+func (s *TestSuite) TestMuteUser(c *C) {
+	alpha, bravo, baja, cabo := setupFeed(c)
+
+	response, _ := req.PatchMutes(alpha, "Alpha", types.Json{"handle": "bravo", "action": "mute"})
+	c.Check(response.StatusCode, Equals, 204)
+	c.Check(feedOf(c, alpha), DeepEquals, feedEntries("Alpha in "+baja, "Alpha in "+cabo, "Charlie in "+cabo))
+
+	mutes := mutesOf(c, alpha, "Alpha")
+	c.Assert(mutes, HasLen, 1)
+	c.Check(mutes[0].Handle, Equals, "Bravo")
+	c.Check(strings.HasSuffix(mutes[0].Url, "/users/Bravo"), Equals, true)
+	c.Check(mutes[0].Until.IsZero(), Equals, true)
+
+	// Bravo stays in the circle, sees all as before and can not tell
+	response, _ = req.GetMutes(bravo, "Alpha")
+	c.Check(response.StatusCode, Equals, 403)
+	c.Check(feedOf(c, bravo), DeepEquals, feedEntries("Alpha in "+baja, "Bravo in "+baja))
+
+	// Unmuting brings them back, and is no error twice
+	for i := 0; i < 2; i++ {
+		response, _ = req.PatchMutes(alpha, "Alpha", types.Json{"handle": "Bravo", "action": "unmute"})
+		c.Check(response.StatusCode, Equals, 204)
+	}
+	c.Check(feedOf(c, alpha), HasLen, 4)
+	c.Check(mutesOf(c, alpha, "Alpha"), HasLen, 0)
+}
+
+func (s *TestSuite) TestMuteCircle(c *C) {
+	alpha, _, baja, cabo := setupFeed(c)
+
+	response, _ := req.PatchMutes(alpha, "Alpha", types.Json{"circleid": cabo, "action": "mute"})
+	c.Check(response.StatusCode, Equals, 204)
+	c.Check(feedOf(c, alpha), DeepEquals, feedEntries("Alpha in "+baja, "Bravo in "+baja))
+
+	mutes := mutesOf(c, alpha, "Alpha")
+	c.Assert(mutes, HasLen, 1)
+	c.Check(mutes[0].CircleId, Equals, cabo)
+	c.Check(mutes[0].Circle, Equals, "Cabo")
+	c.Check(mutes[0].Handle, Equals, "")
+
+	response, _ = req.PatchMutes(alpha, "Alpha", types.Json{"circleid": cabo, "action": "unmute"})
+	c.Check(response.StatusCode, Equals, 204)
+	c.Check(feedOf(c, alpha), HasLen, 4)
+}
+
+func (s *TestSuite) TestMuteExpires(c *C) {
+	alpha, _, _, _ := setupFeed(c)
+
+	response, _ := req.PatchMutes(alpha, "Alpha", types.Json{
+		"handle": "Bravo",
+		"action": "mute",
+		"until":  time.Now().Add(time.Second).Format(time.RFC3339Nano),
+	})
+	c.Check(response.StatusCode, Equals, 204)
+	c.Check(feedOf(c, alpha), HasLen, 3)
+	c.Check(mutesOf(c, alpha, "Alpha"), HasLen, 1)
+
+	time.Sleep(1100 * time.Millisecond)
+	c.Check(feedOf(c, alpha), HasLen, 4)
+	c.Check(mutesOf(c, alpha, "Alpha"), HasLen, 0)
+}
+
+func (s *TestSuite) TestMuteRefusals(c *C) {
+	alpha, bravo, _, _ := setupFeed(c)
+	hidden := req.PostCircleGetCircleId(bravo, "Hidden", false)
+
+	for _, t := range []struct {
+		mute types.Json
+		code int
+	}{
+		{types.Json{"handle": "Alpha", "action": "mute"}, 403},
+		{types.Json{"handle": "Bravo", "action": "mute", "until": time.Now().Add(-time.Hour).Format(time.RFC3339)}, 400},
+		{types.Json{"handle": "Bravo", "circleid": hidden, "action": "mute"}, 400},
+		{types.Json{"action": "mute"}, 400},
+		{types.Json{"handle": "Bravo", "action": "ignore"}, 400},
+		{types.Json{"handle": "nobody", "action": "mute"}, 404},
+		{types.Json{"circleid": hidden, "action": "mute"}, 404},
+	} {
+		response, _ := req.PatchMutes(alpha, "Alpha", t.mute)
+		c.Check(response.StatusCode, Equals, t.code, Commentf("%v", t.mute))
+	}
+	response, _ := req.PatchMutes(bravo, "Alpha", types.Json{"handle": "Charlie", "action": "mute"})
+	c.Check(response.StatusCode, Equals, 403)
+	c.Check(mutesOf(c, alpha, "Alpha"), HasLen, 0)
+}
+
 //
 // Post Join Default Tests:
 //
@@ -0,0 +1,115 @@
+package api_test
+
+import (
+	"../api/util"
+	"../types"
+	"./helper"
+	"encoding/json"
+	"errors"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"time"
+)
+
+// Records what a handler answers, as go-json-rest would send it
+type recordingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (w recordingWriter) WriteJson(v interface{}) error {
+	b, err := w.EncodeJson(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func (w recordingWriter) EncodeJson(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (w recordingWriter) WriteHeader(code int) {
+	w.ResponseRecorder.WriteHeader(code)
+}
+
+func (w recordingWriter) Header() http.Header {
+	return w.ResponseRecorder.Header()
+}
+
+func (s *TestSuite) TestStatusOfErrorKinds(c *C) {
+	statuses := map[types.ErrorKind]int{
+		types.INTERNAL:          500,
+		types.NOT_FOUND:         404,
+		types.CONFLICT:          409,
+		types.FORBIDDEN:         403,
+		types.UNAVAILABLE:       503,
+		types.INVALID_INPUT:     400,
+		types.UNAUTHENTICATED:   401,
+		types.TOO_MANY_REQUESTS: 429,
+	}
+	for kind, status := range statuses {
+		c.Check(util.StatusOf(kind), Equals, status, Commentf("kind %d", kind))
+	}
+}
+
+func (s *TestSuite) TestErrorResponseShape(c *C) {
+	cases := []struct {
+		err    error
+		status int
+		code   string
+		reason string
+	}{
+		{types.Forbidden("own_account", "Not yourself"), 403, "own_account", "Not yourself"},
+		{types.InvalidInput("invalid_limit", "Bad `limit` parameter"), 400, "invalid_limit", "Bad `limit` parameter"},
+		// Untyped errors keep their cause to the logs
+		{errors.New("disk on fire"), 500, "internal_error", "Unexpected internal failure"},
+	}
+	for _, tc := range cases {
+		w := recordingWriter{httptest.NewRecorder()}
+		util.Util{}.ErrorResponse(w, tc.err)
+		c.Check(w.Code, Equals, tc.status)
+
+		body := map[string]string{}
+		c.Assert(json.Unmarshal(w.Body.Bytes(), &body), IsNil)
+		c.Check(body, DeepEquals, map[string]string{"reason": tc.reason, "code": tc.code})
+	}
+
+	w := recordingWriter{httptest.NewRecorder()}
+	util.Util{}.ErrorResponse(w, types.TooManyRequests("too_many_attempts", "Slow down", 1500*time.Millisecond))
+	c.Check(w.Code, Equals, 429)
+	c.Check(w.Header().Get("Retry-After"), Equals, "2")
+}
+
+// Every failure the api answers carries a code next to its reason
+func (s *TestSuite) TestApiErrorsCarryCodes(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.PostCircles(token, types.GOLD, false)
+	c.Check(response.StatusCode, Equals, 403)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "reserved_circle")
+
+	response, _ = req.GetBlocked(token, "handleA", 0, 101)
+	c.Check(response.StatusCode, Equals, 400)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_limit")
+
+	response, _ = helper.ExecuteBody("POST", server.URL+"/circles", token, []byte("{not json"))
+	c.Check(response.StatusCode, Equals, 400)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "malformed_payload")
+}
+
+// The stores answer CONFLICT themselves, for requests racing past the
+// checks of the service
+func (s *TestSuite) TestStoreRefusesTakenHandleOrEmail(c *C) {
+	req.PostSignup("handleA", "test@test.io", "password1", "password1")
+
+	err := a.Svc.Query.CreateUser("HANDLEA", "other@test.io", "hash")
+	c.Check(types.AsError(err).Code, Equals, "handle_taken")
+	err = a.Svc.Query.CreateUser("handleB", "test@test.io", "hash")
+	c.Check(types.AsError(err).Code, Equals, "email_taken")
+}
@@ -51,6 +51,16 @@ func ExecutePatch(token string, url string, m types.JsonArray) (*http.Response,
 	}
 }
 
+// Sends body as is rather than as json, for uploads
+func ExecuteBody(httpMethod string, url string, token string, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(httpMethod, url, b.NewReader(body))
+	if err != nil {
+		log.Fatal(err)
+	}
+	request.Header.Add("Authorization", token)
+	return http.DefaultClient.Do(request)
+}
+
 func GetWithQueryParams(url string, m map[string]interface{}) (*http.Response, error) {
 	token := ""
 	str, ok := m["token"].(string)
@@ -97,6 +107,7 @@ type fields struct {
 	Token    string `json:"token"`
 	Id       string `json:"id"`
 	Url      string `json:"url"`
+	Code     string `json:"code"`
 }
 
 func Unmarshal(r *http.Response, v interface{}) {
@@ -119,6 +130,12 @@ func GetJsonReasonMessage(r *http.Response) string {
 	return f.Reason
 }
 
+func GetJsonReasonAndCode(r *http.Response) (reason, code string) {
+	f := fields{}
+	Unmarshal(r, &f)
+	return f.Reason, f.Code
+}
+
 func GetJsonValidationReasonMessage(r *http.Response) []string {
 	var message struct {
 		Reason []string `json:"reason"`
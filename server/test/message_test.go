@@ -268,9 +268,9 @@ func (s *TestSuite) TestGetMessageByIdDoesNotExist(c *C) {
 
 	if res, _ := req.GetMessageById("some_id", sessionid); true {
 		c.Check(res.StatusCode, Equals, 404)
-		catcher := types.ReasonCatcher{}
-		helper.Unmarshal(res, &catcher)
-		c.Check(catcher.Reason, Equals, "No such message with id some_id could be found")
+		reason, code := helper.GetJsonReasonAndCode(res)
+		c.Check(reason, Equals, "No such message with id some_id could be found")
+		c.Check(code, Equals, "message_not_found")
 	}
 
 	if res, _ := req.GetMessageById("another-wrong-id", sessionid); true {
@@ -10,20 +10,30 @@ import (
 	helper "../helper/"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 // Routes stored in a struct
 type Routes struct {
-	signupURL      string
-	sessionsURL    string
-	userURL        string
-	usersURL       string
-	messagesURL    string
-	publishURL     string
-	joindefaultURL string
-	joinURL        string
-	blockURL       string
-	circlesURL     string
+	signupURL         string
+	sessionsURL       string
+	userURL           string
+	usersURL          string
+	messagesURL       string
+	publishURL        string
+	joindefaultURL    string
+	joinURL           string
+	blockURL          string
+	circlesURL        string
+	changepasswordURL string
+	forgotpasswordURL string
+	resetpasswordURL  string
+	adminURL          string
+	twofactorURL      string
+	keysURL           string
+	oauthURL          string
+	avatarsURL        string
 }
 
 type Requester struct {
@@ -45,6 +55,14 @@ func NewRequester(apiURL string) *Requester {
 		fmt.Sprintf("%s/join", apiURL),
 		fmt.Sprintf("%s/block", apiURL),
 		fmt.Sprintf("%s/circles", apiURL),
+		fmt.Sprintf("%s/changepassword", apiURL),
+		fmt.Sprintf("%s/forgotpassword", apiURL),
+		fmt.Sprintf("%s/resetpassword", apiURL),
+		fmt.Sprintf("%s/admin", apiURL),
+		fmt.Sprintf("%s/2fa", apiURL),
+		fmt.Sprintf("%s/keys", apiURL),
+		fmt.Sprintf("%s/oauth", apiURL),
+		fmt.Sprintf("%s/avatars", apiURL),
 	}
 	req := &Requester{
 		routes,
@@ -74,6 +92,22 @@ func (req Requester) DeleteSessions(token string) (*http.Response, error) {
 	return helper.Execute("DELETE", req.Routes.sessionsURL, payload)
 }
 
+func (req Requester) DeleteSession(id, token string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.sessionsURL+"/"+id, payload)
+}
+
+func (req Requester) GetSessions(token string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.sessionsURL, payload)
+}
+
 func (req Requester) GetMessages(payload types.Json) (*http.Response, error) {
 	return helper.GetWithQueryParams(req.Routes.messagesURL, payload)
 }
@@ -86,14 +120,22 @@ func (req Requester) GetMessageById(id, token string) (*http.Response, error) {
 	return helper.GetWithQueryParams(req.Routes.messagesURL+"/"+id, payload)
 }
 
+func (req Requester) DeleteMessage(id, token string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.messagesURL+"/"+id, payload)
+}
+
 func (req Requester) GetMessageByUrl(url, token string) (*http.Response, error) {
 	id := helper.GetIdFromUrlString(url)
 	return req.GetMessageById(id, token)
 }
 
-func (req Requester) GetUser(handle string) (*http.Response, error) {
+func (req Requester) GetUser(token, handle string) (*http.Response, error) {
 	payload := types.Json{
-		"handle": handle,
+		"token": token,
 	}
 
 	return helper.GetWithQueryParams(req.Routes.usersURL+"/"+handle, payload)
@@ -103,6 +145,273 @@ func (req Requester) EditUser(payload types.JsonArray, handle, token string) (*h
 	return helper.ExecutePatch(token, req.Routes.usersURL+"/"+handle, payload)
 }
 
+// Follows a verification link as mailed, against the server under test
+func (req Requester) GetVerificationLink(link string) (*http.Response, error) {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	// Everything after the users route, the link points at the live server
+	path := parsed.Path[strings.Index(parsed.Path, "/users/")+len("/users"):]
+	payload := types.Json{
+		"expires":   parsed.Query().Get("expires"),
+		"signature": parsed.Query().Get("signature"),
+	}
+
+	return helper.GetWithQueryParams(req.Routes.usersURL+path, payload)
+}
+
+func (req Requester) PostVerify(handle string, expires int64, signature string) (*http.Response, error) {
+	payload := types.Json{
+		"expires":   expires,
+		"signature": signature,
+	}
+
+	return helper.Execute("POST", req.Routes.usersURL+"/"+handle+"/verify", payload)
+}
+
+func (req Requester) PostResendVerification(token, handle string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("POST", req.Routes.usersURL+"/"+handle+"/verify/resend", payload)
+}
+
+func (req Requester) PostExport(token, handle string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("POST", req.Routes.usersURL+"/"+handle+"/export", payload)
+}
+
+func (req Requester) GetExport(token, handle, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.usersURL+"/"+handle+"/export/"+id, payload)
+}
+
+func (req Requester) GetExportArchive(token, handle, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.usersURL+"/"+handle+"/export/"+id+"/archive", payload)
+}
+
+func (req Requester) PutHandle(token, handle, newHandle string) (*http.Response, error) {
+	payload := types.Json{
+		"token":  token,
+		"handle": newHandle,
+	}
+
+	return helper.Execute("PUT", req.Routes.usersURL+"/"+handle+"/handle", payload)
+}
+
+func (req Requester) GetPrivacy(token, handle string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.usersURL+"/"+handle+"/privacy", payload)
+}
+
+func (req Requester) PatchPrivacy(token, handle string, changes types.Json) (*http.Response, error) {
+	changes["token"] = token
+
+	return helper.Execute("PATCH", req.Routes.usersURL+"/"+handle+"/privacy", changes)
+}
+
+func (req Requester) PutAvatar(token, handle string, image []byte) (*http.Response, error) {
+	return helper.ExecuteBody("PUT", req.Routes.usersURL+"/"+handle+"/avatar", token, image)
+}
+
+func (req Requester) GetAvatar(avatarid string, size int) (*http.Response, error) {
+	payload := types.Json{}
+	if size != 0 {
+		payload["size"] = size
+	}
+
+	return helper.GetWithQueryParams(req.Routes.avatarsURL+"/"+avatarid, payload)
+}
+
+func (req Requester) GetLockouts(token string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.adminURL+"/lockouts", payload)
+}
+
+func (req Requester) DeleteLockout(token, kind, subject string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.adminURL+"/lockouts/"+kind+"/"+subject, payload)
+}
+
+func (req Requester) GetAccounts(token string, params types.Json) (*http.Response, error) {
+	params["token"] = token
+
+	return helper.GetWithQueryParams(req.Routes.adminURL+"/users", params)
+}
+
+func (req Requester) PutRole(token, handle, role string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+		"role":  role,
+	}
+
+	return helper.Execute("PUT", req.Routes.adminURL+"/users/"+handle+"/role", payload)
+}
+
+func (req Requester) PostSuspension(token, handle string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("POST", req.Routes.adminURL+"/users/"+handle+"/suspension", payload)
+}
+
+func (req Requester) DeleteSuspension(token, handle string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.adminURL+"/users/"+handle+"/suspension", payload)
+}
+
+func (req Requester) DeleteUserSessions(token, handle string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.adminURL+"/users/"+handle+"/sessions", payload)
+}
+
+func (req Requester) AdminPatchCircle(token, id string, patch types.Json) (*http.Response, error) {
+	patch["token"] = token
+
+	return helper.Execute("PATCH", req.Routes.adminURL+"/circles/"+id, patch)
+}
+
+func (req Requester) AdminDeleteCircle(token, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.adminURL+"/circles/"+id, payload)
+}
+
+func (req Requester) AdminPatchMessage(token, id, content string) (*http.Response, error) {
+	payload := types.Json{
+		"token":   token,
+		"content": content,
+	}
+
+	return helper.Execute("PATCH", req.Routes.adminURL+"/messages/"+id, payload)
+}
+
+func (req Requester) AdminDeleteMessage(token, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.adminURL+"/messages/"+id, payload)
+}
+
+// expires is RFC 3339, or empty for a key that does not expire
+func (req Requester) PostApiKey(token, name string, scopes []string, expires string) (*http.Response, error) {
+	payload := types.Json{
+		"token":  token,
+		"name":   name,
+		"scopes": scopes,
+	}
+	if expires != "" {
+		payload["expires"] = expires
+	}
+
+	return helper.Execute("POST", req.Routes.keysURL, payload)
+}
+
+// Creates an API key, answering with the key itself
+func (req Requester) PostApiKeyGetKey(token, name string, scopes []string) string {
+	res, err := req.PostApiKey(token, name, scopes, "")
+	if err != nil {
+		panic(err)
+	}
+	body := struct{ Key string }{}
+	helper.Unmarshal(res, &body)
+	return body.Key
+}
+
+func (req Requester) GetApiKeys(token string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.keysURL, payload)
+}
+
+func (req Requester) DeleteApiKey(token, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.keysURL+"/"+id, payload)
+}
+
+func (req Requester) PostOAuthClient(token, name string, redirectUris []string) (*http.Response, error) {
+	payload := types.Json{
+		"token":        token,
+		"name":         name,
+		"redirecturis": redirectUris,
+	}
+
+	return helper.Execute("POST", req.Routes.oauthURL+"/clients", payload)
+}
+
+func (req Requester) GetOAuthClients(token string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.oauthURL+"/clients", payload)
+}
+
+func (req Requester) DeleteOAuthClient(token, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.oauthURL+"/clients/"+id, payload)
+}
+
+// params are the query parameters of the authorization request
+func (req Requester) GetOAuthAuthorize(params types.Json) (*http.Response, error) {
+	return helper.GetWithQueryParams(req.Routes.oauthURL+"/authorize", params)
+}
+
+// The authorization request in params, with "approve" for the decision
+func (req Requester) PostOAuthAuthorize(token string, params types.Json) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+	for k, v := range params {
+		payload[k] = v
+	}
+
+	return helper.Execute("POST", req.Routes.oauthURL+"/authorize", payload)
+}
+
+func (req Requester) PostOAuthToken(params types.Json) (*http.Response, error) {
+	return helper.Execute("POST", req.Routes.oauthURL+"/token", params)
+}
+
 func (req Requester) PostBlock(token string, target string) (*http.Response, error) {
 	payload := types.Json{
 		"token":  token,
@@ -112,6 +421,47 @@ func (req Requester) PostBlock(token string, target string) (*http.Response, err
 	return helper.Execute("POST", req.Routes.blockURL, payload)
 }
 
+func (req Requester) GetBlocked(token, handle string, skip, limit int) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+		"skip":  skip,
+		"limit": limit,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.usersURL+"/"+handle+"/blocked", payload)
+}
+
+func (req Requester) PatchBlocked(token, handle, target, action string) (*http.Response, error) {
+	payload := types.Json{
+		"token":  token,
+		"handle": target,
+		"action": action,
+	}
+
+	return helper.Execute("PATCH", req.Routes.usersURL+"/"+handle+"/blocked", payload)
+}
+
+func (req Requester) GetMutes(token, handle string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.usersURL+"/"+handle+"/muted", payload)
+}
+
+// Mutes or unmutes as told by mute, which holds "handle" or "circleid",
+// "action" and optionally "until"
+func (req Requester) PatchMutes(token, handle string, mute types.Json) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+	for key, value := range mute {
+		payload[key] = value
+	}
+
+	return helper.Execute("PATCH", req.Routes.usersURL+"/"+handle+"/muted", payload)
+}
+
 func (req Requester) PostCircles(token string, circleName string, public bool) (*http.Response, error) {
 	payload := types.Json{
 		"token":      token,
@@ -141,6 +491,28 @@ func (req Requester) GetCircles(payload types.Json) (*http.Response, error) {
 	return helper.GetWithQueryParams(req.Routes.circlesURL, payload)
 }
 
+func (req Requester) GetCircle(token, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.circlesURL+"/"+id, payload)
+}
+
+func (req Requester) PatchCircle(token, id string, patch types.Json) (*http.Response, error) {
+	patch["token"] = token
+
+	return helper.Execute("PATCH", req.Routes.circlesURL+"/"+id, patch)
+}
+
+func (req Requester) DeleteCircle(token, id string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("DELETE", req.Routes.circlesURL+"/"+id, payload)
+}
+
 func (req Requester) PostJoin(token string, target string, circle string) (*http.Response, error) {
 	payload := types.Json{
 		"token":  token,
@@ -218,6 +590,34 @@ func (req Requester) PostSessions(handle string, password string) (*http.Respons
 	return helper.Execute("POST", req.Routes.sessionsURL, payload)
 }
 
+func (req Requester) PostSessionsFromDevice(handle, password, device string) (*http.Response, error) {
+	payload := types.Json{
+		"handle":   handle,
+		"password": password,
+		"device":   device,
+	}
+
+	return helper.Execute("POST", req.Routes.sessionsURL, payload)
+}
+
+func (req Requester) PostSessionsRefresh(refreshToken string) (*http.Response, error) {
+	payload := types.Json{
+		"refreshtoken": refreshToken,
+	}
+
+	return helper.Execute("POST", req.Routes.sessionsURL+"/refresh", payload)
+}
+
+func (req Requester) PostSessionGetTokens(handle string, password string) types.SessionTokens {
+	res, err := req.PostSessions(handle, password)
+	if err != nil {
+		panic("Unexpected failure to post session.")
+	}
+	tokens := types.SessionTokens{}
+	helper.Unmarshal(res, &tokens)
+	return tokens
+}
+
 func (req Requester) PostSessionGetAuthToken(handle string, password string) (token string) {
 	res, err := req.PostSessions(handle, password)
 	if err != nil {
@@ -237,6 +637,71 @@ func (req Requester) PostSignup(handle string, email string, password string, co
 	return helper.Execute("POST", req.Routes.signupURL, proposal)
 }
 
+func (req Requester) PostChangePassword(token, oldPassword, newPassword, confirmPassword string) (*http.Response, error) {
+	payload := types.Json{
+		"token":           token,
+		"oldpassword":     oldPassword,
+		"newpassword":     newPassword,
+		"confirmpassword": confirmPassword,
+	}
+
+	return helper.Execute("POST", req.Routes.changepasswordURL, payload)
+}
+
+func (req Requester) PostForgotPassword(email string) (*http.Response, error) {
+	payload := types.Json{
+		"email": email,
+	}
+
+	return helper.Execute("POST", req.Routes.forgotpasswordURL, payload)
+}
+
+func (req Requester) PostResetPassword(code, password, confirmPassword string) (*http.Response, error) {
+	payload := types.Json{
+		"code":            code,
+		"password":        password,
+		"confirmpassword": confirmPassword,
+	}
+
+	return helper.Execute("POST", req.Routes.resetpasswordURL, payload)
+}
+
+func (req Requester) PostTotpEnroll(token string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+	}
+
+	return helper.Execute("POST", req.Routes.twofactorURL+"/enroll", payload)
+}
+
+func (req Requester) PostTotpConfirm(token, code string) (*http.Response, error) {
+	payload := types.Json{
+		"token": token,
+		"code":  code,
+	}
+
+	return helper.Execute("POST", req.Routes.twofactorURL+"/confirm", payload)
+}
+
+func (req Requester) PostTotpDisable(token, password, code string) (*http.Response, error) {
+	payload := types.Json{
+		"token":    token,
+		"password": password,
+		"code":     code,
+	}
+
+	return helper.Execute("POST", req.Routes.twofactorURL+"/disable", payload)
+}
+
+func (req Requester) PostSessionsChallenge(challenge, code string) (*http.Response, error) {
+	payload := types.Json{
+		"challenge": challenge,
+		"code":      code,
+	}
+
+	return helper.Execute("POST", req.Routes.sessionsURL+"/2fa", payload)
+}
+
 func (req Requester) PostJoinDefault(token string, target string) (*http.Response, error) {
 	payload := types.Json{
 		"token":  token,
@@ -257,3 +722,15 @@ func (req Requester) SearchForUsers(circle, nameprefix string, skip, limit int,
 
 	return helper.GetWithQueryParams(req.Routes.usersURL, payload)
 }
+
+func (req Requester) SearchForUsersInOrder(nameprefix string, skip, limit int, sort, order string) (*http.Response, error) {
+	payload := types.Json{
+		"nameprefix": nameprefix,
+		"skip":       skip,
+		"limit":      limit,
+		"sort":       sort,
+		"order":      order,
+	}
+
+	return helper.GetWithQueryParams(req.Routes.usersURL, payload)
+}
@@ -0,0 +1,204 @@
+package api_test
+
+import (
+	"../api/service/query"
+	"../types"
+	. "gopkg.in/check.v1"
+	"strconv"
+	"time"
+)
+
+//
+// Store Tests:
+// The same cases against the memory store and a bolt file, below the
+// service and whatever store the suite runs with.
+//
+
+type testStore struct {
+	name string
+	q    query.Query
+	// Reopens the store, answering it as read back from wherever it keeps
+	// the graph
+	reopen func() query.Query
+	close  func()
+}
+
+func testStores(c *C) []testStore {
+	memory := query.NewMemoryQuery()
+	path := c.MkDir() + "/store.db"
+	bolt, err := query.NewBoltQuery(path)
+	c.Assert(err, IsNil)
+
+	return []testStore{
+		{
+			name:   "memory",
+			q:      memory,
+			reopen: func() query.Query { return memory },
+			close:  func() {},
+		},
+		{
+			name: "bolt",
+			q:    bolt,
+			reopen: func() query.Query {
+				c.Assert(bolt.Close(), IsNil)
+				bolt, err = query.NewBoltQuery(path)
+				c.Assert(err, IsNil)
+				return bolt
+			},
+			close: func() { bolt.Close() },
+		},
+	}
+}
+
+func (s *TestSuite) TestStoresFindUsersByHandleKey(c *C) {
+	for _, store := range testStores(c) {
+		defer store.close()
+		q := store.q
+		name := Commentf("store %s", store.name)
+
+		c.Assert(q.CreateUser("Alice", "alice@test.io", "hash"), IsNil, name)
+		for _, spelling := range []string{"Alice", "alice", "ALICE"} {
+			handle, err := q.GetUserHandle(spelling)
+			c.Check(err, IsNil, name)
+			c.Check(handle, Equals, "Alice", name)
+		}
+		err := q.CreateUser("ALICE", "other@test.io", "hash")
+		c.Check(types.AsError(err).Code, Equals, "handle_taken", name)
+
+		// Renaming moves the key along, deleting frees it
+		c.Assert(q.RenameUser("Alice", "Bob", time.Now().Add(time.Hour)), IsNil, name)
+		_, err = q.GetUserHandle("alice")
+		c.Check(types.IsNotFound(err), Equals, true, name)
+
+		q = store.reopen()
+		handle, err := q.GetUserHandle("BOB")
+		c.Check(err, IsNil, name)
+		c.Check(handle, Equals, "Bob", name)
+
+		_, err = q.DeleteUser("Bob")
+		c.Assert(err, IsNil, name)
+		_, err = q.GetUserHandle("bob")
+		c.Check(types.IsNotFound(err), Equals, true, name)
+		c.Check(q.CreateUser("BOB", "bob@test.io", "hash"), IsNil, name)
+	}
+}
+
+func (s *TestSuite) TestStoresCascadeUserDeletion(c *C) {
+	for _, store := range testStores(c) {
+		defer store.close()
+		q := store.q
+		name := Commentf("store %s", store.name)
+
+		for _, handle := range []string{"handleA", "handleB"} {
+			c.Assert(q.CreateUser(handle, handle+"@test.io", "hash"), IsNil, name)
+			c.Assert(q.CreateDefaultCirclesForUser(handle), IsNil, name)
+		}
+		c.Assert(q.CreateAuthTokenForUser("handleA", query.SessionRecord{
+			TokenHash: "token",
+			Expires:   time.Now().Add(time.Hour),
+		}), IsNil, name)
+
+		circle, err := q.CreateCircle("handleA", "friends", true)
+		c.Assert(err, IsNil, name)
+		c.Assert(q.CreateMemberOfRelation("handleB", circle.Id), IsNil, name)
+		own, err := q.CreateMessage("handleA", "Mine")
+		c.Assert(err, IsNil, name)
+		c.Assert(q.CreatePublishedRelation(own.Id, circle.Id), IsNil, name)
+		other, err := q.CreateMessage("handleB", "Theirs")
+		c.Assert(err, IsNil, name)
+		c.Assert(q.CreatePublishedRelation(other.Id, circle.Id), IsNil, name)
+		c.Assert(q.CreateBlockRelationFromTo("handleB", "handleA"), IsNil, name)
+
+		summary, err := q.DeleteUser("handleA")
+		c.Assert(err, IsNil, name)
+		c.Check(summary, DeepEquals, types.DeletionSummary{
+			Handle:       "handleA",
+			Sessions:     1,
+			Messages:     1,
+			Publications: 2,
+			Circles:      3,
+			Blocks:       1,
+		}, name)
+
+		q = store.reopen()
+		exists, err := q.UserExistsByHandle("handleA")
+		c.Check(err, IsNil, name)
+		c.Check(exists, Equals, false, name)
+		_, err = q.DeriveHandleFromAuthToken("token")
+		c.Check(types.IsNotFound(err), Equals, true, name)
+		_, err = q.GetMessageAuthor(own.Id)
+		c.Check(types.IsNotFound(err), Equals, true, name)
+		_, err = q.GetCircleById(circle.Id)
+		c.Check(types.IsNotFound(err), Equals, true, name)
+
+		// What others had keeps, without what pointed at the user
+		author, err := q.GetMessageAuthor(other.Id)
+		c.Check(err, IsNil, name)
+		c.Check(author, Equals, "handleB", name)
+		published, err := q.GetPublicationsByAuthor("handleB")
+		c.Check(err, IsNil, name)
+		c.Check(len(published), Equals, 0, name)
+		_, total, err := q.GetBlockedUsers("handleB", 0, 20)
+		c.Check(err, IsNil, name)
+		c.Check(total, Equals, 0, name)
+	}
+}
+
+func (s *TestSuite) TestStoresDetectRefreshTokenReuse(c *C) {
+	for _, store := range testStores(c) {
+		defer store.close()
+		q := store.q
+		name := Commentf("store %s", store.name)
+
+		c.Assert(q.CreateUser("handleA", "handleA@test.io", "hash"), IsNil, name)
+		session := func(token, refresh string) query.SessionRecord {
+			return query.SessionRecord{
+				TokenHash:      token,
+				Expires:        time.Now().Add(time.Hour),
+				RefreshHash:    refresh,
+				RefreshExpires: time.Now().Add(24 * time.Hour),
+			}
+		}
+		c.Assert(q.CreateAuthTokenForUser("handleA", session("token1", "refresh1")), IsNil, name)
+
+		handle, err := q.RotateAuthToken("refresh1", session("token2", "refresh2"))
+		c.Check(err, IsNil, name)
+		c.Check(handle, Equals, "handleA", name)
+		_, err = q.DeriveHandleFromAuthToken("token1")
+		c.Check(types.IsNotFound(err), Equals, true, name)
+
+		// Using the spent refresh token again ends the session it became
+		q = store.reopen()
+		_, err = q.RotateAuthToken("refresh1", session("token3", "refresh3"))
+		c.Check(types.AsError(err).Code, Equals, "refresh_token_reused", name)
+		_, err = q.DeriveHandleFromAuthToken("token2")
+		c.Check(types.IsNotFound(err), Equals, true, name)
+		_, err = q.RotateAuthToken("refresh2", session("token4", "refresh4"))
+		c.Check(types.IsNotFound(err), Equals, true, name)
+	}
+}
+
+func (s *TestSuite) TestStoresKeepLatestLockoutEvents(c *C) {
+	for _, store := range testStores(c) {
+		defer store.close()
+		q := store.q
+		name := Commentf("store %s", store.name)
+
+		for i := 0; i < query.LOCKOUT_EVENTS_KEPT+2; i++ {
+			c.Assert(q.CreateLockoutEvent(types.LockoutEvent{
+				Id:      strconv.Itoa(i),
+				Kind:    "ip",
+				Subject: "127.0.0.1",
+				Event:   "locked",
+				At:      time.Now(),
+			}), IsNil, name)
+		}
+
+		q = store.reopen()
+		events, err := q.GetLockoutEvents(query.LOCKOUT_EVENTS_KEPT + 10)
+		c.Assert(err, IsNil, name)
+		c.Assert(len(events), Equals, query.LOCKOUT_EVENTS_KEPT, name)
+		c.Check(events[0].Id, Equals, strconv.Itoa(query.LOCKOUT_EVENTS_KEPT+1), name)
+		c.Check(events[len(events)-1].Id, Equals, "2", name)
+	}
+}
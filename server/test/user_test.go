@@ -1,10 +1,21 @@
 package api_test
 
 import (
+	"../api/service"
+	"../api/service/blob"
 	"../types"
 	"./helper"
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	. "gopkg.in/check.v1"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"strings"
+	"time"
 )
 
 //
@@ -29,25 +40,122 @@ func (s *TestSuite) TestSearchUsersOK(c *C) {
 		c.Error(err)
 	} else {
 		data := struct {
-			Results  string
+			Results  []types.UserSearchView
 			Response string
 			Reason   string
 			Count    int
 		}{}
 		helper.Unmarshal(response, &data)
-		type UserResult struct {
-			Handle string
-			Name   string
-			Id     int
-		}
-
-		results := make([]UserResult, 0)
-		json.Unmarshal([]byte(data.Results), &results)
 		c.Check(response.StatusCode, Equals, 200)
 		c.Check(data.Count, Equals, 3)
 		c.Check(data.Response, Equals, "Search complete")
 		c.Check(data.Reason, Equals, "")
-		c.Check(len(results), Equals, 3)
+		c.Assert(len(data.Results), Equals, 3)
+		c.Check(data.Results[0].Handle, Equals, "cat")
+		c.Check(data.Results[0].Url, Equals, service.API_URL+"/users/cat")
+		c.Check(data.Results[0].Joined.IsZero(), Equals, false)
+	}
+}
+
+// The handles found and how many there are in all
+func searchHandles(c *C, nameprefix string, skip, limit int, sort, order string) ([]string, int) {
+	response, _ := req.SearchForUsersInOrder(nameprefix, skip, limit, sort, order)
+	c.Assert(response.StatusCode, Equals, 200)
+	data := struct {
+		Results []types.UserSearchView
+		Count   int
+	}{}
+	helper.Unmarshal(response, &data)
+	handles := []string{}
+	for _, user := range data.Results {
+		handles = append(handles, user.Handle)
+	}
+	return handles, data.Count
+}
+
+func (s *TestSuite) TestSearchUsersSorts(c *C) {
+	for _, handle := range []string{"bravo", "Alpha", "charlie"} {
+		req.PostSignup(handle, handle+"@test.io", "password1", "password1")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	handles, total := searchHandles(c, "", 0, 10, "handle", "")
+	c.Check(handles, DeepEquals, []string{"Alpha", "bravo", "charlie"})
+	c.Check(total, Equals, 3)
+	handles, _ = searchHandles(c, "", 0, 10, "handle", "desc")
+	c.Check(handles, DeepEquals, []string{"charlie", "bravo", "Alpha"})
+
+	handles, _ = searchHandles(c, "", 0, 10, "joined", "")
+	c.Check(handles, DeepEquals, []string{"charlie", "Alpha", "bravo"})
+	handles, _ = searchHandles(c, "", 0, 10, "joined", "asc")
+	c.Check(handles, DeepEquals, []string{"bravo", "Alpha", "charlie"})
+
+	// Counts everything, not just the page
+	handles, total = searchHandles(c, "", 1, 1, "handle", "")
+	c.Check(handles, DeepEquals, []string{"bravo"})
+	c.Check(total, Equals, 3)
+	handles, total = searchHandles(c, "", 5, 1, "handle", "")
+	c.Check(handles, HasLen, 0)
+	c.Check(total, Equals, 3)
+
+	for _, bad := range [][3]string{{"name", "", "invalid_sort"}, {"stir", "", "invalid_sort"}, {"handle", "up", "invalid_order"}} {
+		response, _ := req.SearchForUsersInOrder("", 0, 10, bad[0], bad[1])
+		c.Check(response.StatusCode, Equals, 400, Commentf("sort=%s order=%s", bad[0], bad[1]))
+		_, code := helper.GetJsonReasonAndCode(response)
+		c.Check(code, Equals, bad[2])
+	}
+	response, _ := req.SearchForUsersInOrder("", 0, 101, "handle", "")
+	c.Check(response.StatusCode, Equals, 400)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_limit")
+	response, _ = req.SearchForUsersInOrder("", -1, 10, "handle", "")
+	c.Check(response.StatusCode, Equals, 400)
+	reason, code := helper.GetJsonReasonAndCode(response)
+	c.Check(reason, Equals, "Skip out of range")
+	c.Check(code, Equals, "invalid_skip")
+}
+
+func (s *TestSuite) TestSearchUsersByName(c *C) {
+	req.PostSignup("pele", "pele@test.io", "password1", "password1")
+	req.PostSignup("zico", "zico@test.io", "password1", "password1")
+	req.PostSignup("garrincha", "garrincha@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("pele", "password1")
+	other := req.PostSessionGetAuthToken("garrincha", "password1")
+
+	req.EditUser(types.JsonArray{
+		types.Json{"resource": "firstname", "value": "Edson"},
+		types.Json{"resource": "lastname", "value": "Arantes"},
+	}, "pele", token)
+	req.EditUser(types.JsonArray{
+		types.Json{"resource": "firstname", "value": "Manuel"},
+	}, "garrincha", other)
+	req.PatchPrivacy(other, "garrincha", types.Json{"firstname": "private"})
+
+	handles, _ := searchHandles(c, "eds", 0, 10, "handle", "")
+	c.Check(handles, DeepEquals, []string{"pele"})
+	handles, _ = searchHandles(c, "arantes", 0, 10, "handle", "")
+	c.Check(handles, DeepEquals, []string{"pele"})
+	handles, _ = searchHandles(c, "Edson Ar", 0, 10, "handle", "")
+	c.Check(handles, DeepEquals, []string{"pele"})
+	handles, _ = searchHandles(c, "zi", 0, 10, "handle", "")
+	c.Check(handles, DeepEquals, []string{"zico"})
+
+	// Names that are not public are neither searched nor shown
+	handles, _ = searchHandles(c, "manuel", 0, 10, "handle", "")
+	c.Check(handles, HasLen, 0)
+	response, _ := req.SearchForUsersInOrder("garr", 0, 10, "handle", "")
+	data := struct {
+		Results []types.UserSearchView
+	}{}
+	helper.Unmarshal(response, &data)
+	c.Assert(data.Results, HasLen, 1)
+	c.Check(data.Results[0].FirstName, Equals, "")
+
+	// Prefixes are taken literally
+	for _, prefix := range []string{".*", "(", "[a-z]", "p|z"} {
+		handles, total := searchHandles(c, prefix, 0, 10, "handle", "")
+		c.Check(handles, HasLen, 0, Commentf("Prefix %q", prefix))
+		c.Check(total, Equals, 0)
 	}
 }
 
@@ -91,7 +199,7 @@ func (s *TestSuite) TestEditUserAllOK(c *C) {
 
 	patchObj7 := types.Json{
 		"resource": "languages",
-		"value":    "English",
+		"value":    "en",
 	}
 
 	patchObj8 := types.Json{
@@ -106,16 +214,758 @@ func (s *TestSuite) TestEditUserAllOK(c *C) {
 
 	patchObj9 := types.Json{
 		"resource": "languages",
-		"value":    "Pig Latin",
+		"value":    "EN-us, x-piglatin",
 	}
 
 	res2, _ := req.EditUser(types.JsonArray{patchObj9}, "handleA", token)
 	c.Check(res2.StatusCode, Equals, 200)
-	// TODO: check that updating a field doesn't delete the other fields.
+
+	user := types.UserView{}
+	res3, _ := req.GetUser(token, "handleA")
+	helper.Unmarshal(res3, &user)
+	c.Check(user.FirstName, Equals, "Thomas")
+	c.Check(user.Gender, Equals, "male")
+	c.Check(user.Birthday.Equal(time.Date(2002, 10, 2, 0, 0, 0, 0, time.UTC)), Equals, true)
+	c.Check(user.Languages, Equals, "en-US, x-piglatin")
+	c.Check(user.Location, Equals, "San Francisco, CA")
+}
+
+func (s *TestSuite) TestEditUserRefusesBadValues(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	tooYoung := time.Now().AddDate(-12, 0, 0).Format("2006-01-02")
+	for _, bad := range []struct {
+		resource, value string
+	}{
+		{"birthday", "banana"},
+		{"birthday", "2002-02-30"},
+		{"birthday", tooYoung},
+		{"birthday", "1800-01-01"},
+		{"languages", "en, Pig Latin"},
+		{"bio", strings.Repeat("a", service.MAX_BIO_LENGTH+1)},
+		{"firstname", "Tho\nmas"},
+		{"location", "Paris,, France"},
+		{"location", "1, 2, 3, 4"},
+		{"nickname", "Neo"},
+	} {
+		patches := types.JsonArray{
+			types.Json{"resource": "firstname", "value": "Thomas"},
+			types.Json{"resource": bad.resource, "value": bad.value},
+		}
+		response, _ := req.EditUser(patches, "handleA", token)
+		c.Check(response.StatusCode, Equals, 400, Commentf("%s %q", bad.resource, bad.value))
+		reasons, index := helper.GetJsonPatchValidationReasonMessage(response)
+		c.Check(index, Equals, 1)
+		c.Check(len(reasons), Equals, 1)
+	}
+
+	// Nothing is changed when any patch is refused
+	user := types.UserView{}
+	response, _ := req.GetUser(token, "handleA")
+	helper.Unmarshal(response, &user)
+	c.Check(user.FirstName, Equals, "")
+}
+
+func (s *TestSuite) TestEditUserClearsFields(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.EditUser(types.JsonArray{
+		types.Json{"resource": "gender", "value": "  Genderfluid "},
+		types.Json{"resource": "birthday", "value": "1990-12-31"},
+		types.Json{"resource": "bio", "value": "Two\nlines"},
+	}, "handleA", token)
+	c.Assert(response.StatusCode, Equals, 200)
+
+	user := types.UserView{}
+	response, _ = req.GetUser(token, "handleA")
+	helper.Unmarshal(response, &user)
+	c.Check(user.Gender, Equals, "Genderfluid")
+	c.Check(user.Bio, Equals, "Two\nlines")
+
+	response, _ = req.EditUser(types.JsonArray{
+		types.Json{"resource": "gender", "value": ""},
+		types.Json{"resource": "birthday", "value": " "},
+	}, "handleA", token)
+	c.Assert(response.StatusCode, Equals, 200)
+
+	user = types.UserView{}
+	response, _ = req.GetUser(token, "handleA")
+	helper.Unmarshal(response, &user)
+	c.Check(user.Gender, Equals, "")
+	c.Check(user.Birthday.IsZero(), Equals, true)
+	c.Check(user.Bio, Equals, "Two\nlines")
+}
+
+func profileOf(c *C, token, handle string) types.UserView {
+	response, _ := req.GetUser(token, handle)
+	c.Assert(response.StatusCode, Equals, 200)
+	user := types.UserView{}
+	helper.Unmarshal(response, &user)
+	return user
+}
+
+func (s *TestSuite) TestProfileOfHandleInAnyCasing(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	circleid := req.PostCircleGetCircleId(token, "friends", true)
+	req.PostMessageWithCirclesGetMessageId("Hello, world!", token, []string{circleid})
+
+	req.EditUser(types.JsonArray{types.Json{"resource": "location", "value": "Lisbon, PT"}}, "handleA", token)
+	response, _ := req.PatchPrivacy(token, "handleA", types.Json{"location": "private"})
+	c.Assert(response.StatusCode, Equals, 200)
+
+	// Users see their own profile whatever the casing
+	user := profileOf(c, token, "HANDLEA")
+	c.Check(user.Handle, Equals, "handleA")
+	c.Check(user.Location, Equals, "Lisbon, PT")
+	c.Check(user.Blocked, Not(Equals), "")
+
+	// and others see the circles of the user viewed
+	user = profileOf(c, other, "HandleA")
+	c.Check(user.Location, Equals, "")
+	c.Check(user.Blocked, Equals, "")
+	names := []string{}
+	for _, circle := range user.Circles {
+		names = append(names, circle.Name)
+	}
+	c.Check(names, DeepEquals, []string{"Broadcast", "friends"})
+
+	messages := []types.PublishedMessageView{}
+	response, _ = req.GetMessages(types.Json{"token": other, "handle": "HANDLEA"})
+	c.Assert(response.StatusCode, Equals, 200)
+	helper.Unmarshal(response, &messages)
+	c.Assert(len(messages), Equals, 1)
+	c.Check(messages[0].Content, Equals, "Hello, world!")
+
+	req.PatchBlocked(token, "handleA", "handleB", "block")
+	response, _ = req.GetMessages(types.Json{"token": other, "handle": "HANDLEA"})
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestProfileVisibility(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	req.PostSignup("handleC", "testC@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	member := req.PostSessionGetAuthToken("handleB", "password1")
+	stranger := req.PostSessionGetAuthToken("handleC", "password1")
+
+	gold, err := a.Svc.GetCircleId("handleA", types.GOLD)
+	c.Assert(err, IsNil)
+	c.Assert(a.Svc.JoinCircle("handleB", gold), IsNil)
+
+	response, _ := req.EditUser(types.JsonArray{
+		types.Json{"resource": "birthday", "value": "1990-12-31"},
+		types.Json{"resource": "location", "value": "Lisbon, PT"},
+		types.Json{"resource": "bio", "value": "Hello"},
+	}, "handleA", token)
+	c.Assert(response.StatusCode, Equals, 200)
+
+	response, _ = req.PatchPrivacy(token, "handleA", types.Json{"birthday": gold, "location": "private"})
+	c.Assert(response.StatusCode, Equals, 200)
+	visibility := map[string]string{}
+	helper.Unmarshal(response, &visibility)
+	c.Check(visibility["birthday"], Equals, gold)
+	c.Check(visibility["location"], Equals, "private")
+	c.Check(visibility["bio"], Equals, "public")
+	c.Check(len(visibility), Equals, 8)
+
+	self := profileOf(c, token, "handleA")
+	c.Check(self.Birthday.IsZero(), Equals, false)
+	c.Check(self.Location, Equals, "Lisbon, PT")
+
+	seen := profileOf(c, member, "handleA")
+	c.Check(seen.Birthday.IsZero(), Equals, false)
+	c.Check(seen.Location, Equals, "")
+	c.Check(seen.Bio, Equals, "Hello")
+
+	seen = profileOf(c, stranger, "handleA")
+	c.Check(seen.Birthday.IsZero(), Equals, true)
+	c.Check(seen.Location, Equals, "")
+	c.Check(seen.Bio, Equals, "Hello")
+
+	response, _ = req.PatchPrivacy(token, "handleA", types.Json{"location": "public"})
+	c.Assert(response.StatusCode, Equals, 200)
+	seen = profileOf(c, stranger, "handleA")
+	c.Check(seen.Location, Equals, "Lisbon, PT")
+	c.Check(seen.Birthday.IsZero(), Equals, true)
+}
+
+func (s *TestSuite) TestProfileVisibilityRefusesBadSettings(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	theirs, err := a.Svc.GetCircleId("handleB", types.GOLD)
+	c.Assert(err, IsNil)
+
+	response, _ := req.PatchPrivacy(token, "handleA", types.Json{"birthday": theirs})
+	c.Check(response.StatusCode, Equals, 400)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_visibility")
+
+	response, _ = req.PatchPrivacy(token, "handleA", types.Json{"birthday": "friends"})
+	c.Check(response.StatusCode, Equals, 400)
+	response, _ = req.PatchPrivacy(token, "handleA", types.Json{"shoesize": "private"})
+	c.Check(response.StatusCode, Equals, 400)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "invalid_resource")
+
+	response, _ = req.PatchPrivacy(other, "handleA", types.Json{"birthday": "private"})
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.GetPrivacy(other, "handleA")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.GetPrivacy(token, "handleA")
+	c.Assert(response.StatusCode, Equals, 200)
+	visibility := map[string]string{}
+	helper.Unmarshal(response, &visibility)
+	c.Check(visibility["birthday"], Equals, "public")
 }
 
 //
 // Delete User Tests:
 //
 
-// Unimplemented
+func feedCount(c *C, token string) int {
+	response, _ := req.GetMessages(types.Json{"token": token})
+	c.Assert(response.StatusCode, Equals, 200)
+	messages := []types.PublishedMessageView{}
+	helper.Unmarshal(response, &messages)
+	return len(messages)
+}
+
+func searchCount(prefix string) int {
+	response, _ := req.SearchForUsers("", prefix, 0, 10, "handle")
+	data := struct {
+		Count int
+	}{}
+	helper.Unmarshal(response, &data)
+	return data.Count
+}
+
+func (s *TestSuite) TestDeleteUserDeactivates(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	key := req.PostApiKeyGetKey(token, "bot", []string{"feed:read"})
+
+	circleid := req.PostCircleGetCircleId(token, "Mine", true)
+	req.PostJoin(other, "handleA", "Mine")
+	messageid := req.PostMessageWithCirclesGetMessageId("Hello from A", token, []string{circleid})
+	c.Assert(feedCount(c, other), Equals, 1)
+
+	response, _ := req.DeleteUser("handleA", "password2", token)
+	c.Check(response.StatusCode, Equals, 401)
+	response, _ = req.DeleteUser("handleA", "password1", other)
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.DeleteUser("handleA", "password1", token)
+	res := struct {
+		Response   string
+		PurgeAfter time.Time
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(res.Response, Equals, "Deleted handleA, logging in before the purge restores the account")
+	c.Check(res.PurgeAfter.After(time.Now().Add(29*24*time.Hour)), Equals, true)
+
+	// Gone from sight, and signed out everywhere
+	response, _ = req.GetMessages(types.Json{"token": token})
+	c.Check(response.StatusCode, Equals, 401)
+	response, _ = req.GetMessages(types.Json{"token": key})
+	c.Check(response.StatusCode, Equals, 401)
+	c.Check(feedCount(c, other), Equals, 0)
+	response, _ = req.GetMessageById(messageid, other)
+	c.Check(response.StatusCode, Equals, 404)
+	c.Check(searchCount("handle"), Equals, 1)
+	response, _ = req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	c.Check(response.StatusCode, Equals, 409)
+
+	// Logging back in restores everything
+	token = req.PostSessionGetAuthToken("handleA", "password1")
+	c.Check(token, Not(Equals), "")
+	c.Check(feedCount(c, other), Equals, 1)
+	c.Check(searchCount("handle"), Equals, 2)
+	response, _ = req.GetMessages(types.Json{"token": key})
+	c.Check(response.StatusCode, Equals, 200)
+
+	summaries, err := a.Svc.PurgeDeactivatedUsers()
+	c.Assert(err, IsNil)
+	c.Check(len(summaries), Equals, 0)
+}
+
+func (s *TestSuite) TestPurgeCascades(c *C) {
+	defer func(policy service.DeletionPolicy) {
+		a.Svc.Deletion = policy
+	}(a.Svc.Deletion)
+
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	req.PostSignup("handleC", "testC@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+
+	req.PostCircles(other, "Club", true)
+	req.PostJoin(token, "handleB", "Club")
+	circleid := req.PostCircleGetCircleId(token, "Mine", true)
+	req.PostJoin(other, "handleA", "Mine")
+	req.PostMessageWithCircles("Hello from A", token, []string{circleid})
+	req.PostMessageWithCircles("Hello from B", other, []string{circleid})
+	req.PostBlock(token, "handleC")
+
+	response, _ := req.DeleteUser("handleA", "password1", token)
+	c.Assert(response.StatusCode, Equals, 200)
+
+	// Nothing is purged within the grace period
+	summaries, err := a.Svc.PurgeDeactivatedUsers()
+	c.Assert(err, IsNil)
+	c.Check(len(summaries), Equals, 0)
+
+	a.Svc.Deletion.GracePeriod = -time.Minute
+	summaries, err = a.Svc.PurgeDeactivatedUsers()
+	c.Assert(err, IsNil)
+	c.Assert(len(summaries), Equals, 1)
+	c.Check(summaries[0], DeepEquals, types.DeletionSummary{
+		Handle:       "handleA",
+		Sessions:     0,
+		Messages:     1,
+		Publications: 2,
+		Memberships:  1,
+		Blocks:       1,
+		Circles:      3,
+	})
+
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 403)
+
+	// The handle is free again, with nothing left over
+	response, _ = req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	c.Check(response.StatusCode, Equals, 201)
+	response, _ = req.PostJoinDefault(req.PostSessionGetAuthToken("handleC", "password1"), "handleA")
+	c.Check(response.StatusCode, Equals, 201)
+}
+
+// Users with nothing but the circles they start with go too, and logging
+// in after the grace period purges whoever the purger has not got to yet
+func (s *TestSuite) TestLoginAfterGracePeriodPurges(c *C) {
+	defer func(policy service.DeletionPolicy) {
+		a.Svc.Deletion = policy
+	}(a.Svc.Deletion)
+	a.Svc.Deletion.GracePeriod = -time.Minute
+
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.DeleteUser("handleA", "password1", token)
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.PostSessions("handleA", "password1")
+	c.Check(response.StatusCode, Equals, 403)
+
+	summaries, err := a.Svc.PurgeDeactivatedUsers()
+	c.Assert(err, IsNil)
+	c.Check(len(summaries), Equals, 0)
+}
+
+func (s *TestSuite) TestAdminDeletesUser(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password2", "password2")
+	makeAdmin(c, "handleA")
+	admin := req.PostSessionGetAuthToken("handleA", "password1")
+	req.PostSessionGetAuthToken("handleB", "password2")
+
+	// Admins confirm with their own password
+	response, _ := req.DeleteUser("handleB", "password2", admin)
+	c.Check(response.StatusCode, Equals, 401)
+	response, _ = req.DeleteUser("handleB", "password1", admin)
+	res := struct {
+		Response string
+		Deleted  types.DeletionSummary
+	}{}
+	helper.Unmarshal(response, &res)
+	c.Check(response.StatusCode, Equals, 200)
+	c.Check(res.Response, Equals, "Deleted handleB for good")
+	c.Check(res.Deleted.Handle, Equals, "handleB")
+	c.Check(searchCount("handle"), Equals, 1)
+	response, _ = req.DeleteUser("nobody", "password1", admin)
+	c.Check(response.StatusCode, Equals, 404)
+
+	// Purged at once, so logging back in cannot undo it
+	response, _ = req.PostSessions("handleB", "password2")
+	c.Check(response.StatusCode, Equals, 403)
+	summaries, err := a.Svc.PurgeDeactivatedUsers()
+	c.Assert(err, IsNil)
+	c.Check(len(summaries), Equals, 0)
+}
+
+//
+// Export Tests:
+//
+
+// Polls the export until it is no longer pending
+func awaitExport(c *C, token, handle, id string) types.ExportJob {
+	job := types.ExportJob{}
+	for i := 0; i < 100; i++ {
+		response, _ := req.GetExport(token, handle, id)
+		c.Assert(response.StatusCode, Equals, 200)
+		helper.Unmarshal(response, &job)
+		if job.Status != "pending" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return job
+}
+
+func (s *TestSuite) TestExportArchive(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+
+	req.PostCircles(other, "Club", true)
+	req.PostJoin(token, "handleB", "Club")
+	circleid := req.PostCircleGetCircleId(token, "Mine", true)
+	messageid := req.PostMessageWithCirclesGetMessageId("Hello, world!", token, []string{circleid})
+	req.PostMessage("Unpublished", token)
+	req.PostBlock(token, "handleB")
+
+	response, _ := req.PostExport(token, "handleA")
+	job := types.ExportJob{}
+	helper.Unmarshal(response, &job)
+	c.Check(response.StatusCode, Equals, 202)
+	c.Check(job.Status, Equals, "pending")
+
+	job = awaitExport(c, token, "handleA", job.Id)
+	c.Assert(job.Status, Equals, "ready")
+	c.Check(strings.HasSuffix(job.Archive, "/users/handleA/export/"+job.Id+"/archive"), Equals, true)
+
+	response, _ = req.GetExportArchive(token, "handleA", job.Id)
+	c.Assert(response.StatusCode, Equals, 200)
+	c.Check(response.Header.Get("Content-Type"), Equals, "application/zip")
+	body, err := ioutil.ReadAll(response.Body)
+	c.Assert(err, IsNil)
+	archive, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	c.Assert(err, IsNil)
+
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		r, err := f.Open()
+		c.Assert(err, IsNil)
+		files[f.Name], _ = ioutil.ReadAll(r)
+		r.Close()
+	}
+	c.Check(len(files), Equals, 6)
+	c.Check(strings.Contains(string(files["index.html"]), `<a href="messages.json">`), Equals, true)
+
+	profile := types.UserView{}
+	c.Assert(json.Unmarshal(files["profile.json"], &profile), IsNil)
+	c.Check(profile.Handle, Equals, "handleA")
+
+	circles := struct {
+		Owned  []types.CircleResponse
+		Joined []types.CircleResponse
+	}{}
+	c.Assert(json.Unmarshal(files["circles.json"], &circles), IsNil)
+	c.Check(len(circles.Owned), Equals, 3)
+	c.Assert(len(circles.Joined), Equals, 1)
+	c.Check(circles.Joined[0].Name, Equals, "Club")
+
+	messages := []types.ExportedMessage{}
+	c.Assert(json.Unmarshal(files["messages.json"], &messages), IsNil)
+	c.Assert(len(messages), Equals, 2)
+	published := map[string]int{}
+	for _, m := range messages {
+		published[m.Id] = len(m.Publications)
+	}
+	c.Check(published[messageid], Equals, 1)
+
+	blocked := []types.UserView{}
+	c.Assert(json.Unmarshal(files["blocked.json"], &blocked), IsNil)
+	c.Assert(len(blocked), Equals, 1)
+	c.Check(blocked[0].Handle, Equals, "handleB")
+	c.Check(string(files["comments.json"]), Equals, "[]")
+}
+
+func (s *TestSuite) TestExportIsPrivate(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+
+	response, _ := req.PostExport(other, "handleA")
+	c.Check(response.StatusCode, Equals, 403)
+
+	response, _ = req.PostExport(token, "handleA")
+	job := types.ExportJob{}
+	helper.Unmarshal(response, &job)
+	awaitExport(c, token, "handleA", job.Id)
+
+	response, _ = req.GetExport(other, "handleA", job.Id)
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.GetExportArchive(other, "handleB", job.Id)
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.GetExport(token, "handleA", "nonexistent")
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+//
+// Avatar Tests:
+//
+
+// A w by h PNG, a different color on each side so crops can be told apart
+func encodeImage(w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			img.Set(x, y, color.RGBA{uint8(255 * x / w), 0, 0, 255})
+		}
+	}
+	encoded := &bytes.Buffer{}
+	png.Encode(encoded, img)
+	return encoded.Bytes()
+}
+
+func avatarIdOf(avatarUrl string) string {
+	return avatarUrl[strings.LastIndex(avatarUrl, "/")+1:]
+}
+
+func (s *TestSuite) TestSetAvatar(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.PutAvatar(token, "handleA", encodeImage(300, 200))
+	c.Assert(response.StatusCode, Equals, 200)
+	data := struct {
+		Avatar string
+	}{}
+	helper.Unmarshal(response, &data)
+	c.Check(strings.HasPrefix(data.Avatar, service.API_URL+"/avatars/"), Equals, true)
+	avatarid := avatarIdOf(data.Avatar)
+
+	for _, size := range []int{0, 32, 64, 128, 256} {
+		response, _ = req.GetAvatar(avatarid, size)
+		c.Assert(response.StatusCode, Equals, 200)
+		c.Check(response.Header.Get("Content-Type"), Equals, "image/png")
+		thumb, err := png.Decode(response.Body)
+		c.Assert(err, IsNil)
+		if size == 0 {
+			size = 256
+		}
+		c.Check(thumb.Bounds(), Equals, image.Rect(0, 0, size, size))
+	}
+	response, _ = req.GetAvatar(avatarid, 33)
+	c.Check(response.StatusCode, Equals, 400)
+
+	user := types.UserView{}
+	response, _ = req.GetUser(token, "handleA")
+	helper.Unmarshal(response, &user)
+	c.Check(user.Avatar, Equals, data.Avatar)
+
+	response, _ = req.SearchForUsers("", "handleA", 0, 10, "handle")
+	results := struct {
+		Results []types.UserSearchView
+	}{}
+	helper.Unmarshal(response, &results)
+	c.Assert(len(results.Results), Equals, 1)
+	c.Check(results.Results[0].Avatar, Equals, data.Avatar)
+
+	// A new avatar replaces the old one, whose thumbnails go
+	webp, _ := base64.StdEncoding.DecodeString("UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA==")
+	response, _ = req.PutAvatar(token, "handleA", webp)
+	c.Assert(response.StatusCode, Equals, 200)
+	response, _ = req.GetAvatar(avatarid, 0)
+	c.Check(response.StatusCode, Equals, 404)
+
+	_, err := a.Svc.DeleteUser("handleA")
+	c.Assert(err, IsNil)
+	c.Check(a.Svc.Blobs.(*blob.MemoryStore).Keys(), HasLen, 0)
+}
+
+func (s *TestSuite) TestSetAvatarRefusesBadImages(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	truncated := encodeImage(64, 64)[:100]
+	for _, body := range [][]byte{[]byte("<svg></svg>"), {}, truncated} {
+		response, _ := req.PutAvatar(token, "handleA", body)
+		c.Check(response.StatusCode, Equals, 400)
+		_, code := helper.GetJsonReasonAndCode(response)
+		c.Check(code, Equals, "bad_media")
+	}
+
+	policy := a.Svc.Avatars
+	defer func() { a.Svc.Avatars = policy }()
+	a.Svc.Avatars.MaxPixels = 100 * 100
+	response, _ := req.PutAvatar(token, "handleA", encodeImage(101, 100))
+	c.Check(response.StatusCode, Equals, 400)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "avatar_too_large")
+
+	large := encodeImage(64, 64)
+	a.Svc.Avatars.MaxBytes = int64(len(large) - 1)
+	response, _ = req.PutAvatar(token, "handleA", large)
+	c.Check(response.StatusCode, Equals, 400)
+	_, code = helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "avatar_too_large")
+
+	c.Check(a.Svc.Blobs.(*blob.MemoryStore).Keys(), HasLen, 0)
+}
+
+func (s *TestSuite) TestSetAvatarOfOthers(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("admin", "admin@test.io", "password1", "password1")
+	makeAdmin(c, "admin")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	admin := req.PostSessionGetAuthToken("admin", "password1")
+
+	response, _ := req.PutAvatar(token, "admin", encodeImage(64, 64))
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.PutAvatar(admin, "handleA", encodeImage(64, 64))
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.PutAvatar(admin, "nobody", encodeImage(64, 64))
+	c.Check(response.StatusCode, Equals, 404)
+	response, _ = req.PutAvatar("", "handleA", encodeImage(64, 64))
+	c.Check(response.StatusCode, Equals, 401)
+}
+
+func (s *TestSuite) TestRenameUser(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+	req.PostCircles(token, "friends", true)
+
+	response, _ := req.PutHandle(token, "handleA", "handleZ")
+	c.Assert(response.StatusCode, Equals, 200)
+
+	// Sessions carry over to the new handle
+	user := profileOf(c, token, "handleZ")
+	c.Check(user.Handle, Equals, "handleZ")
+	response, _ = req.PutHandle(token, "handleA", "handleY")
+	c.Check(response.StatusCode, Equals, 403)
+
+	// The former handle leads to the new one
+	response, _ = req.GetUser(other, "handleA")
+	c.Assert(response.StatusCode, Equals, 200)
+	c.Check(response.Request.URL.Path, Equals, "/users/handleZ")
+	helper.Unmarshal(response, &user)
+	c.Check(user.Handle, Equals, "handleZ")
+
+	response, _ = req.PostJoin(other, "handleA", "friends")
+	c.Check(response.StatusCode, Equals, 201)
+	response, _ = req.PostJoinDefault(other, "handleA")
+	c.Check(response.StatusCode, Equals, 201)
+	circle, err := a.Svc.GetCircleId("handleZ", "friends")
+	c.Assert(err, IsNil)
+	member, err := a.Svc.Query.UserPartOfCircle("handleB", circle)
+	c.Assert(err, IsNil)
+	c.Check(member, Equals, true)
+
+	// and stays reserved
+	response, _ = req.PostSignup("handleA", "testC@test.io", "password1", "password1")
+	c.Check(response.StatusCode, Equals, 409)
+	response, _ = req.PutHandle(other, "handleB", "handleA")
+	c.Check(response.StatusCode, Equals, 409)
+
+	response, _ = req.PutHandle(token, "handleZ", "handleY")
+	c.Check(response.StatusCode, Equals, 429)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "rename_cooldown")
+	c.Check(response.Header.Get("Retry-After"), Not(Equals), "")
+
+	// Former handles can be taken back
+	policy := a.Svc.Renames
+	defer func() { a.Svc.Renames = policy }()
+	a.Svc.Renames.Cooldown = 0
+	response, _ = req.PutHandle(token, "handleZ", "handleA")
+	c.Assert(response.StatusCode, Equals, 200)
+	user = profileOf(c, token, "handleA")
+	c.Check(user.Handle, Equals, "handleA")
+	response, _ = req.GetUser(other, "handleZ")
+	c.Check(response.Request.URL.Path, Equals, "/users/handleA")
+}
+
+func (s *TestSuite) TestRenameUserRefusesBadHandles(c *C) {
+	req.PostSignup("handleA", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("handleA", "password1")
+
+	response, _ := req.PutHandle(token, "handleA", "handleB")
+	c.Check(response.StatusCode, Equals, 409)
+	response, _ = req.PutHandle(token, "handleA", "no spaces")
+	c.Check(response.StatusCode, Equals, 400)
+	response, _ = req.PutHandle(token, "handleA", "handleA")
+	c.Check(response.StatusCode, Equals, 400)
+	_, code := helper.GetJsonReasonAndCode(response)
+	c.Check(code, Equals, "same_handle")
+	response, _ = req.PutHandle("", "handleA", "handleC")
+	c.Check(response.StatusCode, Equals, 401)
+
+	// Failed attempts do not start the cooldown
+	response, _ = req.PutHandle(token, "handleA", "handleC")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.GetUser(token, "handleB")
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.GetUser(token, "nobody")
+	c.Check(response.StatusCode, Equals, 404)
+}
+
+func (s *TestSuite) TestHandlesKeepTheirCasing(c *C) {
+	req.PostSignup("Pele\u0301", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("Pel\u00e9", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+
+	// Stored in NFC as spelled, and found in any casing
+	response, _ := req.GetUser(other, "PEL\u00c9")
+	c.Assert(response.StatusCode, Equals, 200)
+	user := types.UserView{}
+	helper.Unmarshal(response, &user)
+	c.Check(user.Handle, Equals, "Pel\u00e9")
+
+	response, _ = req.PostJoinDefault(other, "pel\u00e9")
+	c.Check(response.StatusCode, Equals, 201)
+
+	// Changing only the casing is no conflict with oneself
+	response, _ = req.PutHandle(token, "Pel\u00e9", "PEL\u00c9")
+	c.Assert(response.StatusCode, Equals, 200)
+	user = profileOf(c, token, "PEL\u00c9")
+	c.Check(user.Handle, Equals, "PEL\u00c9")
+	response, _ = req.PutHandle(other, "handleB", "Pel\u00e9")
+	c.Check(response.StatusCode, Equals, 409)
+}
+
+func (s *TestSuite) TestSelfInAnyCasing(c *C) {
+	req.PostSignup("Pel\u00e9", "testA@test.io", "password1", "password1")
+	req.PostSignup("handleB", "testB@test.io", "password1", "password1")
+	token := req.PostSessionGetAuthToken("Pel\u00e9", "password1")
+	other := req.PostSessionGetAuthToken("handleB", "password1")
+
+	response, _ := req.EditUser(types.JsonArray{
+		types.Json{"resource": "firstname", "value": "Edson"},
+	}, "PELE\u0301", token)
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.GetBlocked(token, "pel\u00e9", 0, 10)
+	c.Check(response.StatusCode, Equals, 200)
+	response, _ = req.PostExport(token, "PEL\u00c9")
+	job := types.ExportJob{}
+	helper.Unmarshal(response, &job)
+	c.Check(response.StatusCode, Equals, 202)
+	c.Check(awaitExport(c, token, "Pel\u00e9", job.Id).Status, Equals, "ready")
+
+	// Still nobody else
+	response, _ = req.GetBlocked(other, "PEL\u00c9", 0, 10)
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.DeleteUser("pel\u00e9", "password1", other)
+	c.Check(response.StatusCode, Equals, 403)
+	response, _ = req.DeleteUser("pel\u00e9", "password1", token)
+	c.Check(response.StatusCode, Equals, 200)
+}
@@ -0,0 +1,107 @@
+package types
+
+import (
+	"errors"
+	"time"
+)
+
+//
+// Error Types
+//
+
+// ErrorKind classifies an Error by what went wrong rather than where,
+// letting the api layer pick the HTTP status to answer with.
+type ErrorKind int
+
+const (
+	INTERNAL ErrorKind = iota
+	NOT_FOUND
+	CONFLICT
+	FORBIDDEN
+	UNAVAILABLE
+	INVALID_INPUT
+	UNAUTHENTICATED
+	TOO_MANY_REQUESTS
+)
+
+// Error is returned by the query and service layers. Code is a stable,
+// machine-readable identifier sent to clients next to the human-readable
+// Reason; Err optionally holds the underlying cause. RetryAfter tells
+// clients how long to wait before trying again, where that is known.
+type Error struct {
+	Kind       ErrorKind
+	Code       string
+	Reason     string
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return e.Reason + ": " + e.Err.Error()
+	}
+	return e.Reason
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+//
+// Constructors
+//
+
+func NewError(kind ErrorKind, code, reason string) *Error {
+	return &Error{Kind: kind, Code: code, Reason: reason}
+}
+
+func WrapError(kind ErrorKind, code, reason string, err error) *Error {
+	return &Error{Kind: kind, Code: code, Reason: reason, Err: err}
+}
+
+func NotFound(code, reason string) *Error {
+	return NewError(NOT_FOUND, code, reason)
+}
+
+func Conflict(code, reason string) *Error {
+	return NewError(CONFLICT, code, reason)
+}
+
+func Forbidden(code, reason string) *Error {
+	return NewError(FORBIDDEN, code, reason)
+}
+
+func InvalidInput(code, reason string) *Error {
+	return NewError(INVALID_INPUT, code, reason)
+}
+
+func Unauthenticated(code, reason string) *Error {
+	return NewError(UNAUTHENTICATED, code, reason)
+}
+
+func TooManyRequests(code, reason string, retryAfter time.Duration) *Error {
+	e := NewError(TOO_MANY_REQUESTS, code, reason)
+	e.RetryAfter = retryAfter
+	return e
+}
+
+//
+// Inspection
+//
+
+// Returns err as an *Error, treating anything untyped as INTERNAL
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	return WrapError(INTERNAL, "internal_error", "Unexpected internal failure", err)
+}
+
+func IsKind(err error, kind ErrorKind) bool {
+	return err != nil && AsError(err).Kind == kind
+}
+
+func IsNotFound(err error) bool {
+	return IsKind(err, NOT_FOUND)
+}
@@ -0,0 +1,125 @@
+package types
+
+import (
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+	"strings"
+)
+
+//
+// Handle Normalization
+//
+
+// Handles are stored in NFC, so the same handle typed on different
+// keyboards is stored the same way, but otherwise as the user spelled them
+func NormalizeHandle(handle string) string {
+	return norm.NFC.String(handle)
+}
+
+// What handles are compared by: two handles with the same key are the
+// same handle, whatever their casing and normalization form
+func HandleKey(handle string) string {
+	// Casers are stateful, each call gets its own
+	return norm.NFC.String(cases.Fold().String(norm.NFC.String(handle)))
+}
+
+// The Unicode TR39 skeleton of handle: two handles with the same skeleton
+// look alike, such as "paypal" and "раураl" spelled with Cyrillic letters.
+// Prototypes are mapped both before and after case folding, so that
+// handles alike in either case, such as "ΗΟΜΕ" and "home", are caught.
+func HandleSkeleton(handle string) string {
+	skeleton := prototypes(norm.NFD.String(handle))
+	skeleton = prototypes(norm.NFD.String(cases.Fold().String(skeleton)))
+	return norm.NFD.String(skeleton)
+}
+
+func prototypes(s string) string {
+	mapped := strings.Builder{}
+	for _, r := range s {
+		if prototype, ok := confusables[r]; ok {
+			mapped.WriteString(prototype)
+		} else {
+			mapped.WriteRune(r)
+		}
+	}
+	return mapped.String()
+}
+
+// The prototypes of confusables.txt from Unicode TR39 for the characters
+// handles may contain that are mistaken for Latin letters and digits most
+// often: Cyrillic, Greek and Armenian look-alikes, Latin variants and the
+// digits themselves. Characters missing here are their own prototype.
+var confusables = map[rune]string{
+	// Digits and Latin
+	'0': "O",
+	'1': "l",
+	'I': "l",
+	'm': "rn",
+	'ı': "i", // dotless i
+	'ɑ': "a", // alpha
+	'ɡ': "g", // script g
+	'ǀ': "l", // dental click
+	'ᴠ': "v", // small capital v
+
+	// Cyrillic
+	'А': "A",
+	'В': "B",
+	'Е': "E",
+	'К': "K",
+	'М': "M",
+	'Н': "H",
+	'О': "O",
+	'Р': "P",
+	'С': "C",
+	'Т': "T",
+	'У': "Y",
+	'Х': "X",
+	'Ѕ': "S",
+	'І': "l",
+	'Ј': "J",
+	'а': "a",
+	'е': "e",
+	'о': "o",
+	'р': "p",
+	'с': "c",
+	'у': "y",
+	'х': "x",
+	'ѕ': "s",
+	'і': "i",
+	'ј': "j",
+	'ѵ': "v",
+	'һ': "h",
+	'ӏ': "l",
+	'ԁ': "d",
+	'ԛ': "q",
+	'ԝ': "w",
+
+	// Greek
+	'Α': "A",
+	'Β': "B",
+	'Ε': "E",
+	'Ζ': "Z",
+	'Η': "H",
+	'Ι': "l",
+	'Κ': "K",
+	'Μ': "M",
+	'Ν': "N",
+	'Ο': "O",
+	'Ρ': "P",
+	'Τ': "T",
+	'Υ': "Y",
+	'Χ': "X",
+	'α': "a",
+	'γ': "y",
+	'ι': "i",
+	'ν': "v",
+	'ο': "o",
+	'ρ': "p",
+
+	// Armenian
+	'հ': "h",
+	'ո': "n",
+	'ս': "u",
+	'ց': "g",
+	'օ': "o",
+}
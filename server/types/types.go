@@ -22,6 +22,186 @@ type SignupProposal struct {
 type LoginCredentials struct {
 	Handle   string `json:"handle" validate:"handle"`
 	Password string `json:"password" validate:"password"`
+	Device   string `json:"device"`
+}
+
+type PasswordChange struct {
+	OldPassword     string `json:"oldpassword"`
+	NewPassword     string `json:"newpassword" validate:"password"`
+	ConfirmPassword string `json:"confirmpassword" validate:"password"`
+}
+
+type HandleChange struct {
+	Handle string `json:"handle" validate:"handle"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email" validate:"email"`
+}
+
+type PasswordReset struct {
+	Code            string `json:"code"`
+	Password        string `json:"password" validate:"password"`
+	ConfirmPassword string `json:"confirmpassword" validate:"password"`
+}
+
+// A fresh TOTP secret, for the user to load into an authenticator app
+// either by hand or through the otpauth:// Uri
+type TotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+type TotpCode struct {
+	Code string `json:"code"`
+}
+
+type TotpDisable struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+// What logging in with a password answers when 2FA is enabled, the
+// Challenge is traded for a session along with a code
+type LoginChallenge struct {
+	Handle    string    `json:"handle"`
+	Challenge string    `json:"challenge"`
+	Expires   time.Time `json:"challengeexpires"`
+}
+
+type ChallengeResponse struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// A handle or client IP locked out of logging in after failing too often
+type Lockout struct {
+	Kind     string    `json:"kind"`
+	Subject  string    `json:"subject"`
+	Failures int       `json:"failures"`
+	Until    time.Time `json:"until"`
+}
+
+// Something that happened to a lockout. Event is "locked" when it
+// started, "unlocked" when it ran out and "cleared" when an admin, By,
+// lifted it early.
+type LockoutEvent struct {
+	Id      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Subject string    `json:"subject"`
+	Event   string    `json:"event"`
+	At      time.Time `json:"at"`
+	Until   time.Time `json:"until"`
+	By      string    `json:"by"`
+}
+
+type EmailVerification struct {
+	Expires   int64  `json:"expires"`
+	Signature string `json:"signature"`
+}
+
+// The credentials of a session as handed to its client. The access token
+// goes in the Authorization header, the refresh token buys a new pair.
+type SessionTokens struct {
+	Handle         string    `json:"handle"`
+	Token          string    `json:"token"`
+	Expires        time.Time `json:"expires"`
+	RefreshToken   string    `json:"refreshtoken"`
+	RefreshExpires time.Time `json:"refreshexpires"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshtoken"`
+}
+
+type ApiKeyRequest struct {
+	Name    string    `json:"name"`
+	Scopes  []string  `json:"scopes"`
+	Expires time.Time `json:"expires"`
+}
+
+// One API key of a user, never carrying the key itself. Expires is zero
+// for keys that do not expire.
+type ApiKeyView struct {
+	Id       string    `json:"id"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"lastused"`
+}
+
+type OAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectUris []string `json:"redirecturis"`
+}
+
+type OAuthClient struct {
+	Id           string    `json:"clientid"`
+	Name         string    `json:"name"`
+	RedirectUris []string  `json:"redirecturis"`
+	Created      time.Time `json:"created"`
+}
+
+// The parameters of an authorization request as RFC 6749 and RFC 7636 name
+// them, along with the decision of the user once they made it
+type OAuthAuthorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientId            string `json:"client_id"`
+	RedirectUri         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Approve             bool   `json:"approve"`
+}
+
+// What a user is asked to allow a client
+type OAuthConsent struct {
+	Client      OAuthClient `json:"client"`
+	Scopes      []string    `json:"scopes"`
+	RedirectUri string      `json:"redirect_uri"`
+	State       string      `json:"state"`
+}
+
+type OAuthTokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	Code         string `json:"code"`
+	RedirectUri  string `json:"redirect_uri"`
+	ClientId     string `json:"client_id"`
+	CodeVerifier string `json:"code_verifier"`
+}
+
+type OAuthAccessToken struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+// One AuthToken of a user, never carrying the token itself
+type SessionView struct {
+	Id        string    `json:"id"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"useragent"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastused"`
+	Expires   time.Time `json:"expires"`
+	Current   bool      `json:"current"`
+}
+
+// A user account as admins see it
+type AccountView struct {
+	Handle    string    `json:"handle"`
+	Email     string    `json:"email"`
+	Role      string    `json:"role"`
+	Suspended bool      `json:"suspended"`
+	Verified  bool      `json:"verified"`
+	Joined    time.Time `json:"joined"`
+}
+
+type RoleChange struct {
+	Role string `json:"role"`
 }
 
 //
@@ -92,8 +272,82 @@ type UserView struct {
 	Interests string           `json:"interests"`
 	Languages string           `json:"languages"`
 	Location  string           `json:"location"`
+	Avatar    string           `json:"avatar"`
 	Circles   []CircleResponse `json:"circles"`
-	Blocked   []UserView       `json:"blocked"`
+	Blocked   string           `json:"blocked,omitempty"`
+}
+
+// A user as listed by user search. Names are only there when the user
+// shows them to everyone.
+type UserSearchView struct {
+	Url       string    `json:"url"`
+	Handle    string    `json:"handle"`
+	FirstName string    `json:"firstname"`
+	LastName  string    `json:"lastname"`
+	Avatar    string    `json:"avatar"`
+	Stir      int       `json:"stir"`
+	Joined    time.Time `json:"joined"`
+}
+
+// Asks to mute, or unmute, either a user by Handle or a circle by
+// CircleId. Mutes end at Until, or last until undone when it is zero.
+type MuteRequest struct {
+	Handle   string    `json:"handle"`
+	CircleId string    `json:"circleid"`
+	Action   string    `json:"action"`
+	Until    time.Time `json:"until"`
+}
+
+// One mute in effect: a user by Handle, or a circle by CircleId and its
+// name. Until is zero for mutes that last until undone.
+type MuteView struct {
+	Url      string    `json:"url"`
+	Handle   string    `json:"handle,omitempty"`
+	CircleId string    `json:"circleid,omitempty"`
+	Circle   string    `json:"circle,omitempty"`
+	Since    time.Time `json:"since"`
+	Until    time.Time `json:"until"`
+}
+
+// What went along with a deleted user. Publications count both those of
+// the user's messages and those of others to the user's circles, Blocks
+// both ways.
+type DeletionSummary struct {
+	Handle       string `json:"handle"`
+	Sessions     int    `json:"sessions"`
+	Messages     int    `json:"messages"`
+	Publications int    `json:"publications"`
+	Memberships  int    `json:"memberships"`
+	Blocks       int    `json:"blocks"`
+	Circles      int    `json:"circles"`
+}
+
+//
+// Export Types
+//
+
+// Where an export of a user's data stands. Status is "pending" until the
+// archive is built, then "ready" or "failed". A ready archive is
+// downloaded from Archive until Expires.
+type ExportJob struct {
+	Id       string    `json:"id"`
+	Status   string    `json:"status"`
+	Created  time.Time `json:"created"`
+	Finished time.Time `json:"finished"`
+	Expires  time.Time `json:"expires"`
+	Archive  string    `json:"archive"`
+}
+
+type Publication struct {
+	Circleid    string    `json:"circleid"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+type ExportedMessage struct {
+	Id           string        `json:"id"`
+	Content      string        `json:"content"`
+	Created      time.Time     `json:"created"`
+	Publications []Publication `json:"publications"`
 }
 
 // The json annotations that accompany these structs allow json.Marshall
@@ -105,6 +359,12 @@ type SearchCirclesResponse struct {
 	Count    int              `json:"count"`
 }
 
+// Fields left out stay as they are, an empty description clears it
+type CirclePatch struct {
+	Name        *string `json:"name"`
+	Description *string `json:"description"`
+}
+
 type CircleResponse struct {
 	Name        string    `json:"name"`
 	Url         string    `json:"url"`
@@ -11,6 +11,7 @@ const (
 	MIN_PASS_LENGTH   = 8
 	MAX_PASS_LENGTH   = 50
 	MAX_HANDLE_LENGTH = 16
+	MAX_USER_VALUE    = 1000
 	GOLD              = "Gold"
 	BROADCAST         = "Broadcast"
 )
@@ -121,10 +122,11 @@ func validateUserResource(i interface{}) error {
 	}
 }
 
+// Empty values clear the field, the service checks each field further
 func validateUserValue(i interface{}) error {
 	value := i.(string)
-	if value == "" {
-		return fmt.Errorf("Required field for user patch")
+	if utf8.RuneCountInString(value) > MAX_USER_VALUE {
+		return fmt.Errorf("Too long, max length is %d", MAX_USER_VALUE)
 	} else {
 		return nil
 	}